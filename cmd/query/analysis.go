@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/relabel"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// twice the scrape interval of the recorder
+	defaultDisappearedGrace = 2 * time.Hour
+	defaultTopK             = 10
+)
+
+// disappearedSeriesResult is also used for the last seen timestamps.
+type disappearedSeriesResult struct {
+	Labels   map[string]string `json:"labels"`
+	LastSeen int64             `json:"lastSeen"`
+}
+
+// parseRangeQuery parses the match[], start and end parameters.
+func parseRangeQuery(query url.Values) ([][]*labels.Matcher, time.Time, time.Time, error) {
+	matchers, err := parser.ParseMetricSelectors(query["match[]"])
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("invalid match[] parameter: %w", err)
+	}
+	start, err := parseTime(query.Get("start"))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("failed to parse start timestamp: %w", err)
+	}
+	end, err := parseTime(query.Get("end"))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("failed to parse end timestamp: %w", err)
+	}
+	if !start.Before(end) {
+		return nil, time.Time{}, time.Time{}, errors.New("end timestamp must be after start timestamp")
+	}
+	return matchers, start, end, nil
+}
+
+// checkMaxSeries fails the analysis queries matching more series than maxSeries with the count query, before loading the series.
+func checkMaxSeries(ctx context.Context, db *database.LabelDB, matchers [][]*labels.Matcher, start, end time.Time, maxSeries int) error {
+	if maxSeries <= 0 {
+		return nil
+	}
+	count := 0
+	for _, matcher := range matchers {
+		n, err := db.CountMetrics(ctx, start, end, matcher)
+		if err != nil {
+			return fmt.Errorf("failed to count series: %w", err)
+		}
+		count += n
+		if count > maxSeries {
+			return tooManySeriesError(maxSeries)
+		}
+	}
+	return nil
+}
+
+func disappearedSeriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, maxSeries int) {
+	query := r.URL.Query()
+	matchers, start, end, err := parseRangeQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkMaxSeries(r.Context(), db, matchers, start, end, maxSeries); err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+	grace := defaultDisappearedGrace
+	if graceParam := query.Get("grace"); graceParam != "" {
+		grace, err = time.ParseDuration(graceParam)
+		if err != nil {
+			http.Error(w, "failed to parse grace: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	disappeared := make(map[string]*model.Metric)
+	for _, matcher := range matchers {
+		series, err := db.QueryDisappearedSeries(r.Context(), start, end, matcher, grace)
+		if err != nil {
+			slog.Error("failed to query disappeared series", "error", err)
+			http.Error(w, "failed to query disappeared series: "+err.Error(), queryErrorStatus(err))
+			return
+		}
+		for _, m := range series {
+			disappeared[m.UniqueKey()] = m
+		}
+	}
+
+	data := make([]disappearedSeriesResult, 0, len(disappeared))
+	for _, m := range disappeared {
+		data = append(data, disappearedSeriesResult{
+			Labels:   m.Labels(),
+			LastSeen: m.ToTS.Unix(),
+		})
+	}
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].LastSeen < data[j].LastSeen
+	})
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// seriesCountHandler returns the number of the series in the database, summed over the selectors.
+func seriesCountHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+	matchers, start, end, err := parseRangeQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count := 0
+	for _, matcher := range matchers {
+		n, err := db.CountMetrics(r.Context(), start, end, matcher)
+		if err != nil {
+			slog.Error("failed to count series", "error", err)
+			http.Error(w, "failed to count series: "+err.Error(), queryErrorStatus(err))
+			return
+		}
+		count += n
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   count,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type newSeriesResult struct {
+	Labels    map[string]string `json:"labels"`
+	FirstSeen int64             `json:"firstSeen"`
+}
+
+func newSeriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, maxSeries int) {
+	matchers, start, end, err := parseRangeQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkMaxSeries(r.Context(), db, matchers, start, end, maxSeries); err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	newSeries := make(map[string]*model.Metric)
+	for _, matcher := range matchers {
+		series, err := db.QueryNewSeries(r.Context(), start, end, matcher)
+		if err != nil {
+			slog.Error("failed to query new series", "error", err)
+			http.Error(w, "failed to query new series: "+err.Error(), queryErrorStatus(err))
+			return
+		}
+		for _, m := range series {
+			newSeries[m.UniqueKey()] = m
+		}
+	}
+
+	data := make([]newSeriesResult, 0, len(newSeries))
+	for _, m := range newSeries {
+		data = append(data, newSeriesResult{
+			Labels:    m.Labels(),
+			FirstSeen: m.FromTS.Unix(),
+		})
+	}
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].FirstSeen < data[j].FirstSeen
+	})
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func topValuesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		http.Error(w, "namespace is required", http.StatusBadRequest)
+		return
+	}
+	label := query.Get("label")
+	if label == "" {
+		http.Error(w, "label is required", http.StatusBadRequest)
+		return
+	}
+	start, err := parseTime(query.Get("start"))
+	if err != nil {
+		http.Error(w, "failed to parse start timestamp: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	end, err := parseTime(query.Get("end"))
+	if err != nil {
+		http.Error(w, "failed to parse end timestamp: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !start.Before(end) {
+		http.Error(w, "end timestamp must be after start timestamp", http.StatusBadRequest)
+		return
+	}
+	k := defaultTopK
+	if kParam := query.Get("k"); kParam != "" {
+		k, err = strconv.Atoi(kParam)
+		if err != nil || k <= 0 {
+			http.Error(w, "k must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := db.QueryTopValues(r.Context(), start, end, namespace, label, k)
+	if err != nil {
+		slog.Error("failed to query top values", "error", err, "namespace", namespace, "label", label)
+		http.Error(w, "failed to query top values: "+err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type seriesDiffResult struct {
+	Added     []map[string]string `json:"added"`
+	Removed   []map[string]string `json:"removed"`
+	Unchanged []map[string]string `json:"unchanged"`
+}
+
+func seriesDiffHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, maxSeries int) {
+	query := r.URL.Query()
+	matchers, start, end, err := parseRangeQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	baseStart, err := parseTime(query.Get("base_start"))
+	if err != nil {
+		http.Error(w, "failed to parse base_start timestamp: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	baseEnd, err := parseTime(query.Get("base_end"))
+	if err != nil {
+		http.Error(w, "failed to parse base_end timestamp: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !baseStart.Before(baseEnd) {
+		http.Error(w, "base_end timestamp must be after base_start timestamp", http.StatusBadRequest)
+		return
+	}
+	for _, tr := range [][2]time.Time{{baseStart, baseEnd}, {start, end}} {
+		if err := checkMaxSeries(r.Context(), db, matchers, tr[0], tr[1], maxSeries); err != nil {
+			http.Error(w, err.Error(), queryErrorStatus(err))
+			return
+		}
+	}
+
+	added := make(map[string]*model.Metric)
+	removed := make(map[string]*model.Metric)
+	unchanged := make(map[string]*model.Metric)
+	for _, matcher := range matchers {
+		diff, err := db.QuerySeriesDiff(r.Context(), baseStart, baseEnd, start, end, matcher)
+		if err != nil {
+			slog.Error("failed to query series diff", "error", err)
+			http.Error(w, "failed to query series diff: "+err.Error(), queryErrorStatus(err))
+			return
+		}
+		for _, m := range diff.Added {
+			added[m.UniqueKey()] = m
+		}
+		for _, m := range diff.Removed {
+			removed[m.UniqueKey()] = m
+		}
+		for _, m := range diff.Unchanged {
+			unchanged[m.UniqueKey()] = m
+		}
+	}
+	// the series matched by multiple selectors are unchanged if any selector finds them in both ranges
+	for k := range unchanged {
+		delete(added, k)
+		delete(removed, k)
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data": seriesDiffResult{
+			Added:     sortedLabels(added),
+			Removed:   sortedLabels(removed),
+			Unchanged: sortedLabels(unchanged),
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func sortedLabels(series map[string]*model.Metric) []map[string]string {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	data := make([]map[string]string, 0, len(keys))
+	for _, k := range keys {
+		data = append(data, series[k].Labels())
+	}
+	return data
+}
+
+func lastSeenHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, maxSeries int, retention time.Duration) {
+	query := r.URL.Query()
+	matchers, err := parser.ParseMetricSelectors(query["match[]"])
+	if err != nil {
+		http.Error(w, "invalid match[] parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// search all partitions by default
+	start := time.Unix(0, 0).UTC()
+	if startParam := query.Get("start"); startParam != "" {
+		start, err = parseTime(startParam)
+		if err != nil {
+			http.Error(w, "failed to parse start timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	end := time.Now().UTC()
+	if endParam := query.Get("end"); endParam != "" {
+		end, err = parseTime(endParam)
+		if err != nil {
+			http.Error(w, "failed to parse end timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !start.Before(end) {
+		http.Error(w, "end timestamp must be after start timestamp", http.StatusBadRequest)
+		return
+	}
+	// the partitions before the retention are not searched
+	var warnings []string
+	if query.Get("start") != "" {
+		start, warnings = lookbackConfig{retention: retention}.clampStart(start, end, time.Now().UTC())
+	} else if retention > 0 {
+		start = time.Now().UTC().Add(-retention)
+	}
+	limit := 0
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := checkMaxSeries(r.Context(), db, matchers, start, end, seriesAbortLimit(limit, maxSeries)); err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	lastSeen := make(map[string]*model.Metric)
+	for _, matcher := range matchers {
+		series, err := db.QueryLastSeen(r.Context(), start, end, matcher, limit)
+		if err != nil {
+			slog.Error("failed to query last seen", "error", err)
+			http.Error(w, "failed to query last seen: "+err.Error(), queryErrorStatus(err))
+			return
+		}
+		for _, m := range series {
+			if prev, ok := lastSeen[m.UniqueKey()]; !ok || prev.ToTS.Before(m.ToTS) {
+				lastSeen[m.UniqueKey()] = m
+			}
+		}
+	}
+
+	data := make([]disappearedSeriesResult, 0, len(lastSeen))
+	for _, m := range lastSeen {
+		data = append(data, disappearedSeriesResult{
+			Labels:   m.Labels(),
+			LastSeen: m.ToTS.Unix(),
+		})
+	}
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].LastSeen > data[j].LastSeen
+	})
+	if limit > 0 && len(data) > limit {
+		data = data[:limit]
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// searchSeriesHandler returns the series with a dimension value containing the q parameter, e.g. for the search boxes of the UIs.
+// The fresh metrics from CloudWatch are not searched.
+func searchSeriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, opts *queryOptions) {
+	query := r.URL.Query()
+	s := query.Get("q")
+	if s == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	// all the series are searched without match[]
+	matchers := [][]*labels.Matcher{nil}
+	if len(query["match[]"]) > 0 {
+		var err error
+		matchers, err = parser.ParseMetricSelectors(query["match[]"])
+		if err != nil {
+			http.Error(w, "invalid match[] parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	end := now
+	var err error
+	if endParam := query.Get("end"); endParam != "" {
+		end, err = parseTime(endParam)
+		if err != nil {
+			http.Error(w, "failed to parse end timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	start := end.Add(-opts.lookback.defaultLookback)
+	if startParam := query.Get("start"); startParam != "" {
+		start, err = parseTime(startParam)
+		if err != nil {
+			http.Error(w, "failed to parse start timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if end.Before(start) {
+		http.Error(w, "end timestamp must not be before start timestamp", http.StatusBadRequest)
+		return
+	}
+	start, warnings := opts.lookback.clampStart(start, end, now)
+	limit := 0
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	limits := opts.limits(limit)
+
+	result := make(map[string]*model.Metric)
+	for _, matcher := range matchers {
+		series, err := db.SearchSeries(r.Context(), start, end, matcher, s, limits.fetch)
+		if err != nil {
+			slog.Error("failed to search series", "error", err)
+			http.Error(w, "failed to search series: "+err.Error(), queryErrorStatus(err))
+			return
+		}
+		maps.Copy(result, series)
+	}
+	data := make([]map[string]string, 0, len(result))
+	for _, m := range result {
+		data = append(data, m.Labels())
+	}
+	data = relabel.Apply(data, opts.relabelConfigs)
+	data, warnings, err = limits.apply(data, warnings)
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
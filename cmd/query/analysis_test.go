@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+)
+
+func TestAnalysisHandlersMaxSeries(t *testing.T) {
+	db := newTestDB(t, 3)
+	handlers := map[string]func(http.ResponseWriter, *http.Request, *database.LabelDB, int){
+		"disappeared": disappearedSeriesHandler,
+		"new":         newSeriesHandler,
+		"last_seen": func(w http.ResponseWriter, r *http.Request, db *database.LabelDB, maxSeries int) {
+			lastSeenHandler(w, r, db, maxSeries, 0)
+		},
+		"diff": seriesDiffHandler,
+	}
+	params := rangeParams(`{Namespace="AWS/EC2"}`)
+	params.Set("base_start", testTime.Add(-time.Hour).Format(time.RFC3339))
+	params.Set("base_end", testTime.Add(time.Hour).Format(time.RFC3339))
+
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			serve := func(params url.Values, maxSeries int) int {
+				r := httptest.NewRequest(http.MethodGet, "/?"+params.Encode(), nil)
+				w := httptest.NewRecorder()
+				handler(w, r, db, maxSeries)
+				return w.Code
+			}
+			if code := serve(params, 0); code != http.StatusOK {
+				t.Fatalf("unexpected status without max series: %d", code)
+			}
+			if code := serve(params, 3); code != http.StatusOK {
+				t.Fatalf("unexpected status within max series: %d", code)
+			}
+			if code := serve(params, 2); code != http.StatusUnprocessableEntity {
+				t.Fatalf("unexpected status over max series: %d", code)
+			}
+		})
+	}
+}
+
+func TestSearchSeriesHandler(t *testing.T) {
+	db := newTestDB(t, 12)
+	opts := newTestOptions()
+	tests := []struct {
+		params url.Values
+		code   int
+		series int
+	}{
+		{url.Values{"q": {"i-01"}}, http.StatusOK, 2},
+		{url.Values{"q": {"i-0"}, "limit": {"5"}}, http.StatusOK, 5},
+		{url.Values{"q": {"i-0"}, "match[]": {`{InstanceId=~"i-00[0-4]"}`}}, http.StatusOK, 5},
+		{url.Values{"q": {"i-0"}, "match[]": {`{Namespace="AWS/ELB"}`}}, http.StatusOK, 0},
+		{url.Values{}, http.StatusBadRequest, 0},
+		{url.Values{"q": {"i-0"}, "match[]": {`{`}}, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		params := rangeParams("")
+		delete(params, "match[]")
+		for k, v := range tt.params {
+			params[k] = v
+		}
+		r := httptest.NewRequest(http.MethodGet, "/?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		searchSeriesHandler(w, r, db, opts)
+		if w.Code != tt.code {
+			t.Fatalf("unexpected status of %v: %d", tt.params, w.Code)
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var resp seriesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) != tt.series {
+			t.Fatalf("unexpected series of %v: %v", tt.params, resp.Data)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/mtanda/prometheus-labels-db/internal/audit"
+)
+
+type queryAuditor struct {
+	logger     audit.Logger
+	userHeader string
+}
+
+func (a *queryAuditor) user(r *http.Request) string {
+	if a.userHeader != "" {
+		if user := r.Header.Get(a.userHeader); user != "" {
+			return user
+		}
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return ""
+}
+
+func (a *queryAuditor) log(r *http.Request, e audit.Entry) {
+	if a == nil || a.logger == nil {
+		return
+	}
+	e.User = a.user(r)
+	e.RemoteAddr = r.RemoteAddr
+	e.Handler = r.URL.Path
+	// the request context may already be canceled
+	if err := a.logger.Log(context.Background(), e); err != nil {
+		// ignore error
+		slog.Error("failed to write audit log", "error", err)
+	}
+}
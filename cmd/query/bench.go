@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/bench"
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+)
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var dbDir string
+	fs.StringVar(&dbDir, "db.dir", "./data/", "Path to the database directory to populate")
+	var series int
+	fs.IntVar(&series, "populate.series", 0, "Number of synthetic series to populate (skipped if 0)")
+	var namespaces int
+	fs.IntVar(&namespaces, "populate.namespaces", 10, "Number of namespaces of the synthetic series")
+	var metricNames int
+	fs.IntVar(&metricNames, "populate.metric-names", 10, "Number of metric names per namespace of the synthetic series")
+	var partitions int
+	fs.IntVar(&partitions, "populate.partitions", 4, "Number of partitions to spread the synthetic series over")
+	var serverURL string
+	fs.StringVar(&serverURL, "query.url", "", "URL of the query server to replay the query mix against (skipped if empty)")
+	var queryMix string
+	fs.StringVar(&queryMix, "query.mix", "", "Path to the YAML file of the query mix (built-in mix if empty)")
+	var concurrency int
+	fs.IntVar(&concurrency, "query.concurrency", 8, "Number of concurrent clients")
+	var duration time.Duration
+	fs.DurationVar(&duration, "query.duration", 1*time.Minute, "Duration of the replay")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	// keep the synthetic series out of the fresh metrics window
+	end := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Hour)
+	if series > 0 {
+		ldb, err := database.Open(dbDir)
+		if err != nil {
+			return err
+		}
+		defer ldb.Close()
+		err = bench.Populate(ctx, ldb, bench.PopulateConfig{
+			Series:        series,
+			Namespaces:    namespaces,
+			MetricNames:   metricNames,
+			Partitions:    partitions,
+			LatestPartEnd: end,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if serverURL == "" {
+		return nil
+	}
+	queries := bench.DefaultQueryMix()
+	if queryMix != "" {
+		var err error
+		queries, err = bench.LoadQueryMix(queryMix)
+		if err != nil {
+			return err
+		}
+	}
+	report, err := bench.Run(ctx, bench.RunConfig{
+		URL:         serverURL,
+		Queries:     queries,
+		Concurrency: concurrency,
+		Duration:    duration,
+		End:         end,
+	})
+	if err != nil {
+		return err
+	}
+	report.Write(os.Stdout)
+	return nil
+}
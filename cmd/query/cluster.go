@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/cluster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	// requests forwarded by other nodes are always handled locally
+	forwardedHeader = "X-Labels-DB-Forwarded"
+	peerTimeout     = 1 * time.Minute
+)
+
+// clusterRouter routes the selectors to the nodes which own their namespaces.
+type clusterRouter struct {
+	ring         *cluster.Ring
+	self         string
+	tenantHeader string
+	client       *http.Client
+	forwarded    *prometheus.CounterVec
+}
+
+func newClusterRouter(peers []string, self string, tenantHeader string, registry prometheus.Registerer) (*clusterRouter, error) {
+	nodes := []string{self}
+	for _, peer := range peers {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			nodes = append(nodes, peer)
+		}
+	}
+	ring, err := cluster.NewRing(nodes, cluster.DefaultVirtualNodes)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterRouter{
+		ring:         ring,
+		self:         self,
+		tenantHeader: tenantHeader,
+		client:       &http.Client{Timeout: peerTimeout},
+		forwarded: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "cluster_forwarded_requests_total",
+			Help: "Total number of requests forwarded to the other nodes",
+		}, []string{"peer", "status"}),
+	}, nil
+}
+
+func selectorNamespace(matchers []*labels.Matcher) string {
+	for _, m := range matchers {
+		if m.Name == "Namespace" && m.Type == labels.MatchEqual {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+// split returns the selectors to query locally, and the selectors to forward to each peer.
+// The selectors without the namespace are queried on all nodes.
+func (c *clusterRouter) split(r *http.Request, matchParam []string, matchers [][]*labels.Matcher) ([][]*labels.Matcher, map[string][]string) {
+	if c == nil || r.Header.Get(forwardedHeader) != "" {
+		return matchers, nil
+	}
+	var local [][]*labels.Matcher
+	remote := make(map[string][]string)
+	for i, m := range matchers {
+		namespace := selectorNamespace(m)
+		if namespace == "" {
+			local = append(local, m)
+			for _, node := range c.ring.Nodes() {
+				if node != c.self {
+					remote[node] = append(remote[node], matchParam[i])
+				}
+			}
+			continue
+		}
+		if owner := c.ring.Owner(namespace); owner != c.self {
+			remote[owner] = append(remote[owner], matchParam[i])
+			continue
+		}
+		local = append(local, m)
+	}
+	return local, remote
+}
+
+// query sends the selectors to the peers in parallel, and returns the merged results.
+func (c *clusterRouter) query(ctx context.Context, r *http.Request, remote map[string][]string, start, end time.Time, limit int) ([]map[string]string, []string, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var allErr error
+	var result []map[string]string
+	var warnings []string
+	for peer, selectors := range remote {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, peerWarnings, err := c.queryPeer(ctx, r, peer, selectors, start, end, limit)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				c.forwarded.WithLabelValues(peer, "failure").Inc()
+				allErr = errors.Join(allErr, fmt.Errorf("failed to query %s: %w", peer, err))
+				return
+			}
+			c.forwarded.WithLabelValues(peer, "success").Inc()
+			result = append(result, data...)
+			for _, w := range peerWarnings {
+				if !slices.Contains(warnings, w) {
+					warnings = append(warnings, w)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return result, warnings, allErr
+}
+
+func (c *clusterRouter) queryPeer(ctx context.Context, r *http.Request, peer string, selectors []string, start, end time.Time, limit int) ([]map[string]string, []string, error) {
+	params := url.Values{
+		"match[]": selectors,
+		"start":   {start.Format(time.RFC3339)},
+		"end":     {end.Format(time.RFC3339)},
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	for _, p := range []string{"case_insensitive", "limit_per_selector"} {
+		if v := r.Form.Get(p); v != "" {
+			params.Set(p, v)
+		}
+	}
+	header := http.Header{}
+	header.Set(forwardedHeader, c.self)
+	for _, h := range []string{c.tenantHeader, "Authorization"} {
+		if v := r.Header.Get(h); h != "" && v != "" {
+			header.Set(h, v)
+		}
+	}
+	return postSeries(ctx, c.client, peer, params, header)
+}
+
+// postSeries queries the series API of the other instance, and returns the series and the warnings.
+func postSeries(ctx context.Context, client *http.Client, endpoint string, params url.Values, header http.Header) ([]map[string]string, []string, error) {
+	// POST not to exceed the URL length limit with long selectors
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/api/v1/series", strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	response := struct {
+		Status   string              `json:"status"`
+		Data     []map[string]string `json:"data"`
+		Warnings []string            `json:"warnings"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, nil, err
+	}
+	return response.Data, response.Warnings, nil
+}
+
+// mergeSeries appends the series in src which are not in dst.
+func mergeSeries(dst []map[string]string, src []map[string]string) []map[string]string {
+	seen := make(map[string]struct{}, len(dst))
+	for _, m := range dst {
+		seen[labels.FromMap(m).String()] = struct{}{}
+	}
+	for _, m := range src {
+		key := labels.FromMap(m).String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		dst = append(dst, m)
+	}
+	return dst
+}
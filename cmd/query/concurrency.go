@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// concurrencyLimiter queues the series queries beyond the maximum concurrency,
+// so that the bursts of expensive queries don't open the SQLite readers at once.
+type concurrencyLimiter struct {
+	slots chan struct{}
+
+	running prometheus.Gauge
+	queued  prometheus.Gauge
+}
+
+func newConcurrencyLimiter(max int, registry prometheus.Registerer) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots: make(chan struct{}, max),
+		running: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "query_concurrency_running",
+			Help: "Number of the series queries running",
+		}),
+		queued: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "query_concurrency_queued",
+			Help: "Number of the series queries waiting for the maximum concurrency",
+		}),
+	}
+}
+
+func (l *concurrencyLimiter) handler(handler http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		l.queued.Inc()
+		select {
+		case l.slots <- struct{}{}:
+			l.queued.Dec()
+		case <-r.Context().Done():
+			// the queries timed out in the queue, same as the queries timed out while running
+			l.queued.Dec()
+			http.Error(w, "query timed out in the queue: "+r.Context().Err().Error(), http.StatusServiceUnavailable)
+			return
+		}
+		l.running.Inc()
+		defer func() {
+			l.running.Dec()
+			<-l.slots
+		}()
+		handler(w, r)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := newConcurrencyLimiter(1, prometheus.NewRegistry())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := limiter.handler(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/series", nil))
+			done <- struct{}{}
+		}()
+	}
+	<-started
+	// the second query waits for the first one
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(limiter.queued) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the second query is not queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(limiter.running); got != 1 {
+		t.Fatalf("unexpected running queries: %v", got)
+	}
+
+	// the queued query times out
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/series", nil).WithContext(ctx))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	close(release)
+	<-started
+	<-done
+	<-done
+	if got := testutil.ToFloat64(limiter.running) + testutil.ToFloat64(limiter.queued); got != 0 {
+		t.Fatalf("unexpected queries left: %v", got)
+	}
+
+	// unlimited without the maximum concurrency
+	var disabled *concurrencyLimiter
+	w = httptest.NewRecorder()
+	disabled.handler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})(w, httptest.NewRequest(http.MethodGet, "/api/v1/series", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/sync/singleflight"
+)
+
+// queryGroup shares the execution of the identical queries running at once, e.g. the same selectors from the panels of a dashboard.
+// The shared results are read only.
+type queryGroup struct {
+	group  singleflight.Group
+	shared prometheus.Counter
+}
+
+type localResult struct {
+	fresh    map[string]*model.Metric
+	result   map[string]*model.Metric
+	warnings []string
+}
+
+func newQueryGroup(registry prometheus.Registerer) *queryGroup {
+	return &queryGroup{
+		shared: promauto.With(registry).NewCounter(prometheus.CounterOpts{
+			Name: "query_deduplicated_total",
+			Help: "Total number of the series queries which shared the execution of an identical query",
+		}),
+	}
+}
+
+// queryKey identifies the query of the tenant database.
+func queryKey(db *database.LabelDB, q seriesQuery) string {
+	selectors := make([]string, 0, len(q.matchers))
+	for _, lm := range q.matchers {
+		selectors = append(selectors, selectorString(lm))
+	}
+	return fmt.Sprintf("%p|%s|%d|%d|%d|%t", db, strings.Join(selectors, ","), q.start.UnixNano(), q.end.UnixNano(), q.limits.fetch, q.partial)
+}
+
+// selectorString formats the matchers as a series selector.
+func selectorString(lm []*labels.Matcher) string {
+	ms := make([]string, 0, len(lm))
+	for _, m := range lm {
+		ms = append(ms, m.String())
+	}
+	return "{" + strings.Join(ms, ", ") + "}"
+}
+
+// do calls f, or waits for the identical query running at once.
+// f is called again if the shared execution is canceled by the other request, e.g. when its client is gone.
+func (g *queryGroup) do(ctx context.Context, key string, f func(context.Context) (localResult, error)) (localResult, error) {
+	if g == nil {
+		return f(ctx)
+	}
+	executed := false
+	ch := g.group.DoChan(key, func() (interface{}, error) {
+		executed = true
+		return f(ctx)
+	})
+	select {
+	case <-ctx.Done():
+		return localResult{}, ctx.Err()
+	case res := <-ch:
+		if executed {
+			return res.Val.(localResult), res.Err
+		}
+		g.shared.Inc()
+		if res.Err != nil && ctx.Err() == nil && (errors.Is(res.Err, context.Canceled) || errors.Is(res.Err, context.DeadlineExceeded)) {
+			return f(ctx)
+		}
+		r := res.Val.(localResult)
+		// the callers append the warnings
+		r.warnings = slices.Clone(r.warnings)
+		return r, res.Err
+	}
+}
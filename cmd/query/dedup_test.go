@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueryGroup(t *testing.T) {
+	g := newQueryGroup(prometheus.NewRegistry())
+	var calls atomic.Int32
+	release := make(chan struct{})
+	f := func(ctx context.Context) (localResult, error) {
+		calls.Add(1)
+		<-release
+		return localResult{warnings: []string{"warning"}}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]localResult, 3)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := g.do(context.Background(), "key", f)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = r
+		}()
+	}
+	// wait for the other queries to join the first one
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("the identical queries are executed %d times", calls.Load())
+	}
+	if testutil.ToFloat64(g.shared) != 2 {
+		t.Fatalf("unexpected shared queries: %v", testutil.ToFloat64(g.shared))
+	}
+	for _, r := range results {
+		if len(r.warnings) != 1 {
+			t.Fatalf("unexpected result: %+v", r)
+		}
+	}
+}
+
+func TestQueryGroupCanceled(t *testing.T) {
+	g := newQueryGroup(prometheus.NewRegistry())
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go g.do(ctx, "key", func(ctx context.Context) (localResult, error) {
+		close(started)
+		<-ctx.Done()
+		return localResult{}, ctx.Err()
+	})
+	<-started
+
+	// the query waiting for the canceled one executes again
+	done := make(chan error)
+	go func() {
+		_, err := g.do(context.Background(), "key", func(ctx context.Context) (localResult, error) {
+			return localResult{}, nil
+		})
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
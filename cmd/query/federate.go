@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// the federated instances don't federate the requests again, so that the instances can federate each other
+const federatedHeader = "X-Labels-DB-Federated"
+
+// federateConfig is the file of --federate.config.file.
+type federateConfig struct {
+	Endpoints []federateEndpoint `yaml:"endpoints"`
+}
+
+// federateEndpoint is the federated instance and the credentials to it.
+// The credentials of the clients are never forwarded, since the instances can be in the other accounts.
+type federateEndpoint struct {
+	URL              string `yaml:"url"`
+	web.ClientConfig `yaml:",inline"`
+}
+
+func loadFederateConfig(path string) (*federateConfig, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg federateConfig
+	if err := yaml.UnmarshalStrict(buf, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// federation fans the series queries out to the other labels-db instances, e.g. the query services of the recorders of the other accounts,
+// so that a single endpoint serves the series of all of them.
+// Unlike the cluster nodes, the instances are independent, so their failures are only warned.
+// Only the series API is federated, the label names and values of the gRPC API are of the local instance.
+type federation struct {
+	endpoints    []string
+	clients      map[string]*http.Client
+	tenantHeader string
+	requests     *prometheus.CounterVec
+}
+
+func newFederation(endpoints []federateEndpoint, tenantHeader string, registry prometheus.Registerer) (*federation, error) {
+	f := &federation{
+		clients:      make(map[string]*http.Client),
+		tenantHeader: tenantHeader,
+		requests: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "federate_requests_total",
+			Help: "Total number of the series queries sent to the federated instances",
+		}, []string{"endpoint", "status"}),
+	}
+	for _, e := range endpoints {
+		if e.URL == "" {
+			return nil, fmt.Errorf("url of the federated endpoint is required")
+		}
+		if _, ok := f.clients[e.URL]; ok {
+			return nil, fmt.Errorf("duplicated federated endpoint: %s", e.URL)
+		}
+		client, err := e.ClientConfig.NewClient(peerTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("federated endpoint %s: %w", e.URL, err)
+		}
+		f.endpoints = append(f.endpoints, e.URL)
+		f.clients[e.URL] = client
+	}
+	return f, nil
+}
+
+// query sends the selectors to all the instances in parallel, and returns the merged series and the warnings including the failures.
+func (f *federation) query(ctx context.Context, r *http.Request, selectors []string, start, end time.Time, limit int) ([]map[string]string, []string) {
+	// the requests forwarded by the other cluster nodes are federated by the node which received them
+	if f == nil || r.Header.Get(federatedHeader) != "" || r.Header.Get(forwardedHeader) != "" {
+		return nil, nil
+	}
+	params := url.Values{
+		"match[]": selectors,
+		"start":   {start.Format(time.RFC3339)},
+		"end":     {end.Format(time.RFC3339)},
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	for _, p := range []string{"case_insensitive", "limit_per_selector", "partial_response"} {
+		if v := r.Form.Get(p); v != "" {
+			params.Set(p, v)
+		}
+	}
+	header := http.Header{}
+	header.Set(federatedHeader, "1")
+	if v := r.Header.Get(f.tenantHeader); f.tenantHeader != "" && v != "" {
+		header.Set(f.tenantHeader, v)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var result []map[string]string
+	var warnings []string
+	for _, endpoint := range f.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, endpointWarnings, err := postSeries(ctx, f.clients[endpoint], endpoint, params, header)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				f.requests.WithLabelValues(endpoint, "failure").Inc()
+				warnings = append(warnings, fmt.Sprintf("failed to query federated instance %s: %s", endpoint, err))
+				return
+			}
+			f.requests.WithLabelValues(endpoint, "success").Inc()
+			result = mergeSeries(result, data)
+			for _, w := range endpointWarnings {
+				if !slices.Contains(warnings, w) {
+					warnings = append(warnings, w)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return result, warnings
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mtanda/prometheus-labels-db/internal/web"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSeriesHandlerFederation(t *testing.T) {
+	db := newTestDB(t, 1)
+	var forwarded http.Header
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		json.NewEncoder(w).Encode(map[string]any{
+			"status": "success",
+			"data": []map[string]string{
+				// the same series as the local one is deduplicated
+				{"__name__": "CPUUtilization", "MetricName": "CPUUtilization", "Namespace": "AWS/EC2", "Region": "us-east-1", "InstanceId": "i-000"},
+				{"__name__": "CPUUtilization", "MetricName": "CPUUtilization", "Namespace": "AWS/EC2", "Region": "us-west-2", "InstanceId": "i-100"},
+			},
+			"warnings": []string{"remote warning"},
+		})
+	}))
+	defer remote.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("remote-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opts := newTestOptions()
+	var err error
+	opts.federation, err = newFederation([]federateEndpoint{
+		{URL: remote.URL, ClientConfig: web.ClientConfig{BearerTokenFile: tokenFile}},
+		{URL: failing.URL},
+	}, "X-Scope-OrgID", prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/series?"+rangeParams(`{Namespace="AWS/EC2"}`).Encode(), nil)
+	r.Header.Set("Authorization", "Bearer local-token")
+	w := httptest.NewRecorder()
+	seriesHandler(w, r, db, opts, nil, nil)
+	resp := decodeSeries(t, w)
+	if len(resp.Data) != 2 {
+		t.Fatalf("unexpected data: %v", resp.Data)
+	}
+	if forwarded.Get(federatedHeader) == "" {
+		t.Fatalf("the federated header is not sent: %v", forwarded)
+	}
+	// the credentials of the client are not forwarded to the other instances
+	if got := forwarded.Get("Authorization"); got != "Bearer remote-token" {
+		t.Fatalf("unexpected authorization: %q", got)
+	}
+	var failed bool
+	for _, w := range resp.Warnings {
+		failed = failed || strings.Contains(w, failing.URL)
+	}
+	if !failed || !strings.Contains(strings.Join(resp.Warnings, "\n"), "remote warning") {
+		t.Fatalf("unexpected warnings: %v", resp.Warnings)
+	}
+
+	// the federated requests and the requests forwarded by the other cluster nodes are not federated again
+	for _, h := range []string{federatedHeader, forwardedHeader} {
+		r = httptest.NewRequest(http.MethodGet, "/api/v1/series?"+rangeParams(`{Namespace="AWS/EC2"}`).Encode(), nil)
+		r.Header.Set(h, "1")
+		w = httptest.NewRecorder()
+		seriesHandler(w, r, db, opts, nil, nil)
+		resp = decodeSeries(t, w)
+		if len(resp.Data) != 1 || len(resp.Warnings) != 0 {
+			t.Fatalf("unexpected response with %s: %+v", h, resp)
+		}
+	}
+}
+
+func TestLoadFederateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "federate.yaml")
+	err := os.WriteFile(path, []byte(`
+endpoints:
+- url: https://query-account-b:8080
+  bearer_token_file: /etc/labels-db/token
+  tls_config:
+    ca_file: /etc/labels-db/ca.pem
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadFederateConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Endpoints) != 1 {
+		t.Fatalf("unexpected endpoints: %+v", cfg.Endpoints)
+	}
+	e := cfg.Endpoints[0]
+	if e.URL != "https://query-account-b:8080" || e.BearerTokenFile != "/etc/labels-db/token" || e.TLSConfig == nil || e.TLSConfig.CAFile != "/etc/labels-db/ca.pem" {
+		t.Errorf("unexpected endpoint: %+v", e)
+	}
+
+	if err := os.WriteFile(path, []byte("endpoints:\n- url: http://a\n  unknown: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFederateConfig(path); err == nil {
+		t.Error("expected error for the unknown field")
+	}
+}
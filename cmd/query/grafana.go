@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/relabel"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// dimensionValue is the element of the dimension-values resource of the Grafana CloudWatch datasource.
+type dimensionValue struct {
+	Value string `json:"value"`
+}
+
+// parseDimensionFilters parses the dimensionFilters parameter of Grafana, which maps the dimension keys to a value or the values.
+// The value "*" or no value matches any value of the dimension.
+func parseDimensionFilters(param string) ([]*labels.Matcher, error) {
+	if param == "" {
+		return nil, nil
+	}
+	var filters map[string]any
+	if err := json.Unmarshal([]byte(param), &filters); err != nil {
+		return nil, err
+	}
+	var matchers []*labels.Matcher
+	for _, key := range slices.Sorted(maps.Keys(filters)) {
+		var values []string
+		switch v := filters[key].(type) {
+		case string:
+			values = []string{v}
+		case []any:
+			for _, e := range v {
+				s, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("invalid value of dimension %s: %v", key, e)
+				}
+				values = append(values, s)
+			}
+		case nil:
+		default:
+			return nil, fmt.Errorf("invalid value of dimension %s: %v", key, v)
+		}
+		values = slices.DeleteFunc(values, func(v string) bool { return v == "" })
+		if len(values) == 0 || slices.Contains(values, "*") {
+			matchers = append(matchers, labels.MustNewMatcher(labels.MatchNotEqual, key, ""))
+			continue
+		}
+		quoted := make([]string, 0, len(values))
+		for _, v := range values {
+			quoted = append(quoted, regexp.QuoteMeta(v))
+		}
+		m, err := labels.NewMatcher(labels.MatchRegexp, key, strings.Join(quoted, "|"))
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// dimensionValuesHandler serves the values of a dimension the same as the dimension-values resource of the Grafana CloudWatch datasource,
+// so that the template variables can query this service instead of CloudWatch.
+// The response has no warnings, so the values of the series over --query.max-limit are dropped silently.
+func dimensionValuesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, opts *queryOptions) {
+	query := r.URL.Query()
+	region := query.Get("region")
+	namespace := query.Get("namespace")
+	dimensionKey := query.Get("dimensionKey")
+	if region == "" || namespace == "" || dimensionKey == "" {
+		http.Error(w, "region, namespace and dimensionKey are required", http.StatusBadRequest)
+		return
+	}
+	matcher := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", namespace),
+		labels.MustNewMatcher(labels.MatchEqual, "Region", region),
+		labels.MustNewMatcher(labels.MatchNotEqual, dimensionKey, ""),
+	}
+	if metricName := query.Get("metricName"); metricName != "" {
+		matcher = append(matcher, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, metricName))
+	}
+	filters, err := parseDimensionFilters(query.Get("dimensionFilters"))
+	if err != nil {
+		http.Error(w, "invalid dimensionFilters parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	matcher = append(matcher, filters...)
+
+	// same as the series API, the range defaults to the lookback before now
+	now := time.Now().UTC()
+	end := now
+	if endParam := query.Get("end"); endParam != "" {
+		end, err = parseTime(endParam)
+		if err != nil {
+			http.Error(w, "failed to parse end timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	start := end.Add(-opts.lookback.defaultLookback)
+	if startParam := query.Get("start"); startParam != "" {
+		start, err = parseTime(startParam)
+		if err != nil {
+			http.Error(w, "failed to parse start timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if end.Before(start) {
+		http.Error(w, "end timestamp must not be before start timestamp", http.StatusBadRequest)
+		return
+	}
+
+	// the response has no warnings of the clamps
+	start, _ = opts.lookback.clampStart(start, end, now)
+	limits := opts.limits(0)
+	_, result, _, err := queryLocalMetrics(r.Context(), db, opts, seriesQuery{
+		matchers: [][]*labels.Matcher{matcher},
+		start:    start,
+		end:      end,
+		now:      now,
+		limits:   limits,
+		partial:  opts.partial,
+	}, nil)
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+	data := make([]map[string]string, 0, len(result))
+	for _, metric := range result {
+		data = append(data, metric.Labels())
+	}
+	data = relabel.Apply(data, opts.relabelConfigs)
+	data, _, err = limits.apply(data, nil)
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	values := make(map[string]struct{})
+	for _, lbls := range data {
+		if v, ok := lbls[dimensionKey]; ok {
+			values[v] = struct{}{}
+		}
+	}
+	response := make([]dimensionValue, 0, len(values))
+	for _, v := range slices.Sorted(maps.Keys(values)) {
+		response = append(response, dimensionValue{Value: v})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		// ignore error
+		slog.Error("failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDimensionValuesHandler(t *testing.T) {
+	db := newTestDB(t, 3)
+	opts := newTestOptions()
+	get := func(params url.Values) *httptest.ResponseRecorder {
+		params.Set("start", testTime.Format(time.RFC3339))
+		params.Set("end", testTime.Add(time.Hour).Format(time.RFC3339))
+		w := httptest.NewRecorder()
+		dimensionValuesHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/grafana/dimension-values?"+params.Encode(), nil), db, opts)
+		return w
+	}
+
+	tests := []struct {
+		filters string
+		want    []dimensionValue
+	}{
+		{"", []dimensionValue{{"i-000"}, {"i-001"}, {"i-002"}}},
+		{`{"InstanceId":"i-001"}`, []dimensionValue{{"i-001"}}},
+		{`{"InstanceId":["i-000","i-002"]}`, []dimensionValue{{"i-000"}, {"i-002"}}},
+		{`{"InstanceId":"*"}`, []dimensionValue{{"i-000"}, {"i-001"}, {"i-002"}}},
+		// the series without the filtered dimension
+		{`{"AutoScalingGroupName":"*"}`, []dimensionValue{}},
+	}
+	for _, tt := range tests {
+		w := get(url.Values{
+			"region":           []string{"us-east-1"},
+			"namespace":        []string{"AWS/EC2"},
+			"metricName":       []string{"CPUUtilization"},
+			"dimensionKey":     []string{"InstanceId"},
+			"dimensionFilters": []string{tt.filters},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status for %s: %d %s", tt.filters, w.Code, w.Body.String())
+		}
+		var got []dimensionValue
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dimension values for %s = %v, want %v", tt.filters, got, tt.want)
+		}
+	}
+
+	for _, params := range []url.Values{
+		{"region": []string{"us-east-1"}, "namespace": []string{"AWS/EC2"}},
+		{"region": []string{"us-east-1"}, "namespace": []string{"AWS/EC2"}, "dimensionKey": []string{"InstanceId"}, "dimensionFilters": []string{`{"InstanceId":1}`}},
+	} {
+		if w := get(params); w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status for %v: %d", params, w.Code)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/relabel"
+	"github.com/mtanda/prometheus-labels-db/internal/web"
+	"github.com/mtanda/prometheus-labels-db/labelspb"
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcBatchSize is the maximum number of the series or the values in a streamed response.
+const grpcBatchSize = 1000
+
+// grpcServer serves the same series as the HTTP API, except the other nodes in cluster mode.
+type grpcServer struct {
+	labelspb.UnimplementedLabelsDBServer
+	options  *liveOptions
+	resolver *tenantResolver
+	// authorize checks the authorization metadata with the web config, nil without it
+	authorize func(authorization string) error
+}
+
+func newGRPCServer(s *grpcServer, guard *memoryGuard) *grpc.Server {
+	server := grpc.NewServer(grpc.ChainStreamInterceptor(s.authInterceptor, guard.streamInterceptor))
+	labelspb.RegisterLabelsDBServer(server, s)
+	return server
+}
+
+// authInterceptor requires the same credentials as the HTTP API in the authorization metadata, and applies the same rate limits.
+func (s *grpcServer) authInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if s.authorize == nil {
+		return handler(srv, ss)
+	}
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ss.Context()); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			authorization = v[0]
+		}
+	}
+	switch err := s.authorize(authorization); err {
+	case nil:
+		return handler(srv, ss)
+	case web.ErrRateLimited:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+}
+
+// resolve gets the database of the tenant in the metadata, with the same key as the tenant header.
+// Same as the header, the metadata must be set only by a trusted proxy when the tenants are isolated.
+func (s *grpcServer) resolve(ctx context.Context) (*database.LabelDB, error) {
+	tenant := s.resolver.defaultTenant
+	if md, ok := metadata.FromIncomingContext(ctx); ok && s.resolver.header != "" {
+		if v := md.Get(strings.ToLower(s.resolver.header)); len(v) > 0 && v[0] != "" {
+			tenant = v[0]
+		}
+	}
+	if err := database.ValidateTenant(tenant); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "failed to resolve tenant: "+err.Error())
+	}
+	db, err := s.resolver.tenants.Get(tenant)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "failed to resolve tenant: "+err.Error())
+	}
+	return db, nil
+}
+
+func fromSelectors(selectors []*labelspb.Selector) ([][]*labels.Matcher, error) {
+	result := make([][]*labels.Matcher, 0, len(selectors))
+	for _, selector := range selectors {
+		matchers := make([]*labels.Matcher, 0, len(selector.Matchers))
+		for _, m := range selector.Matchers {
+			var t labels.MatchType
+			switch m.Type {
+			case labelspb.LabelMatcher_EQ:
+				t = labels.MatchEqual
+			case labelspb.LabelMatcher_NEQ:
+				t = labels.MatchNotEqual
+			case labelspb.LabelMatcher_RE:
+				t = labels.MatchRegexp
+			case labelspb.LabelMatcher_NRE:
+				t = labels.MatchNotRegexp
+			default:
+				return nil, fmt.Errorf("invalid matcher type: %s", m.Type)
+			}
+			matcher, err := labels.NewMatcher(t, m.Name, m.Value)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, matcher)
+		}
+		result = append(result, matchers)
+	}
+	return result, nil
+}
+
+// query returns the label sets of the series, the same as the HTTP series API.
+func (s *grpcServer) query(ctx context.Context, selectors []*labelspb.Selector, startMs, endMs int64, limit int) ([]map[string]string, []string, error) {
+	opts := s.options.load()
+	limits := opts.limits(limit)
+	db, err := s.resolve(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	matchers, err := fromSelectors(selectors)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, "invalid selectors: "+err.Error())
+	}
+	if len(matchers) == 0 {
+		return nil, nil, status.Error(codes.InvalidArgument, "no selectors")
+	}
+	// after the returned series are observed
+	queryStart := time.Now()
+	var outcome queryOutcome
+	defer func() {
+		outcome.duration = time.Since(queryStart)
+		opts.usage.observeQuery(matchers, outcome)
+	}()
+
+	if endMs < startMs {
+		return nil, nil, status.Error(codes.InvalidArgument, "end timestamp must not be before start timestamp")
+	}
+	now := time.Now().UTC()
+	end := time.UnixMilli(endMs).UTC()
+	start, rangeWarnings := opts.lookback.clampStart(time.UnixMilli(startMs).UTC(), end, now)
+	q := seriesQuery{
+		matchers: matchers,
+		start:    start,
+		end:      end,
+		now:      now,
+		limits:   limits,
+		partial:  opts.partial,
+		warnings: rangeWarnings,
+	}
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	_, result, warnings, err := queryLocalMetrics(ctx, db, opts, q, nil)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, nil, status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	data := []map[string]string{}
+	for _, metric := range result {
+		data = append(data, metric.Labels())
+	}
+	data = relabel.Apply(data, opts.relabelConfigs)
+	fetched := len(data)
+	data, warnings, err = limits.apply(data, warnings)
+	if err != nil {
+		return nil, nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	opts.usage.observeSeries(data)
+	outcome.data = data
+	outcome.truncated = len(data) < fetched
+	return data, warnings, nil
+}
+
+func (s *grpcServer) Series(req *labelspb.SeriesRequest, stream grpc.ServerStreamingServer[labelspb.SeriesResponse]) error {
+	if req.Limit < 0 {
+		return status.Error(codes.InvalidArgument, "limit must be non-negative")
+	}
+	data, warnings, err := s.query(stream.Context(), req.Selectors, req.StartTimestampMs, req.EndTimestampMs, int(req.Limit))
+	if err != nil {
+		return err
+	}
+
+	resp := &labelspb.SeriesResponse{Warnings: warnings}
+	for _, lbls := range data {
+		series := &labelspb.Series{Labels: make([]*labelspb.Label, 0, len(lbls))}
+		for _, name := range slices.Sorted(maps.Keys(lbls)) {
+			series.Labels = append(series.Labels, &labelspb.Label{Name: name, Value: lbls[name]})
+		}
+		resp.Series = append(resp.Series, series)
+		if len(resp.Series) == grpcBatchSize {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &labelspb.SeriesResponse{}
+		}
+	}
+	// send the last batch, or the warnings without series
+	if len(resp.Series) > 0 || len(resp.Warnings) > 0 {
+		return stream.Send(resp)
+	}
+	return nil
+}
+
+func (s *grpcServer) LabelNames(req *labelspb.LabelNamesRequest, stream grpc.ServerStreamingServer[labelspb.LabelNamesResponse]) error {
+	data, warnings, err := s.query(stream.Context(), req.Selectors, req.StartTimestampMs, req.EndTimestampMs, 0)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]struct{})
+	for _, lbls := range data {
+		for name := range lbls {
+			names[name] = struct{}{}
+		}
+	}
+	return sendBatches(slices.Sorted(maps.Keys(names)), warnings, func(batch []string, warnings []string) error {
+		return stream.Send(&labelspb.LabelNamesResponse{Names: batch, Warnings: warnings})
+	})
+}
+
+func (s *grpcServer) LabelValues(req *labelspb.LabelValuesRequest, stream grpc.ServerStreamingServer[labelspb.LabelValuesResponse]) error {
+	if req.Name == "" {
+		return status.Error(codes.InvalidArgument, "name is required")
+	}
+	data, warnings, err := s.query(stream.Context(), req.Selectors, req.StartTimestampMs, req.EndTimestampMs, 0)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]struct{})
+	for _, lbls := range data {
+		if v, ok := lbls[req.Name]; ok {
+			values[v] = struct{}{}
+		}
+	}
+	return sendBatches(slices.Sorted(maps.Keys(values)), warnings, func(batch []string, warnings []string) error {
+		return stream.Send(&labelspb.LabelValuesResponse{Values: batch, Warnings: warnings})
+	})
+}
+
+// sendBatches sends the values in batches, and the warnings with the first batch, or alone if there are no values.
+func sendBatches(values []string, warnings []string, send func([]string, []string) error) error {
+	if len(values) == 0 && len(warnings) > 0 {
+		return send(nil, warnings)
+	}
+	for i := 0; i < len(values); i += grpcBatchSize {
+		if err := send(values[i:min(i+grpcBatchSize, len(values))], warnings); err != nil {
+			return err
+		}
+		warnings = nil
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/web"
+	"github.com/mtanda/prometheus-labels-db/labelspb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGRPCClient serves s on the in-process connection, with the default tenant of a series and the tenant team-a of n series.
+func newTestGRPCClient(t *testing.T, s *grpcServer, n int) labelspb.LabelsDBClient {
+	t.Helper()
+	dir := t.TempDir()
+	for tenant, count := range map[string]int{"": 1, "team-a": n} {
+		db, err := database.OpenTenant(dir, tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recordTestSeries(t, db, count)
+		db.Close()
+	}
+	tenants := database.OpenTenants(dir)
+	t.Cleanup(func() { tenants.Close() })
+	s.resolver = &tenantResolver{tenants: tenants, header: "X-Scope-OrgID"}
+
+	l := bufconn.Listen(1 << 20)
+	server := newGRPCServer(s, nil)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return labelspb.NewLabelsDBClient(conn)
+}
+
+func testSeriesRequest(limit int64) *labelspb.SeriesRequest {
+	return &labelspb.SeriesRequest{
+		Selectors: []*labelspb.Selector{{Matchers: []*labelspb.LabelMatcher{
+			{Type: labelspb.LabelMatcher_EQ, Name: "Namespace", Value: "AWS/EC2"},
+		}}},
+		StartTimestampMs: testTime.UnixMilli(),
+		EndTimestampMs:   testTime.Add(time.Hour).UnixMilli(),
+		Limit:            limit,
+	}
+}
+
+// receiveAll returns the responses until the end of the stream.
+func receiveAll[T any](stream grpc.ServerStreamingClient[T]) ([]*T, error) {
+	var responses []*T
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return responses, nil
+		}
+		if err != nil {
+			return responses, err
+		}
+		responses = append(responses, resp)
+	}
+}
+
+func teamA(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "X-Scope-OrgID", "team-a")
+}
+
+func TestGRPCSeries(t *testing.T) {
+	client := newTestGRPCClient(t, &grpcServer{options: newLiveOptions(newTestOptions())}, grpcBatchSize+1)
+	ctx := context.Background()
+
+	// the series of the tenant in the metadata are sent in batches
+	stream, err := client.Series(teamA(ctx), testSeriesRequest(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err := receiveAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 || len(responses[0].Series) != grpcBatchSize || len(responses[1].Series) != 1 {
+		t.Fatalf("unexpected batches: %d", len(responses))
+	}
+	// sorted by the label sets
+	first := responses[0].Series[0].Labels
+	if first[0].Name != "InstanceId" || first[0].Value != "i-000" {
+		t.Fatalf("unexpected series: %v", first)
+	}
+
+	// the default tenant without the metadata
+	stream, err = client.Series(ctx, testSeriesRequest(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err = receiveAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || len(responses[0].Series) != 1 {
+		t.Fatalf("unexpected responses: %v", responses)
+	}
+
+	// truncated by the limit with the warning
+	stream, err = client.Series(teamA(ctx), testSeriesRequest(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err = receiveAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || len(responses[0].Series) != 2 || len(responses[0].Warnings) != 1 || responses[0].Warnings[0] != truncatedWarning {
+		t.Fatalf("unexpected responses: %v", responses)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	opts := newTestOptions()
+	opts.maxSeries = 2
+	client := newTestGRPCClient(t, &grpcServer{options: newLiveOptions(opts)}, 3)
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		req  *labelspb.SeriesRequest
+		code codes.Code
+	}{
+		{name: "too many series", ctx: teamA(ctx), req: testSeriesRequest(0), code: codes.ResourceExhausted},
+		{name: "unknown tenant", ctx: metadata.AppendToOutgoingContext(ctx, "X-Scope-OrgID", "unknown"), req: testSeriesRequest(0), code: codes.InvalidArgument},
+		{name: "invalid tenant", ctx: metadata.AppendToOutgoingContext(ctx, "X-Scope-OrgID", "../team-a"), req: testSeriesRequest(0), code: codes.InvalidArgument},
+		{name: "negative limit", ctx: teamA(ctx), req: testSeriesRequest(-1), code: codes.InvalidArgument},
+		{name: "no selectors", ctx: teamA(ctx), req: &labelspb.SeriesRequest{}, code: codes.InvalidArgument},
+		{
+			name: "end before start",
+			ctx:  teamA(ctx),
+			req: &labelspb.SeriesRequest{
+				Selectors:        testSeriesRequest(0).Selectors,
+				StartTimestampMs: testTime.Add(time.Hour).UnixMilli(),
+				EndTimestampMs:   testTime.UnixMilli(),
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := client.Series(tt.ctx, tt.req)
+			if err == nil {
+				_, err = receiveAll(stream)
+			}
+			if status.Code(err) != tt.code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	dir := t.TempDir()
+	tokensFile := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokensFile, []byte("token-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := web.DefaultConfig()
+	cfg.ConfigFile = filepath.Join(dir, "web.yml")
+	config := "bearer_tokens_file: " + tokensFile + "\nrate_limit:\n  requests_per_second: 0.001\n  burst: 1\n"
+	if err := os.WriteFile(cfg.ConfigFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	server, err := web.NewServer("", nil, cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestGRPCClient(t, &grpcServer{options: newLiveOptions(newTestOptions()), authorize: server.Authorize}, 1)
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{name: "no credentials", ctx: teamA(ctx), code: codes.Unauthenticated},
+		{name: "invalid token", ctx: metadata.AppendToOutgoingContext(teamA(ctx), "authorization", "Bearer token-b"), code: codes.Unauthenticated},
+		{name: "valid token", ctx: metadata.AppendToOutgoingContext(teamA(ctx), "authorization", "Bearer token-a"), code: codes.OK},
+		// the burst is taken by the previous request
+		{name: "rate limited", ctx: metadata.AppendToOutgoingContext(teamA(ctx), "authorization", "Bearer token-a"), code: codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := client.Series(tt.ctx, testSeriesRequest(0))
+			if err == nil {
+				_, err = receiveAll(stream)
+			}
+			if status.Code(err) != tt.code {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	opts := newTestOptions()
+	opts.timeout = time.Nanosecond
+	client := newTestGRPCClient(t, &grpcServer{options: newLiveOptions(opts)}, 1)
+	stream, err := client.Series(teamA(context.Background()), testSeriesRequest(0))
+	if err == nil {
+		_, err = receiveAll(stream)
+	}
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGRPCLabelNamesAndValues(t *testing.T) {
+	opts := newTestOptions()
+	opts.maxLimit = 2
+	client := newTestGRPCClient(t, &grpcServer{options: newLiveOptions(opts)}, 3)
+	ctx := teamA(context.Background())
+	req := testSeriesRequest(0)
+
+	namesStream, err := client.LabelNames(ctx, &labelspb.LabelNamesRequest{Selectors: req.Selectors, StartTimestampMs: req.StartTimestampMs, EndTimestampMs: req.EndTimestampMs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := receiveAll(namesStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the truncation by --query.max-limit is warned
+	if len(names) != 1 || len(names[0].Names) != 5 || len(names[0].Warnings) != 1 || names[0].Warnings[0] != truncatedWarning {
+		t.Fatalf("unexpected responses: %v", names)
+	}
+
+	valuesStream, err := client.LabelValues(ctx, &labelspb.LabelValuesRequest{Name: "InstanceId", Selectors: req.Selectors, StartTimestampMs: req.StartTimestampMs, EndTimestampMs: req.EndTimestampMs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := receiveAll(valuesStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || len(values[0].Values) != 2 || values[0].Values[0] != "i-000" || len(values[0].Warnings) != 1 {
+		t.Fatalf("unexpected responses: %v", values)
+	}
+
+	// the warnings are sent without values
+	valuesStream, err = client.LabelValues(ctx, &labelspb.LabelValuesRequest{Name: "unknown", Selectors: req.Selectors, StartTimestampMs: req.StartTimestampMs, EndTimestampMs: req.EndTimestampMs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err = receiveAll(valuesStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || len(values[0].Values) != 0 || len(values[0].Warnings) != 1 {
+		t.Fatalf("unexpected responses: %v", values)
+	}
+}
+
+func TestFromSelectors(t *testing.T) {
+	selectors := []*labelspb.Selector{{Matchers: []*labelspb.LabelMatcher{
+		{Type: labelspb.LabelMatcher_EQ, Name: "a", Value: "1"},
+		{Type: labelspb.LabelMatcher_NEQ, Name: "b", Value: "2"},
+		{Type: labelspb.LabelMatcher_RE, Name: "c", Value: "3.*"},
+		{Type: labelspb.LabelMatcher_NRE, Name: "d", Value: "4.*"},
+	}}}
+	got, err := fromSelectors(selectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []labels.MatchType{labels.MatchEqual, labels.MatchNotEqual, labels.MatchRegexp, labels.MatchNotRegexp}
+	if len(got) != 1 || len(got[0]) != len(want) {
+		t.Fatalf("unexpected matchers: %v", got)
+	}
+	for i, m := range got[0] {
+		if m.Type != want[i] {
+			t.Fatalf("unexpected matcher: %s", m)
+		}
+	}
+
+	for _, m := range []*labelspb.LabelMatcher{
+		{Type: labelspb.LabelMatcher_RE, Name: "a", Value: "("},
+		{Type: labelspb.LabelMatcher_Type(10), Name: "a", Value: "1"},
+	} {
+		if _, err := fromSelectors([]*labelspb.Selector{{Matchers: []*labelspb.LabelMatcher{m}}}); err == nil {
+			t.Fatalf("expected error for %v", m)
+		}
+	}
+}
+
+func TestSendBatches(t *testing.T) {
+	values := make([]string, 2*grpcBatchSize+1)
+	var batches [][]string
+	var warnings [][]string
+	err := sendBatches(values, []string{"warning"}, func(batch []string, w []string) error {
+		batches = append(batches, batch)
+		warnings = append(warnings, w)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 3 || len(batches[2]) != 1 || len(warnings[0]) != 1 || warnings[1] != nil || warnings[2] != nil {
+		t.Fatalf("unexpected batches: %d", len(batches))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/relabel"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type instantSample struct {
+	Metric map[string]string `json:"metric"`
+	// the timestamp in seconds and the value as string, same as Prometheus
+	Value [2]any `json:"value"`
+}
+
+type instantQueryResult struct {
+	ResultType string          `json:"resultType"`
+	Result     []instantSample `json:"result"`
+}
+
+// parseVectorSelector parses the query restricted to a vector selector, optionally in parentheses.
+func parseVectorSelector(query string) ([]*labels.Matcher, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		expr = paren.Expr
+	}
+	vs, ok := expr.(*parser.VectorSelector)
+	if !ok {
+		return nil, errors.New("only vector selectors are supported")
+	}
+	if vs.OriginalOffset != 0 || vs.Timestamp != nil || vs.StartOrEnd != 0 {
+		return nil, errors.New("offset and @ modifiers are not supported")
+	}
+	return vs.LabelMatchers, nil
+}
+
+// instantQueryHandler evaluates the vector selectors at the time with the sample value 1 for each series,
+// which is enough for the tools only checking the matching series, e.g. the Grafana variable queries.
+// The series seen within --query.default-lookback before the time are returned, because the recorder scrapes periodically.
+func instantQueryHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, opts *queryOptions) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "failed to parse parameters: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	matcher, err := parseVectorSelector(r.Form.Get("query"))
+	if err != nil {
+		http.Error(w, "invalid query parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	// after the returned series are observed
+	var outcome queryOutcome
+	defer func() {
+		outcome.duration = time.Since(now)
+		opts.usage.observeQuery([][]*labels.Matcher{matcher}, outcome)
+	}()
+	ts := now
+	if timeParam := r.Form.Get("time"); timeParam != "" {
+		ts, err = parseTime(timeParam)
+		if err != nil {
+			http.Error(w, "failed to parse time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limits := opts.limits(0)
+	start, rangeWarnings := opts.lookback.clampStart(ts.Add(-opts.lookback.defaultLookback), ts, now)
+	_, result, warnings, err := queryLocalMetrics(r.Context(), db, opts, seriesQuery{
+		matchers: [][]*labels.Matcher{matcher},
+		start:    start,
+		end:      ts,
+		now:      now,
+		limits:   limits,
+		partial:  opts.partial,
+		warnings: rangeWarnings,
+	}, nil)
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+	data := make([]map[string]string, 0, len(result))
+	for _, metric := range result {
+		data = append(data, metric.Labels())
+	}
+	data = relabel.Apply(data, opts.relabelConfigs)
+	fetched := len(data)
+	data, warnings, err = limits.apply(data, warnings)
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+	opts.usage.observeSeries(data)
+	outcome.data = data
+	outcome.truncated = len(data) < fetched
+
+	samples := make([]instantSample, 0, len(data))
+	t := float64(ts.UnixMilli()) / 1000
+	for _, lbls := range data {
+		samples = append(samples, instantSample{
+			Metric: lbls,
+			Value:  [2]any{t, strconv.Itoa(syntheticSampleValue)},
+		})
+	}
+	response := map[string]interface{}{
+		"status": "success",
+		"data": instantQueryResult{
+			ResultType: "vector",
+			Result:     samples,
+		},
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		// ignore error
+		slog.Error("failed to write response", "error", err)
+	}
+}
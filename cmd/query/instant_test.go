@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstantQueryHandler(t *testing.T) {
+	db := newTestDB(t, 2)
+	opts := newTestOptions()
+	get := func(params url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		instantQueryHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+params.Encode(), nil), db, opts)
+		return w
+	}
+
+	ts := testTime.Add(90 * time.Minute)
+	w := get(url.Values{"query": []string{`(CPUUtilization{Namespace="AWS/EC2",InstanceId="i-001"})`}, "time": []string{ts.Format(time.RFC3339)}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Status string             `json:"status"`
+		Data   instantQueryResult `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "success" || resp.Data.ResultType != "vector" || len(resp.Data.Result) != 1 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	sample := resp.Data.Result[0]
+	if sample.Metric["InstanceId"] != "i-001" || sample.Value[0] != float64(ts.Unix()) || sample.Value[1] != "1" {
+		t.Fatalf("unexpected sample: %+v", sample)
+	}
+
+	// the series not seen within the lookback before the time
+	w = get(url.Values{"query": []string{`CPUUtilization{Namespace="AWS/EC2"}`}, "time": []string{testTime.Add(3 * time.Hour).Format(time.RFC3339)}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"result":[]`) {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, query := range []string{`rate(CPUUtilization[5m])`, `CPUUtilization offset 1h`, `CPUUtilization{`} {
+		if w := get(url.Values{"query": []string{query}}); w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status for %s: %d", query, w.Code)
+		}
+	}
+}
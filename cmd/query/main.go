@@ -2,33 +2,97 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/mtanda/prometheus-labels-db/internal/accesslog"
+	"github.com/mtanda/prometheus-labels-db/internal/audit"
+	"github.com/mtanda/prometheus-labels-db/internal/cloudwatchmock"
 	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/database/regexp"
+	"github.com/mtanda/prometheus-labels-db/internal/encoding"
 	"github.com/mtanda/prometheus-labels-db/internal/fresh_metrics"
+	"github.com/mtanda/prometheus-labels-db/internal/labelindex"
 	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/objstore"
+	"github.com/mtanda/prometheus-labels-db/internal/relabel"
+	"github.com/mtanda/prometheus-labels-db/internal/replication"
+	"github.com/mtanda/prometheus-labels-db/internal/systemd"
+	"github.com/mtanda/prometheus-labels-db/internal/tracing"
+	"github.com/mtanda/prometheus-labels-db/internal/web"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
 const (
 	unusedDBCheckInterval = 10 * time.Minute
+	// same as Prometheus
+	truncatedWarning = "results truncated due to limit"
+	// the unix timestamps from this are milliseconds, i.e. after 2001-09-09 in milliseconds, or after year 33658 in seconds
+	minUnixMilli = 1_000_000_000_000
+	tracerName   = "github.com/mtanda/prometheus-labels-db/cmd/query"
 )
 
-func seriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, fmc *fresh_metrics.FreshMetrics) {
+// parseTime parses RFC3339 with optional fractional seconds, or unix timestamps, same as Prometheus.
+// The unix timestamps can be fractional, and the timestamps too large for seconds are parsed as milliseconds.
+func parseTime(param string) (time.Time, error) {
+	if unixTime, err := strconv.ParseInt(param, 10, 64); err == nil {
+		if unixTime >= minUnixMilli || unixTime <= -minUnixMilli {
+			return time.UnixMilli(unixTime).UTC(), nil
+		}
+		return time.Unix(unixTime, 0).UTC(), nil
+	}
+	if unixTime, err := strconv.ParseFloat(param, 64); err == nil {
+		if math.Abs(unixTime) >= minUnixMilli {
+			// same precision as Prometheus
+			return time.UnixMilli(int64(math.Round(unixTime))).UTC(), nil
+		}
+		s, ns := math.Modf(unixTime)
+		// same precision as Prometheus
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(s), int64(ns*float64(time.Second))).UTC(), nil
+	}
+	t, err := time.ParseInLocation(time.RFC3339Nano, param, time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+func seriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, opts *queryOptions, auditor *queryAuditor, router *clusterRouter) {
 	var matchParam []string
 	var start, end time.Time
 	var limit int
+	var seriesCount int
+	// continue the trace of the client
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "seriesHandler", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
 	// log request
 	now := time.Now().UTC()
 	isSuccess := false
@@ -36,41 +100,83 @@ func seriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB,
 		slog.Info("request log",
 			"match", matchParam, "start", start, "end", end, "limit", limit,
 			"durationMs", time.Since(now).Seconds()*1000, "status", isSuccess)
+		span.SetAttributes(
+			attribute.StringSlice("match", matchParam),
+			attribute.Int64("start", start.Unix()),
+			attribute.Int64("end", end.Unix()),
+			attribute.Int("limit", limit),
+			attribute.Int("series", seriesCount),
+		)
+		if !isSuccess {
+			span.SetStatus(codes.Error, "query failed")
+		}
+		if err := opts.accessLog.Log(accesslog.Entry{
+			Timestamp:   now,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Matchers:    matchParam,
+			Start:       start,
+			End:         end,
+			SeriesCount: seriesCount,
+			DurationMs:  time.Since(now).Seconds() * 1000,
+			Success:     isSuccess,
+		}); err != nil {
+			// ignore error
+			slog.Error("failed to write access log", "error", err)
+		}
+		auditor.log(r, audit.Entry{
+			Timestamp:   now,
+			Matchers:    matchParam,
+			Start:       start,
+			End:         end,
+			SeriesCount: seriesCount,
+			Success:     isSuccess,
+		})
 	}()
 
-	// parse query
-	query := r.URL.Query()
+	// parse query, the parameters can be form-encoded in POST body for long selectors
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "failed to parse parameters: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.Form
 	matchParam = query["match[]"]
 	matchers, err := parser.ParseMetricSelectors(matchParam)
 	if err != nil {
 		http.Error(w, "invalid match[] parameter: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	// after the returned series are observed
+	var outcome queryOutcome
+	defer func(matchers [][]*labels.Matcher) {
+		outcome.duration = time.Since(now)
+		opts.usage.observeQuery(matchers, outcome)
+	}(matchers)
 
 	startParam := query.Get("start")
 	endParam := query.Get("end")
-	parseTime := func(param string) (time.Time, error) {
-		t, err := time.ParseInLocation(time.RFC3339, param, time.UTC)
-		if err == nil {
-			return t, nil
-		}
-		unixTime, err := strconv.ParseInt(param, 10, 64)
+	// same as Prometheus, start and end can be omitted
+	end = now
+	if endParam != "" {
+		end, err = parseTime(endParam)
 		if err != nil {
-			return time.Time{}, err
+			http.Error(w, "failed to parse end timestamp: "+err.Error(), http.StatusBadRequest)
+			return
 		}
-		return time.Unix(unixTime, 0).UTC(), nil
 	}
-
-	start, err = parseTime(startParam)
-	if err != nil {
-		http.Error(w, "failed to parse start timestamp: "+err.Error(), http.StatusBadRequest)
-		return
+	start = end.Add(-opts.lookback.defaultLookback)
+	if startParam != "" {
+		start, err = parseTime(startParam)
+		if err != nil {
+			http.Error(w, "failed to parse start timestamp: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
-	end, err = parseTime(endParam)
-	if err != nil {
-		http.Error(w, "failed to parse end timestamp: "+err.Error(), http.StatusBadRequest)
+	if end.Before(start) {
+		http.Error(w, "end timestamp must not be before start timestamp", http.StatusBadRequest)
 		return
 	}
+	start, rangeWarnings := opts.lookback.clampStart(start, end, now)
 	limit = 0
 	limitParam := query.Get("limit")
 	if limitParam != "" {
@@ -79,6 +185,38 @@ func seriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB,
 			http.Error(w, "failed to parse limit: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		if limit < 0 {
+			http.Error(w, "limit must be non-negative", http.StatusBadRequest)
+			return
+		}
+	}
+	limits := opts.limits(limit)
+	limit = limits.limit
+	partial := opts.partial
+	if partialParam := query.Get("partial_response"); partialParam != "" {
+		partial, err = strconv.ParseBool(partialParam)
+		if err != nil {
+			http.Error(w, "failed to parse partial_response: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if caseParam := query.Get("case_insensitive"); caseParam != "" {
+		caseInsensitive, err := strconv.ParseBool(caseParam)
+		if err != nil {
+			http.Error(w, "failed to parse case_insensitive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if caseInsensitive {
+			matchers = foldCase(matchers)
+		}
+	}
+	perSelector := false
+	if perSelectorParam := query.Get("limit_per_selector"); perSelectorParam != "" {
+		perSelector, err = strconv.ParseBool(perSelectorParam)
+		if err != nil {
+			http.Error(w, "failed to parse limit_per_selector: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 	debugMode := false
 	debugParam := query.Get("debug")
@@ -90,82 +228,498 @@ func seriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB,
 		}
 	}
 
-	// get fresh metrics
-	ctx := r.Context()
-	result := make(map[string]*model.Metric)
-	// if the end time is within 3 hours and 50 minutes from now, query fresh metrics
-	if end.After(now.Add(-(60*3 + 50) * time.Minute)) {
-		for _, matcher := range matchers {
-			result, err = fmc.QueryMetrics(ctx, matcher, result)
-			if err != nil {
-				http.Error(w, "failed to query fresh metrics: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// query the other nodes in cluster mode, and the federated instances
+	matchers, remote := router.split(r, matchParam, matchers)
+	type peerResult struct {
+		data     []map[string]string
+		warnings []string
+		err      error
+	}
+	peerCh := make(chan peerResult, 1)
+	go func() {
+		var federated peerResult
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			federated.data, federated.warnings = opts.federation.query(ctx, r, matchParam, start, end, limits.fetch)
+		}()
+		var peer peerResult
+		if len(remote) > 0 {
+			peer.data, peer.warnings, peer.err = router.query(ctx, r, remote, start, end, limits.fetch)
+		}
+		<-done
+		peer.data = mergeSeries(peer.data, federated.data)
+		peer.warnings = append(peer.warnings, federated.warnings...)
+		peerCh <- peer
+	}()
+	q := seriesQuery{
+		matchers: matchers,
+		start:    start,
+		end:      end,
+		now:      now,
+		limits:   limits,
+		partial:  partial,
+		warnings: rangeWarnings,
+	}
+
+	// stream the series without holding the whole result in memory
+	if query.Get("format") == "ndjson" || encoding.Negotiate(r.Header.Get("Accept")) == encoding.ContentTypeNDJSON {
+		if perSelector {
+			http.Error(w, "limit_per_selector is not supported by the stream", http.StatusBadRequest)
+			return
+		}
+		waitPeer := func() ([]map[string]string, []string, error) {
+			peer := <-peerCh
+			return peer.data, peer.warnings, peer.err
+		}
+		seriesCount, err = streamSeries(ctx, w, db, opts, q, waitPeer)
+		if err != nil {
+			slog.Error("failed to stream series", "error", err)
+			return
+		}
+		isSuccess = true
+		return
+	}
+
+	var stats *queryStats
+	if query.Get("stats") != "" {
+		stats = &queryStats{}
+	}
+	data := []map[string]string{}
+	var warnings []string
+	selectorsTruncated := false
+	if perSelector {
+		data, warnings, selectorsTruncated, err = querySelectors(ctx, db, opts, q, stats)
+		if err != nil {
+			http.Error(w, err.Error(), queryErrorStatus(err))
+			return
+		}
+	} else {
+		var fresh, result map[string]*model.Metric
+		fresh, result, warnings, err = queryLocalMetrics(ctx, db, opts, q, stats)
+		if err != nil {
+			http.Error(w, err.Error(), queryErrorStatus(err))
+			return
 		}
 		if debugMode {
 			data := []map[string]string{}
-			for _, metric := range result {
+			for _, metric := range fresh {
 				data = append(data, metric.Labels())
 			}
 			slog.Info("[debug] fresh metrics result", "result", data, "count", len(data))
 		}
+		for _, metric := range result {
+			data = append(data, metric.Labels())
+		}
+		// the results of the cluster nodes are already relabeled
+		data = relabel.Apply(data, opts.relabelConfigs)
 	}
+	peer := <-peerCh
+	if peer.err != nil && partial {
+		warnings = append(warnings, "failed to query cluster nodes: "+peer.err.Error())
+	} else if peer.err != nil {
+		http.Error(w, "failed to query cluster nodes: "+peer.err.Error(), http.StatusBadGateway)
+		return
+	}
+	data = mergeSeries(data, peer.data)
+	warnings = append(warnings, peer.warnings...)
 
-	// get metrics from database, and merge with fresh metrics
+	if debugMode {
+		slog.Info("[debug] query result", "result", data, "count", len(data))
+	}
+
+	// apply limit after merging the results, the series of each selector are already truncated with limit_per_selector
+	fetched := len(data)
+	if perSelector {
+		data, warnings, err = seriesLimits{abort: limits.abort}.apply(data, warnings)
+	} else {
+		data, warnings, err = limits.apply(data, warnings)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+	var truncation *encoding.Truncation
+	if len(data) < fetched || selectorsTruncated {
+		truncation = &encoding.Truncation{
+			TotalEstimate: estimateSeries(ctx, db, matchers, start, end, fetched),
+		}
+	}
+
+	seriesCount = len(data)
+	opts.usage.observeSeries(data)
+	outcome.data = data
+	outcome.truncated = truncation != nil
+	isSuccess = true
+	var response any
+	if stats != nil {
+		stats.Series.Returned = len(data)
+		stats.Timings.ExecTotalTime = time.Since(now).Seconds()
+		stats.finish()
+		response = stats
+	}
+	if err := encoding.WriteSeries(w, r, data, warnings, truncation, response); err != nil {
+		// ignore error
+		slog.Error("failed to write response", "error", err)
+	}
+}
+
+// estimateSeries returns the number of the series matching the local matchers in the database,
+// or fetched if larger, since the fetched series include the fresh metrics and the series of the cluster nodes.
+func estimateSeries(ctx context.Context, db *database.LabelDB, matchers [][]*labels.Matcher, start, end time.Time, fetched int) int {
+	count := 0
 	for _, matcher := range matchers {
-		result, err = db.QueryMetrics(ctx, start, end, matcher, limit, result)
+		n, err := db.CountMetrics(ctx, start, end, matcher)
 		if err != nil {
-			http.Error(w, "failed to query metrics: "+err.Error(), http.StatusInternalServerError)
+			// ignore error
+			slog.Error("failed to count series", "error", err)
+			return fetched
+		}
+		count += n
+	}
+	return max(count, fetched)
+}
+
+// queryErrorStatus returns 503 for the queries timed out, same as Prometheus, 422 for the queries matching too many series, otherwise 500.
+func queryErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, errTooManySeries) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// withTimeout sets the deadline of the query to the request context, the timeout is got per request for the reload.
+func withTimeout(timeout func() time.Duration, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := timeout()
+		if timeout <= 0 {
+			handler(w, r)
 			return
 		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
 	}
+}
 
-	data := []map[string]string{}
-	for _, metric := range result {
-		data = append(data, metric.Labels())
+// queryFreshMetrics queries the fresh metrics if the end time is recent, and fmc is not nil.
+// The fetch limit is pushed down same as the database.
+// With partial, the errors are returned as the warnings.
+func queryFreshMetrics(ctx context.Context, fmc *fresh_metrics.FreshMetrics, q seriesQuery) (map[string]*model.Metric, []string, error) {
+	var err error
+	var warnings []string
+	fresh := make(map[string]*model.Metric)
+	// if the end time is within the cutoff from now, query fresh metrics
+	if fmc != nil && q.end.After(q.now.Add(-fmc.Cutoff())) {
+		for _, matcher := range q.matchers {
+			fresh, err = fmc.QueryMetrics(ctx, matcher, q.limits.fetch, fresh)
+			if errors.Is(err, fresh_metrics.ErrNamespaceNotAllowed) {
+				// fall back to the database
+				warnings = append(warnings, err.Error())
+				continue
+			} else if err != nil && q.partial && ctx.Err() == nil {
+				// e.g. CloudWatch throttling
+				warnings = append(warnings, "failed to query fresh metrics: "+err.Error())
+				continue
+			} else if err != nil {
+				return nil, nil, fmt.Errorf("failed to query fresh metrics: %w", err)
+			}
+		}
 	}
+	return fresh, warnings, nil
+}
 
-	if debugMode {
-		slog.Info("[debug] query result", "result", data, "count", len(data))
+// querySelectors queries the selectors one by one, and truncates the series of each selector by the limit,
+// so that a broad selector does not starve the others. The returned series are relabeled, and whether any selector is truncated is returned.
+func querySelectors(ctx context.Context, db *database.LabelDB, opts *queryOptions, q seriesQuery, stats *queryStats) ([]map[string]string, []string, bool, error) {
+	var data []map[string]string
+	warnings := slices.Clone(q.warnings)
+	truncated := false
+	for _, matcher := range q.matchers {
+		sq := q
+		sq.matchers = [][]*labels.Matcher{matcher}
+		sq.warnings = nil
+		_, result, selectorWarnings, err := queryLocalMetrics(ctx, db, opts, sq, stats)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		selectorData := make([]map[string]string, 0, len(result))
+		for _, metric := range result {
+			selectorData = append(selectorData, metric.Labels())
+		}
+		selectorData = relabel.Apply(selectorData, opts.relabelConfigs)
+		fetched := len(selectorData)
+		selectorData, selectorWarnings, err = q.limits.apply(selectorData, selectorWarnings)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		truncated = truncated || len(selectorData) < fetched
+		if stats != nil {
+			stats.Selectors = append(stats.Selectors, selectorStats{
+				Selector:  selectorString(matcher),
+				Series:    len(selectorData),
+				Truncated: len(selectorData) < fetched,
+			})
+		}
+		data = mergeSeries(data, selectorData)
+		for _, w := range selectorWarnings {
+			if !slices.Contains(warnings, w) {
+				warnings = append(warnings, w)
+			}
+		}
 	}
+	return data, warnings, truncated, nil
+}
 
-	if limit > 0 && len(data) > limit {
-		data = data[:limit]
+// queryLocalMetrics queries the fresh metrics and the database of this node, and merges them.
+// The statistics are recorded in stats if it is not nil.
+// With partial, the failed fresh metrics and partitions are skipped, and the errors are returned as the warnings.
+// The identical queries running at once share the results, except the queries with the statistics.
+func queryLocalMetrics(ctx context.Context, db *database.LabelDB, opts *queryOptions, q seriesQuery, stats *queryStats) (map[string]*model.Metric, map[string]*model.Metric, []string, error) {
+	if stats != nil {
+		return executeLocalMetrics(ctx, db, opts, q, stats)
+	}
+	r, err := opts.queries.do(ctx, queryKey(db, q), func(ctx context.Context) (localResult, error) {
+		fresh, result, warnings, err := executeLocalMetrics(ctx, db, opts, q, nil)
+		return localResult{fresh: fresh, result: result, warnings: warnings}, err
+	})
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	return r.fresh, r.result, r.warnings, nil
+}
 
-	response := map[string]interface{}{
-		"status": "success",
-		"data":   data,
+func executeLocalMetrics(ctx context.Context, db *database.LabelDB, opts *queryOptions, q seriesQuery, stats *queryStats) (map[string]*model.Metric, map[string]*model.Metric, []string, error) {
+	freshStart := time.Now()
+	fresh, freshWarnings, err := queryFreshMetrics(ctx, opts.fmc, q)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	warnings := append(slices.Clone(q.warnings), freshWarnings...)
+	dbOpts := database.QueryOptions{
+		Stats:       stats.dbStats(),
+		Concurrency: opts.partitionConcurrency,
+	}
+	if q.partial {
+		dbOpts.OnPartitionError = func(dbPath string, err error) {
+			slog.Warn("skipped the failed partition", "path", dbPath, "error", err)
+			warnings = append(warnings, fmt.Sprintf("failed to query partition %s: %s", filepath.Base(dbPath), err))
+		}
 	}
 
-	isSuccess = true
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	// get metrics from database, and merge with fresh metrics
+	dbStart := time.Now()
+	result := make(map[string]*model.Metric)
+	for _, matcher := range q.matchers {
+		var indexed bool
+		if result, indexed = opts.labelIndex.Query(db, q.start, q.end, matcher, q.limits.fetch, result); indexed {
+			continue
+		}
+		result, err = db.QueryMetricsWithOptions(ctx, q.start, q.end, matcher, q.limits.fetch, result, dbOpts)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to query metrics: %w", err)
+		}
+	}
+	if stats != nil {
+		// accumulated over the selectors queried one by one
+		stats.Timings.FreshQueryTime += dbStart.Sub(freshStart).Seconds()
+		stats.Timings.DBQueryTime += time.Since(dbStart).Seconds()
+		stats.Series.Fresh += len(fresh)
+		stats.Series.DB += len(result)
+	}
+	opts.usage.observeSources(fresh, result)
+	return fresh, model.MergeMetrics(result, fresh, opts.mergeStrategy), warnings, nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+		if err := runBench(os.Args[2:]); err != nil {
+			slog.Error("failed to run benchmark", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var dbDir string
 	flag.StringVar(&dbDir, "db.dir", "./data/", "Path to the database directory")
+	var maxOpenPartitions int
+	flag.IntVar(&maxOpenPartitions, "db.max-open-partitions", 0, "Maximum number of the open partitions of each tenant, the least recently used ones are closed (unlimited if 0)")
 	var listenAddress string
-	flag.StringVar(&listenAddress, "web.listen-address", "0.0.0.0:8080", "Address to listen")
+	flag.StringVar(&listenAddress, "web.listen-address", "0.0.0.0:8080", "Address to listen, or unix:///path/to/socket to listen on the unix domain socket")
+	webConfig := web.DefaultConfig()
+	// the series responses are highly compressible JSON
+	webConfig.Compression = true
+	webConfig.RegisterFlags(flag.CommandLine)
+	webConfig.CORS = web.DefaultCORSConfig()
+	webConfig.CORS.RegisterFlags(flag.CommandLine)
+	var grpcListenAddress string
+	flag.StringVar(&grpcListenAddress, "grpc.listen-address", "", "Address to listen for the gRPC API (disabled if empty)")
+	var tenantHeader string
+	flag.StringVar(&tenantHeader, "tenant.header", "X-Scope-OrgID", "HTTP header to specify the tenant, which must be set only by a trusted proxy when the tenants are isolated")
+	var defaultTenant string
+	flag.StringVar(&defaultTenant, "tenant.default", "", "Tenant used when the tenant header is not specified")
+	var hydrationURL string
+	flag.StringVar(&hydrationURL, "hydration.url", "", "Object storage URL to download missing partitions from, e.g. s3://bucket/prefix (disabled if empty)")
+	var hydrationMaxBytes int64
+	flag.Int64Var(&hydrationMaxBytes, "hydration.max-bytes", 10*1024*1024*1024, "Maximum total size of the downloaded partitions")
+	var leaderURL string
+	flag.StringVar(&leaderURL, "replica.leader-url", "", "URL of the recorder to sync the partitions from, e.g. http://recorder:8081 (disabled if empty)")
+	var replicaClientConfig string
+	flag.StringVar(&replicaClientConfig, "replica.client-config.file", "", "Path to the file of the credentials and the TLS settings to the recorder, e.g. when it requires the authentication or the client certificates")
+	var replicaSyncInterval time.Duration
+	flag.DurationVar(&replicaSyncInterval, "replica.sync-interval", 1*time.Minute, "Interval of syncing the partitions from the recorder")
+	opts := &queryOptions{}
+	var maxConcurrency int
+	flag.IntVar(&maxConcurrency, "query.max-concurrency", 0, "Maximum number of series queries running concurrently, the other queries wait in the queue until the query timeout (unlimited if 0)")
+	flag.IntVar(&opts.partitionConcurrency, "query.partition-concurrency", database.DefaultQueryConcurrency, "Number of the partitions queried at once by each series query")
+	flag.IntVar(&opts.maxLimit, "query.max-limit", 0, "Maximum number of series returned by a query, applied when the limit parameter is larger or unspecified (unlimited if 0)")
+	var clusterPeers string
+	flag.StringVar(&clusterPeers, "cluster.peers", "", "Comma separated URLs of the query nodes in the cluster (cluster mode is disabled if empty)")
+	var clusterSelf string
+	flag.StringVar(&clusterSelf, "cluster.self", "", "URL of this node in the cluster")
+	var federateEndpoints string
+	flag.StringVar(&federateEndpoints, "federate.endpoints", "", "Comma separated URLs of the other labels-db query services, e.g. of the other accounts, whose series are merged into the series API, without credentials")
+	var federateConfigFile string
+	flag.StringVar(&federateConfigFile, "federate.config.file", "", "Path to the file of the federated endpoints with the credentials to them, in addition to --federate.endpoints")
+	var labelIndexNamespaces int
+	flag.IntVar(&labelIndexNamespaces, "label-index.namespaces", 0, "Number of the most queried namespaces whose series are kept in memory to serve the queries without the database (disabled if 0)")
+	var labelIndexWindow time.Duration
+	flag.DurationVar(&labelIndexWindow, "label-index.window", 24*time.Hour, "Time range of the series kept in the label index")
+	var labelIndexRefreshInterval time.Duration
+	flag.DurationVar(&labelIndexRefreshInterval, "label-index.refresh-interval", 1*time.Minute, "Interval of adding the updated series to the label index")
+	var memoryLimit int64
+	flag.Int64Var(&memoryLimit, "memory.limit", 0, "Soft limit of the Go runtime memory in bytes, same as GOMEMLIMIT (unchanged if 0)")
+	var memoryBudget uint64
+	flag.Uint64Var(&memoryBudget, "memory.budget", 0, "Heap size in bytes above which series queries are rejected and caches are shrunk (disabled if 0)")
+	var freshAllowedNamespaces string
+	flag.StringVar(&freshAllowedNamespaces, "fresh.allowed-namespaces", "", "Comma separated namespaces which can query CloudWatch for the fresh metrics, the other namespaces are queried only from the database (all namespaces if empty)")
+	var queryConfigFile string
+	flag.StringVar(&queryConfigFile, "query.config-file", "", "Path to the file of the query limits overriding the flags, reloaded on SIGHUP or POST /-/reload")
+	var enableLifecycle bool
+	flag.BoolVar(&enableLifecycle, "web.enable-lifecycle", false, "Enable POST /-/reload to reload the query config file and the web config file")
+	var freshEnabled bool
+	flag.BoolVar(&freshEnabled, "fresh-metrics.enabled", true, "Query CloudWatch for the fresh metrics, disable to serve only the database, e.g. without AWS credentials")
+	var freshCutoff time.Duration
+	flag.DurationVar(&freshCutoff, "fresh.cutoff", model.RecentlyActiveWindow, "CloudWatch is queried for the fresh metrics when the end of the query is within this duration from now, and the fresh metrics are assumed to be active since then")
+	var cloudwatchFixture string
+	flag.StringVar(&cloudwatchFixture, "dev.cloudwatch-fixture", "", "Path to the fixture of the mock CloudWatch used instead of AWS for local development (disabled if empty)")
+	var mergeStrategyName string
+	flag.StringVar(&mergeStrategyName, "query.merge-strategy", string(model.MergeUnion), "Lifetime of the series found in both the fresh metrics and the database (union, prefer-db or prefer-fresh)")
+	flag.DurationVar(&opts.timeout, "query.timeout", 2*time.Minute, "Maximum duration of a query before it is canceled (unlimited if 0)")
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "web.shutdown-timeout", 2*time.Minute, "Maximum duration to wait for the in-flight queries on SIGTERM before they are canceled")
+	flag.DurationVar(&opts.lookback.defaultLookback, "query.default-lookback", 1*time.Hour, "Time range of the series queries before end when start is omitted")
+	flag.DurationVar(&opts.lookback.maxLookback, "query.max-lookback", 0, "Maximum time range of the series queries, start is clamped to end minus this duration (unlimited if 0)")
+	flag.DurationVar(&opts.lookback.retention, "query.retention", 0, "Retention of the recorded series, start of the queries is clamped to now minus this duration, e.g. 10920h (455 days) same as CloudWatch (unlimited if 0)")
+	flag.IntVar(&opts.maxSeries, "query.max-series", 0, "Maximum number of series matched by a query, the queries matching more series without a smaller limit parameter fail (unlimited if 0)")
+	flag.BoolVar(&opts.partial, "query.partial-response", false, "Return the series found so far with warnings when the fresh metrics, partitions or cluster nodes fail, unless the partial_response parameter is specified")
+	var relabelConfigFile string
+	flag.StringVar(&relabelConfigFile, "query.relabel-config-file", "", "Path to the file of relabel_configs applied to the returned series (disabled if empty)")
+	var auditLogPath string
+	flag.StringVar(&auditLogPath, "audit.log-path", "", "Path to the audit log (disabled if empty)")
+	var auditLogType string
+	flag.StringVar(&auditLogType, "audit.log-type", "file", "Type of the audit log (file or sqlite)")
+	var auditUserHeader string
+	flag.StringVar(&auditUserHeader, "audit.user-header", "X-WEBAUTH-USER", "HTTP header to identify the user in the audit log")
+	var accessLogConfig accesslog.Config
+	accessLogConfig.RegisterFlags(flag.CommandLine)
+	var tracingConfig tracing.Config
+	tracingConfig.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
 	slog.SetDefault(logger)
 
-	db, err := database.Open(dbDir)
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingConfig, "labels-db-query")
 	if err != nil {
+		slog.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			// ignore error
+			slog.Error("failed to flush spans", "error", err)
+		}
+	}()
+
+	if memoryLimit > 0 {
+		debug.SetMemoryLimit(memoryLimit)
+	}
+
+	if err := database.ValidateTenant(defaultTenant); err != nil {
+		slog.Error("invalid default tenant", "error", err)
+		os.Exit(1)
+	}
+	tenants := database.OpenTenants(dbDir)
+	defer tenants.Close()
+	tenants.SetMaxOpenPartitions(maxOpenPartitions)
+	if hydrationURL != "" {
+		bucket, err := objstore.New(context.Background(), hydrationURL)
+		if err != nil {
+			slog.Error("failed to open object storage", "error", err, "url", hydrationURL)
+			os.Exit(1)
+		}
+		hydrator, err := database.NewHydrator(bucket, hydrationMaxBytes)
+		if err != nil {
+			slog.Error("failed to setup hydration", "error", err)
+			os.Exit(1)
+		}
+		tenants.SetHydrator(hydrator)
+	}
+	resolver := &tenantResolver{
+		tenants:       tenants,
+		header:        tenantHeader,
+		defaultTenant: defaultTenant,
+	}
+	// open the default tenant database on startup to detect errors early
+	if _, err := tenants.Get(defaultTenant); err != nil {
 		slog.Error("failed to open database", "error", err, "dbDir", dbDir)
 		os.Exit(1)
 	}
-	defer db.Close()
+
+	opts.mergeStrategy, err = model.ParseMergeStrategy(mergeStrategyName)
+	if err != nil {
+		slog.Error("invalid merge strategy", "error", err)
+		os.Exit(1)
+	}
+	if relabelConfigFile != "" {
+		opts.relabelConfigs, err = relabel.LoadConfig(relabelConfigFile)
+		if err != nil {
+			slog.Error("failed to load relabel config", "error", err, "path", relabelConfigFile)
+			os.Exit(1)
+		}
+	}
+
+	auditor := &queryAuditor{
+		userHeader: auditUserHeader,
+	}
+	if auditLogPath != "" {
+		var err error
+		auditor.logger, err = audit.New(auditLogType, auditLogPath)
+		if err != nil {
+			slog.Error("failed to open audit log", "error", err, "path", auditLogPath)
+			os.Exit(1)
+		}
+		defer auditor.logger.Close()
+	}
+
+	opts.accessLog, err = accesslog.New(accessLogConfig)
+	if err != nil {
+		slog.Error("failed to open access log", "error", err, "path", accessLogConfig.Path)
+		os.Exit(1)
+	}
+	defer opts.accessLog.Close()
 
 	// check unused db periodically
 	ticker := time.NewTicker(unusedDBCheckInterval)
 	defer ticker.Stop()
 	go func() {
 		for range ticker.C {
-			err := db.CleanupUnusedDB(context.Background())
+			err := tenants.CleanupUnusedDB(context.Background())
 			if err != nil {
 				// ignore error
 				slog.Error("failed to cleanup unused DB", "error", err)
@@ -176,14 +730,119 @@ func main() {
 	}()
 
 	reg := prometheus.NewRegistry()
+	if leaderURL != "" {
+		var clientConfig *web.ClientConfig
+		if replicaClientConfig != "" {
+			var err error
+			clientConfig, err = web.LoadClientConfig(replicaClientConfig)
+			if err != nil {
+				slog.Error("failed to load client config", "error", err, "path", replicaClientConfig)
+				os.Exit(1)
+			}
+		}
+		// the snapshots of the partitions can take long to download
+		client, err := clientConfig.NewClient(0)
+		if err != nil {
+			slog.Error("failed to setup replica client", "error", err)
+			os.Exit(1)
+		}
+		follower := replication.NewFollower(leaderURL, dbDir, tenants, client, reg)
+		go follower.Run(context.Background(), replicaSyncInterval)
+	}
+
+	var router *clusterRouter
+	if clusterPeers != "" {
+		if clusterSelf == "" {
+			slog.Error("--cluster.self is required in cluster mode")
+			os.Exit(1)
+		}
+		var err error
+		router, err = newClusterRouter(strings.Split(clusterPeers, ","), clusterSelf, tenantHeader, reg)
+		if err != nil {
+			slog.Error("failed to setup cluster", "error", err)
+			os.Exit(1)
+		}
+	}
+	var endpoints []federateEndpoint
+	for _, endpoint := range strings.Split(federateEndpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, federateEndpoint{URL: endpoint})
+		}
+	}
+	if federateConfigFile != "" {
+		cfg, err := loadFederateConfig(federateConfigFile)
+		if err != nil {
+			slog.Error("failed to load federate config", "error", err, "path", federateConfigFile)
+			os.Exit(1)
+		}
+		endpoints = append(endpoints, cfg.Endpoints...)
+	}
+	if len(endpoints) > 0 {
+		var err error
+		opts.federation, err = newFederation(endpoints, tenantHeader, reg)
+		if err != nil {
+			slog.Error("failed to setup federation", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	ListMetricsDefaultMaxTPS := 25
 	limiter := rate.NewLimiter(rate.Limit(ListMetricsDefaultMaxTPS/5), 1)
 	fmc := fresh_metrics.New(limiter, reg)
+	if freshEnabled {
+		opts.fmc = fmc
+	} else {
+		slog.Info("querying the database only, CloudWatch is not called for the fresh metrics")
+	}
+	if cloudwatchFixture != "" {
+		fixture, err := cloudwatchmock.LoadFixture(cloudwatchFixture)
+		if err != nil {
+			slog.Error("failed to load CloudWatch fixture", "error", err, "path", cloudwatchFixture)
+			os.Exit(1)
+		}
+		slog.Warn("using the mock CloudWatch", "fixture", cloudwatchFixture)
+		fmc.SetClientFactory(func(ctx context.Context, region string) (fresh_metrics.CloudWatchAPI, error) {
+			return cloudwatchmock.NewClient(fixture, region), nil
+		})
+	}
+	if freshAllowedNamespaces != "" {
+		fmc.SetAllowedNamespaces(strings.Split(freshAllowedNamespaces, ","))
+	}
+	var guard *memoryGuard
+	if memoryBudget > 0 {
+		guard = newMemoryGuard(memoryBudget, reg, fmc.PurgeCache, tenants.ShrinkMemory)
+		go guard.run(context.Background())
+	}
 	reg.MustRegister(
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
+	if err := regexp.RegisterMetrics(reg); err != nil {
+		slog.Error("failed to register regexp cache metrics", "error", err)
+		os.Exit(1)
+	}
 	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	web.HandleHealth(http.DefaultServeMux, func() error {
+		return web.CheckDir(dbDir)
+	})
+
+	if labelIndexNamespaces > 0 {
+		opts.labelIndex = labelindex.New(labelIndexNamespaces, labelIndexWindow, reg)
+		go opts.labelIndex.Run(context.Background(), labelIndexRefreshInterval)
+	}
+
+	// the options of the flags are overridden by the config file
+	opts.usage = newNamespaceUsage(reg)
+	opts.queries = newQueryGroup(reg)
+	reloader := newReloader(queryConfigFile, opts, freshCutoff, fmc, reg)
+	if err := reloader.reload(); err != nil {
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+	options := reloader.options
+	if enableLifecycle {
+		http.HandleFunc("/-/reload", reloader.handler)
+	}
 
 	counter := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 		Name: "http_requests_total",
@@ -201,22 +860,106 @@ func main() {
 			Help:    "A histogram of response sizes for requests.",
 			Buckets: prometheus.ExponentialBuckets(100, 2, 10),
 		}, []string{"handler"})
-	http.HandleFunc("/api/v1/series", promhttp.InstrumentHandlerDuration(
-		duration.MustCurryWith(prometheus.Labels{"handler": "/api/v1/series"}),
-		promhttp.InstrumentHandlerCounter(
-			counter,
-			promhttp.InstrumentHandlerResponseSize(
-				responseSize.MustCurryWith(prometheus.Labels{"handler": "/api/v1/series"}),
-				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					seriesHandler(w, r, db, fmc)
-				}),
+	instrumentHandler := func(handlerName string, handler http.HandlerFunc) http.Handler {
+		return promhttp.InstrumentHandlerDuration(
+			duration.MustCurryWith(prometheus.Labels{"handler": handlerName}),
+			promhttp.InstrumentHandlerCounter(
+				counter,
+				promhttp.InstrumentHandlerResponseSize(
+					responseSize.MustCurryWith(prometheus.Labels{"handler": handlerName}),
+					withTimeout(func() time.Duration { return options.load().timeout }, handler),
+				),
 			),
-		),
-	))
+		)
+	}
+	inflight := newInflightQueries(resolver)
+	var concurrency *concurrencyLimiter
+	if maxConcurrency > 0 {
+		concurrency = newConcurrencyLimiter(maxConcurrency, reg)
+	}
+	http.Handle("/api/v1/series", instrumentHandler("/api/v1/series", inflight.handler(guard.handler(concurrency.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		seriesHandler(w, r, db, options.load(), auditor, router)
+	}))))))
+	http.Handle("/api/v1/status/active_series", instrumentHandler("/api/v1/status/active_series", resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		activeSeriesHandler(w, r, db)
+	})))
+	http.Handle("/api/v1/series/count", instrumentHandler("/api/v1/series/count", resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		seriesCountHandler(w, r, db)
+	})))
+	http.Handle("/api/v1/series/disappeared", instrumentHandler("/api/v1/series/disappeared", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		disappearedSeriesHandler(w, r, db, options.load().maxSeries)
+	}))))
+	http.Handle("/api/v1/series/new", instrumentHandler("/api/v1/series/new", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		newSeriesHandler(w, r, db, options.load().maxSeries)
+	}))))
+	http.Handle("/api/v1/read", instrumentHandler("/api/v1/read", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		remoteReadHandler(w, r, db, options.load())
+	}))))
+	http.Handle("/api/v1/query", instrumentHandler("/api/v1/query", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		instantQueryHandler(w, r, db, options.load())
+	}))))
+	http.Handle("/api/v1/grafana/dimension-values", instrumentHandler("/api/v1/grafana/dimension-values", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		dimensionValuesHandler(w, r, db, options.load())
+	}))))
+	http.Handle("/api/v1/series/last_seen", instrumentHandler("/api/v1/series/last_seen", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		opts := options.load()
+		lastSeenHandler(w, r, db, opts.maxSeries, opts.lookback.retention)
+	}))))
+	http.Handle("/api/v1/series/search", instrumentHandler("/api/v1/series/search", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		searchSeriesHandler(w, r, db, options.load())
+	}))))
+	http.Handle("/api/v1/series/diff", instrumentHandler("/api/v1/series/diff", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		seriesDiffHandler(w, r, db, options.load().maxSeries)
+	}))))
+	http.Handle("/api/v1/status/top_values", instrumentHandler("/api/v1/status/top_values", guard.handler(resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		topValuesHandler(w, r, db)
+	}))))
+	http.Handle("/api/v1/status/labelsdb", instrumentHandler("/api/v1/status/labelsdb", resolver.handler(func(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+		labelsDBStatusHandler(w, r, db)
+	})))
+	http.Handle("/api/v1/status/runtime", instrumentHandler("/api/v1/status/runtime", func(w http.ResponseWriter, r *http.Request) {
+		runtimeHandler(w, r, fmc, tenants, inflight)
+	}))
 	slog.Info("Starting server", "address", listenAddress)
-	err = http.ListenAndServe(listenAddress, nil)
+	server, err := web.NewServer(listenAddress, nil, webConfig, reg)
+	if err != nil {
+		slog.Error("failed to setup server", "error", err)
+		os.Exit(1)
+	}
+	reloader.server = server
+	var gs *grpc.Server
+	if grpcListenAddress != "" {
+		gl, err := net.Listen("tcp", grpcListenAddress)
+		if err != nil {
+			slog.Error("failed to listen gRPC", "error", err)
+			os.Exit(1)
+		}
+		gs = newGRPCServer(&grpcServer{
+			resolver:  resolver,
+			options:   options,
+			authorize: server.Authorize,
+		}, guard)
+		slog.Info("Starting gRPC server", "address", grpcListenAddress)
+		go func() {
+			if err := gs.Serve(gl); err != nil {
+				slog.Error("failed to start gRPC server", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	l, err := server.Listen()
 	if err != nil {
-		slog.Error("failed to start server", "error", err)
+		slog.Error("failed to listen", "error", err)
+		os.Exit(1)
+	}
+	systemd.Ready()
+	go systemd.RunWatchdog(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go reloader.run(ctx)
+	if err := serve(ctx, server, l, gs, shutdownTimeout); err != nil {
+		slog.Error("failed to serve", "error", err)
 		os.Exit(1)
 	}
+	slog.Info("query server stopped successfully")
 }
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/accesslog"
+	"github.com/mtanda/prometheus-labels-db/internal/cloudwatchmock"
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/encoding"
+	"github.com/mtanda/prometheus-labels-db/internal/fresh_metrics"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/time/rate"
+)
+
+// testTime is old enough not to query the fresh metrics.
+var testTime = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestDB returns the database with n series recorded by recordTestSeries.
+func newTestDB(t *testing.T, n int) *database.LabelDB {
+	t.Helper()
+	db, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	recordTestSeries(t, db, n)
+	return db
+}
+
+// recordTestSeries records n series of AWS/EC2 CPUUtilization from testTime for an hour.
+func recordTestSeries(t *testing.T, db *database.LabelDB, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		err := db.RecordMetric(context.Background(), model.Metric{
+			Namespace:  "AWS/EC2",
+			MetricName: "CPUUtilization",
+			Region:     "us-east-1",
+			Dimensions: model.Dimensions{{Name: "InstanceId", Value: fmt.Sprintf("i-%03d", i)}},
+			FromTS:     testTime,
+			ToTS:       testTime.Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestOptions returns the options with the fresh metrics of the empty mock CloudWatch.
+func newTestOptions() *queryOptions {
+	reg := prometheus.NewRegistry()
+	fmc := fresh_metrics.New(rate.NewLimiter(rate.Inf, 1), reg)
+	fmc.SetClientFactory(func(ctx context.Context, region string) (fresh_metrics.CloudWatchAPI, error) {
+		return cloudwatchmock.NewClient(&cloudwatchmock.Fixture{}, region), nil
+	})
+	return &queryOptions{
+		fmc:           fmc,
+		usage:         newNamespaceUsage(reg),
+		mergeStrategy: model.MergeUnion,
+		lookback:      lookbackConfig{defaultLookback: time.Hour},
+	}
+}
+
+type seriesResponse struct {
+	Status        string              `json:"status"`
+	Data          []map[string]string `json:"data"`
+	Warnings      []string            `json:"warnings"`
+	Truncated     bool                `json:"truncated"`
+	TotalEstimate int                 `json:"totalEstimate"`
+}
+
+// getSeries requests the series API with the parameters.
+func getSeries(t *testing.T, db *database.LabelDB, opts *queryOptions, params url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/series?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	seriesHandler(w, r, db, opts, nil, nil)
+	return w
+}
+
+func decodeSeries(t *testing.T, w *httptest.ResponseRecorder) seriesResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", w.Code, w.Body.String())
+	}
+	var resp seriesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func rangeParams(match string) url.Values {
+	return url.Values{
+		"match[]": []string{match},
+		"start":   []string{testTime.Format(time.RFC3339)},
+		"end":     []string{testTime.Add(time.Hour).Format(time.RFC3339)},
+	}
+}
+
+func TestSeriesHandlerMaxSeries(t *testing.T) {
+	db := newTestDB(t, 3)
+	opts := newTestOptions()
+	opts.maxSeries = 2
+
+	params := rangeParams(`{Namespace="AWS/EC2"}`)
+	w := getSeries(t, db, opts, params)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "too many series") {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+
+	// the stream is aborted with the error in the trailer
+	params.Set("format", "ndjson")
+	w = getSeries(t, db, opts, params)
+	if got := w.Result().Trailer.Get(encoding.ErrorHeader); !strings.Contains(got, "too many series") {
+		t.Fatalf("unexpected error trailer: %q", got)
+	}
+	params.Del("format")
+
+	// the smaller limit truncates the result instead
+	params.Set("limit", "1")
+	resp := decodeSeries(t, getSeries(t, db, opts, params))
+	if len(resp.Data) != 1 || !slices.Contains(resp.Warnings, truncatedWarning) {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if !resp.Truncated || resp.TotalEstimate != 3 {
+		t.Fatalf("unexpected truncation: %+v", resp)
+	}
+
+	// the matched series within the limit
+	resp = decodeSeries(t, getSeries(t, db, opts, rangeParams(`{Namespace="AWS/EC2",InstanceId=~"i-00[01]"}`)))
+	if len(resp.Data) != 2 || len(resp.Warnings) != 0 || resp.Truncated {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+func TestSeriesHandlerCaseInsensitive(t *testing.T) {
+	db := newTestDB(t, 2)
+	opts := newTestOptions()
+
+	params := rangeParams(`{Namespace="AWS/EC2",InstanceId="I-000"}`)
+	resp := decodeSeries(t, getSeries(t, db, opts, params))
+	if len(resp.Data) != 0 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	params.Set("case_insensitive", "true")
+	resp = decodeSeries(t, getSeries(t, db, opts, params))
+	if len(resp.Data) != 1 || resp.Data[0]["InstanceId"] != "i-000" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	// the namespace is still matched exactly
+	params = rangeParams(`{Namespace="aws/ec2",InstanceId=~"I-00.|x"}`)
+	params.Set("case_insensitive", "true")
+	resp = decodeSeries(t, getSeries(t, db, opts, params))
+	if len(resp.Data) != 0 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	params = rangeParams(`{Namespace="AWS/EC2",InstanceId!="I-000"}`)
+	params.Set("case_insensitive", "true")
+	resp = decodeSeries(t, getSeries(t, db, opts, params))
+	if len(resp.Data) != 1 || resp.Data[0]["InstanceId"] != "i-001" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	params.Set("case_insensitive", "maybe")
+	if w := getSeries(t, db, opts, params); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+func TestSeriesHandlerTimeRange(t *testing.T) {
+	db := newTestDB(t, 1)
+	match := `{Namespace="AWS/EC2"}`
+	format := func(t time.Time) string { return t.Format(time.RFC3339) }
+	tests := []struct {
+		name        string
+		params      url.Values
+		maxLookback time.Duration
+		retention   time.Duration
+		series      int
+		warning     string
+	}{
+		{
+			name:   "default start before end",
+			params: url.Values{"match[]": {match}, "end": {format(testTime.Add(30 * time.Minute))}},
+			series: 1,
+		},
+		{
+			name:   "default start after the series",
+			params: url.Values{"match[]": {match}, "end": {format(testTime.Add(3 * time.Hour))}},
+			series: 0,
+		},
+		{
+			name:   "default end",
+			params: url.Values{"match[]": {match}},
+			series: 0,
+		},
+		{
+			name:        "clamped by max lookback",
+			params:      url.Values{"match[]": {match}, "start": {format(testTime.Add(-24 * time.Hour))}, "end": {format(testTime.Add(3 * time.Hour))}},
+			maxLookback: time.Hour,
+			series:      0,
+			warning:     "start is clamped to " + format(testTime.Add(2*time.Hour)),
+		},
+		{
+			name:        "clamped to the series",
+			params:      url.Values{"match[]": {match}, "start": {format(testTime.Add(-24 * time.Hour))}, "end": {format(testTime.Add(3 * time.Hour))}},
+			maxLookback: 4 * time.Hour,
+			series:      1,
+			warning:     "start is clamped to " + format(testTime.Add(-time.Hour)),
+		},
+		{
+			name:        "within max lookback",
+			params:      rangeParams(match),
+			maxLookback: time.Hour,
+			series:      1,
+		},
+		{
+			name:      "before the retention",
+			params:    rangeParams(match),
+			retention: time.Hour,
+			series:    0,
+			warning:   "start is clamped to ",
+		},
+		{
+			name:      "within the retention",
+			params:    rangeParams(match),
+			retention: time.Since(testTime) + time.Hour,
+			series:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOptions()
+			opts.lookback.maxLookback = tt.maxLookback
+			opts.lookback.retention = tt.retention
+			resp := decodeSeries(t, getSeries(t, db, opts, tt.params))
+			if len(resp.Data) != tt.series {
+				t.Fatalf("unexpected series: %v", resp.Data)
+			}
+			if tt.warning == "" && len(resp.Warnings) != 0 || tt.warning != "" && (len(resp.Warnings) != 1 || !strings.HasPrefix(resp.Warnings[0], tt.warning)) {
+				t.Fatalf("unexpected warnings: %v", resp.Warnings)
+			}
+		})
+	}
+
+	// end before start
+	params := url.Values{"match[]": {match}, "start": {format(testTime.Add(time.Hour))}, "end": {format(testTime)}}
+	if w := getSeries(t, db, newTestOptions(), params); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		param   string
+		want    time.Time
+		wantErr bool
+	}{
+		{param: "1738368000", want: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{param: "1738368000.5", want: time.Date(2025, 2, 1, 0, 0, 0, 500*int(time.Millisecond), time.UTC)},
+		// rounded to milliseconds
+		{param: "1738368000.1234", want: time.Date(2025, 2, 1, 0, 0, 0, 123*int(time.Millisecond), time.UTC)},
+		{param: "1738368000000", want: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{param: "1738368000123", want: time.Date(2025, 2, 1, 0, 0, 0, 123*int(time.Millisecond), time.UTC)},
+		{param: "1738368000000.5", want: time.Date(2025, 2, 1, 0, 0, 0, 1*int(time.Millisecond), time.UTC)},
+		{param: "1.738368e12", want: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{param: "2025-02-01T00:00:00Z", want: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{param: "2025-02-01T00:00:00.123456789Z", want: time.Date(2025, 2, 1, 0, 0, 0, 123456789, time.UTC)},
+		{param: "2025-02-01T09:00:00+09:00", want: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{param: "2025-02-01", wantErr: true},
+		{param: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.param, func(t *testing.T) {
+			got, err := parseTime(tt.param)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Fatalf("unexpected time: %s", got)
+			}
+		})
+	}
+}
+
+func TestSeriesHandlerPostForm(t *testing.T) {
+	db := newTestDB(t, 3)
+	params := rangeParams(`{Namespace="AWS/EC2",InstanceId=~"i-00[01]"}`)
+	params.Add("match[]", `{Namespace="AWS/EC2",InstanceId="i-002"}`)
+	params.Set("limit", "2")
+
+	get := decodeSeries(t, getSeries(t, db, newTestOptions(), params))
+	if len(get.Data) != 2 || len(get.Warnings) != 1 {
+		t.Fatalf("unexpected response: %+v", get)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/series", strings.NewReader(params.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	seriesHandler(w, r, db, newTestOptions(), nil, nil)
+	post := decodeSeries(t, w)
+	if !reflect.DeepEqual(post, get) {
+		t.Fatalf("unexpected response: %+v", post)
+	}
+
+	// the form body is merged with the query string
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/series?limit=1", strings.NewReader(params.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	seriesHandler(w, r, db, newTestOptions(), nil, nil)
+	if post := decodeSeries(t, w); len(post.Data) != 2 {
+		t.Fatalf("the body should take precedence: %+v", post)
+	}
+}
+
+func TestSeriesHandlerTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	db := newTestDB(t, 2)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/series?"+rangeParams(`{Namespace="AWS/EC2"}`).Encode(), nil)
+	traceID := "0af7651916cd43dd8448eb211c80319c"
+	r.Header.Set("traceparent", "00-"+traceID+"-b7ad6b7169203331-01")
+	w := httptest.NewRecorder()
+	seriesHandler(w, r, db, newTestOptions(), nil, nil)
+	decodeSeries(t, w)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range sr.Ended() {
+		spans[span.Name()] = span
+	}
+	handler, query, partition := spans["seriesHandler"], spans["LabelDB.QueryMetrics"], spans["partition query"]
+	if handler == nil || query == nil || partition == nil {
+		t.Fatalf("unexpected spans: %v", slices.Collect(maps.Keys(spans)))
+	}
+	// the trace of the client is continued
+	if got := handler.SpanContext().TraceID().String(); got != traceID {
+		t.Fatalf("unexpected trace id: %s", got)
+	}
+	if query.Parent().SpanID() != handler.SpanContext().SpanID() || partition.Parent().SpanID() != query.SpanContext().SpanID() {
+		t.Fatal("unexpected span hierarchy")
+	}
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range partition.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if !strings.HasSuffix(attrs["db.path"].AsString(), ".db") || attrs["db.rows_examined"].AsInt64() != 2 {
+		t.Fatalf("unexpected partition attributes: %v", partition.Attributes())
+	}
+}
+
+func TestSeriesHandlerAccessLog(t *testing.T) {
+	db := newTestDB(t, 2)
+	opts := newTestOptions()
+	path := filepath.Join(t.TempDir(), "access.log")
+	var err error
+	opts.accessLog, err = accesslog.New(accesslog.Config{Path: path, MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opts.accessLog.Close()
+
+	decodeSeries(t, getSeries(t, db, opts, rangeParams(`{Namespace="AWS/EC2"}`)))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e accesslog.Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Method != http.MethodGet || !slices.Equal(e.Matchers, []string{`{Namespace="AWS/EC2"}`}) || !e.Start.Equal(testTime) || e.SeriesCount != 2 || !e.Success {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+}
+
+func TestQueryFreshMetricsCutoff(t *testing.T) {
+	fmc := fresh_metrics.New(rate.NewLimiter(rate.Inf, 1), prometheus.NewRegistry())
+	fmc.SetClientFactory(func(ctx context.Context, region string) (fresh_metrics.CloudWatchAPI, error) {
+		return cloudwatchmock.NewClient(&cloudwatchmock.Fixture{Metrics: []cloudwatchmock.FixtureMetric{{
+			Region:     "us-east-1",
+			Namespace:  "AWS/EC2",
+			MetricName: "CPUUtilization",
+			Dimensions: map[string]string{"InstanceId": "i-000"},
+		}}}, region), nil
+	})
+	fmc.SetCutoff(time.Hour)
+	matchers, err := parser.ParseMetricSelectors([]string{`CPUUtilization{Namespace="AWS/EC2",Region="us-east-1"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+
+	// CloudWatch is not queried beyond the cutoff
+	fresh, _, err := queryFreshMetrics(context.Background(), fmc, seriesQuery{matchers: matchers, end: now.Add(-2 * time.Hour), now: now})
+	if err != nil || len(fresh) != 0 {
+		t.Fatalf("unexpected result: %v %v", fresh, err)
+	}
+	fresh, _, err = queryFreshMetrics(context.Background(), fmc, seriesQuery{matchers: matchers, end: now.Add(-30 * time.Minute), now: now})
+	if err != nil || len(fresh) != 1 {
+		t.Fatalf("unexpected result: %v %v", fresh, err)
+	}
+	// the fresh metrics are active since the cutoff
+	for _, m := range fresh {
+		if d := m.ToTS.Sub(m.FromTS); d != time.Hour {
+			t.Fatalf("unexpected lifetime: %s", d)
+		}
+	}
+}
+
+func TestQueryFreshMetricsLimit(t *testing.T) {
+	fmc := fresh_metrics.New(rate.NewLimiter(rate.Inf, 1), prometheus.NewRegistry())
+	fmc.SetClientFactory(func(ctx context.Context, region string) (fresh_metrics.CloudWatchAPI, error) {
+		fixture := &cloudwatchmock.Fixture{}
+		for i := 0; i < 3; i++ {
+			fixture.Metrics = append(fixture.Metrics, cloudwatchmock.FixtureMetric{
+				Region:     "us-east-1",
+				Namespace:  "AWS/EC2",
+				MetricName: "CPUUtilization",
+				Dimensions: map[string]string{"InstanceId": fmt.Sprintf("i-%03d", i)},
+			})
+		}
+		return cloudwatchmock.NewClient(fixture, region), nil
+	})
+	matchers, err := parser.ParseMetricSelectors([]string{`CPUUtilization{Namespace="AWS/EC2",Region="us-east-1"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+
+	// the fresh metrics are limited to the fetch limit in the order of the keys
+	limits := (&queryOptions{}).limits(1)
+	fresh, _, err := queryFreshMetrics(context.Background(), fmc, seriesQuery{matchers: matchers, end: now, now: now, limits: limits})
+	if err != nil || len(fresh) != limits.fetch {
+		t.Fatalf("unexpected result: %v %v", fresh, err)
+	}
+	for _, m := range fresh {
+		if v := m.Dimensions[0].Value; v != "i-000" && v != "i-001" {
+			t.Fatalf("unexpected series: %v", m)
+		}
+	}
+}
+
+func TestSeriesHandlerWithoutFreshMetrics(t *testing.T) {
+	db, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	now := time.Now().UTC()
+	err = db.RecordMetric(context.Background(), model.Metric{
+		Namespace:  "AWS/EC2",
+		MetricName: "CPUUtilization",
+		Region:     "us-east-1",
+		Dimensions: model.Dimensions{{Name: "InstanceId", Value: "i-000"}},
+		FromTS:     now.Add(-time.Hour),
+		ToTS:       now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := newTestOptions()
+	opts.fmc = nil
+
+	// the recent queries are served from the database
+	resp := decodeSeries(t, getSeries(t, db, opts, url.Values{"match[]": []string{`CPUUtilization{Namespace="AWS/EC2",Region="us-east-1"}`}}))
+	if len(resp.Data) != 1 || len(resp.Warnings) != 0 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+func TestSeriesHandlerLimitPerSelector(t *testing.T) {
+	db := newTestDB(t, 5)
+	opts := newTestOptions()
+	params := rangeParams(`{Namespace="AWS/EC2"}`)
+	params.Add("match[]", `{Namespace="AWS/EC2", InstanceId="i-004"}`)
+	params.Set("limit", "1")
+
+	// the broad selector starves the other
+	resp := decodeSeries(t, getSeries(t, db, opts, params))
+	if len(resp.Data) != 1 || resp.Data[0]["InstanceId"] != "i-000" {
+		t.Fatalf("unexpected data: %v", resp.Data)
+	}
+
+	params.Set("limit_per_selector", "true")
+	params.Set("stats", "all")
+	w := getSeries(t, db, opts, params)
+	var statsResp struct {
+		seriesResponse
+		Stats queryStats `json:"stats"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&statsResp); err != nil {
+		t.Fatal(err)
+	}
+	if len(statsResp.Data) != 2 || statsResp.Data[0]["InstanceId"] != "i-000" || statsResp.Data[1]["InstanceId"] != "i-004" || !statsResp.Truncated {
+		t.Fatalf("unexpected response: %+v", statsResp.seriesResponse)
+	}
+	expected := []selectorStats{
+		{Selector: `{Namespace="AWS/EC2"}`, Series: 1, Truncated: true},
+		{Selector: `{Namespace="AWS/EC2", InstanceId="i-004"}`, Series: 1},
+	}
+	if !reflect.DeepEqual(statsResp.Stats.Selectors, expected) {
+		t.Fatalf("unexpected stats: %+v", statsResp.Stats.Selectors)
+	}
+
+	params.Set("format", "ndjson")
+	if w := getSeries(t, db, opts, params); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status of the stream: %d", w.Code)
+	}
+}
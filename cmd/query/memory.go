@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	memoryCheckInterval = 1 * time.Second
+	heapMetric          = "/memory/classes/heap/objects:bytes"
+	// resume accepting queries when the heap goes below this ratio of the budget
+	memoryResumeRatio = 0.9
+)
+
+// memoryGuard rejects expensive queries while the heap exceeds the soft memory budget.
+type memoryGuard struct {
+	budget   uint64
+	shrink   []func()
+	exceeded atomic.Bool
+
+	exceededGauge prometheus.Gauge
+	rejected      prometheus.Counter
+}
+
+func newMemoryGuard(budget uint64, registry prometheus.Registerer, shrink ...func()) *memoryGuard {
+	return &memoryGuard{
+		budget: budget,
+		shrink: shrink,
+		exceededGauge: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "memory_budget_exceeded",
+			Help: "Whether the heap exceeds the soft memory budget",
+		}),
+		rejected: promauto.With(registry).NewCounter(prometheus.CounterOpts{
+			Name: "memory_budget_rejected_requests_total",
+			Help: "Total number of requests rejected by the soft memory budget",
+		}),
+	}
+}
+
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+func (g *memoryGuard) run(ctx context.Context) {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.check(heapBytes())
+		}
+	}
+}
+
+func (g *memoryGuard) check(heap uint64) {
+	if heap > g.budget {
+		if !g.exceeded.Swap(true) {
+			slog.Warn("memory budget exceeded, rejecting expensive queries", "heapBytes", heap, "budgetBytes", g.budget)
+			g.exceededGauge.Set(1)
+			for _, f := range g.shrink {
+				f()
+			}
+			debug.FreeOSMemory()
+		}
+		return
+	}
+	if heap < uint64(float64(g.budget)*memoryResumeRatio) && g.exceeded.Swap(false) {
+		slog.Info("memory usage is back under the budget", "heapBytes", heap, "budgetBytes", g.budget)
+		g.exceededGauge.Set(0)
+	}
+}
+
+func (g *memoryGuard) handler(handler http.HandlerFunc) http.HandlerFunc {
+	if g == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if g.exceeded.Load() {
+			g.rejected.Inc()
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "memory budget exceeded, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (g *memoryGuard) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if g != nil && g.exceeded.Load() {
+		g.rejected.Inc()
+		return status.Error(codes.Unavailable, "memory budget exceeded, try again later")
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMemoryGuardHandler(t *testing.T) {
+	shrunk := 0
+	guard := newMemoryGuard(1000, prometheus.NewRegistry(), func() { shrunk++ })
+	handler := guard.handler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/series", nil))
+		return w
+	}
+
+	if w := serve(); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	guard.check(1001)
+	w := serve()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("unexpected response: %d %v", w.Code, w.Header())
+	}
+	if got := testutil.ToFloat64(guard.rejected); got != 1 {
+		t.Fatalf("unexpected rejected requests: %v", got)
+	}
+	if got := testutil.ToFloat64(guard.exceededGauge); got != 1 {
+		t.Fatalf("unexpected exceeded gauge: %v", got)
+	}
+	// the caches are shrunk once per excess
+	guard.check(1001)
+	if shrunk != 1 {
+		t.Fatalf("unexpected shrinks: %d", shrunk)
+	}
+
+	// still rejected until the heap goes below the resume ratio
+	guard.check(950)
+	if w := serve(); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	guard.check(800)
+	if w := serve(); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	// disabled without the budget
+	var disabled *memoryGuard
+	w = httptest.NewRecorder()
+	disabled.handler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+func TestMemoryGuardStreamInterceptor(t *testing.T) {
+	guard := newMemoryGuard(1000, prometheus.NewRegistry())
+	called := 0
+	handler := func(srv any, ss grpc.ServerStream) error {
+		called++
+		return nil
+	}
+	intercept := func(g *memoryGuard) error {
+		return g.streamInterceptor(nil, nil, &grpc.StreamServerInfo{FullMethod: "/labelsdb.v1.LabelsDB/Series"}, handler)
+	}
+
+	if err := intercept(guard); err != nil || called != 1 {
+		t.Fatalf("unexpected result: %v %d", err, called)
+	}
+	guard.check(1001)
+	if err := intercept(guard); status.Code(err) != codes.Unavailable || called != 1 {
+		t.Fatalf("unexpected result: %v %d", err, called)
+	}
+	if got := testutil.ToFloat64(guard.rejected); got != 1 {
+		t.Fatalf("unexpected rejected requests: %v", got)
+	}
+	// disabled without the budget
+	if err := intercept(nil); err != nil || called != 2 {
+		t.Fatalf("unexpected result: %v %d", err, called)
+	}
+}
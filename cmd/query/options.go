@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/accesslog"
+	"github.com/mtanda/prometheus-labels-db/internal/fresh_metrics"
+	"github.com/mtanda/prometheus-labels-db/internal/labelindex"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/prometheus/model/labels"
+	promrelabel "github.com/prometheus/prometheus/model/relabel"
+)
+
+// errTooManySeries aborts the queries matching more series than --query.max-series.
+var errTooManySeries = errors.New("too many series")
+
+func tooManySeriesError(maxSeries int) error {
+	return fmt.Errorf("%w: the query matches more than %d series, narrow the selectors or specify limit", errTooManySeries, maxSeries)
+}
+
+// queryOptions is the settings of the series queries shared by the HTTP, streaming and gRPC APIs.
+type queryOptions struct {
+	// the database only if nil
+	fmc            *fresh_metrics.FreshMetrics
+	usage          *namespaceUsage
+	relabelConfigs []*promrelabel.Config
+	mergeStrategy  model.MergeStrategy
+	// unlimited if 0
+	maxLimit  int
+	maxSeries int
+	// the default of the partial_response parameter
+	partial  bool
+	lookback lookbackConfig
+	// the queries are canceled after the timeout, unlimited if 0
+	timeout time.Duration
+	// the number of the partitions queried at once, the default of the database if 0
+	partitionConcurrency int
+	// discards the entries if nil
+	accessLog *accesslog.Logger
+	// the series API queries only this instance if nil
+	federation *federation
+	// the namespaces are queried from the database if nil
+	labelIndex *labelindex.Index
+	// the identical queries are executed separately if nil
+	queries *queryGroup
+}
+
+// lookbackConfig is the time range of the series queries without start, and the maximum range.
+type lookbackConfig struct {
+	defaultLookback time.Duration
+	// unlimited if 0
+	maxLookback time.Duration
+	// the queries don't reach before now minus the retention, unlimited if 0
+	retention time.Duration
+}
+
+// clampStart clamps start by the maximum lookback before end, and by the retention before now, and returns the warnings of the clamps.
+// start can be after end when the whole range is before the retention.
+func (c lookbackConfig) clampStart(start, end, now time.Time) (time.Time, []string) {
+	var warnings []string
+	if c.maxLookback > 0 && end.Sub(start) > c.maxLookback {
+		start = end.Add(-c.maxLookback)
+		warnings = append(warnings, fmt.Sprintf("start is clamped to %s by the maximum lookback %s", start.Format(time.RFC3339), c.maxLookback))
+	}
+	if horizon := now.Add(-c.retention); c.retention > 0 && start.Before(horizon) {
+		start = horizon
+		warnings = append(warnings, fmt.Sprintf("start is clamped to %s by the retention %s", start.Format(time.RFC3339), c.retention))
+	}
+	return start, warnings
+}
+
+// seriesLimits is the limits of a query, resolved from the limit parameter and the options.
+type seriesLimits struct {
+	// the number of the returned series, unlimited if 0
+	limit int
+	// the number of the series above which the query is aborted, disabled if 0
+	abort int
+	// the number of the series fetched from each source to detect truncation, unlimited if 0
+	fetch int
+}
+
+// limits returns the limits of the query with the limit parameter, 0 if unspecified.
+func (o *queryOptions) limits(limit int) seriesLimits {
+	if o.maxLimit > 0 && (limit == 0 || limit > o.maxLimit) {
+		limit = o.maxLimit
+	}
+	l := seriesLimits{
+		limit: limit,
+		abort: seriesAbortLimit(limit, o.maxSeries),
+	}
+	// fetch one more series to detect truncation
+	if l.limit > 0 {
+		l.fetch = l.limit + 1
+	}
+	if l.abort > 0 {
+		l.fetch = l.abort + 1
+	}
+	return l
+}
+
+// seriesAbortLimit returns the number of the series above which the query is aborted, or 0 if the limit truncates the result first.
+func seriesAbortLimit(limit int, maxSeries int) int {
+	if maxSeries > 0 && (limit == 0 || limit > maxSeries) {
+		return maxSeries
+	}
+	return 0
+}
+
+// apply aborts the query matching too many series, otherwise sorts the series and truncates them by the limit.
+func (l seriesLimits) apply(data []map[string]string, warnings []string) ([]map[string]string, []string, error) {
+	if l.abort > 0 && len(data) > l.abort {
+		return nil, nil, tooManySeriesError(l.abort)
+	}
+	// sort for the same response to the same request, only the returned series are sorted
+	// since the sources stop scanning at the fetch limit in arbitrary order
+	data = sortSeries(data)
+	if l.limit > 0 && len(data) > l.limit {
+		data = data[:l.limit]
+		warnings = append(warnings, truncatedWarning)
+	}
+	return data, warnings, nil
+}
+
+// seriesQuery is the parameters of a series query.
+type seriesQuery struct {
+	matchers        [][]*labels.Matcher
+	start, end, now time.Time
+	limits          seriesLimits
+	partial         bool
+	// the warnings about the parameters, e.g. the clamped time range
+	warnings []string
+}
+
+// sortSeries sorts the series by the label sets in lexicographic order, same as Prometheus.
+func sortSeries(data []map[string]string) []map[string]string {
+	type series struct {
+		labels labels.Labels
+		m      map[string]string
+	}
+	sorted := make([]series, 0, len(data))
+	for _, m := range data {
+		sorted = append(sorted, series{labels: labels.FromMap(m), m: m})
+	}
+	slices.SortFunc(sorted, func(a, b series) int {
+		return labels.Compare(a.labels, b.labels)
+	})
+	for i, s := range sorted {
+		data[i] = s.m
+	}
+	return data
+}
+
+// foldCase returns the selectors matching the dimension values case-insensitively, e.g. for the values differing in case across the accounts.
+// The equality matchers are replaced by the case-insensitive regexps, which both the database and the fresh metrics evaluate.
+// The Namespace, the metric name and the region are matched exactly, since the lifetime tables and ListMetrics look them up.
+func foldCase(matchers [][]*labels.Matcher) [][]*labels.Matcher {
+	folded := make([][]*labels.Matcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		lm := make([]*labels.Matcher, 0, len(matcher))
+		for _, m := range matcher {
+			switch m.Name {
+			case "Namespace", labels.MetricName, "MetricName", "Region":
+				lm = append(lm, m)
+				continue
+			}
+			t, v := m.Type, m.Value
+			switch m.Type {
+			case labels.MatchEqual:
+				t, v = labels.MatchRegexp, regexp.QuoteMeta(v)
+			case labels.MatchNotEqual:
+				t, v = labels.MatchNotRegexp, regexp.QuoteMeta(v)
+			}
+			// the flag applies to all the alternatives in the anchored group
+			lm = append(lm, labels.MustNewMatcher(t, m.Name, "(?i)"+v))
+		}
+		folded = append(folded, lm)
+	}
+	return folded
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSortSeries(t *testing.T) {
+	data := []map[string]string{
+		{"__name__": "b", "InstanceId": "i-1"},
+		{"__name__": "a", "InstanceId": "i-2"},
+		{"__name__": "a", "InstanceId": "i-1", "Region": "us-east-1"},
+		{"__name__": "a", "InstanceId": "i-1"},
+	}
+	want := []map[string]string{
+		{"__name__": "a", "InstanceId": "i-1", "Region": "us-east-1"},
+		{"__name__": "a", "InstanceId": "i-1"},
+		{"__name__": "b", "InstanceId": "i-1"},
+		{"__name__": "a", "InstanceId": "i-2"},
+	}
+	// compared label by label in the order of the names, same as Prometheus
+	if got := sortSeries(data); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected order: %v", got)
+	}
+}
+
+func TestQueryOptionsLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxLimit  int
+		maxSeries int
+		limit     int
+		want      seriesLimits
+	}{
+		{name: "unlimited", want: seriesLimits{}},
+		{name: "limit", limit: 10, want: seriesLimits{limit: 10, fetch: 11}},
+		{name: "max limit", maxLimit: 5, want: seriesLimits{limit: 5, fetch: 6}},
+		{name: "smaller limit than max limit", maxLimit: 5, limit: 3, want: seriesLimits{limit: 3, fetch: 4}},
+		{name: "max series", maxSeries: 100, want: seriesLimits{abort: 100, fetch: 101}},
+		{name: "larger limit than max series", maxSeries: 100, limit: 200, want: seriesLimits{limit: 200, abort: 100, fetch: 101}},
+		{name: "smaller limit than max series", maxSeries: 100, limit: 10, want: seriesLimits{limit: 10, fetch: 11}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &queryOptions{maxLimit: tt.maxLimit, maxSeries: tt.maxSeries}
+			if got := opts.limits(tt.limit); got != tt.want {
+				t.Fatalf("unexpected limits: %+v", got)
+			}
+		})
+	}
+}
+
+func TestSeriesLimitsApply(t *testing.T) {
+	data := func() []map[string]string {
+		return []map[string]string{{"id": "3"}, {"id": "1"}, {"id": "2"}}
+	}
+
+	got, warnings, err := seriesLimits{limit: 2, fetch: 3}.apply(data(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []map[string]string{{"id": "1"}, {"id": "2"}}) || !reflect.DeepEqual(warnings, []string{truncatedWarning}) {
+		t.Fatalf("unexpected result: %v %v", got, warnings)
+	}
+
+	got, warnings, err = seriesLimits{limit: 3, fetch: 4}.apply(data(), nil)
+	if err != nil || len(got) != 3 || len(warnings) != 0 {
+		t.Fatalf("unexpected result: %v %v %v", got, warnings, err)
+	}
+
+	if _, _, err := (seriesLimits{abort: 2, fetch: 3}).apply(data(), nil); !errors.Is(err, errTooManySeries) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLookbackClampStart(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	c := lookbackConfig{maxLookback: 30 * 24 * time.Hour, retention: 455 * 24 * time.Hour}
+
+	start, warnings := c.clampStart(now.Add(-time.Hour), now, now)
+	if !start.Equal(now.Add(-time.Hour)) || len(warnings) != 0 {
+		t.Fatalf("unexpected result within the limits: %v %v", start, warnings)
+	}
+
+	// the range starting at the epoch ends before the retention
+	end := now.Add(-500 * 24 * time.Hour)
+	start, warnings = c.clampStart(time.Unix(0, 0).UTC(), end, now)
+	if !start.Equal(now.Add(-455*24*time.Hour)) || len(warnings) != 2 || !strings.Contains(warnings[1], "by the retention") {
+		t.Fatalf("unexpected result before the retention: %v %v", start, warnings)
+	}
+}
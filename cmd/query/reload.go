@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/fresh_metrics"
+	"github.com/mtanda/prometheus-labels-db/internal/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	commonmodel "github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// liveOptions is the options replaced by the reload, the handlers load them once per query.
+type liveOptions struct {
+	p atomic.Pointer[queryOptions]
+}
+
+func newLiveOptions(opts *queryOptions) *liveOptions {
+	o := &liveOptions{}
+	o.p.Store(opts)
+	return o
+}
+
+func (o *liveOptions) load() *queryOptions {
+	return o.p.Load()
+}
+
+// queryConfig is the settings of --query.config-file, which override the flags and are reloaded without restarting.
+// The settings not in the file are the values of the flags.
+type queryConfig struct {
+	MaxSeries   *int                  `yaml:"max_series"`
+	MaxLimit    *int                  `yaml:"max_limit"`
+	Timeout     *commonmodel.Duration `yaml:"timeout"`
+	MaxLookback *commonmodel.Duration `yaml:"max_lookback"`
+	Retention   *commonmodel.Duration `yaml:"retention"`
+	FreshCutoff *commonmodel.Duration `yaml:"fresh_cutoff"`
+}
+
+func loadQueryConfig(path string) (*queryConfig, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg queryConfig
+	if err := yaml.UnmarshalStrict(buf, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// reloader applies --query.config-file and the web config file on SIGHUP or POST /-/reload.
+// The open databases are kept.
+type reloader struct {
+	mu          sync.Mutex
+	path        string
+	flags       *queryOptions
+	flagsCutoff time.Duration
+	options     *liveOptions
+	fmc         *fresh_metrics.FreshMetrics
+	server      *web.Server
+
+	lastSuccess          prometheus.Gauge
+	lastSuccessTimestamp prometheus.Gauge
+}
+
+func newReloader(path string, flags *queryOptions, flagsCutoff time.Duration, fmc *fresh_metrics.FreshMetrics, registry prometheus.Registerer) *reloader {
+	return &reloader{
+		path:        path,
+		flags:       flags,
+		flagsCutoff: flagsCutoff,
+		options:     newLiveOptions(flags),
+		fmc:         fmc,
+		lastSuccess: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "query_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		}),
+		lastSuccessTimestamp: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "query_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		}),
+	}
+}
+
+// reload applies the files, or keeps the current settings if any of them is invalid.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.apply()
+	if err != nil {
+		r.lastSuccess.Set(0)
+		return err
+	}
+	r.lastSuccess.Set(1)
+	r.lastSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (r *reloader) apply() error {
+	opts := *r.flags
+	cutoff := r.flagsCutoff
+	if r.path != "" {
+		cfg, err := loadQueryConfig(r.path)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", r.path, err)
+		}
+		if cfg.MaxSeries != nil {
+			opts.maxSeries = *cfg.MaxSeries
+		}
+		if cfg.MaxLimit != nil {
+			opts.maxLimit = *cfg.MaxLimit
+		}
+		if cfg.Timeout != nil {
+			opts.timeout = time.Duration(*cfg.Timeout)
+		}
+		if cfg.MaxLookback != nil {
+			opts.lookback.maxLookback = time.Duration(*cfg.MaxLookback)
+		}
+		if cfg.Retention != nil {
+			opts.lookback.retention = time.Duration(*cfg.Retention)
+		}
+		if cfg.FreshCutoff != nil {
+			cutoff = time.Duration(*cfg.FreshCutoff)
+		}
+	}
+	if opts.maxSeries < 0 || opts.maxLimit < 0 {
+		return errors.New("max_series and max_limit must be non-negative")
+	}
+	if cutoff <= 0 {
+		return errors.New("fresh_cutoff must be positive")
+	}
+	if r.server != nil {
+		if err := r.server.ReloadConfig(); err != nil {
+			return fmt.Errorf("failed to reload web config: %w", err)
+		}
+	}
+	r.options.p.Store(&opts)
+	r.fmc.SetCutoff(cutoff)
+	return nil
+}
+
+// run reloads on SIGHUP until ctx is done.
+func (r *reloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.reload(); err != nil {
+				// ignore error
+				slog.Error("failed to reload config", "error", err)
+				continue
+			}
+			slog.Info("reloaded config")
+		}
+	}
+}
+
+// handler serves /-/reload same as Prometheus.
+func (r *reloader) handler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		slog.Error("failed to reload config", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("reloaded config")
+	io.WriteString(w, "Reloaded.\n")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.yml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("max_series: 100\ntimeout: 30s\n")
+	flags := newTestOptions()
+	flags.maxLimit = 10
+	flags.timeout = time.Minute
+	r := newReloader(path, flags, time.Hour, flags.fmc, prometheus.NewRegistry())
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	opts := r.options.load()
+	// the settings not in the file are the flags
+	if opts.maxSeries != 100 || opts.timeout != 30*time.Second || opts.maxLimit != 10 || flags.fmc.Cutoff() != time.Hour {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	write("max_limit: 5\nfresh_cutoff: 2h\n")
+	w := httptest.NewRecorder()
+	r.handler(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", w.Code, w.Body.String())
+	}
+	opts = r.options.load()
+	if opts.maxSeries != 0 || opts.timeout != time.Minute || opts.maxLimit != 5 || flags.fmc.Cutoff() != 2*time.Hour {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+	if got := testutil.ToFloat64(r.lastSuccess); got != 1 {
+		t.Fatalf("unexpected last reload: %v", got)
+	}
+
+	// the invalid config is not applied
+	for _, content := range []string{"max_series: -1\n", "unknown: 1\n", "fresh_cutoff: 0s\n"} {
+		write(content)
+		if err := r.reload(); err == nil {
+			t.Fatalf("expected error for %q", content)
+		}
+		if r.options.load() != opts || flags.fmc.Cutoff() != 2*time.Hour {
+			t.Fatalf("the invalid config %q is applied", content)
+		}
+		if got := testutil.ToFloat64(r.lastSuccess); got != 0 {
+			t.Fatalf("unexpected last reload: %v", got)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.handler(w, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
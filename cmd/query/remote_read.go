@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// syntheticSampleValue is the value of the sample added to each series, so that the series are visible in PromQL.
+const syntheticSampleValue = 1
+
+func fromLabelMatchers(matchers []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	result := make([]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		var t labels.MatchType
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			t = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			t = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			t = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			t = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("invalid matcher type: %s", m.Type)
+		}
+		matcher, err := labels.NewMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, matcher)
+	}
+	return result, nil
+}
+
+// toTimeSeries converts the series with a synthetic sample at the last seen timestamp in the query range.
+func toTimeSeries(m *model.Metric, startMs int64, endMs int64) *prompb.TimeSeries {
+	lbls := m.Labels()
+	ts := &prompb.TimeSeries{
+		Labels: make([]prompb.Label, 0, len(lbls)),
+	}
+	for name, value := range lbls {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: name, Value: value})
+	}
+	sort.Slice(ts.Labels, func(i, j int) bool {
+		return ts.Labels[i].Name < ts.Labels[j].Name
+	})
+	t := min(max(m.ToTS.UnixMilli(), startMs), endMs)
+	ts.Samples = []prompb.Sample{{Value: syntheticSampleValue, Timestamp: t}}
+	return ts
+}
+
+// remoteReadHandler serves the series in the Prometheus remote read protocol.
+// Only the sampled response type is supported, which Prometheus accepts regardless of the accepted response types.
+// The protocol has no warnings, so the series over --query.max-limit are dropped silently.
+func remoteReadHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB, opts *queryOptions) {
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, "failed to decode request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req prompb.ReadRequest
+	if err := req.Unmarshal(buf); err != nil {
+		http.Error(w, "failed to unmarshal request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, 0, len(req.Queries)),
+	}
+	for _, q := range req.Queries {
+		matchers, err := fromLabelMatchers(q.Matchers)
+		if err != nil {
+			http.Error(w, "invalid matchers: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.EndTimestampMs < q.StartTimestampMs {
+			http.Error(w, "end timestamp must not be before start timestamp", http.StatusBadRequest)
+			return
+		}
+		start := time.UnixMilli(q.StartTimestampMs).UTC()
+		end := time.UnixMilli(q.EndTimestampMs).UTC()
+		limits := opts.limits(0)
+		result, err := db.QueryMetrics(r.Context(), start, end, matchers, limits.fetch, make(map[string]*model.Metric))
+		if err != nil {
+			slog.Error("failed to query metrics", "error", err)
+			http.Error(w, "failed to query metrics: "+err.Error(), queryErrorStatus(err))
+			return
+		}
+		if limits.abort > 0 && len(result) > limits.abort {
+			err := tooManySeriesError(limits.abort)
+			http.Error(w, err.Error(), queryErrorStatus(err))
+			return
+		}
+
+		keys := make([]string, 0, len(result))
+		for k := range result {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if limits.limit > 0 && len(keys) > limits.limit {
+			keys = keys[:limits.limit]
+		}
+		qr := &prompb.QueryResult{
+			Timeseries: make([]*prompb.TimeSeries, 0, len(keys)),
+		}
+		for _, k := range keys {
+			qr.Timeseries = append(qr.Timeseries, toTimeSeries(result[k], q.StartTimestampMs, q.EndTimestampMs))
+		}
+		resp.Results = append(resp.Results, qr)
+	}
+
+	data, err := resp.Marshal()
+	if err != nil {
+		http.Error(w, "failed to marshal response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+		// ignore error
+		slog.Error("failed to write response", "error", err)
+	}
+}
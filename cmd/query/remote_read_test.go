@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func remoteRead(t *testing.T, opts *queryOptions, n int, req *prompb.ReadRequest) (*httptest.ResponseRecorder, *prompb.ReadResponse) {
+	t.Helper()
+	buf, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, buf)))
+	w := httptest.NewRecorder()
+	remoteReadHandler(w, r, newTestDB(t, n), opts)
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+	if w.Header().Get("Content-Encoding") != "snappy" {
+		t.Fatalf("unexpected content encoding: %s", w.Header().Get("Content-Encoding"))
+	}
+	body, err := io.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp prompb.ReadResponse
+	if err := resp.Unmarshal(decoded); err != nil {
+		t.Fatal(err)
+	}
+	return w, &resp
+}
+
+func TestRemoteReadHandler(t *testing.T) {
+	startMs := testTime.Add(-time.Hour).UnixMilli()
+	endMs := testTime.Add(2 * time.Hour).UnixMilli()
+	req := &prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				StartTimestampMs: startMs,
+				EndTimestampMs:   endMs,
+				Matchers: []*prompb.LabelMatcher{
+					{Type: prompb.LabelMatcher_EQ, Name: "Namespace", Value: "AWS/EC2"},
+					{Type: prompb.LabelMatcher_RE, Name: "InstanceId", Value: "i-00[01]"},
+				},
+			},
+			{
+				StartTimestampMs: startMs,
+				EndTimestampMs:   endMs,
+				Matchers: []*prompb.LabelMatcher{
+					{Type: prompb.LabelMatcher_EQ, Name: "Namespace", Value: "AWS/ELB"},
+				},
+			},
+		},
+	}
+	_, resp := remoteRead(t, newTestOptions(), 3, req)
+	if resp == nil {
+		t.Fatal("unexpected error")
+	}
+	if len(resp.Results) != 2 {
+		t.Fatalf("unexpected results: %d", len(resp.Results))
+	}
+	series := resp.Results[0].Timeseries
+	if len(series) != 2 || len(resp.Results[1].Timeseries) != 0 {
+		t.Fatalf("unexpected series: %v", resp.Results)
+	}
+	for i, ts := range series {
+		// the labels are sorted by name
+		for j := 1; j < len(ts.Labels); j++ {
+			if ts.Labels[j-1].Name >= ts.Labels[j].Name {
+				t.Fatalf("unsorted labels: %v", ts.Labels)
+			}
+		}
+		// the last seen timestamp
+		if len(ts.Samples) != 1 || ts.Samples[0].Value != syntheticSampleValue || ts.Samples[0].Timestamp != testTime.Add(time.Hour).UnixMilli() {
+			t.Fatalf("unexpected samples: %v", ts.Samples)
+		}
+		want := []string{"i-000", "i-001"}[i]
+		found := false
+		for _, l := range ts.Labels {
+			if l.Name == "InstanceId" && l.Value == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("unexpected series: %v", ts.Labels)
+		}
+	}
+}
+
+func TestRemoteReadHandlerLimits(t *testing.T) {
+	req := &prompb.ReadRequest{
+		Queries: []*prompb.Query{{
+			StartTimestampMs: testTime.UnixMilli(),
+			EndTimestampMs:   testTime.Add(time.Hour).UnixMilli(),
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "Namespace", Value: "AWS/EC2"},
+			},
+		}},
+	}
+
+	opts := newTestOptions()
+	opts.maxLimit = 2
+	_, resp := remoteRead(t, opts, 3, req)
+	if resp == nil || len(resp.Results[0].Timeseries) != 2 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	opts = newTestOptions()
+	opts.maxSeries = 2
+	w, _ := remoteRead(t, opts, 3, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	_, resp = remoteRead(t, opts, 2, req)
+	if resp == nil || len(resp.Results[0].Timeseries) != 2 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	// invalid request
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader([]byte("invalid")))
+	rec := httptest.NewRecorder()
+	remoteReadHandler(rec, r, newTestDB(t, 0), newTestOptions())
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/fresh_metrics"
+)
+
+type inflightQuery struct {
+	Tenant    string    `json:"tenant"`
+	Matchers  []string  `json:"matchers"`
+	Start     string    `json:"start"`
+	End       string    `json:"end"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// inflightQueries tracks the series queries being processed.
+type inflightQueries struct {
+	resolver *tenantResolver
+	mu       sync.Mutex
+	nextID   uint64
+	queries  map[uint64]inflightQuery
+}
+
+func newInflightQueries(resolver *tenantResolver) *inflightQueries {
+	return &inflightQueries{
+		resolver: resolver,
+		queries:  make(map[uint64]inflightQuery),
+	}
+}
+
+func (q *inflightQueries) handler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the error is reported by the handler
+		_ = r.ParseForm()
+		query := r.Form
+		q.mu.Lock()
+		id := q.nextID
+		q.nextID++
+		q.queries[id] = inflightQuery{
+			Tenant:    q.resolver.tenant(r),
+			Matchers:  query["match[]"],
+			Start:     query.Get("start"),
+			End:       query.Get("end"),
+			StartedAt: time.Now().UTC(),
+		}
+		q.mu.Unlock()
+		defer func() {
+			q.mu.Lock()
+			delete(q.queries, id)
+			q.mu.Unlock()
+		}()
+		handler(w, r)
+	}
+}
+
+func (q *inflightQueries) list() []inflightQuery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queries := make([]inflightQuery, 0, len(q.queries))
+	for _, query := range q.queries {
+		queries = append(queries, query)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].StartedAt.Before(queries[j].StartedAt)
+	})
+	return queries
+}
+
+type runtimeStatus struct {
+	FreshMetricsCache []fresh_metrics.CacheEntry   `json:"freshMetricsCache"`
+	LimiterTokens     float64                      `json:"limiterTokens"`
+	OpenDBs           map[string][]database.OpenDB `json:"openDBs"`
+	InflightQueries   []inflightQuery              `json:"inflightQueries"`
+}
+
+func runtimeHandler(w http.ResponseWriter, r *http.Request, fmc *fresh_metrics.FreshMetrics, tenants *database.Tenants, inflight *inflightQueries) {
+	response := map[string]interface{}{
+		"status": "success",
+		"data": runtimeStatus{
+			FreshMetricsCache: fmc.CacheEntries(),
+			LimiterTokens:     fmc.LimiterTokens(),
+			OpenDBs:           tenants.OpenDBs(),
+			InflightQueries:   inflight.list(),
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/systemd"
+	"github.com/mtanda/prometheus-labels-db/internal/web"
+	"google.golang.org/grpc"
+)
+
+// serve serves the HTTP and gRPC servers until ctx is canceled, and then drains the in-flight queries.
+// The queries still running after shutdownTimeout are canceled.
+func serve(ctx context.Context, server *web.Server, l net.Listener, gs *grpc.Server, shutdownTimeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(l)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("received signal, draining the queries...")
+	systemd.Stopping()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	grpcStopped := make(chan struct{})
+	go func() {
+		defer close(grpcStopped)
+		if gs == nil {
+			return
+		}
+		stopped := make(chan struct{})
+		go func() {
+			gs.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			gs.Stop()
+		}
+	}()
+	err := server.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// ignore error
+		slog.Error("failed to drain the queries in time", "timeout", shutdownTimeout)
+		err = server.Close()
+	}
+	<-grpcStopped
+	if serveErr := <-errCh; !errors.Is(serveErr, http.ErrServerClosed) {
+		return serveErr
+	}
+	return err
+}
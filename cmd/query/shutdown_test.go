@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/web"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func startServe(t *testing.T, handler http.Handler, shutdownTimeout time.Duration) (string, context.CancelFunc, chan error) {
+	t.Helper()
+	server, err := web.NewServer("", handler, web.DefaultConfig(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, server, l, nil, shutdownTimeout)
+	}()
+	return "http://" + l.Addr().String(), cancel, done
+}
+
+func TestServeDrainsQueries(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	url, cancel, done := startServe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), time.Minute)
+
+	respCh := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		respCh <- err
+	}()
+	<-started
+	cancel()
+
+	// the in-flight query is not canceled
+	select {
+	case err := <-done:
+		t.Fatalf("serve returned before the query completed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-respCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// the listener is closed
+	if _, err := http.Get(url); err == nil {
+		t.Fatal("expected error after shutdown")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	url, cancel, done := startServe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}), 100*time.Millisecond)
+
+	respCh := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		respCh <- err
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the query is not canceled after the shutdown timeout")
+	}
+	if err := <-respCh; err == nil {
+		t.Fatal("expected error for the canceled query")
+	}
+}
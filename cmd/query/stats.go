@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+)
+
+// queryStats is the execution statistics of a series query, similar to the Prometheus query stats.
+type queryStats struct {
+	Timings    queryTimings    `json:"timings" msgpack:"timings"`
+	Series     seriesStats     `json:"series" msgpack:"series"`
+	Partitions partitionsStats `json:"partitions" msgpack:"partitions"`
+	// the series of each selector with limit_per_selector
+	Selectors []selectorStats `json:"selectors,omitempty" msgpack:"selectors,omitempty"`
+
+	db database.QueryStats
+}
+
+type queryTimings struct {
+	FreshQueryTime float64 `json:"freshQueryTime" msgpack:"freshQueryTime"`
+	DBQueryTime    float64 `json:"dbQueryTime" msgpack:"dbQueryTime"`
+	ExecTotalTime  float64 `json:"execTotalTime" msgpack:"execTotalTime"`
+}
+
+type seriesStats struct {
+	Fresh    int `json:"fresh" msgpack:"fresh"`
+	DB       int `json:"db" msgpack:"db"`
+	Returned int `json:"returned" msgpack:"returned"`
+}
+
+type selectorStats struct {
+	Selector  string `json:"selector" msgpack:"selector"`
+	Series    int    `json:"series" msgpack:"series"`
+	Truncated bool   `json:"truncated" msgpack:"truncated"`
+}
+
+type partitionsStats struct {
+	Scanned      int `json:"scanned" msgpack:"scanned"`
+	Skipped      int `json:"skipped" msgpack:"skipped"`
+	RowsExamined int `json:"rowsExamined" msgpack:"rowsExamined"`
+}
+
+// dbStats returns the statistics passed to the database, or nil if stats is nil.
+func (s *queryStats) dbStats() *database.QueryStats {
+	if s == nil {
+		return nil
+	}
+	return &s.db
+}
+
+func (s *queryStats) finish() {
+	s.Partitions = partitionsStats{
+		Scanned:      s.db.PartitionsScanned,
+		Skipped:      s.db.PartitionsSkipped,
+		RowsExamined: s.db.RowsExamined,
+	}
+}
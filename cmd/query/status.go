@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+)
+
+type activeSeriesResult struct {
+	Namespace string `json:"namespace"`
+	Region    string `json:"region"`
+	Timestamp int64  `json:"timestamp"`
+	Count     int64  `json:"count"`
+}
+
+func activeSeriesHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	start, err := parseTime(query.Get("start"))
+	if err != nil {
+		http.Error(w, "failed to parse start timestamp: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	end, err := parseTime(query.Get("end"))
+	if err != nil {
+		http.Error(w, "failed to parse end timestamp: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !start.Before(end) {
+		http.Error(w, "end timestamp must be after start timestamp", http.StatusBadRequest)
+		return
+	}
+
+	activeSeries, err := db.QueryActiveSeries(r.Context(), start, end, namespace)
+	if err != nil {
+		slog.Error("failed to query active series", "error", err, "namespace", namespace)
+		http.Error(w, "failed to query active series: "+err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	data := make([]activeSeriesResult, 0, len(activeSeries))
+	for _, as := range activeSeries {
+		data = append(data, activeSeriesResult{
+			Namespace: as.Namespace,
+			Region:    as.Region,
+			Timestamp: as.Timestamp.Unix(),
+			Count:     as.Count,
+		})
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func labelsDBStatusHandler(w http.ResponseWriter, r *http.Request, db *database.LabelDB) {
+	stats, err := db.Stats(r.Context())
+	if err != nil {
+		slog.Error("failed to get database stats", "error", err)
+		http.Error(w, "failed to get database stats: "+err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   stats,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+)
+
+func TestLabelsDBStatusHandler(t *testing.T) {
+	db := newTestDB(t, 3)
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/status/labelsdb", nil)
+	w := httptest.NewRecorder()
+	labelsDBStatusHandler(w, r, db)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	var resp struct {
+		Status string         `json:"status"`
+		Data   database.Stats `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "success" || len(resp.Data.Partitions) != 1 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	p := resp.Data.Partitions[0]
+	if p.Series != 3 || p.SizeBytes == 0 || resp.Data.SizeBytes != p.SizeBytes {
+		t.Errorf("unexpected partition stats: %+v", p)
+	}
+	if len(p.Namespaces) != 1 || p.Namespaces[0].Namespace != "AWS/EC2" || p.Namespaces[0].Series != 3 {
+		t.Errorf("unexpected namespace stats: %+v", p.Namespaces)
+	}
+	if !p.MinTime.Equal(testTime) || !p.MaxTime.Equal(testTime.Add(time.Hour)) {
+		t.Errorf("unexpected time range: %s - %s", p.MinTime, p.MaxTime)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/encoding"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/relabel"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// errLimitReached stops scanning the series when one more series than the limit is found.
+var errLimitReached = errors.New("limit reached")
+
+// streamSeries writes the series as NDJSON while they are scanned from the database, and returns the number of the written series.
+// Only the keys of the written series are kept in memory to deduplicate them.
+func streamSeries(ctx context.Context, w http.ResponseWriter, db *database.LabelDB, opts *queryOptions, q seriesQuery, waitPeer func() ([]map[string]string, []string, error)) (int, error) {
+	fresh, freshWarnings, err := queryFreshMetrics(ctx, opts.fmc, q)
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return 0, err
+	}
+	warnings := append(slices.Clone(q.warnings), freshWarnings...)
+
+	nw := encoding.NewNDJSONWriter(w)
+	count := 0
+	written := make(map[string]struct{})
+	write := func(series map[string]string) error {
+		key := labels.FromMap(series).String()
+		if _, ok := written[key]; ok {
+			return nil
+		}
+		if q.limits.abort > 0 && count >= q.limits.abort {
+			return tooManySeriesError(q.limits.abort)
+		}
+		if q.limits.limit > 0 && count >= q.limits.limit {
+			return errLimitReached
+		}
+		written[key] = struct{}{}
+		if err := nw.Write(series); err != nil {
+			return err
+		}
+		opts.usage.observeSeries([]map[string]string{series})
+		count++
+		return nil
+	}
+	// the results of the cluster nodes are already relabeled
+	writeLocal := func(m *model.Metric) error {
+		for _, series := range relabel.Apply([]map[string]string{m.Labels()}, opts.relabelConfigs) {
+			if err := write(series); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// the lifetimes are not returned, so the fresh metrics and the database are merged as union
+	seen := make(map[string]struct{}, len(fresh))
+	err = func() error {
+		for k, m := range fresh {
+			seen[k] = struct{}{}
+			if err := writeLocal(m); err != nil {
+				return err
+			}
+		}
+		for _, matcher := range q.matchers {
+			if err := db.ScanMetrics(ctx, q.start, q.end, matcher, q.limits.fetch, seen, writeLocal); err != nil {
+				return err
+			}
+		}
+
+		data, peerWarnings, err := waitPeer()
+		if err != nil && q.partial {
+			warnings = append(warnings, "failed to query cluster nodes: "+err.Error())
+		} else if err != nil {
+			return fmt.Errorf("failed to query cluster nodes: %w", err)
+		}
+		warnings = append(warnings, peerWarnings...)
+		for _, series := range data {
+			if err := write(series); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if errors.Is(err, errLimitReached) {
+		warnings = append(warnings, truncatedWarning)
+	} else if err != nil {
+		nw.Abort(err)
+		return count, err
+	}
+	nw.Close(warnings)
+	return count, nil
+}
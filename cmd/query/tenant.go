@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+)
+
+// tenantResolver selects the tenant by the header, which is not bound to the authenticated identity,
+// so the header must be set only by a trusted proxy when the tenants are isolated.
+type tenantResolver struct {
+	tenants       *database.Tenants
+	header        string
+	defaultTenant string
+}
+
+func (t *tenantResolver) tenant(r *http.Request) string {
+	if t.header != "" {
+		if h := r.Header.Get(t.header); h != "" {
+			return h
+		}
+	}
+	return t.defaultTenant
+}
+
+func (t *tenantResolver) resolve(r *http.Request) (*database.LabelDB, error) {
+	tenant := t.tenant(r)
+	if err := database.ValidateTenant(tenant); err != nil {
+		return nil, err
+	}
+	return t.tenants.Get(tenant)
+}
+
+func (t *tenantResolver) handler(f func(http.ResponseWriter, *http.Request, *database.LabelDB)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db, err := t.resolve(r)
+		if err != nil {
+			http.Error(w, "failed to resolve tenant: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		f(w, r, db)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// otherNamespace is the label value of the queries for the namespaces never returned, so that the clients can not create arbitrary label values.
+const otherNamespace = "other"
+
+// namespaceUsage accounts the series queries to the namespaces for chargeback, and to see which namespaces drive the load.
+// The selectors without the Namespace equality matcher are accounted to the empty namespace.
+// Only the namespaces of the returned series are known, since they are recorded in the database or found in CloudWatch.
+type namespaceUsage struct {
+	queries        *prometheus.CounterVec
+	seriesReturned *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	seriesPerQuery *prometheus.HistogramVec
+	truncated      *prometheus.CounterVec
+	seriesBySource *prometheus.CounterVec
+
+	mu    sync.RWMutex
+	known map[string]struct{}
+}
+
+func newNamespaceUsage(registry prometheus.Registerer) *namespaceUsage {
+	return &namespaceUsage{
+		queries: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_namespace_queries_total",
+			Help: "Total number of series queries by the namespace of the selectors",
+		}, []string{"namespace"}),
+		seriesReturned: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_namespace_series_returned_total",
+			Help: "Total number of series returned by the namespace of the series",
+		}, []string{"namespace"}),
+		duration: promauto.With(registry).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "query_namespace_query_duration_seconds",
+			Help:    "A histogram of the durations of the series queries by the namespace of the selectors",
+			Buckets: prometheus.ExponentialBuckets(0.0625, 2, 10),
+		}, []string{"namespace"}),
+		seriesPerQuery: promauto.With(registry).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "query_namespace_series_returned",
+			Help:    "A histogram of the series returned by each query by the namespace of the selectors",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		}, []string{"namespace"}),
+		truncated: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_namespace_truncated_queries_total",
+			Help: "Total number of series queries truncated by the limit by the namespace of the selectors",
+		}, []string{"namespace"}),
+		seriesBySource: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_namespace_source_series_total",
+			Help: "Total number of series found in CloudWatch (fresh) or the database (db) by the namespace of the series",
+		}, []string{"namespace", "source"}),
+		known: make(map[string]struct{}),
+	}
+}
+
+// queryOutcome is the result of a query accounted to the namespaces of the selectors.
+type queryOutcome struct {
+	duration time.Duration
+	// the returned series, the streamed series are not known
+	data      []map[string]string
+	truncated bool
+}
+
+// observeQuery should be called after observeSeries of the query, so that the first query of a namespace is accounted to it.
+// The series returned for the empty namespace are all the returned series.
+func (u *namespaceUsage) observeQuery(matchers [][]*labels.Matcher, outcome queryOutcome) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	seen := make(map[string]struct{})
+	for _, m := range matchers {
+		namespace := selectorNamespace(m)
+		if _, ok := u.known[namespace]; !ok && namespace != "" {
+			namespace = otherNamespace
+		}
+		if _, ok := seen[namespace]; ok {
+			continue
+		}
+		seen[namespace] = struct{}{}
+		u.queries.WithLabelValues(namespace).Inc()
+		u.duration.WithLabelValues(namespace).Observe(outcome.duration.Seconds())
+		if outcome.truncated {
+			u.truncated.WithLabelValues(namespace).Inc()
+		}
+		if outcome.data != nil {
+			returned := 0
+			for _, series := range outcome.data {
+				if namespace == "" || series["Namespace"] == namespace {
+					returned++
+				}
+			}
+			u.seriesPerQuery.WithLabelValues(namespace).Observe(float64(returned))
+		}
+	}
+}
+
+// observeSources counts the series found in each source before they are merged.
+func (u *namespaceUsage) observeSources(fresh, db map[string]*model.Metric) {
+	for source, metrics := range map[string]map[string]*model.Metric{"fresh": fresh, "db": db} {
+		counts := make(map[string]int)
+		for _, m := range metrics {
+			counts[m.Namespace]++
+		}
+		for namespace, n := range counts {
+			u.seriesBySource.WithLabelValues(namespace, source).Add(float64(n))
+		}
+	}
+}
+
+func (u *namespaceUsage) observeSeries(data []map[string]string) {
+	counts := make(map[string]int)
+	for _, m := range data {
+		counts[m["Namespace"]]++
+	}
+	u.mu.Lock()
+	for namespace := range counts {
+		u.known[namespace] = struct{}{}
+	}
+	u.mu.Unlock()
+	for namespace, n := range counts {
+		u.seriesReturned.WithLabelValues(namespace).Add(float64(n))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestNamespaceUsage(t *testing.T) {
+	usage := newNamespaceUsage(prometheus.NewRegistry())
+	observe := func(selectors []string, data []map[string]string) {
+		t.Helper()
+		matchers, err := parser.ParseMetricSelectors(selectors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usage.observeSeries(data)
+		usage.observeQuery(matchers, queryOutcome{duration: time.Second, data: data, truncated: len(data) > 1})
+	}
+
+	observe([]string{`{Namespace="AWS/EC2"}`, `{Namespace="AWS/EC2",InstanceId="i-1"}`}, []map[string]string{
+		{"Namespace": "AWS/EC2", "InstanceId": "i-1"},
+		{"Namespace": "AWS/EC2", "InstanceId": "i-2"},
+	})
+	// the unknown namespaces are accounted to the fixed label value
+	observe([]string{`{Namespace="random-1"}`}, nil)
+	observe([]string{`{Namespace="random-2"}`}, nil)
+	// without the namespace
+	observe([]string{`{InstanceId="i-1"}`}, []map[string]string{{"Namespace": "AWS/EC2", "InstanceId": "i-1"}})
+	// known by the series returned before
+	observe([]string{`{Namespace="AWS/EC2"}`}, nil)
+
+	tests := []struct {
+		namespace string
+		queries   float64
+	}{
+		{"AWS/EC2", 2},
+		{otherNamespace, 2},
+		{"", 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(usage.queries.WithLabelValues(tt.namespace)); got != tt.queries {
+			t.Fatalf("unexpected queries of %q: %v", tt.namespace, got)
+		}
+	}
+	if got := testutil.CollectAndCount(usage.queries); got != 3 {
+		t.Fatalf("unexpected label values: %d", got)
+	}
+	if got := testutil.ToFloat64(usage.seriesReturned.WithLabelValues("AWS/EC2")); got != 3 {
+		t.Fatalf("unexpected series returned: %v", got)
+	}
+	if got := testutil.CollectAndCount(usage.duration); got != 3 {
+		t.Fatalf("unexpected label values of the durations: %d", got)
+	}
+	// the queries of the other namespaces have no data same as the streams
+	if got := testutil.CollectAndCount(usage.seriesPerQuery); got != 2 {
+		t.Fatalf("unexpected label values of the series per query: %d", got)
+	}
+	if got := testutil.ToFloat64(usage.truncated.WithLabelValues("AWS/EC2")); got != 1 {
+		t.Fatalf("unexpected truncated queries: %v", got)
+	}
+	if got := testutil.ToFloat64(usage.truncated.WithLabelValues("")); got != 0 {
+		t.Fatalf("unexpected truncated queries without the namespace: %v", got)
+	}
+
+	usage.observeSources(map[string]*model.Metric{
+		"a": {Namespace: "AWS/EC2"},
+	}, map[string]*model.Metric{
+		"a": {Namespace: "AWS/EC2"},
+		"b": {Namespace: "AWS/ELB"},
+	})
+	for _, tt := range []struct {
+		namespace, source string
+		series            float64
+	}{
+		{"AWS/EC2", "fresh", 1},
+		{"AWS/EC2", "db", 1},
+		{"AWS/ELB", "db", 1},
+		{"AWS/ELB", "fresh", 0},
+	} {
+		if got := testutil.ToFloat64(usage.seriesBySource.WithLabelValues(tt.namespace, tt.source)); got != tt.series {
+			t.Fatalf("unexpected series of %s from %s: %v", tt.namespace, tt.source, got)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// backuper takes the snapshots of the tenants into the timestamped directories under dir.
+type backuper struct {
+	dir      string
+	recorder *Recorder
+	mu       sync.Mutex
+}
+
+// backup writes the snapshot to <dir>/<timestamp>/ with the same layout as the database directory, and returns the snapshot directory and the backed up files of the tenants.
+func (b *backuper) backup(ctx context.Context) (string, map[string][]string, error) {
+	snapshotDir := filepath.Join(b.dir, time.Now().UTC().Format("20060102T150405Z"))
+	files := make(map[string][]string)
+	for tenant, tr := range b.recorder.tenants {
+		backedUp, err := tr.ldb.Backup(ctx, filepath.Join(snapshotDir, tenant))
+		if err != nil {
+			return snapshotDir, files, err
+		}
+		files[tenant] = backedUp
+	}
+	return snapshotDir, files, nil
+}
+
+// handler serves /admin/backup, only a backup runs at a time.
+func (b *backuper) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !b.mu.TryLock() {
+		http.Error(w, "backup is already running", http.StatusConflict)
+		return
+	}
+	defer b.mu.Unlock()
+
+	start := time.Now()
+	dir, files, err := b.backup(r.Context())
+	if err != nil {
+		slog.Error("failed to back up", "error", err, "dir", dir)
+		http.Error(w, "failed to back up: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("backup completed", "dir", dir, "duration", time.Since(start))
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"dir":   dir,
+			"files": files,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
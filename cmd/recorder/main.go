@@ -2,59 +2,66 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/mtanda/prometheus-labels-db/internal/audit"
+	"github.com/mtanda/prometheus-labels-db/internal/cloudwatchmock"
 	"github.com/mtanda/prometheus-labels-db/internal/database"
 	"github.com/mtanda/prometheus-labels-db/internal/importer"
 	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/objstore"
+	"github.com/mtanda/prometheus-labels-db/internal/replication"
+	"github.com/mtanda/prometheus-labels-db/internal/systemd"
+	"github.com/mtanda/prometheus-labels-db/internal/web"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	commonmodel "github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/tsdb"
 )
 
-func openDB(dbDir string) (*database.LabelDB, error) {
-	if stat, err := os.Stat(dbDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dbDir, 0o777); err != nil {
-			return nil, fmt.Errorf("failed to create directory: %v", err)
-		}
-	} else if !stat.IsDir() {
-		return nil, fmt.Errorf("path exists but is not a directory: %s", dbDir)
-	}
-
-	ldb, err := database.Open(dbDir)
+func setupRecorder(dbDir string, cfg *model.Config, layout database.PartitionLayout, defaultRetention time.Duration, maintenanceHour int, searchIndex bool, cloudwatchFixture string, replicationURL string, replicationInterval time.Duration, reg *prometheus.Registry) (*Recorder, error) {
+	recorder, err := newRecorder(dbDir, layout, cfg.Redaction, reg)
 	if err != nil {
 		return nil, err
 	}
-	return ldb, nil
-}
-
-func setupRecorder(dbDir string, configFile string, reg *prometheus.Registry) (*Recorder, error) {
-	ldb, err := openDB(dbDir)
-	if err != nil {
-		return nil, err
+	recorder.enableMaintenance(maintenanceHour)
+	if searchIndex {
+		recorder.enableSearchIndex()
 	}
-
-	recorder, err := newRecorder(ldb, reg)
-	if err != nil {
-		return nil, err
+	if cloudwatchFixture != "" {
+		fixture, err := cloudwatchmock.LoadFixture(cloudwatchFixture)
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("using the mock CloudWatch", "fixture", cloudwatchFixture)
+		recorder.useMockCloudWatch(fixture)
 	}
-
-	cfg, err := model.LoadConfig(configFile)
-	if err != nil {
-		return nil, err
+	if replicationURL != "" {
+		bucket, err := objstore.New(context.Background(), replicationURL)
+		if err != nil {
+			return nil, err
+		}
+		recorder.enableReplication(bucket, replicationInterval)
 	}
 
 	for _, target := range cfg.Targets {
-		err := recorder.addTarget(target)
+		retention := cfg.Retention(target.Tenant)
+		if retention == 0 {
+			retention = defaultRetention
+		}
+		err := recorder.addTarget(target, retention, cfg.StaleSeries(target.Tenant))
 		if err != nil {
 			return nil, err
 		}
@@ -96,13 +103,177 @@ func importOldData(dbDir string, importDB string, importSandbox string, logger *
 	return nil
 }
 
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	var dbDir string
+	fs.StringVar(&dbDir, "db.dir", "./data/", "Path to the database directory")
+	var replicationURL string
+	fs.StringVar(&replicationURL, "replication.url", "", "Object storage URL of the replica, e.g. s3://bucket/prefix")
+	var backupDir string
+	fs.StringVar(&backupDir, "backup.dir", "", "Directory of the backup taken by /admin/backup, e.g. /backup/labels-db/20250101T030000Z")
+	var tenant string
+	fs.StringVar(&tenant, "tenant", "", "Tenant to restore")
+	var force bool
+	fs.BoolVar(&force, "force", false, "Overwrite existing partitions, even if they are newer than the backup")
+	fs.Parse(args)
+
+	if (replicationURL == "") == (backupDir == "") {
+		return fmt.Errorf("either --replication.url or --backup.dir is required")
+	}
+	if err := database.ValidateTenant(tenant); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if backupDir != "" {
+		// the running recorder would keep the replaced partitions open
+		lock, err := database.AcquireLock(ctx, dbDir, false)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		restored, err := database.RestoreBackup(ctx, filepath.Join(backupDir, tenant), filepath.Join(dbDir, tenant), force)
+		if err != nil {
+			return err
+		}
+		slog.Info("restore completed", "files", restored)
+		return nil
+	}
+	bucket, err := objstore.New(ctx, replicationURL)
+	if err != nil {
+		return err
+	}
+	restored, err := replication.Restore(ctx, bucket, tenantPrefix(tenant), filepath.Join(dbDir, tenant), force)
+	if err != nil {
+		return err
+	}
+	slog.Info("restore completed", "partitions", restored)
+	return nil
+}
+
+func purgeNamespace(args []string) error {
+	fs := flag.NewFlagSet("purge-namespace", flag.ExitOnError)
+	var dbDir string
+	fs.StringVar(&dbDir, "db.dir", "./data/", "Path to the database directory")
+	var tenant string
+	fs.StringVar(&tenant, "tenant", "", "Tenant to purge the namespace from")
+	var namespace string
+	fs.StringVar(&namespace, "namespace", "", "Namespace to purge")
+	var dryRun bool
+	fs.BoolVar(&dryRun, "dry-run", false, "Only count the series to be purged")
+	var auditLogPath string
+	fs.StringVar(&auditLogPath, "audit.log-path", "", "Path to the audit log (audit.log in --db.dir if empty)")
+	var auditLogType string
+	fs.StringVar(&auditLogType, "audit.log-type", "file", "Type of the audit log (file or sqlite)")
+	fs.Parse(args)
+
+	if namespace == "" {
+		return fmt.Errorf("--namespace is required")
+	}
+	if err := database.ValidateTenant(tenant); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	// the running recorder would write the namespace again
+	lock, err := database.AcquireLock(ctx, dbDir, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	ldb, err := database.Open(filepath.Join(dbDir, tenant))
+	if err != nil {
+		return err
+	}
+	defer ldb.Close()
+	purged, err := ldb.PurgeNamespace(ctx, namespace, dryRun)
+	total := 0
+	for _, count := range purged {
+		total += count
+	}
+	if dryRun {
+		if err == nil {
+			slog.Info("dry run completed", "namespace", namespace, "series", total, "partitions", purged)
+		}
+		return err
+	}
+
+	if auditLogPath == "" {
+		auditLogPath = filepath.Join(dbDir, "audit.log")
+	}
+	auditLogger, auditErr := audit.New(auditLogType, auditLogPath)
+	if auditErr == nil {
+		auditErr = auditLogger.Log(ctx, audit.Entry{
+			Timestamp:   time.Now().UTC(),
+			User:        os.Getenv("USER"),
+			Handler:     "purge-namespace",
+			Matchers:    []string{fmt.Sprintf("{Namespace=%q}", namespace)},
+			SeriesCount: total,
+			Success:     err == nil,
+		})
+		auditErr = errors.Join(auditErr, auditLogger.Close())
+	}
+	if auditErr != nil {
+		// ignore error
+		slog.Error("failed to write audit log", "error", auditErr, "path", auditLogPath)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("purge completed", "namespace", namespace, "tenant", tenant, "series", total, "partitions", purged)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+		if err := restore(os.Args[2:]); err != nil {
+			slog.Error("failed to restore", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "purge-namespace" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+		if err := purgeNamespace(os.Args[2:]); err != nil {
+			slog.Error("failed to purge namespace", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var dbDir string
 	flag.StringVar(&dbDir, "db.dir", "./data/", "Path to the database directory")
 	var configFile string
 	flag.StringVar(&configFile, "config.file", "config.yaml", "Path to the config file")
 	var listenAddress string
-	flag.StringVar(&listenAddress, "web.listen-address", "0.0.0.0:8081", "Address to listen")
+	flag.StringVar(&listenAddress, "web.listen-address", "0.0.0.0:8081", "Address to listen, or unix:///path/to/socket to listen on the unix domain socket")
+	webConfig := web.DefaultConfig()
+	// the partition snapshots for the followers can take long to send
+	webConfig.WriteTimeout = 0
+	webConfig.RegisterFlags(flag.CommandLine)
+	var partitionMonths int
+	flag.IntVar(&partitionMonths, "db.partition-months", 0, "Number of calendar months in a partition, partitions of 84 days are used if 0 (can't be changed after the partitions are created)")
+	var partitionEpoch string
+	flag.StringVar(&partitionEpoch, "db.partition-epoch", "", "Date to align the partitions to, e.g. 2025-01-06 for ISO weeks (can't be changed after the partitions are created)")
+	// CloudWatch keeps the metrics for 15 months
+	defaultRetention := commonmodel.Duration(455 * 24 * time.Hour)
+	flag.Var(&defaultRetention, "db.retention", "Retention period of the partitions of the tenants without the retention in the config, e.g. 455d (disabled if 0)")
+	var maintenanceHour int
+	flag.IntVar(&maintenanceHour, "db.maintenance-hour", 3, "Hour of the local time to run PRAGMA optimize and the incremental vacuum on the partitions not written for a day (disabled if -1)")
+	var searchIndex bool
+	flag.BoolVar(&searchIndex, "db.search-index", false, "Index the dimension values with FTS5 for the substring search (requires the build with -tags sqlite_fts5)")
+	var replicationURL string
+	flag.StringVar(&replicationURL, "replication.url", "", "Object storage URL to replicate the database to, e.g. s3://bucket/prefix (disabled if empty)")
+	var replicationInterval time.Duration
+	flag.DurationVar(&replicationInterval, "replication.interval", 10*time.Second, "Interval of shipping WAL to the replica")
+	var enableReplicationAPI bool
+	flag.BoolVar(&enableReplicationAPI, "web.enable-replication-api", false, "Serve the partitions to the query servers in follower mode, with the authentication of --web.config.file")
+	var backupDir string
+	flag.StringVar(&backupDir, "backup.dir", "", "Directory to write the snapshots of the database to on POST /admin/backup (disabled if empty)")
+	var standby bool
+	flag.BoolVar(&standby, "standby", false, "Wait until the recorder holding the lock of the database directory dies, and take over")
+	var cloudwatchFixture string
+	flag.StringVar(&cloudwatchFixture, "dev.cloudwatch-fixture", "", "Path to the fixture of the mock CloudWatch used instead of AWS for local development (disabled if empty)")
 	var oneshot bool
 	flag.BoolVar(&oneshot, "oneshot", false, "Run in oneshot mode")
 	// importer
@@ -119,25 +290,101 @@ func main() {
 	slog.SetDefault(logger)
 
 	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	// the recorder is ready after loading the config and starting the scrapers
+	var started atomic.Bool
+	web.HandleHealth(http.DefaultServeMux, func() error {
+		if !started.Load() {
+			return errors.New("recorder is not started")
+		}
+		return web.CheckDir(dbDir)
+	})
+	if enableReplicationAPI {
+		http.Handle("/api/v1/replication/", replication.Handler(dbDir))
+	}
+	slog.Info("Starting server", "address", listenAddress)
+	server, err := web.NewServer(listenAddress, nil, webConfig, reg)
+	if err != nil {
+		slog.Error("failed to setup server", "error", err)
+		os.Exit(1)
+	}
+	l, err := server.Listen()
+	if err != nil {
+		slog.Error("failed to listen", "error", err)
+		os.Exit(1)
+	}
 	go func() {
-		reg.MustRegister(
-			collectors.NewGoCollector(),
-			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
-		)
-		http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
-		slog.Info("Starting server", "address", listenAddress)
-		err := http.ListenAndServe(listenAddress, nil)
+		err := server.Serve(l)
 		if err != nil {
 			slog.Error("failed to start server", "error", err)
 			os.Exit(1)
 		}
 	}()
 
-	recorder, err := setupRecorder(dbDir, configFile, reg)
+	// load the config before waiting for the lock to detect errors early
+	cfg, err := model.LoadConfig(configFile)
+	if err != nil {
+		slog.Error("failed to load config", "error", err, "configFile", configFile)
+		os.Exit(1)
+	}
+	layout := database.PartitionLayout{Months: partitionMonths}
+	if partitionEpoch != "" {
+		layout.Epoch, err = time.ParseInLocation("2006-01-02", partitionEpoch, time.UTC)
+		if err != nil {
+			slog.Error("failed to parse partition epoch", "error", err, "epoch", partitionEpoch)
+			os.Exit(1)
+		}
+	}
+	if err := layout.Validate(); err != nil {
+		slog.Error("invalid partition layout", "error", err)
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(dbDir, 0o777); err != nil {
+		slog.Error("failed to create database directory", "error", err, "dbDir", dbDir)
+		os.Exit(1)
+	}
+	standbyGauge := promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "recorder_standby",
+		Help: "Whether the recorder is waiting for the lock of the database directory",
+	})
+	go systemd.RunWatchdog(context.Background())
+	if standby {
+		slog.Info("waiting for the lock of the database directory", "dbDir", dbDir)
+		standbyGauge.Set(1)
+		// the standby is ready to take over
+		systemd.Ready()
+	}
+	lockCtx, stopLock := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	lock, err := database.AcquireLock(lockCtx, dbDir, standby)
+	stopLock()
+	if errors.Is(err, context.Canceled) {
+		slog.Info("received signal while waiting for the lock")
+		return
+	} else if err != nil {
+		slog.Error("failed to lock database directory", "error", err, "dbDir", dbDir)
+		os.Exit(1)
+	}
+	defer lock.Release()
+	if standby {
+		slog.Info("acquired the lock of the database directory, taking over", "dbDir", dbDir)
+		standbyGauge.Set(0)
+	}
+
+	recorder, err := setupRecorder(dbDir, cfg, layout, time.Duration(defaultRetention), maintenanceHour, searchIndex, cloudwatchFixture, replicationURL, replicationInterval, reg)
 	if err != nil {
 		slog.Error("failed to setup recorder", "error", err)
 		os.Exit(1)
 	}
+	if backupDir != "" {
+		// registered after the tenants are opened
+		b := &backuper{dir: backupDir, recorder: recorder}
+		http.HandleFunc("/admin/backup", b.handler)
+	}
+	systemd.Ready()
 
 	if oneshot {
 		recordLastSuccess := promauto.With(reg).NewGauge(prometheus.GaugeOpts{
@@ -161,9 +408,11 @@ func main() {
 		time.Sleep(60 * time.Second) // wait for 60 seconds to scrape metrics
 	} else {
 		recorder.run()
+		started.Store(true)
 
 		<-sig
 		slog.Info("received signal, stopping the recorder...")
+		systemd.Stopping()
 		recorder.stop()
 		slog.Info("recorder stopped successfully")
 	}
@@ -3,50 +3,152 @@ package main
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/mtanda/prometheus-labels-db/internal/cloudwatchmock"
 	"github.com/mtanda/prometheus-labels-db/internal/database"
 	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/objstore"
 	"github.com/mtanda/prometheus-labels-db/internal/recorder"
+	"github.com/mtanda/prometheus-labels-db/internal/replication"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/time/rate"
 )
 
+type tenantRecorder struct {
+	metricsCh      chan model.Metric
+	activeSeriesCh chan model.ActiveSeries
+	registry       prometheus.Registerer
+	ldb            *database.LabelDB
+	recorder       *recorder.Recorder
+}
+
 type Recorder struct {
-	metricsCh chan model.Metric
-	limiter   *rate.Limiter
-	registry  *prometheus.Registry
-	ldb       *database.LabelDB
-	scraper   []*recorder.CloudWatchScraper
-	recorder  *recorder.Recorder
+	dbDir               string
+	limiter             *rate.Limiter
+	registry            *prometheus.Registry
+	tenants             map[string]*tenantRecorder
+	scraper             []*recorder.CloudWatchScraper
+	replicationBucket   objstore.Bucket
+	replicationInterval time.Duration
+	maintenanceHour     int
+	searchIndex         bool
+	layout              database.PartitionLayout
+	redactionRules      []model.RedactionRule
+	cloudwatchFixture   *cloudwatchmock.Fixture
 }
 
-func newRecorder(ldb *database.LabelDB, registry *prometheus.Registry) (*Recorder, error) {
-	metricsCh := make(chan model.Metric, 1000)
+func newRecorder(dbDir string, layout database.PartitionLayout, redactionRules []model.RedactionRule, registry *prometheus.Registry) (*Recorder, error) {
 	ListMetricsDefaultMaxTPS := 25
 	limiter := rate.NewLimiter(rate.Limit(ListMetricsDefaultMaxTPS/2), 1)
 
-	recorder := recorder.New(ldb, metricsCh, registry)
-	recorder.Run()
-
 	return &Recorder{
-		metricsCh: metricsCh,
-		limiter:   limiter,
-		registry:  registry,
-		ldb:       ldb,
-		recorder:  recorder,
+		dbDir:           dbDir,
+		limiter:         limiter,
+		registry:        registry,
+		tenants:         make(map[string]*tenantRecorder),
+		layout:          layout,
+		redactionRules:  redactionRules,
+		maintenanceHour: -1,
 	}, nil
 }
 
-func (r *Recorder) addTarget(target model.Target) error {
-	awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(target.Region))
+// useMockCloudWatch scrapes the fixture instead of CloudWatch for local development.
+func (r *Recorder) useMockCloudWatch(fixture *cloudwatchmock.Fixture) {
+	r.cloudwatchFixture = fixture
+}
+
+// enableMaintenance optimizes the partitions of the tenants added after this call at the hour every day.
+func (r *Recorder) enableMaintenance(hour int) {
+	r.maintenanceHour = hour
+}
+
+// enableSearchIndex indexes the dimension values of the tenants added after this call for the substring search.
+func (r *Recorder) enableSearchIndex() {
+	r.searchIndex = true
+}
+
+// enableReplication replicates the partitions of the tenants added after this call.
+func (r *Recorder) enableReplication(bucket objstore.Bucket, interval time.Duration) {
+	r.replicationBucket = bucket
+	r.replicationInterval = interval
+}
+
+func (r *Recorder) getTenant(tenant string, retention time.Duration, staleSeries []model.StaleSeriesRule) (*tenantRecorder, error) {
+	if tr, ok := r.tenants[tenant]; ok {
+		return tr, nil
+	}
+
+	ldb, err := database.OpenTenant(r.dbDir, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if err := ldb.SetPartitionLayout(context.Background(), r.layout); err != nil {
+		return nil, err
+	}
+	if r.searchIndex {
+		if err := ldb.EnableSearchIndex(); err != nil {
+			return nil, err
+		}
+	}
+	metricsCh := make(chan model.Metric, 1000)
+	activeSeriesCh := make(chan model.ActiveSeries, 100)
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenant}, r.registry)
+	if err := reg.Register(database.NewPartitionCollector(ldb.Dir())); err != nil {
+		return nil, err
+	}
+
+	redactor, err := recorder.NewRedactor(r.redactionRules, reg)
+	if err != nil {
+		return nil, err
+	}
+	recorder := recorder.New(ldb, metricsCh, activeSeriesCh, reg)
+	recorder.SetRetention(retention)
+	recorder.SetStaleSeries(staleSeries)
+	recorder.SetRedactor(redactor)
+	recorder.SetMaintenanceHour(r.maintenanceHour)
+	if r.replicationBucket != nil {
+		replicator, err := replication.New(ldb.Dir(), r.replicationBucket, tenantPrefix(tenant))
+		if err != nil {
+			return nil, err
+		}
+		if err := recorder.SetReplicator(replicator, r.replicationInterval); err != nil {
+			return nil, err
+		}
+	}
+	recorder.Run()
+
+	tr := &tenantRecorder{
+		metricsCh:      metricsCh,
+		activeSeriesCh: activeSeriesCh,
+		registry:       reg,
+		ldb:            ldb,
+		recorder:       recorder,
+	}
+	r.tenants[tenant] = tr
+	return tr, nil
+}
+
+func (r *Recorder) addTarget(target model.Target, retention time.Duration, staleSeries []model.StaleSeriesRule) error {
+	tr, err := r.getTenant(target.Tenant, retention, staleSeries)
 	if err != nil {
 		return err
 	}
-	client := cloudwatch.NewFromConfig(awsCfg)
 
-	scraper := recorder.NewCloudWatchScraper(client, target.Region, target.Namespace, r.metricsCh, r.limiter, r.registry)
+	var client recorder.CloudWatchAPI
+	if r.cloudwatchFixture != nil {
+		client = cloudwatchmock.NewClient(r.cloudwatchFixture, target.Region)
+	} else {
+		awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(target.Region))
+		if err != nil {
+			return err
+		}
+		client = cloudwatch.NewFromConfig(awsCfg)
+	}
+
+	scraper := recorder.NewCloudWatchScraper(client, target.Region, target.Namespace, tr.metricsCh, tr.activeSeriesCh, r.limiter, tr.registry)
 	r.scraper = append(r.scraper, scraper)
 
 	return nil
@@ -70,7 +172,18 @@ func (r *Recorder) stop() {
 	for _, s := range r.scraper {
 		s.Stop()
 	}
-	close(r.metricsCh)
-	r.recorder.Stop()
-	r.ldb.Close()
+	for _, tr := range r.tenants {
+		close(tr.activeSeriesCh)
+		close(tr.metricsCh)
+		tr.recorder.Stop()
+		tr.ldb.Close()
+	}
+}
+
+// tenantPrefix returns the object storage prefix of the tenant.
+func tenantPrefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return tenant + "/"
 }
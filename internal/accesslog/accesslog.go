@@ -0,0 +1,78 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"flag"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Config is the file of the access log and its rotation.
+type Config struct {
+	Path       string
+	MaxSizeMB  int
+	MaxBackups int
+}
+
+// RegisterFlags registers the access-log.* flags to fs.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Path, "access-log.path", "", "Path to the access log of the queries (disabled if empty)")
+	fs.IntVar(&c.MaxSizeMB, "access-log.max-size-mb", 100, "Size in megabytes at which the access log is rotated")
+	fs.IntVar(&c.MaxBackups, "access-log.max-backups", 5, "Number of the rotated access logs kept")
+}
+
+type Entry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Matchers    []string  `json:"matchers"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	SeriesCount int       `json:"series_count"`
+	DurationMs  float64   `json:"duration_ms"`
+	Success     bool      `json:"success"`
+}
+
+// Logger writes the entries as JSON lines, and rotates the file by its size.
+// The nil Logger discards the entries.
+type Logger struct {
+	w *lumberjack.Logger
+}
+
+// New returns the Logger of cfg, or nil if the path is not configured.
+func New(cfg Config) (*Logger, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	w := &lumberjack.Logger{
+		Filename:   cfg.Path,
+		MaxSize:    cfg.MaxSizeMB,
+		MaxBackups: cfg.MaxBackups,
+	}
+	// fail on startup if the file can't be written
+	if _, err := w.Write(nil); err != nil {
+		return nil, err
+	}
+	return &Logger{w: w}, nil
+}
+
+func (l *Logger) Log(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// a line is written at once, lumberjack serializes the writes
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.w.Close()
+}
@@ -0,0 +1,82 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	l, err := New(Config{Path: path, MaxSizeMB: 1, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	e := Entry{
+		Timestamp:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		Method:      "GET",
+		Path:        "/api/v1/series",
+		Matchers:    []string{`{Namespace="AWS/EC2",InstanceId=~"` + strings.Repeat("i-0", 300) + `"}`},
+		SeriesCount: 3,
+		DurationMs:  1.5,
+		Success:     true,
+	}
+	if err := l.Log(e); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	if !scanner.Scan() {
+		t.Fatal("no entry written")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if got.Method != e.Method || got.SeriesCount != e.SeriesCount || got.Matchers[0] != e.Matchers[0] {
+		t.Fatalf("unexpected entry: %+v", got)
+	}
+
+	// rotated beyond 1MB, and the older backups are removed
+	for i := 0; i < 3000; i++ {
+		if err := l.Log(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, err := filepath.Glob(filepath.Join(dir, "access-*.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the backups are removed in background
+		if len(files) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected backups: %v", files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// disabled without the path
+	l, err = New(Config{})
+	if err != nil || l != nil {
+		t.Fatalf("unexpected logger: %v %v", l, err)
+	}
+	if err := l.Log(e); err != nil {
+		t.Fatal(err)
+	}
+}
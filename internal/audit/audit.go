@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/sqlite"
+)
+
+type Entry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	User        string    `json:"user"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Handler     string    `json:"handler"`
+	Matchers    []string  `json:"matchers"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	SeriesCount int       `json:"series_count"`
+	Success     bool      `json:"success"`
+}
+
+type Logger interface {
+	Log(ctx context.Context, e Entry) error
+	Close() error
+}
+
+// New returns an audit logger for the given type ("file" or "sqlite").
+func New(logType string, path string) (Logger, error) {
+	switch logType {
+	case "file":
+		return NewFileLogger(path)
+	case "sqlite":
+		return NewSQLiteLogger(path)
+	default:
+		return nil, fmt.Errorf("unknown audit log type: %s", logType)
+	}
+}
+
+type FileLogger struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileLogger(path string) (*FileLogger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLogger{f: f}, nil
+}
+
+func (l *FileLogger) Log(ctx context.Context, e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(b)
+	return err
+}
+
+func (l *FileLogger) Close() error {
+	return l.f.Close()
+}
+
+type SQLiteLogger struct {
+	db *sql.DB
+}
+
+func NewSQLiteLogger(path string) (*SQLiteLogger, error) {
+	db, err := sql.Open(sqlite.DriverName, sqlite.DSN(path, sqlite.Options{WAL: true, BusyTimeout: 10 * time.Second}))
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp INT NOT NULL,
+			user TEXT NOT NULL,
+			remote_addr TEXT NOT NULL,
+			handler TEXT NOT NULL,
+			matchers JSON NOT NULL,
+			start_timestamp INT NOT NULL,
+			end_timestamp INT NOT NULL,
+			series_count INT NOT NULL,
+			success INT NOT NULL
+		);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteLogger{db: db}, nil
+}
+
+func (l *SQLiteLogger) Log(ctx context.Context, e Entry) error {
+	matchers, err := json.Marshal(e.Matchers)
+	if err != nil {
+		return err
+	}
+	_, err = l.db.ExecContext(ctx, `
+		INSERT INTO audit_log (
+			timestamp,
+			user,
+			remote_addr,
+			handler,
+			matchers,
+			start_timestamp,
+			end_timestamp,
+			series_count,
+			success
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+		`,
+		e.Timestamp.Unix(),
+		e.User,
+		e.RemoteAddr,
+		e.Handler,
+		matchers,
+		e.Start.Unix(),
+		e.End.Unix(),
+		e.SeriesCount,
+		e.Success,
+	)
+	return err
+}
+
+func (l *SQLiteLogger) Close() error {
+	return l.db.Close()
+}
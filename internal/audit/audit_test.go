@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEntry() Entry {
+	return Entry{
+		Timestamp:   time.Unix(1735689600, 0).UTC(),
+		User:        "test_user",
+		RemoteAddr:  "127.0.0.1:12345",
+		Handler:     "/api/v1/series",
+		Matchers:    []string{`test_name{Namespace="test_namespace"}`},
+		Start:       time.Unix(1735603200, 0).UTC(),
+		End:         time.Unix(1735689600, 0).UTC(),
+		SeriesCount: 3,
+		Success:     true,
+	}
+}
+
+func TestFileLogger(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := New("file", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.Log(ctx, testEntry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.User != "test_user" || e.SeriesCount != 3 || len(e.Matchers) != 1 {
+			t.Fatalf("unexpected entry: %+v", e)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("unexpected number of entries: %d", lines)
+	}
+}
+
+func TestSQLiteLogger(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.db")
+	l, err := NewSQLiteLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Log(ctx, testEntry()); err != nil {
+		t.Fatal(err)
+	}
+
+	var user string
+	var count int
+	err = l.db.QueryRowContext(ctx, "SELECT user, series_count FROM audit_log").Scan(&user, &count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "test_user" || count != 3 {
+		t.Fatalf("unexpected row: user=%s, count=%d", user, count)
+	}
+}
+
+func TestUnknownLogger(t *testing.T) {
+	if _, err := New("unknown", ""); err == nil {
+		t.Fatal("expected error for unknown audit log type")
+	}
+}
@@ -0,0 +1,248 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	commonmodel "github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var regions = []string{"us-east-1", "us-west-2", "eu-west-1", "ap-northeast-1"}
+
+// PopulateConfig controls the synthetic series written to the database.
+type PopulateConfig struct {
+	Series        int
+	Namespaces    int
+	MetricNames   int
+	Partitions    int
+	LatestPartEnd time.Time
+}
+
+func namespaceName(i int) string {
+	return fmt.Sprintf("Bench/NS%d", i)
+}
+
+func metricName(i int) string {
+	return fmt.Sprintf("Metric%d", i)
+}
+
+// Populate writes synthetic series spread over the partitions ending at cfg.LatestPartEnd.
+func Populate(ctx context.Context, ldb *database.LabelDB, cfg PopulateConfig) error {
+	if cfg.Namespaces <= 0 || cfg.MetricNames <= 0 || cfg.Partitions <= 0 {
+		return errors.New("namespaces, metric names and partitions must be positive")
+	}
+	start := time.Now()
+	for i := 0; i < cfg.Series; i++ {
+		// the same series appears in consecutive partitions like real metrics
+		p := i % cfg.Partitions
+		to := cfg.LatestPartEnd.Add(-time.Duration(p) * database.PartitionInterval)
+		err := ldb.RecordMetric(ctx, model.Metric{
+			Namespace:  namespaceName(i % cfg.Namespaces),
+			MetricName: metricName((i / cfg.Namespaces) % cfg.MetricNames),
+			Region:     regions[i%len(regions)],
+			Dimensions: []model.Dimension{
+				{Name: "InstanceId", Value: fmt.Sprintf("i-%08x", i)},
+				{Name: "AutoScalingGroupName", Value: fmt.Sprintf("asg-%d", i%100)},
+			},
+			FromTS: to.Add(-1 * time.Hour),
+			ToTS:   to,
+		})
+		if err != nil {
+			return err
+		}
+		if (i+1)%100000 == 0 {
+			slog.Info("populating series", "count", i+1, "elapsed", time.Since(start).String())
+		}
+	}
+	slog.Info("populated series", "count", cfg.Series, "elapsed", time.Since(start).String())
+	return nil
+}
+
+// Query is an entry of the query mix.
+type Query struct {
+	Match  []string             `yaml:"match"`
+	Range  commonmodel.Duration `yaml:"range"`
+	Limit  int                  `yaml:"limit"`
+	Weight int                  `yaml:"weight"`
+}
+
+// DefaultQueryMix returns the queries against the series written by Populate.
+func DefaultQueryMix() []Query {
+	return []Query{
+		{
+			Match:  []string{`{Namespace="` + namespaceName(0) + `",__name__="` + metricName(0) + `",Region="us-east-1"}`},
+			Range:  commonmodel.Duration(24 * time.Hour),
+			Weight: 5,
+		},
+		{
+			Match:  []string{`{Namespace="` + namespaceName(1) + `",__name__="` + metricName(1) + `",AutoScalingGroupName=~"asg-1.*"}`},
+			Range:  commonmodel.Duration(7 * 24 * time.Hour),
+			Weight: 3,
+		},
+		{
+			Match:  []string{`{Namespace="` + namespaceName(2) + `",InstanceId!=""}`},
+			Range:  commonmodel.Duration(30 * 24 * time.Hour),
+			Limit:  1000,
+			Weight: 1,
+		},
+		{
+			Match:  []string{`{Namespace="` + namespaceName(3) + `",__name__=~"Metric1.*"}`},
+			Range:  commonmodel.Duration(90 * 24 * time.Hour),
+			Limit:  1000,
+			Weight: 1,
+		},
+	}
+}
+
+// LoadQueryMix reads the query mix from the YAML file.
+func LoadQueryMix(path string) ([]Query, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var queries []Query
+	if err := yaml.Unmarshal(b, &queries); err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, errors.New("no queries in the query mix")
+	}
+	return queries, nil
+}
+
+// RunConfig controls the replay of the query mix.
+type RunConfig struct {
+	URL         string
+	Queries     []Query
+	Concurrency int
+	Duration    time.Duration
+	End         time.Time
+}
+
+// Report is the result of the replay.
+type Report struct {
+	Requests  int
+	Errors    int
+	Duration  time.Duration
+	latencies []time.Duration
+}
+
+// Percentile returns the latency at p (0-100) of the successful requests.
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p / 100)
+	return r.latencies[i]
+}
+
+func (r *Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "requests: %d\n", r.Requests)
+	fmt.Fprintf(w, "errors:   %d\n", r.Errors)
+	fmt.Fprintf(w, "rate:     %.2f req/s\n", float64(r.Requests)/r.Duration.Seconds())
+	for _, p := range []float64{50, 90, 99, 100} {
+		fmt.Fprintf(w, "p%-7g %s\n", p, r.Percentile(p))
+	}
+}
+
+func pick(rnd *rand.Rand, queries []Query, totalWeight int) Query {
+	n := rnd.Intn(totalWeight)
+	for _, q := range queries {
+		n -= max(q.Weight, 1)
+		if n < 0 {
+			return q
+		}
+	}
+	return queries[len(queries)-1]
+}
+
+// Run replays the query mix against the series API with the concurrent workers until the duration elapses.
+func Run(ctx context.Context, cfg RunConfig) (*Report, error) {
+	if len(cfg.Queries) == 0 {
+		return nil, errors.New("no queries in the query mix")
+	}
+	totalWeight := 0
+	for _, q := range cfg.Queries {
+		totalWeight += max(q.Weight, 1)
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	report := &Report{}
+	start := time.Now()
+	for i := 0; i < max(cfg.Concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+			for ctx.Err() == nil {
+				q := pick(rnd, cfg.Queries, totalWeight)
+				reqStart := time.Now()
+				err := query(ctx, cfg.URL, q, cfg.End)
+				latency := time.Since(reqStart)
+				if ctx.Err() != nil {
+					// the request is interrupted at the end of the run
+					return
+				}
+				mu.Lock()
+				report.Requests++
+				if err != nil {
+					report.Errors++
+					slog.Debug("query failed", "err", err, "match", q.Match)
+				} else {
+					report.latencies = append(report.latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	report.Duration = time.Since(start)
+	sort.Slice(report.latencies, func(i, j int) bool {
+		return report.latencies[i] < report.latencies[j]
+	})
+	return report, nil
+}
+
+func query(ctx context.Context, baseURL string, q Query, end time.Time) error {
+	params := url.Values{
+		"match[]": q.Match,
+		"start":   {end.Add(-time.Duration(q.Range)).Format(time.RFC3339)},
+		"end":     {end.Format(time.RFC3339)},
+	}
+	if q.Limit > 0 {
+		params.Set("limit", fmt.Sprint(q.Limit))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/api/v1/series?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package bench
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestPopulate(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	end, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Populate(ctx, db, PopulateConfig{
+		Series:        100,
+		Namespaces:    2,
+		MetricNames:   5,
+		Partitions:    2,
+		LatestPartEnd: end,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.QueryMetrics(ctx, end.Add(-1*time.Hour), end, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", namespaceName(0)),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 50 {
+		t.Fatalf("unexpected series count: %d", len(result))
+	}
+}
+
+func TestRun(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("limit") != "" {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	defer server.Close()
+
+	report, err := Run(context.Background(), RunConfig{
+		URL:         server.URL,
+		Queries:     DefaultQueryMix(),
+		Concurrency: 1,
+		Duration:    200 * time.Millisecond,
+		End:         time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests == 0 || int64(report.Requests) > requests.Load() {
+		t.Fatalf("unexpected requests: %d, server received %d", report.Requests, requests.Load())
+	}
+	if report.Errors == 0 || report.Errors == report.Requests {
+		t.Fatalf("unexpected errors: %d", report.Errors)
+	}
+	if report.Percentile(50) > report.Percentile(100) {
+		t.Fatalf("unexpected percentiles: p50=%s, p100=%s", report.Percentile(50), report.Percentile(100))
+	}
+}
@@ -0,0 +1,132 @@
+package cloudwatchmock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// same as CloudWatch
+const pageSize = 500
+
+// Fixture is the metrics returned by the mock CloudWatch.
+type Fixture struct {
+	Metrics []FixtureMetric `yaml:"metrics"`
+}
+
+type FixtureMetric struct {
+	Region     string            `yaml:"region"`
+	Namespace  string            `yaml:"namespace"`
+	MetricName string            `yaml:"metric_name"`
+	Dimensions map[string]string `yaml:"dimensions"`
+}
+
+func LoadFixture(path string) (*Fixture, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture Fixture
+	if err := yaml.UnmarshalStrict(buf, &fixture); err != nil {
+		return nil, err
+	}
+	for i, m := range fixture.Metrics {
+		if m.Region == "" || m.Namespace == "" || m.MetricName == "" {
+			return nil, fmt.Errorf("region, namespace and metric_name are required: metrics[%d]", i)
+		}
+	}
+	return &fixture, nil
+}
+
+// Client serves ListMetrics of a region from the fixture, without AWS credentials.
+type Client struct {
+	metrics []types.Metric
+}
+
+func NewClient(fixture *Fixture, region string) *Client {
+	c := &Client{}
+	for _, m := range fixture.Metrics {
+		if m.Region != region {
+			continue
+		}
+		names := make([]string, 0, len(m.Dimensions))
+		for name := range m.Dimensions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		dimensions := make([]types.Dimension, 0, len(names))
+		for _, name := range names {
+			dimensions = append(dimensions, types.Dimension{
+				Name:  aws.String(name),
+				Value: aws.String(m.Dimensions[name]),
+			})
+		}
+		c.metrics = append(c.metrics, types.Metric{
+			Namespace:  aws.String(m.Namespace),
+			MetricName: aws.String(m.MetricName),
+			Dimensions: dimensions,
+		})
+	}
+	return c
+}
+
+// ListMetrics returns the metrics matching the namespace, the metric name and the dimension filters.
+// RecentlyActive is ignored, all metrics in the fixture are active.
+func (c *Client) ListMetrics(ctx context.Context, params *cloudwatch.ListMetricsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListMetricsOutput, error) {
+	start := 0
+	if params.NextToken != nil {
+		var err error
+		start, err = strconv.Atoi(*params.NextToken)
+		if err != nil {
+			return nil, fmt.Errorf("invalid next token: %s", *params.NextToken)
+		}
+	}
+
+	output := &cloudwatch.ListMetricsOutput{}
+	matched := 0
+	for _, m := range c.metrics {
+		if !match(m, params) {
+			continue
+		}
+		matched++
+		if matched <= start {
+			continue
+		}
+		if len(output.Metrics) == pageSize {
+			output.NextToken = aws.String(strconv.Itoa(start + pageSize))
+			break
+		}
+		output.Metrics = append(output.Metrics, m)
+	}
+	return output, nil
+}
+
+func match(m types.Metric, params *cloudwatch.ListMetricsInput) bool {
+	if params.Namespace != nil && *params.Namespace != *m.Namespace {
+		return false
+	}
+	if params.MetricName != nil && *params.MetricName != *m.MetricName {
+		return false
+	}
+	for _, f := range params.Dimensions {
+		found := false
+		for _, d := range m.Dimensions {
+			if *d.Name == aws.ToString(f.Name) && (f.Value == nil || *d.Value == *f.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
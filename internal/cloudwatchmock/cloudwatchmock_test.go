@@ -0,0 +1,71 @@
+package cloudwatchmock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+func TestListMetrics(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("metrics:\n")
+	for i := 0; i < pageSize+10; i++ {
+		fmt.Fprintf(&sb, "- {region: us-east-1, namespace: AWS/EC2, metric_name: CPUUtilization, dimensions: {InstanceId: i-%d}}\n", i)
+	}
+	sb.WriteString("- {region: us-east-1, namespace: AWS/ELB, metric_name: RequestCount, dimensions: {LoadBalancerName: lb}}\n")
+	sb.WriteString("- {region: ap-northeast-1, namespace: AWS/EC2, metric_name: CPUUtilization}\n")
+	path := filepath.Join(t.TempDir(), "fixture.yaml")
+	if err := os.WriteFile(path, []byte(sb.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := LoadFixture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(fixture, "us-east-1")
+
+	count := 0
+	paginator := cloudwatch.NewListMetricsPaginator(client, &cloudwatch.ListMetricsInput{
+		Namespace:      aws.String("AWS/EC2"),
+		RecentlyActive: "PT3H",
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += len(output.Metrics)
+	}
+	if count != pageSize+10 {
+		t.Fatalf("unexpected metrics count: %d", count)
+	}
+
+	output, err := client.ListMetrics(context.Background(), &cloudwatch.ListMetricsInput{
+		Namespace:  aws.String("AWS/EC2"),
+		MetricName: aws.String("CPUUtilization"),
+		Dimensions: []types.DimensionFilter{{Name: aws.String("InstanceId"), Value: aws.String("i-3")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Metrics) != 1 || *output.Metrics[0].Dimensions[0].Value != "i-3" {
+		t.Fatalf("unexpected metrics: %v", output.Metrics)
+	}
+}
+
+func TestLoadFixtureInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.yaml")
+	if err := os.WriteFile(path, []byte("metrics:\n- {namespace: AWS/EC2, metric_name: CPUUtilization}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFixture(path); err == nil {
+		t.Fatal("expected error for the metric without region")
+	}
+}
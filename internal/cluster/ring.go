@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+const DefaultVirtualNodes = 128
+
+type virtualNode struct {
+	hash uint32
+	node string
+}
+
+// Ring assigns keys to nodes by consistent hashing.
+type Ring struct {
+	nodes  []string
+	vnodes []virtualNode
+}
+
+func NewRing(nodes []string, virtualNodes int) (*Ring, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no nodes in the ring")
+	}
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	r := &Ring{}
+	for _, node := range nodes {
+		if slices.Contains(r.nodes, node) {
+			continue
+		}
+		r.nodes = append(r.nodes, node)
+		for i := 0; i < virtualNodes; i++ {
+			r.vnodes = append(r.vnodes, virtualNode{
+				hash: hash(node + "#" + strconv.Itoa(i)),
+				node: node,
+			})
+		}
+	}
+	sort.Slice(r.vnodes, func(i, j int) bool {
+		if r.vnodes[i].hash != r.vnodes[j].hash {
+			return r.vnodes[i].hash < r.vnodes[j].hash
+		}
+		return r.vnodes[i].node < r.vnodes[j].node
+	})
+	return r, nil
+}
+
+func hash(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Owner returns the node which owns the key.
+func (r *Ring) Owner(key string) string {
+	h := hash(key)
+	i := sort.Search(len(r.vnodes), func(i int) bool {
+		return r.vnodes[i].hash >= h
+	})
+	if i == len(r.vnodes) {
+		i = 0
+	}
+	return r.vnodes[i].node
+}
+
+// Nodes returns all nodes in the ring.
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
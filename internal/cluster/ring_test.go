@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingOwner(t *testing.T) {
+	nodes := []string{"http://node1:8080", "http://node2:8080", "http://node3:8080"}
+	r, err := NewRing(nodes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("Custom/Namespace%d", i)
+		owners[key] = r.Owner(key)
+		counts[owners[key]]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 200 {
+			t.Fatalf("keys are not distributed: %v", counts)
+		}
+	}
+
+	// the order of the nodes doesn't matter
+	reversed, err := NewRing([]string{nodes[2], nodes[1], nodes[0]}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, owner := range owners {
+		if reversed.Owner(key) != owner {
+			t.Fatalf("unexpected owner of %s: %s", key, reversed.Owner(key))
+		}
+	}
+
+	// only the keys of the removed node move
+	removed, err := NewRing(nodes[:2], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, owner := range owners {
+		if owner != nodes[2] && removed.Owner(key) != owner {
+			t.Fatalf("unexpected owner of %s: %s", key, removed.Owner(key))
+		}
+	}
+}
+
+func TestRingNoNodes(t *testing.T) {
+	if _, err := NewRing(nil, 0); err == nil {
+		t.Fatal("expected error for empty ring")
+	}
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// The conformance harness generates random label sets and matchers, and checks that QueryMetrics
+// selects the same series as Prometheus' matchers do.
+
+var (
+	conformanceNamespace   = "conformance"
+	conformanceMetricNames = []string{"a", "ab", "ba", "abc"}
+	conformanceRegions     = []string{"r1", "r2"}
+	conformanceDimensions  = []string{"dim1", "dim2", "dim3"}
+	conformanceValues      = []string{"", "a", "b", "ab", "ba", "abc", "x1", "x12"}
+	// REGEXP is fully anchored like Prometheus, and the explicit anchors are also allowed.
+	// The patterns with the flags and the classes check the RE2 syntax.
+	conformancePatterns = []string{
+		"a", "a.*", ".*b", "ab|ba", "[ab]+", "", ".*", ".+", "a?b", "x[0-9]+", "a|", "b", "^a$",
+		"(?i)AB", `x\d{2}`, "[[:alpha:]]+", `\pL+|x1`, "(?U)a.*",
+	}
+	conformanceLabelNames = append([]string{"__name__", "Region"}, conformanceDimensions...)
+)
+
+func randomMetric(rnd *rand.Rand, i int, from time.Time) model.Metric {
+	m := model.Metric{
+		Namespace:  conformanceNamespace,
+		MetricName: conformanceMetricNames[rnd.Intn(len(conformanceMetricNames))],
+		Region:     conformanceRegions[rnd.Intn(len(conformanceRegions))],
+		// make the series unique
+		Dimensions: []model.Dimension{{Name: "id", Value: fmt.Sprint(i)}},
+		FromTS:     from,
+		ToTS:       from.Add(1 * time.Hour),
+	}
+	for _, name := range conformanceDimensions {
+		// the dimension might be absent
+		if rnd.Intn(3) == 0 {
+			continue
+		}
+		m.Dimensions = append(m.Dimensions, model.Dimension{
+			Name:  name,
+			Value: conformanceValues[rnd.Intn(len(conformanceValues))],
+		})
+	}
+	return m
+}
+
+func randomMatcher(rnd *rand.Rand) *labels.Matcher {
+	name := conformanceLabelNames[rnd.Intn(len(conformanceLabelNames))]
+	t := labels.MatchType(rnd.Intn(4))
+	var value string
+	switch t {
+	case labels.MatchEqual, labels.MatchNotEqual:
+		value = conformanceValues[rnd.Intn(len(conformanceValues))]
+		if name == "__name__" && rnd.Intn(2) == 0 {
+			value = conformanceMetricNames[rnd.Intn(len(conformanceMetricNames))]
+		}
+	default:
+		value = conformancePatterns[rnd.Intn(len(conformancePatterns))]
+	}
+	return labels.MustNewMatcher(t, name, value)
+}
+
+func matchesAll(m model.Metric, lm []*labels.Matcher) bool {
+	ls := m.Labels()
+	for _, matcher := range lm {
+		// absent labels are matched as empty
+		if !matcher.Matches(ls[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzMatcherConformance(f *testing.F) {
+	ctx := context.Background()
+	db, err := Open(f.TempDir())
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer db.Close()
+
+	from, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		f.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	var metrics []model.Metric
+	for i := 0; i < 200; i++ {
+		m := randomMetric(rnd, i, from)
+		if err := db.RecordMetric(ctx, m); err != nil {
+			f.Fatal(err)
+		}
+		metrics = append(metrics, m)
+	}
+
+	for seed := int64(0); seed < 50; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		rnd := rand.New(rand.NewSource(seed))
+		lm := []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "Namespace", conformanceNamespace),
+		}
+		for i := 0; i < 1+rnd.Intn(3); i++ {
+			lm = append(lm, randomMatcher(rnd))
+		}
+
+		var want []string
+		for _, m := range metrics {
+			if matchesAll(m, lm) {
+				want = append(want, m.UniqueKey())
+			}
+		}
+		result, err := db.QueryMetrics(ctx, from, from.Add(1*time.Hour), lm, 0, map[string]*model.Metric{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for k := range result {
+			got = append(got, k)
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("matchers %v: got %d series, want %d series\ngot:  %v\nwant: %v", lm, len(got), len(want), got, want)
+		}
+	})
+}
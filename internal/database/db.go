@@ -6,15 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	_ "embed"
 
 	lru "github.com/hashicorp/golang-lru/v2"
-	_ "github.com/mattn/go-sqlite3"
-
-	_ "github.com/mtanda/prometheus-labels-db/internal/database/regexp"
+	"github.com/mtanda/prometheus-labels-db/internal/sqlite"
 )
 
 const (
@@ -23,17 +25,35 @@ const (
 	InitCacheSize     = 1000
 	WalAutoCheckpoint = 100
 	IdleTimeout       = 1 * time.Hour
+	// the partitions used within evictionGrace aren't evicted, since the queries might still use them
+	evictionGrace = 1 * time.Minute
+	// same as database/sql
+	defaultMaxIdleConns = 2
 )
 
 type DBCache struct {
 	db       *sql.DB
+	stmts    *stmtCache
 	lastUsed time.Time
 }
 
 type LabelDB struct {
-	dir         string
-	dbCache     map[string]DBCache
-	initialized *lru.Cache[string, struct{}]
+	dir string
+	// mu guards dbCache, layout, bounds and seenPartitions against the concurrent queries and the replication
+	mu                sync.RWMutex
+	dbCache           map[string]DBCache
+	initialized       *lru.Cache[string, struct{}]
+	hydrator          *Hydrator
+	hydrationPrefix   string
+	walAutoCheckpoint int
+	searchIndex       bool
+	maxOpenPartitions int
+	layout            PartitionLayout
+	// metadataDB is shared by the concurrent queries
+	metadataMu     sync.Mutex
+	metadataDB     *sql.DB
+	bounds         map[string]bounds
+	seenPartitions map[string]struct{}
 }
 
 //go:embed sql/table.sql
@@ -44,64 +64,255 @@ func Open(dir string) (*LabelDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	layout, err := LoadPartitionLayout(context.Background(), dir)
+	if err != nil {
+		return nil, err
+	}
 	return &LabelDB{
-		dir:         dir,
-		dbCache:     make(map[string]DBCache),
-		initialized: cache,
+		dir:               dir,
+		dbCache:           make(map[string]DBCache),
+		initialized:       cache,
+		walAutoCheckpoint: WalAutoCheckpoint,
+		layout:            layout,
+		bounds:            make(map[string]bounds),
+		seenPartitions:    make(map[string]struct{}),
 	}, nil
 }
 
+func (ldb *LabelDB) Dir() string {
+	return ldb.dir
+}
+
+// SetWalAutoCheckpoint changes the WAL auto checkpoint threshold, 0 disables auto checkpoint.
+// When auto checkpoint is disabled, each partition uses a single connection to make the setting effective.
+func (ldb *LabelDB) SetWalAutoCheckpoint(n int) error {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+	ldb.walAutoCheckpoint = n
+	for _, dbCache := range ldb.dbCache {
+		if n == 0 {
+			dbCache.db.SetMaxOpenConns(1)
+		}
+		if err := setAutoCheckpoint(dbCache.db, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMaxOpenPartitions limits the number of the open partition databases, 0 means unlimited.
+// The least recently used partitions are closed when the other partition is opened,
+// but the partitions used within a minute are kept open, so the limit can be exceeded temporarily.
+func (ldb *LabelDB) SetMaxOpenPartitions(n int) {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+	ldb.maxOpenPartitions = n
+}
+
+// takePartitionDB removes the partition database from dbCache without closing it, so that the caller can close it without holding mu.
+func (ldb *LabelDB) takePartitionDB(dbPath string) (DBCache, bool) {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+	dbCache, ok := ldb.dbCache[dbPath]
+	if ok {
+		delete(ldb.dbCache, dbPath)
+	}
+	return dbCache, ok
+}
+
+// closePartitionDB closes the partition database if it's open.
+// It's closed after unlocking, since closing waits for the running queries.
+func (ldb *LabelDB) closePartitionDB(dbPath string) error {
+	dbCache, ok := ldb.takePartitionDB(dbPath)
+	if !ok {
+		return nil
+	}
+	return dbCache.close()
+}
+
 func (ldb *LabelDB) getDB(t time.Time) (*sql.DB, error) {
-	suffix := getTableSuffix(t)
+	return ldb.getPartitionDB(ldb.PartitionLayout().getDBPath(t))
+}
 
-	dbPath := fmt.Sprintf(DbPathPattern, suffix)
+func (ldb *LabelDB) getPartitionDB(dbPath string) (*sql.DB, error) {
+	if ldb.hydrator != nil {
+		if err := ldb.hydrator.hydrate(ldb, dbPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var evicted map[string]DBCache
+	// close the evicted databases after unlocking, since closing waits for their running queries
+	defer func() {
+		for path, dbCache := range evicted {
+			if err := dbCache.close(); err != nil {
+				// ignore error
+				slog.Error("failed to close db", "err", err, "dbPath", path)
+			}
+		}
+	}()
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
 	if dbCache, ok := ldb.dbCache[dbPath]; ok {
 		dbCache.lastUsed = time.Now().UTC()
+		ldb.dbCache[dbPath] = dbCache
 		return dbCache.db, nil
 	}
 
+	if ldb.hydrator != nil {
+		if _, err := os.Stat(filepath.Join(ldb.dir, dbPath)); errors.Is(err, os.ErrNotExist) {
+			return nil, errNotHydrated
+		}
+	}
 	// TODO: support mode=ro for query command
-	db, err := sql.Open("sqlite3", "file:"+ldb.dir+"/"+dbPath+"?_journal_mode=WAL&_sync=NORMAL&_busy_timeout=10000")
+	db, err := sql.Open(driverName, sqlite.DSN(ldb.dir+"/"+dbPath, sqlite.Options{WAL: true, BusyTimeout: busyTimeout, IncrementalVacuum: true}))
 	if err != nil {
 		return nil, err
 	}
-	setAutoCheckpoint(db, WalAutoCheckpoint)
+	if ldb.walAutoCheckpoint == 0 {
+		db.SetMaxOpenConns(1)
+	}
+	setAutoCheckpoint(db, ldb.walAutoCheckpoint)
+	if err := migrate(context.Background(), db, dbPath); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if ldb.searchIndex {
+		if err := ensureSearchIndex(context.Background(), db, dbPath); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
 	ldb.dbCache[dbPath] = DBCache{
 		db:       db,
+		stmts:    newStmtCache(),
 		lastUsed: time.Now().UTC(),
 	}
+	evicted = ldb.evictPartitionDBs(dbPath)
 
 	return db, nil
 }
 
+// evictPartitionDBs removes the least recently used partition databases over maxOpenPartitions except keep from dbCache, and returns them to be closed.
+// The caller must hold mu.
+func (ldb *LabelDB) evictPartitionDBs(keep string) map[string]DBCache {
+	if ldb.maxOpenPartitions <= 0 || len(ldb.dbCache) <= ldb.maxOpenPartitions {
+		return nil
+	}
+	paths := make([]string, 0, len(ldb.dbCache))
+	for dbPath := range ldb.dbCache {
+		if dbPath != keep {
+			paths = append(paths, dbPath)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return ldb.dbCache[paths[i]].lastUsed.Before(ldb.dbCache[paths[j]].lastUsed)
+	})
+
+	evicted := make(map[string]DBCache)
+	threshold := time.Now().UTC().Add(-evictionGrace)
+	for _, dbPath := range paths {
+		dbCache := ldb.dbCache[dbPath]
+		if len(ldb.dbCache) <= ldb.maxOpenPartitions || dbCache.lastUsed.After(threshold) {
+			break
+		}
+		delete(ldb.dbCache, dbPath)
+		evicted[dbPath] = dbCache
+		slog.Info("evicted partition db", "dbPath", dbPath, "lastUsed", dbCache.lastUsed)
+	}
+	return evicted
+}
+
 func (ldb *LabelDB) Close() error {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
 	var allErr error
 	for dbPath, dbCache := range ldb.dbCache {
-		if err := dbCache.db.Close(); err != nil {
+		if err := dbCache.close(); err != nil {
 			// ignore error
 			slog.Error("failed to close db", "err", err, "dbPath", dbPath)
 			allErr = errors.Join(allErr, err)
 		}
 	}
+	if ldb.metadataDB != nil {
+		if err := ldb.metadataDB.Close(); err != nil {
+			// ignore error
+			slog.Error("failed to close metadata db", "err", err)
+			allErr = errors.Join(allErr, err)
+		}
+	}
 	return allErr
 }
 
+// CleanupUnusedDB closes the partitions not used for IdleTimeout, and evicts the hydrated files over the size limit.
 func (ldb *LabelDB) CleanupUnusedDB(ctx context.Context) error {
+	ldb.closeUnusedDB()
+	if ldb.hydrator != nil {
+		ldb.hydrator.Shrink()
+	}
+	return nil
+}
+
+func (ldb *LabelDB) closeUnusedDB() {
+	unused := make(map[string]DBCache)
+	ldb.mu.Lock()
 	for dbPath, dbCache := range ldb.dbCache {
 		if dbCache.lastUsed.Add(IdleTimeout).After(time.Now().UTC()) {
 			// still used
 			continue
 		}
+		unused[dbPath] = dbCache
+		delete(ldb.dbCache, dbPath)
+	}
+	ldb.mu.Unlock()
 
-		if err := dbCache.db.Close(); err != nil {
+	// close the unused databases after unlocking, same as the evicted ones
+	for dbPath, dbCache := range unused {
+		if err := dbCache.close(); err != nil {
 			// ignore error
 			slog.Error("failed to close db", "err", err, "dbPath", dbPath)
 			continue
 		}
-		delete(ldb.dbCache, dbPath)
 		slog.Info("close unused db", "dbPath", dbPath)
 	}
-	return nil
+}
+
+// ShrinkMemory closes the idle connections to release their page caches.
+func (ldb *LabelDB) ShrinkMemory() {
+	ldb.mu.RLock()
+	defer ldb.mu.RUnlock()
+	for _, dbCache := range ldb.dbCache {
+		dbCache.db.SetMaxIdleConns(0)
+		dbCache.db.SetMaxIdleConns(defaultMaxIdleConns)
+	}
+}
+
+// OpenDB is the state of an open partition database.
+type OpenDB struct {
+	Path            string    `json:"path"`
+	LastUsed        time.Time `json:"lastUsed"`
+	OpenConnections int       `json:"openConnections"`
+	InUse           int       `json:"inUse"`
+}
+
+// OpenDBs returns the partition databases opened by ldb.
+func (ldb *LabelDB) OpenDBs() []OpenDB {
+	ldb.mu.RLock()
+	defer ldb.mu.RUnlock()
+	dbs := make([]OpenDB, 0, len(ldb.dbCache))
+	for dbPath, dbCache := range ldb.dbCache {
+		stats := dbCache.db.Stats()
+		dbs = append(dbs, OpenDB{
+			Path:            dbPath,
+			LastUsed:        dbCache.lastUsed,
+			OpenConnections: stats.OpenConnections,
+			InUse:           stats.InUse,
+		})
+	}
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].Path < dbs[j].Path
+	})
+	return dbs
 }
 
 type timeRange struct {
@@ -109,29 +320,90 @@ type timeRange struct {
 	To   time.Time
 }
 
-func getPartition(t time.Time) timeRange {
-	from := t.Truncate(PartitionInterval)
-	to := from.Add(PartitionInterval).Add(-1 * time.Second)
+// PartitionLayout decides the time ranges of the partitions.
+// The zero value is the partitions of PartitionInterval truncated from the zero time.
+type PartitionLayout struct {
+	// Months is the number of calendar months in a partition, PartitionInterval is used if 0.
+	Months int `json:"months"`
+	// Epoch is the start of a partition, and the other partitions are aligned to it.
+	// Only the year and the month are used when Months is set.
+	Epoch time.Time `json:"epoch"`
+}
+
+func (l PartitionLayout) String() string {
+	if l.Months > 0 {
+		return fmt.Sprintf("%d months from %s", l.Months, l.Epoch.Format("2006-01"))
+	}
+	return fmt.Sprintf("%s from %s", PartitionInterval, l.Epoch.Format(time.RFC3339))
+}
+
+// Validate reports an error if the layout can't be used.
+func (l PartitionLayout) Validate() error {
+	if l.Months < 0 {
+		return fmt.Errorf("months must be non-negative: %d", l.Months)
+	}
+	if l.Epoch.Location() != time.UTC {
+		return fmt.Errorf("epoch must be in UTC: %s", l.Epoch)
+	}
+	return nil
+}
+
+func (l PartitionLayout) getPartition(t time.Time) timeRange {
+	var from, to time.Time
+	switch {
+	case l.Months > 0:
+		months := (t.Year()*12 + int(t.Month()) - 1) - (l.Epoch.Year()*12 + int(l.Epoch.Month()) - 1)
+		n := months / l.Months
+		if months < 0 && months%l.Months != 0 {
+			n--
+		}
+		from = time.Date(l.Epoch.Year(), l.Epoch.Month()+time.Month(n*l.Months), 1, 0, 0, 0, 0, time.UTC)
+		to = from.AddDate(0, l.Months, 0).Add(-1 * time.Second)
+	case l.Epoch.IsZero():
+		from = t.Truncate(PartitionInterval)
+		to = from.Add(PartitionInterval).Add(-1 * time.Second)
+	default:
+		d := t.Sub(l.Epoch)
+		n := d / PartitionInterval
+		if d < 0 && d%PartitionInterval != 0 {
+			n--
+		}
+		from = l.Epoch.Add(n * PartitionInterval)
+		to = from.Add(PartitionInterval).Add(-1 * time.Second)
+	}
 	return timeRange{
 		From: from,
 		To:   to,
 	}
 }
 
-func getTableSuffix(t time.Time) string {
-	p := getPartition(t)
+func (l PartitionLayout) getTableSuffix(t time.Time) string {
+	p := l.getPartition(t)
 	return "_" + p.From.Format("20060102") + "_" + p.To.Format("20060102")
 }
 
-func getLifetimeTableSuffix(t time.Time, namespace string) string {
+func (l PartitionLayout) getDBPath(t time.Time) string {
+	return fmt.Sprintf(DbPathPattern, l.getTableSuffix(t))
+}
+
+func (l PartitionLayout) getLifetimeTableSuffix(t time.Time, namespace string) string {
+	return lifetimeTableSuffix(l.getTableSuffix(t), namespace)
+}
+
+func lifetimeTableSuffix(suffix string, namespace string) string {
 	namespace = strings.ReplaceAll(namespace, "/", "_")
-	return getTableSuffix(t) + "_" + namespace
+	return suffix + "_" + namespace
 }
 
-func getLifetimeRanges(from time.Time, to time.Time) []timeRange {
+// getLifetimeRanges returns the ranges of the partitions between from and to, or nil if to is before from.
+func (l PartitionLayout) getLifetimeRanges(from time.Time, to time.Time) []timeRange {
+	if to.Before(from) {
+		return nil
+	}
 	var partitions []timeRange
-	for t := from; t.Before(to); t = t.Add(PartitionInterval) {
-		partitions = append(partitions, getPartition(t))
+	// iterate over the aligned partitions so that the partition containing to is not skipped
+	for p := l.getPartition(from); !p.From.After(to); p = l.getPartition(p.To.Add(1 * time.Second)) {
+		partitions = append(partitions, p)
 	}
 	partitions[0].From = from
 	partitions[len(partitions)-1].To = to
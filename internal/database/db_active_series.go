@@ -0,0 +1,84 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+)
+
+func (ldb *LabelDB) RecordActiveSeries(ctx context.Context, as model.ActiveSeries) error {
+	db, err := ldb.getDB(as.Timestamp)
+	if err != nil {
+		return err
+	}
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		err := ldb.init(ctx, tx, as.Timestamp, as.Namespace)
+		if err != nil {
+			return err
+		}
+
+		s := ldb.PartitionLayout().getTableSuffix(as.Timestamp)
+		_, err = tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO active_series`+s+` (
+				namespace,
+				region,
+				timestamp,
+				count
+			) VALUES (?, ?, ?, ?);
+			`,
+			as.Namespace,
+			as.Region,
+			as.Timestamp.Unix(),
+			as.Count,
+		)
+		return err
+	})
+}
+
+func (ldb *LabelDB) QueryActiveSeries(ctx context.Context, from, to time.Time, namespace string) ([]model.ActiveSeries, error) {
+	result := make([]model.ActiveSeries, 0)
+	trs := ldb.PartitionLayout().getLifetimeRanges(from, to)
+	for _, tr := range trs {
+		err := func() error {
+			db, err := ldb.getDB(tr.From)
+			if err != nil {
+				return err
+			}
+
+			s := ldb.PartitionLayout().getTableSuffix(tr.From)
+			q := `SELECT namespace, region, timestamp, count FROM active_series` + s + `
+WHERE timestamp >= ? AND timestamp <= ?`
+			args := []interface{}{tr.From.Unix(), tr.To.Unix()}
+			if namespace != "" {
+				q += ` AND namespace = ?`
+				args = append(args, namespace)
+			}
+			q += ` ORDER BY timestamp, namespace, region`
+			rows, err := db.QueryContext(ctx, q, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var as model.ActiveSeries
+				var ts int64
+				if err := rows.Scan(&as.Namespace, &as.Region, &ts, &as.Count); err != nil {
+					return err
+				}
+				as.Timestamp = time.Unix(ts, 0).UTC()
+				result = append(result, as)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			if isNoSuchTable(err) {
+				continue
+			}
+			return result, err
+		}
+	}
+	return result, nil
+}
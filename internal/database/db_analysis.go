@@ -0,0 +1,364 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// the number of the series ids looked up by a query, below the limit of the bound parameters
+const seriesIDBatchSize = 500
+
+// QueryDisappearedSeries returns the series matching lm in the time range, which are not seen after to - grace.
+// The series are sorted by the last seen timestamp.
+func (ldb *LabelDB) QueryDisappearedSeries(ctx context.Context, from, to time.Time, lm []*labels.Matcher, grace time.Duration) ([]*model.Metric, error) {
+	result, err := ldb.QueryMetrics(ctx, from, to, lm, 0, map[string]*model.Metric{})
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := to.Add(-grace)
+	disappeared := make([]*model.Metric, 0)
+	for _, m := range result {
+		// ToTS is the last seen timestamp merged over the partitions
+		if m.ToTS.Before(threshold) {
+			disappeared = append(disappeared, m)
+		}
+	}
+	sort.Slice(disappeared, func(i, j int) bool {
+		if !disappeared[i].ToTS.Equal(disappeared[j].ToTS) {
+			return disappeared[i].ToTS.Before(disappeared[j].ToTS)
+		}
+		return disappeared[i].UniqueKey() < disappeared[j].UniqueKey()
+	})
+	return disappeared, nil
+}
+
+// QueryNewSeries returns the series matching lm whose first seen timestamp is in the time range.
+// The series are sorted by the first seen timestamp.
+func (ldb *LabelDB) QueryNewSeries(ctx context.Context, from, to time.Time, lm []*labels.Matcher) ([]*model.Metric, error) {
+	result, err := ldb.QueryMetrics(ctx, from, to, lm, 0, map[string]*model.Metric{})
+	if err != nil {
+		return nil, err
+	}
+	for k, m := range result {
+		// FromTS is the first seen timestamp merged over the partitions
+		if m.FromTS.Before(from) {
+			delete(result, k)
+		}
+	}
+
+	// the series might be seen in the older partitions
+	oldest, err := ldb.oldestPartitionStart()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > 0 && !oldest.IsZero() && oldest.Before(from) {
+		ids := make([]int64, 0, len(result))
+		for _, m := range result {
+			ids = append(ids, m.SeriesID)
+		}
+		seen, err := ldb.seenBefore(ctx, oldest, from, ids)
+		if err != nil {
+			return nil, err
+		}
+		for k, m := range result {
+			if _, ok := seen[m.SeriesID]; ok {
+				delete(result, k)
+			}
+		}
+	}
+
+	series := make([]*model.Metric, 0, len(result))
+	for _, m := range result {
+		series = append(series, m)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if !series[i].FromTS.Equal(series[j].FromTS) {
+			return series[i].FromTS.Before(series[j].FromTS)
+		}
+		return series[i].UniqueKey() < series[j].UniqueKey()
+	})
+	return series, nil
+}
+
+// seenBefore returns the series of ids seen in the partitions from oldest before t.
+// The series are looked up by their ids, so that the labels aren't matched again.
+func (ldb *LabelDB) seenBefore(ctx context.Context, oldest, t time.Time, ids []int64) (map[int64]struct{}, error) {
+	seen := make(map[int64]struct{})
+	for _, tr := range ldb.PartitionLayout().getLifetimeRanges(oldest, t.Add(-1*time.Second)) {
+		if ldb.skipPartition(ctx, tr, "") {
+			continue
+		}
+		db, err := ldb.getDB(tr.From)
+		if err != nil {
+			return nil, err
+		}
+		s := ldb.PartitionLayout().getTableSuffix(tr.From)
+		for chunk := range slices.Chunk(ids, seriesIDBatchSize) {
+			args := make([]interface{}, 0, len(chunk)+1)
+			for _, id := range chunk {
+				args = append(args, id)
+			}
+			args = append(args, t.Unix())
+			err := func() error {
+				rows, err := db.QueryContext(ctx, `SELECT DISTINCT series_id FROM metrics`+s+`
+WHERE series_id IN (?`+strings.Repeat(", ?", len(chunk)-1)+`) AND from_timestamp < ?`, args...)
+				if err != nil {
+					return err
+				}
+				defer rows.Close()
+				for rows.Next() {
+					var id int64
+					if err := rows.Scan(&id); err != nil {
+						return err
+					}
+					seen[id] = struct{}{}
+				}
+				return rows.Err()
+			}()
+			if isNoSuchTable(err) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return seen, nil
+}
+
+// QueryLastSeen returns the series matching lm seen in the time range with their last seen timestamps in ToTS.
+// The partitions are searched from the newest one, and the search stops when limit series are found if limit > 0.
+// The series are sorted by the last seen timestamp in descending order.
+func (ldb *LabelDB) QueryLastSeen(ctx context.Context, from, to time.Time, lm []*labels.Matcher, limit int) ([]*model.Metric, error) {
+	// don't search before the oldest partition
+	oldest, err := ldb.oldestPartitionStart()
+	if err != nil {
+		return nil, err
+	}
+	if oldest.IsZero() {
+		return []*model.Metric{}, nil
+	}
+	from = maxTime(from, oldest)
+
+	result := make(map[string]*model.Metric)
+	for p := ldb.PartitionLayout().getPartition(to); !p.To.Before(from); p = ldb.PartitionLayout().getPartition(p.From.Add(-1 * time.Second)) {
+		tr := timeRange{From: maxTime(p.From, from), To: minTime(p.To, to)}
+		found, err := ldb.QueryMetrics(ctx, tr.From, tr.To, lm, 0, map[string]*model.Metric{})
+		if err != nil {
+			return nil, err
+		}
+		// the series in the newer partitions are seen later
+		for k, m := range found {
+			if _, ok := result[k]; !ok {
+				result[k] = m
+			}
+		}
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+
+	series := make([]*model.Metric, 0, len(result))
+	for _, m := range result {
+		series = append(series, m)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if !series[i].ToTS.Equal(series[j].ToTS) {
+			return series[i].ToTS.After(series[j].ToTS)
+		}
+		return series[i].UniqueKey() < series[j].UniqueKey()
+	})
+	if limit > 0 && len(series) > limit {
+		series = series[:limit]
+	}
+	return series, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func (ldb *LabelDB) oldestPartitionStart() (time.Time, error) {
+	files, err := PartitionFiles(ldb.dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var oldest time.Time
+	for _, dbPath := range files {
+		start, err := PartitionStart(dbPath)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if oldest.IsZero() || start.Before(oldest) {
+			oldest = start
+		}
+	}
+	return oldest, nil
+}
+
+// LabelValueCount is the number of series having the label value.
+type LabelValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// labelColumn returns the SQL expression of the label, and its argument for dimensions.
+func labelColumn(label string) (string, []interface{}) {
+	switch label {
+	case "__name__", "MetricName":
+		return "m.metric_name", nil
+	case "Region":
+		return "m.region", nil
+	default:
+		return `IFNULL(json_extract(m.dimensions, ?), '')`, []interface{}{`$."` + label + `"`}
+	}
+}
+
+// QueryTopValues returns the k values of the label with the most series in the namespace in the time range.
+func (ldb *LabelDB) QueryTopValues(ctx context.Context, from, to time.Time, namespace string, label string, k int) ([]LabelValueCount, error) {
+	column, columnArgs := labelColumn(label)
+	trs := ldb.PartitionLayout().getLifetimeRanges(from, to)
+	// the series in multiple partitions are counted once
+	counts := make(map[string]int)
+	seen := make(map[string]struct{})
+	for _, tr := range trs {
+		if ldb.skipPartition(ctx, tr, namespace) {
+			continue
+		}
+		err := func() error {
+			db, err := ldb.getDB(tr.From)
+			if err != nil {
+				return err
+			}
+			timeCondition, timeArgs := buildTimeConditions(tr)
+			s := ldb.PartitionLayout().getTableSuffix(tr.From)
+			ls := ldb.PartitionLayout().getLifetimeTableSuffix(tr.From, namespace)
+			where := strings.Join(append(timeCondition, "m.namespace = ?", column+` != ''`), " AND ")
+			// the label column is used in both SELECT and WHERE
+			args := append([]interface{}{}, columnArgs...)
+			args = append(args, timeArgs...)
+			args = append(args, namespace)
+			args = append(args, columnArgs...)
+
+			var q string
+			if len(trs) == 1 {
+				q = `SELECT ` + column + ` AS value, COUNT(*) FROM metrics_lifetime` + ls + ` ml
+JOIN metrics` + s + ` m ON ml.metric_id = m.metric_id
+WHERE ` + where + `
+GROUP BY value`
+			} else {
+				q = `SELECT ` + column + ` AS value, m.metric_name || char(0) || m.region || char(0) || m.dimensions FROM metrics_lifetime` + ls + ` ml
+JOIN metrics` + s + ` m ON ml.metric_id = m.metric_id
+WHERE ` + where
+			}
+			rows, err := db.QueryContext(ctx, q, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var value string
+				if len(trs) == 1 {
+					var count int
+					if err := rows.Scan(&value, &count); err != nil {
+						return err
+					}
+					counts[value] = count
+					continue
+				}
+				var key string
+				if err := rows.Scan(&value, &key); err != nil {
+					return err
+				}
+				if _, ok := seen[value+"\x00"+key]; ok {
+					continue
+				}
+				seen[value+"\x00"+key] = struct{}{}
+				counts[value]++
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			if isNoSuchTable(err) {
+				continue
+			}
+			return nil, err
+		}
+	}
+
+	result := make([]LabelValueCount, 0, len(counts))
+	for value, count := range counts {
+		result = append(result, LabelValueCount{Value: value, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Value < result[j].Value
+	})
+	if k > 0 && len(result) > k {
+		result = result[:k]
+	}
+	return result, nil
+}
+
+// SeriesDiff is the difference of the series between two time ranges.
+type SeriesDiff struct {
+	Added     []*model.Metric
+	Removed   []*model.Metric
+	Unchanged []*model.Metric
+}
+
+// QuerySeriesDiff compares the series matching lm in the base time range and in the time range.
+// The series are sorted by their unique keys.
+func (ldb *LabelDB) QuerySeriesDiff(ctx context.Context, baseFrom, baseTo, from, to time.Time, lm []*labels.Matcher) (*SeriesDiff, error) {
+	base, err := ldb.QueryMetrics(ctx, baseFrom, baseTo, lm, 0, map[string]*model.Metric{})
+	if err != nil {
+		return nil, err
+	}
+	target, err := ldb.QueryMetrics(ctx, from, to, lm, 0, map[string]*model.Metric{})
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &SeriesDiff{
+		Added:     make([]*model.Metric, 0),
+		Removed:   make([]*model.Metric, 0),
+		Unchanged: make([]*model.Metric, 0),
+	}
+	for k, m := range target {
+		if _, ok := base[k]; ok {
+			diff.Unchanged = append(diff.Unchanged, m)
+		} else {
+			diff.Added = append(diff.Added, m)
+		}
+	}
+	for k, m := range base {
+		if _, ok := target[k]; !ok {
+			diff.Removed = append(diff.Removed, m)
+		}
+	}
+	for _, series := range [][]*model.Metric{diff.Added, diff.Removed, diff.Unchanged} {
+		sort.Slice(series, func(i, j int) bool {
+			return series[i].UniqueKey() < series[j].UniqueKey()
+		})
+	}
+	return diff, nil
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Backup writes the consistent snapshots of the partitions and the metadata to destDir by VACUUM INTO while the recorder keeps writing, and returns the backed up files.
+// Each snapshot is written to a temporary file and renamed, so destDir doesn't have a partial file.
+func (ldb *LabelDB) Backup(ctx context.Context, destDir string) ([]string, error) {
+	src, err := filepath.Abs(ldb.dir)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := filepath.Abs(destDir)
+	if err != nil {
+		return nil, err
+	}
+	if src == dest {
+		return nil, fmt.Errorf("backup directory is the database directory: %s", destDir)
+	}
+	files, err := PartitionFiles(ldb.dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(destDir, 0o777); err != nil {
+		return nil, err
+	}
+
+	backedUp := make([]string, 0, len(files)+1)
+	for _, dbPath := range append(files, metadataDBPath) {
+		err := backupFile(ctx, filepath.Join(ldb.dir, dbPath), filepath.Join(destDir, dbPath))
+		if errors.Is(err, os.ErrNotExist) {
+			// the partition might be deleted by the retention, or the metadata is not created yet
+			continue
+		} else if err != nil {
+			return backedUp, fmt.Errorf("failed to back up %s: %w", dbPath, err)
+		}
+		backedUp = append(backedUp, dbPath)
+	}
+	return backedUp, nil
+}
+
+func backupFile(ctx context.Context, path string, dest string) error {
+	// the error of opening the missing file is not os.ErrNotExist
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := openPartitionFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// VACUUM INTO fails if the file exists
+	tmp := dest + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// RestoreBackup validates the backup in backupDir written by Backup, and installs it into dir.
+// The whole backup is validated before installing any file. The existing partitions newer than the backup are not overwritten unless force is true,
+// and the existing metadata is kept since it has the partition layout of dir.
+func RestoreBackup(ctx context.Context, backupDir string, dir string, force bool) ([]string, error) {
+	files, err := PartitionFiles(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no partitions in backup: %s", backupDir)
+	}
+	for _, dbPath := range files {
+		if err := validateBackupPartition(ctx, filepath.Join(backupDir, dbPath)); err != nil {
+			return nil, err
+		}
+		if force {
+			continue
+		}
+		path := filepath.Join(dir, dbPath)
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		current, err := PartitionVersion(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		backup, err := PartitionVersion(ctx, filepath.Join(backupDir, dbPath))
+		if err != nil {
+			return nil, err
+		}
+		if current > backup {
+			return nil, fmt.Errorf("partition is newer than backup: %s", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(backupDir, metadataDBPath)); err == nil {
+		if _, err := os.Stat(filepath.Join(dir, metadataDBPath)); errors.Is(err, os.ErrNotExist) {
+			files = append(files, metadataDBPath)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	restored := make([]string, 0, len(files))
+	for _, dbPath := range files {
+		if err := installFile(filepath.Join(backupDir, dbPath), filepath.Join(dir, dbPath)); err != nil {
+			return restored, err
+		}
+		slog.Info("restored file from backup", "dbPath", dbPath)
+		restored = append(restored, dbPath)
+	}
+	return restored, nil
+}
+
+// validateBackupPartition checks the integrity of the partition, and that its tables have the suffix of the file name.
+func validateBackupPartition(ctx context.Context, path string) error {
+	s, err := partitionSuffix(path)
+	if err != nil {
+		return err
+	}
+	db, err := openPartitionFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s: %s", path, result)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND (name LIKE 'metrics%' OR name LIKE 'active_series%')`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(name, "metrics"+s) && !strings.HasPrefix(name, "metrics_lifetime"+s) && !strings.HasPrefix(name, "active_series"+s) {
+			return fmt.Errorf("table %s doesn't match the partition: %s", name, path)
+		}
+	}
+	return rows.Err()
+}
+
+// installFile copies the file to a temporary file and renames it, removing the WAL of the replaced file.
+func installFile(src string, path string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := path + ".restore"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,306 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/sqlite"
+)
+
+// MetricChange is a row of the metrics table with its lifetime in the partition.
+type MetricChange struct {
+	MetricID     int64           `json:"metric_id"`
+	Namespace    string          `json:"namespace"`
+	MetricName   string          `json:"metric_name"`
+	Region       string          `json:"region"`
+	Dimensions   json.RawMessage `json:"dimensions"`
+	FromTS       int64           `json:"from_timestamp"`
+	ToTS         int64           `json:"to_timestamp"`
+	UpdatedAt    int64           `json:"updated_at"`
+	LifetimeFrom int64           `json:"lifetime_from_timestamp"`
+	LifetimeTo   int64           `json:"lifetime_to_timestamp"`
+}
+
+// Changes are the rows of a partition updated since a version.
+// The version is the latest updated_at of the metrics in the partition.
+type Changes struct {
+	Version      int64                `json:"version"`
+	Metrics      []MetricChange       `json:"metrics"`
+	ActiveSeries []model.ActiveSeries `json:"active_series"`
+}
+
+// PartitionStart returns the start time of the partition file.
+func PartitionStart(dbPath string) (time.Time, error) {
+	matches := partitionFilePattern.FindStringSubmatch(filepath.Base(dbPath))
+	if matches == nil {
+		return time.Time{}, fmt.Errorf("invalid partition file name: %s", dbPath)
+	}
+	return time.ParseInLocation("20060102", matches[1], time.UTC)
+}
+
+// partitionSuffix returns the table suffix of the partition file, which doesn't depend on the partition layout.
+func partitionSuffix(dbPath string) (string, error) {
+	matches := partitionFilePattern.FindStringSubmatch(filepath.Base(dbPath))
+	if matches == nil {
+		return "", fmt.Errorf("invalid partition file name: %s", dbPath)
+	}
+	return "_" + matches[1] + "_" + matches[2], nil
+}
+
+func openPartitionFile(path string, readOnly bool) (*sql.DB, error) {
+	return sql.Open(driverName, sqlite.DSN(path, sqlite.Options{ReadOnly: readOnly, BusyTimeout: busyTimeout}))
+}
+
+// PartitionVersion returns the version of the partition file.
+func PartitionVersion(ctx context.Context, path string) (int64, error) {
+	s, err := partitionSuffix(path)
+	if err != nil {
+		return 0, err
+	}
+	return partitionVersion(ctx, path, s)
+}
+
+func partitionVersion(ctx context.Context, path string, s string) (int64, error) {
+	db, err := openPartitionFile(path, true)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var version sql.NullInt64
+	err = db.QueryRowContext(ctx, `SELECT MAX(updated_at) FROM metrics`+s).Scan(&version)
+	if isNoSuchTable(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return version.Int64, nil
+}
+
+// SnapshotPartition writes a consistent copy of the partition file to dst, and returns its version.
+// It's safe to call while the partition is written.
+func SnapshotPartition(ctx context.Context, path string, dst string) (int64, error) {
+	s, err := partitionSuffix(path)
+	if err != nil {
+		return 0, err
+	}
+	db, err := openPartitionFile(path, true)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, dst); err != nil {
+		return 0, err
+	}
+	return partitionVersion(ctx, dst, s)
+}
+
+// PartitionChanges returns the rows of the partition updated at or after since.
+func PartitionChanges(ctx context.Context, path string, since int64) (*Changes, error) {
+	s, err := partitionSuffix(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := openPartitionFile(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	changes := &Changes{
+		Metrics:      make([]MetricChange, 0),
+		ActiveSeries: make([]model.ActiveSeries, 0),
+	}
+	// read all tables in the same transaction to get a consistent view
+	err = withTx(ctx, db, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT metric_id, namespace, metric_name, region, dimensions, from_timestamp, to_timestamp, updated_at
+			FROM metrics`+s+`
+			WHERE updated_at >= ?
+			ORDER BY metric_id
+		`, since)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var mc MetricChange
+			var dimensions string
+			if err := rows.Scan(&mc.MetricID, &mc.Namespace, &mc.MetricName, &mc.Region, &dimensions, &mc.FromTS, &mc.ToTS, &mc.UpdatedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			mc.Dimensions = json.RawMessage(dimensions)
+			changes.Metrics = append(changes.Metrics, mc)
+			changes.Version = max(changes.Version, mc.UpdatedAt)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i := range changes.Metrics {
+			mc := &changes.Metrics[i]
+			ls := lifetimeTableSuffix(s, mc.Namespace)
+			err := tx.QueryRowContext(ctx, `SELECT from_timestamp, to_timestamp FROM metrics_lifetime`+ls+` WHERE metric_id = ?`, mc.MetricID).
+				Scan(&mc.LifetimeFrom, &mc.LifetimeTo)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		rows, err = tx.QueryContext(ctx, `SELECT namespace, region, timestamp, count FROM active_series`+s+` WHERE timestamp >= ?`, since)
+		if isNoSuchTable(err) {
+			// the partition is created before the active series table is added
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var as model.ActiveSeries
+			var ts int64
+			if err := rows.Scan(&as.Namespace, &as.Region, &ts, &as.Count); err != nil {
+				return err
+			}
+			as.Timestamp = time.Unix(ts, 0).UTC()
+			changes.ActiveSeries = append(changes.ActiveSeries, as)
+		}
+		return rows.Err()
+	})
+	if isNoSuchTable(err) {
+		// the partition is empty
+		return changes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// ApplyPartitionChanges writes the changes to the partition file, which is created if it doesn't exist.
+func ApplyPartitionChanges(ctx context.Context, path string, changes *Changes) error {
+	s, err := partitionSuffix(path)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(driverName, sqlite.DSN(path, sqlite.Options{WAL: true, BusyTimeout: busyTimeout}))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		initialized := make(map[string]struct{})
+		for _, mc := range changes.Metrics {
+			ls := lifetimeTableSuffix(s, mc.Namespace)
+			if _, ok := initialized[ls]; !ok {
+				if err := createTables(ctx, tx, s, ls); err != nil {
+					return err
+				}
+				initialized[ls] = struct{}{}
+			}
+
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO metrics`+s+` (
+					metric_id,
+					namespace,
+					metric_name,
+					region,
+					dimensions,
+					from_timestamp,
+					to_timestamp,
+					updated_at
+				) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(metric_id) DO UPDATE SET
+					from_timestamp = excluded.from_timestamp,
+					to_timestamp = excluded.to_timestamp,
+					updated_at = excluded.updated_at;
+				`,
+				mc.MetricID,
+				mc.Namespace,
+				mc.MetricName,
+				mc.Region,
+				string(mc.Dimensions),
+				mc.FromTS,
+				mc.ToTS,
+				mc.UpdatedAt,
+			)
+			if err != nil {
+				return err
+			}
+
+			if mc.LifetimeFrom == 0 && mc.LifetimeTo == 0 {
+				continue
+			}
+			res, err := tx.ExecContext(ctx, `
+				INSERT OR IGNORE INTO metrics_lifetime`+ls+` (
+					metric_id,
+					from_timestamp,
+					to_timestamp
+				) VALUES (?, ?, ?);
+				`,
+				mc.MetricID,
+				mc.LifetimeFrom,
+				mc.LifetimeTo,
+			)
+			if err != nil {
+				return err
+			}
+			rowsAffected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rowsAffected == 0 {
+				_, err = tx.ExecContext(ctx, `
+					UPDATE metrics_lifetime`+ls+` SET
+						from_timestamp = ?,
+						to_timestamp = ?
+					WHERE metric_id = ?;
+					`,
+					mc.LifetimeFrom,
+					mc.LifetimeTo,
+					mc.MetricID,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, as := range changes.ActiveSeries {
+			ls := lifetimeTableSuffix(s, as.Namespace)
+			if _, ok := initialized[ls]; !ok {
+				if err := createTables(ctx, tx, s, ls); err != nil {
+					return err
+				}
+				initialized[ls] = struct{}{}
+			}
+			_, err := tx.ExecContext(ctx, `
+				INSERT OR REPLACE INTO active_series`+s+` (
+					namespace,
+					region,
+					timestamp,
+					count
+				) VALUES (?, ?, ?, ?);
+				`,
+				as.Namespace,
+				as.Region,
+				as.Timestamp.Unix(),
+				as.Count,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// the labels of all the series, besides the dimensions
+var seriesLabelNames = []string{"__name__", "MetricName", "Namespace", "Region"}
+
+// forEachPartition calls f with the database, the joined tables and the conditions of the series matching lm in each partition of the time range.
+// The tables of the series are m, and the lifetimes are ml.
+func (ldb *LabelDB) forEachPartition(ctx context.Context, from, to time.Time, lm []*labels.Matcher, f func(db *sql.DB, tables string, where string, args []interface{}) error) error {
+	labelCondition, labelArgs, ns, err := buildLabelConditions(lm)
+	if err != nil {
+		return err
+	}
+	for _, tr := range ldb.PartitionLayout().getLifetimeRanges(from, to) {
+		namespaces, skip := ldb.pruneNamespaces(ctx, tr, ns)
+		if skip {
+			continue
+		}
+		db, err := ldb.getDB(tr.From)
+		if err != nil {
+			return err
+		}
+		timeCondition, timeArgs := buildTimeConditions(tr)
+		s := ldb.PartitionLayout().getTableSuffix(tr.From)
+		lt, err := lifetimeTable(ctx, db, s, namespaces)
+		if err == nil {
+			tables := lt + ` ml
+JOIN metrics` + s + ` m ON ml.metric_id = m.metric_id`
+			err = f(db, tables, strings.Join(append(timeCondition, labelCondition...), " AND "), append(timeArgs, labelArgs...))
+		}
+		if isNoSuchTable(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LabelNames returns the sorted names of the labels of the series matching lm in the time range,
+// which are the dimension keys and the labels of all the series, e.g. Namespace.
+func (ldb *LabelDB) LabelNames(ctx context.Context, from, to time.Time, lm []*labels.Matcher) ([]string, error) {
+	names := make(map[string]struct{})
+	matched := false
+	err := ldb.forEachPartition(ctx, from, to, lm, func(db *sql.DB, tables string, where string, args []interface{}) error {
+		// the series without the dimensions have the NULL key
+		rows, err := db.QueryContext(ctx, `SELECT DISTINCT d.key
+FROM `+tables+`
+LEFT JOIN json_each(m.dimensions) d
+WHERE `+where, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key sql.NullString
+			if err := rows.Scan(&key); err != nil {
+				return err
+			}
+			matched = true
+			if key.Valid {
+				names[key.String] = struct{}{}
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(names)+len(seriesLabelNames))
+	if matched {
+		result = append(result, seriesLabelNames...)
+	}
+	for name := range names {
+		if !slices.Contains(seriesLabelNames, name) {
+			result = append(result, name)
+		}
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+// labelValueColumn returns the SQL expression of the value of the label in the labels of the series, and its arguments.
+// The absent dimensions are NULL.
+func labelValueColumn(name string) (string, []interface{}) {
+	switch name {
+	case "__name__":
+		return "safe_metric_name(m.metric_name)", nil
+	case "MetricName":
+		return "m.metric_name", nil
+	case "Namespace":
+		return "m.namespace", nil
+	case "Region":
+		return "m.region", nil
+	default:
+		return "m.dimensions->>?", []interface{}{`$."` + name + `"`}
+	}
+}
+
+// LabelValues returns the sorted distinct values of the label of the series matching lm in the time range.
+// The values are selected in each partition without loading the series, and the first limit values are returned if limit > 0.
+func (ldb *LabelDB) LabelValues(ctx context.Context, name string, from, to time.Time, lm []*labels.Matcher, limit int) ([]string, error) {
+	column, columnArgs := labelValueColumn(name)
+	values := make(map[string]struct{})
+	err := ldb.forEachPartition(ctx, from, to, lm, func(db *sql.DB, tables string, where string, args []interface{}) error {
+		q := `SELECT DISTINCT ` + column + ` AS value
+FROM ` + tables + `
+WHERE ` + where + ` AND value != ''
+ORDER BY value`
+		args = append(append([]interface{}{}, columnArgs...), args...)
+		// the first values of each partition include the first values of all the partitions
+		if limit > 0 {
+			q += ` LIMIT ?`
+			args = append(args, limit)
+		}
+		rows, err := db.QueryContext(ctx, q, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var value string
+			if err := rows.Scan(&value); err != nil {
+				return err
+			}
+			values[value] = struct{}{}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := slices.Sorted(maps.Keys(values))
+	if result == nil {
+		result = []string{}
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"time"
+)
+
+// the auto_vacuum mode of the partitions which free pages are reclaimed by the incremental vacuum
+const autoVacuumIncremental = 2
+
+// Optimize runs PRAGMA optimize and the incremental vacuum on the partitions not used for idle, and returns the number of the reclaimed pages.
+// The partitions created before the incremental auto vacuum are vacuumed entirely once to enable it.
+func (ldb *LabelDB) Optimize(ctx context.Context, idle time.Duration) (int64, error) {
+	files, err := PartitionFiles(ldb.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+	for _, dbPath := range files {
+		if ldb.usedSince(dbPath, time.Now().UTC().Add(-idle)) {
+			continue
+		}
+		n, err := optimizePartition(ctx, filepath.Join(ldb.dir, dbPath))
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += n
+	}
+	return reclaimed, nil
+}
+
+func (ldb *LabelDB) usedSince(dbPath string, t time.Time) bool {
+	ldb.mu.RLock()
+	defer ldb.mu.RUnlock()
+	dbCache, ok := ldb.dbCache[dbPath]
+	return ok && dbCache.lastUsed.After(t)
+}
+
+func optimizePartition(ctx context.Context, path string) (int64, error) {
+	db, err := openPartitionFile(path, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	// the pragmas are connection local
+	db.SetMaxOpenConns(1)
+
+	var before, after int64
+	if err := db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&before); err != nil {
+		return 0, err
+	}
+	if _, err := db.ExecContext(ctx, `PRAGMA optimize`); err != nil {
+		return 0, err
+	}
+	var mode int
+	if err := db.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return 0, err
+	}
+	if mode == autoVacuumIncremental {
+		err = incrementalVacuum(ctx, db)
+	} else {
+		// the auto vacuum mode of the existing database is changed by VACUUM
+		if _, err := db.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+			return 0, err
+		}
+		_, err = db.ExecContext(ctx, `VACUUM`)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&after); err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+// incrementalVacuum reclaims all the free pages, a page is reclaimed by each step of the statement.
+func incrementalVacuum(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `PRAGMA incremental_vacuum`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
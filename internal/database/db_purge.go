@@ -0,0 +1,140 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// PurgeNamespace deletes the metrics of the namespace from all partitions, and returns the number of deleted series per partition.
+// If dryRun is true, it only counts the series.
+func (ldb *LabelDB) PurgeNamespace(ctx context.Context, namespace string, dryRun bool) (map[string]int, error) {
+	files, err := PartitionFiles(ldb.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	purged := make(map[string]int)
+	for _, dbPath := range files {
+		s, err := partitionSuffix(dbPath)
+		if err != nil {
+			return purged, err
+		}
+		ls := lifetimeTableSuffix(s, namespace)
+		db, err := ldb.getPartitionDB(dbPath)
+		if err != nil {
+			return purged, err
+		}
+
+		var count int
+		err = withTx(ctx, db, func(tx *sql.Tx) error {
+			err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM metrics`+s+` WHERE namespace = ?`, namespace).Scan(&count)
+			if err != nil || count == 0 || dryRun {
+				return err
+			}
+
+			// the lifetime table can be shared with the other namespace which has the same sanitized name
+			_, err = tx.ExecContext(ctx, "DELETE FROM `metrics_lifetime"+ls+"` WHERE metric_id IN (SELECT metric_id FROM metrics"+s+" WHERE namespace = ?)", namespace)
+			if err != nil && !isNoSuchTable(err) {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM metrics`+s+` WHERE namespace = ?`, namespace); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `DELETE FROM active_series`+s+` WHERE namespace = ?`, namespace)
+			if isNoSuchTable(err) {
+				// the partition is created before the active series table is added
+				return nil
+			}
+			return err
+		})
+		if isNoSuchTable(err) {
+			// the partition is empty
+			continue
+		} else if err != nil {
+			return purged, err
+		}
+		if count == 0 {
+			continue
+		}
+		purged[dbPath] = count
+		if !dryRun {
+			slog.Info("purged namespace from partition", "namespace", namespace, "dbPath", dbPath, "series", count)
+		}
+	}
+	if dryRun {
+		return purged, nil
+	}
+
+	ldb.mu.Lock()
+	for key := range ldb.bounds {
+		if strings.HasSuffix(key, "\x00"+namespace) {
+			delete(ldb.bounds, key)
+		}
+	}
+	ldb.mu.Unlock()
+	db, err := ldb.getMetadataDB()
+	if err != nil {
+		return purged, err
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM partition_namespaces WHERE namespace = ?`, namespace)
+	return purged, err
+}
+
+// PurgeStaleSeries deletes the metrics of the namespace not updated since before, and returns the number of deleted series per partition.
+// The partitions ended before it are left to the retention, since all of their series are stale.
+func (ldb *LabelDB) PurgeStaleSeries(ctx context.Context, namespace string, before time.Time) (map[string]int, error) {
+	files, err := PartitionFiles(ldb.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	purged := make(map[string]int)
+	for _, dbPath := range files {
+		matches := partitionFilePattern.FindStringSubmatch(dbPath)
+		to, err := time.ParseInLocation("20060102", matches[2], time.UTC)
+		if err != nil {
+			continue
+		}
+		// the partition ends at the end of the day
+		if !to.Add(24 * time.Hour).After(before) {
+			continue
+		}
+		s, err := partitionSuffix(dbPath)
+		if err != nil {
+			return purged, err
+		}
+		ls := lifetimeTableSuffix(s, namespace)
+		db, err := ldb.getPartitionDB(dbPath)
+		if err != nil {
+			return purged, err
+		}
+
+		var count int64
+		err = withTx(ctx, db, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "DELETE FROM `metrics_lifetime"+ls+"` WHERE metric_id IN (SELECT metric_id FROM metrics"+s+" WHERE namespace = ? AND updated_at < ?)", namespace, before.Unix())
+			if err != nil && !isNoSuchTable(err) {
+				return err
+			}
+			res, err := tx.ExecContext(ctx, `DELETE FROM metrics`+s+` WHERE namespace = ? AND updated_at < ?`, namespace, before.Unix())
+			if err != nil {
+				return err
+			}
+			count, err = res.RowsAffected()
+			return err
+		})
+		if isNoSuchTable(err) {
+			// the partition is empty
+			continue
+		} else if err != nil {
+			return purged, err
+		}
+		if count > 0 {
+			purged[dbPath] = int(count)
+			slog.Info("purged stale series from partition", "namespace", namespace, "dbPath", dbPath, "series", count)
+		}
+	}
+	return purged, nil
+}
@@ -2,114 +2,513 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mtanda/prometheus-labels-db/internal/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 )
 
+const tracerName = "github.com/mtanda/prometheus-labels-db/internal/database"
+
+// errScanDone stops scanning the partitions when enough series are found.
+var errScanDone = errors.New("scan done")
+
+// QueryStats is the execution statistics of the queries, accumulated over the calls.
+type QueryStats struct {
+	PartitionsScanned int
+	// the partitions pruned by the namespace bounds, or without the tables of the namespace
+	PartitionsSkipped int
+	// the rows read from the partitions, including the series found in multiple partitions
+	RowsExamined int
+}
+
+// DefaultQueryConcurrency is the number of the partitions queried at once by QueryMetrics.
+const DefaultQueryConcurrency = 4
+
+// QueryOptions changes how QueryMetricsWithOptions queries the partitions.
+type QueryOptions struct {
+	// the execution statistics are added if not nil
+	Stats *QueryStats
+	// if not nil, the partitions which fail to be queried are skipped, and the errors are passed
+	OnPartitionError func(dbPath string, err error)
+	// the number of the partitions queried at once, DefaultQueryConcurrency if 0
+	Concurrency int
+	// if not zero, only the series recorded since the time are queried, e.g. to refresh the caches incrementally
+	UpdatedSince time.Time
+	// if not empty, only the series with a dimension value containing the string are queried
+	Contains string
+}
+
 func (ldb *LabelDB) QueryMetrics(ctx context.Context, from, to time.Time, lm []*labels.Matcher, limit int, result map[string]*model.Metric) (map[string]*model.Metric, error) {
+	return ldb.QueryMetricsWithOptions(ctx, from, to, lm, limit, result, QueryOptions{})
+}
+
+// QueryMetricsWithOptions is QueryMetrics with the options.
+func (ldb *LabelDB) QueryMetricsWithOptions(ctx context.Context, from, to time.Time, lm []*labels.Matcher, limit int, result map[string]*model.Metric, opts QueryOptions) (map[string]*model.Metric, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "LabelDB.QueryMetrics", trace.WithAttributes(
+		attribute.String("matchers", matchersString(lm)),
+		attribute.Int64("start", from.Unix()),
+		attribute.Int64("end", to.Unix()),
+		attribute.Int("limit", limit),
+	))
+	defer span.End()
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultQueryConcurrency
+	}
+	count := len(result)
+	err := ldb.scanMetrics(ctx, from, to, lm, limit, opts, concurrency, func(m *model.Metric) error {
+		k := m.UniqueKey()
+		_, ok := result[k]
+		// the other partitions may find the series until they are stopped
+		if !ok && limit != 0 && len(result) >= limit {
+			return errScanDone
+		}
+		if ok {
+			result[k].FromTS = time.Unix(min(m.FromTS.Unix(), result[k].FromTS.Unix()), 0).UTC()
+			result[k].ToTS = time.Unix(max(m.ToTS.Unix(), result[k].ToTS.Unix()), 0).UTC()
+		} else {
+			result[k] = m
+		}
+		// check if we have enough results
+		if limit != 0 && len(result) >= limit {
+			return errScanDone
+		}
+		return nil
+	})
+	span.SetAttributes(attribute.Int("series", len(result)-count))
+	if err != nil && !errors.Is(err, errScanDone) {
+		span.SetStatus(codes.Error, err.Error())
+		return result, err
+	}
+
+	// trim result to limit at the caller side
+	return result, nil
+}
+
+// matchersString formats lm as a series selector for the span attributes.
+func matchersString(lm []*labels.Matcher) string {
+	ms := make([]string, 0, len(lm))
+	for _, m := range lm {
+		ms = append(ms, m.String())
+	}
+	return "{" + strings.Join(ms, ", ") + "}"
+}
+
+// ScanMetrics calls f with each series as it is scanned, so that the whole result is not held in memory.
+// The series in seen are skipped, and the passed series are added to seen.
+// The lifetime of the series found in multiple partitions is the one in the first partition.
+// Scanning stops when f returns an error, and the error is returned.
+func (ldb *LabelDB) ScanMetrics(ctx context.Context, from, to time.Time, lm []*labels.Matcher, limit int, seen map[string]struct{}, f func(*model.Metric) error) error {
+	// one by one in the order of the partitions
+	return ldb.scanMetrics(ctx, from, to, lm, limit, QueryOptions{}, 1, func(m *model.Metric) error {
+		k := m.UniqueKey()
+		if _, ok := seen[k]; ok {
+			return nil
+		}
+		seen[k] = struct{}{}
+		return f(m)
+	})
+}
+
+func (ldb *LabelDB) scanMetrics(ctx context.Context, from, to time.Time, lm []*labels.Matcher, limit int, opts QueryOptions, concurrency int, f func(*model.Metric) error) error {
+	stats := opts.Stats
+	if stats == nil {
+		stats = &QueryStats{}
+	}
 	// convert prometheus label matchers to sql where clause
-	labelCondition, labelArgs, namespace, err := buildLabelConditions(lm)
+	labelCondition, labelArgs, ns, err := buildLabelConditions(lm)
 	if err != nil {
-		return result, err
+		return err
+	}
+	if !opts.UpdatedSince.IsZero() {
+		labelCondition = append(labelCondition, "m.updated_at >= ?")
+		labelArgs = append(labelArgs, opts.UpdatedSince.Unix())
 	}
 
-	// TODO: support multiple namespaces
-	trs := getLifetimeRanges(from, to)
+	// the partitions are queried by the workers, and f and stats are guarded by mu
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	trs := ldb.PartitionLayout().getLifetimeRanges(from, to)
 	for _, tr := range trs {
-		err = func() error {
-			db, err := ldb.getDB(tr.From)
+		// including the partitions where scanning is stopped by the others
+		if gctx.Err() != nil {
+			break
+		}
+		namespaces, skip := ldb.pruneNamespaces(gctx, tr, ns)
+		if skip {
+			mu.Lock()
+			stats.PartitionsSkipped++
+			mu.Unlock()
+			continue
+		}
+		g.Go(func() error {
+			errFromF := false
+			rowsExamined, err := ldb.scanPartition(gctx, tr, namespaces, labelCondition, labelArgs, opts.Contains, limit, func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if err := f(m); err != nil {
+					errFromF = true
+					return err
+				}
+				return nil
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			stats.RowsExamined += rowsExamined
 			if err != nil {
+				if !errFromF && errors.Is(err, ErrPartitionNotFound) {
+					stats.PartitionsSkipped++
+					return nil
+				}
+				if !errFromF && opts.OnPartitionError != nil && gctx.Err() == nil {
+					opts.OnPartitionError(ldb.PartitionLayout().getDBPath(tr.From), err)
+					stats.PartitionsSkipped++
+					return nil
+				}
+				// including the partition where scanning is stopped
+				stats.PartitionsScanned++
 				return err
 			}
-			timeCondition, timeArgs := buildTimeConditions(tr)
+			stats.PartitionsScanned++
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// scanPartition calls f with each series matching the conditions in the partition, and returns the number of the rows read.
+func (ldb *LabelDB) scanPartition(ctx context.Context, tr timeRange, namespaces namespaceSelector, labelCondition []string, labelArgs []interface{}, contains string, limit int, f func(*model.Metric) error) (rowsExamined int, err error) {
+	dbPath := ldb.PartitionLayout().getDBPath(tr.From)
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "partition query", trace.WithAttributes(attribute.String("db.path", dbPath)))
+	errFromF := false
+	defer func() {
+		if !errFromF {
+			err = wrapTableNotFound(err)
+		}
+		span.SetAttributes(attribute.Int("db.rows_examined", rowsExamined))
+		if err != nil && !errFromF && !errors.Is(err, ErrPartitionNotFound) {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	db, err := ldb.getDB(tr.From)
+	if err != nil {
+		return 0, err
+	}
+	timeCondition, timeArgs := buildTimeConditions(tr)
+	if contains != "" {
+		condition, args, err := containsCondition(ctx, db, contains)
+		if err != nil {
+			return 0, err
+		}
+		labelCondition = append(slices.Clip(labelCondition), condition)
+		labelArgs = append(slices.Clip(labelArgs), args...)
+	}
 
-			s := getTableSuffix(tr.From)
-			ls := getLifetimeTableSuffix(tr.From, namespace)
-			q := `SELECT m.*
-FROM metrics_lifetime` + ls + ` ml
+	s := ldb.PartitionLayout().getTableSuffix(tr.From)
+	lt, err := lifetimeTable(ctx, db, s, namespaces)
+	if err != nil {
+		return 0, err
+	}
+	q := `SELECT m.metric_id, m.namespace, m.metric_name, m.region, m.dimensions, m.from_timestamp, m.to_timestamp, m.updated_at, m.series_id
+FROM ` + lt + ` ml
 JOIN metrics` + s + ` m ON ml.metric_id = m.metric_id
 WHERE ` + strings.Join(append(timeCondition, labelCondition...), " AND ")
-			var limitArgs []interface{}
-			if limit > 0 {
-				q += ` LIMIT ?`
-				limitArgs = append(limitArgs, limit)
+	var limitArgs []interface{}
+	if limit > 0 {
+		q += ` LIMIT ?`
+		limitArgs = append(limitArgs, limit)
+	}
+	rows, err := db.QueryContext(ctx, q, append(append(timeArgs, labelArgs...), limitArgs...)...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		// stop the long scans, e.g. with regexps, at the deadline
+		if err := ctx.Err(); err != nil {
+			return rowsExamined, err
+		}
+		var m model.Metric
+		var dim []byte
+		var fromTS int64
+		var toTS int64
+		var updatedAt int64
+		if err := rows.Scan(&m.MetricID, &m.Namespace, &m.MetricName, &m.Region, &dim, &fromTS, &toTS, &updatedAt, &m.SeriesID); err != nil {
+			return rowsExamined, err
+		}
+		err = json.Unmarshal(dim, &m.Dimensions)
+		if err != nil {
+			return rowsExamined, err
+		}
+		m.FromTS = time.Unix(fromTS, 0).UTC()
+		m.ToTS = time.Unix(toTS, 0).UTC()
+		m.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		rowsExamined++
+		if err := f(&m); err != nil {
+			errFromF = true
+			return rowsExamined, err
+		}
+	}
+	return rowsExamined, rows.Err()
+}
+
+// CountMetrics returns the number of the series matching lm without fetching them.
+// The series continuing from the previous partition are counted once, by their lifetimes starting at the partition start.
+func (ldb *LabelDB) CountMetrics(ctx context.Context, from, to time.Time, lm []*labels.Matcher) (int, error) {
+	labelCondition, labelArgs, ns, err := buildLabelConditions(lm)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	prevScanned := false
+	for _, tr := range ldb.PartitionLayout().getLifetimeRanges(from, to) {
+		namespaces, skip := ldb.pruneNamespaces(ctx, tr, ns)
+		if skip {
+			prevScanned = false
+			continue
+		}
+		db, err := ldb.getDB(tr.From)
+		if err != nil {
+			return 0, err
+		}
+		conditions, args := buildTimeConditions(tr)
+		if prevScanned {
+			conditions = append(conditions, "ml.from_timestamp > ?")
+			args = append(args, tr.From.Unix())
+		}
+
+		s := ldb.PartitionLayout().getTableSuffix(tr.From)
+		var count int
+		lt, err := lifetimeTable(ctx, db, s, namespaces)
+		if err == nil {
+			q := `SELECT COUNT(*)
+FROM ` + lt + ` ml
+JOIN metrics` + s + ` m ON ml.metric_id = m.metric_id
+WHERE ` + strings.Join(append(conditions, labelCondition...), " AND ")
+			err = db.QueryRowContext(ctx, q, append(args, labelArgs...)...).Scan(&count)
+		}
+		if isNoSuchTable(err) {
+			prevScanned = false
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		total += count
+		prevScanned = true
+	}
+	return total, nil
+}
+
+// QueryByKeys returns the series of keys which exist in the time range, keyed by the hashes of the keys.
+// The series are looked up by the unique index, so that no label matching is needed.
+func (ldb *LabelDB) QueryByKeys(ctx context.Context, keys []model.SeriesKey, from, to time.Time) (map[uint64]*model.Metric, error) {
+	byNamespace := make(map[string][]model.SeriesKey)
+	for _, k := range keys {
+		byNamespace[k.Namespace] = append(byNamespace[k.Namespace], k)
+	}
+
+	result := make(map[uint64]*model.Metric)
+	for _, tr := range ldb.PartitionLayout().getLifetimeRanges(from, to) {
+		for namespace, nsKeys := range byNamespace {
+			if ldb.skipPartition(ctx, tr, namespace) {
+				continue
 			}
-			rows, err := db.QueryContext(ctx, q, append(append(timeArgs, labelArgs...), limitArgs...)...)
+			err := ldb.queryByKeys(ctx, tr, namespace, nsKeys, result)
+			if isNoSuchTable(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (ldb *LabelDB) queryByKeys(ctx context.Context, tr timeRange, namespace string, keys []model.SeriesKey, result map[uint64]*model.Metric) error {
+	db, err := ldb.getDB(tr.From)
+	if err != nil {
+		return err
+	}
+	timeCondition, timeArgs := buildTimeConditions(tr)
+	s := ldb.PartitionLayout().getTableSuffix(tr.From)
+	ls := ldb.PartitionLayout().getLifetimeTableSuffix(tr.From, namespace)
+	q := `SELECT m.metric_id, m.from_timestamp, m.to_timestamp, m.updated_at
+FROM metrics` + s + ` m
+JOIN metrics_lifetime` + ls + ` ml ON ml.metric_id = m.metric_id
+WHERE ` + strings.Join(append([]string{"m.namespace = ?", "m.metric_name = ?", "m.region = ?", "m.dimensions = ?"}, timeCondition...), " AND ")
+
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, q)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, k := range keys {
+			// same encoding as the recorded dimensions
+			dimensions := make(model.Dimensions, len(k.Dimensions))
+			copy(dimensions, k.Dimensions)
+			d, err := json.Marshal(dimensions)
 			if err != nil {
 				return err
 			}
-			defer rows.Close()
-
-			for rows.Next() {
-				var m model.Metric
-				var dim []byte
-				var fromTS int64
-				var toTS int64
-				var updatedAt int64
-				rows.Scan(&m.MetricID, &m.Namespace, &m.MetricName, &m.Region, &dim, &fromTS, &toTS, &updatedAt)
-				err = json.Unmarshal(dim, &m.Dimensions)
-				if err != nil {
-					return err
-				}
-				m.FromTS = time.Unix(fromTS, 0).UTC()
-				m.ToTS = time.Unix(toTS, 0).UTC()
-				m.UpdatedAt = time.Unix(updatedAt, 0).UTC()
-				k := m.UniqueKey()
-				if _, ok := result[k]; ok {
-					result[k].FromTS = time.Unix(min(m.FromTS.Unix(), result[k].FromTS.Unix()), 0).UTC()
-					result[k].ToTS = time.Unix(max(m.ToTS.Unix(), result[k].ToTS.Unix()), 0).UTC()
-				} else {
-					result[k] = &m
-				}
+			m := model.Metric{
+				SeriesID:   k.ID(),
+				Namespace:  k.Namespace,
+				MetricName: k.MetricName,
+				Region:     k.Region,
+				Dimensions: dimensions,
 			}
-			return nil
-		}()
-		if err != nil {
-			if strings.Contains(err.Error(), "no such table: ") {
+			var fromTS, toTS, updatedAt int64
+			err = stmt.QueryRowContext(ctx, append([]interface{}{k.Namespace, k.MetricName, k.Region, d}, timeArgs...)...).
+				Scan(&m.MetricID, &fromTS, &toTS, &updatedAt)
+			if errors.Is(err, sql.ErrNoRows) {
 				continue
+			} else if err != nil {
+				return err
+			}
+			m.FromTS = time.Unix(fromTS, 0).UTC()
+			m.ToTS = time.Unix(toTS, 0).UTC()
+			m.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+
+			h := k.Hash()
+			if r, ok := result[h]; ok {
+				r.FromTS = time.Unix(min(m.FromTS.Unix(), r.FromTS.Unix()), 0).UTC()
+				r.ToTS = time.Unix(max(m.ToTS.Unix(), r.ToTS.Unix()), 0).UTC()
+			} else {
+				result[h] = &m
 			}
-			return result, err
 		}
+		return nil
+	})
+}
 
-		// check if we have enough results
-		if limit != 0 && len(result) >= limit {
-			break
+// namespaceSelector is the namespaces of the lifetime tables read by the query, derived from the Namespace matchers.
+// The matchers are still applied to the series, so the tables only need to cover the matched namespaces.
+type namespaceSelector struct {
+	// the namespaces, or all the namespaces if nil
+	names []string
+	// the prefix of all the namespaces if names is nil, e.g. "AWS/" for Namespace=~"AWS/.*"
+	prefix string
+}
+
+// pruneNamespaces returns the namespaces of ns which can have the metrics in the partition, and whether the partition can be skipped.
+func (ldb *LabelDB) pruneNamespaces(ctx context.Context, tr timeRange, ns namespaceSelector) (namespaceSelector, bool) {
+	if ns.names == nil {
+		return ns, ldb.skipPartition(ctx, tr, "")
+	}
+	var pruned namespaceSelector
+	for _, namespace := range ns.names {
+		if !ldb.skipPartition(ctx, tr, namespace) {
+			pruned.names = append(pruned.names, namespace)
 		}
 	}
+	return pruned, len(pruned.names) == 0
+}
 
-	// trim result to limit at the caller side
-	return result, nil
+// lifetimeTable returns the lifetime table of the namespace in the partition of the table suffix s.
+// For multiple namespaces, it returns the union of their lifetime tables in the partition,
+// and TableNotFoundError if the partition has none, same as the missing table of a namespace.
+func lifetimeTable(ctx context.Context, db *sql.DB, s string, ns namespaceSelector) (string, error) {
+	if len(ns.names) == 1 {
+		return "metrics_lifetime" + lifetimeTableSuffix(s, ns.names[0]), nil
+	}
+	pattern := "metrics_lifetime" + lifetimeTableSuffix(s, "")
+	// the shadow tables of the R*Tree are not virtual tables
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND substr(name, 1, ?) = ? AND sql LIKE 'CREATE VIRTUAL TABLE%' ORDER BY name`, len(pattern), pattern)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		tables = append(tables, name)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	// the namespaces sharing the sanitized name share the table
+	wanted := make(map[string]struct{}, len(ns.names))
+	for _, namespace := range ns.names {
+		wanted["metrics_lifetime"+lifetimeTableSuffix(s, namespace)] = struct{}{}
+	}
+	prefix := "metrics_lifetime" + lifetimeTableSuffix(s, ns.prefix)
+	var selects []string
+	for _, name := range tables {
+		if _, ok := wanted[name]; ns.names != nil && !ok {
+			continue
+		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		selects = append(selects, "SELECT * FROM `"+name+"`")
+	}
+	if len(selects) == 0 {
+		return "", &TableNotFoundError{Table: prefix + "*"}
+	}
+	// each series has the lifetime only in the table of its namespace, so the union has no duplicates
+	return "(" + strings.Join(selects, " UNION ALL ") + ")", nil
 }
 
-func buildLabelConditions(lm []*labels.Matcher) ([]string, []interface{}, string, error) {
+func buildLabelConditions(lm []*labels.Matcher) ([]string, []interface{}, namespaceSelector, error) {
 	var labelCondition []string
 	var labelArgs []interface{}
-	var namespace string
+	var ns namespaceSelector
 	for _, m := range lm {
 		ln := m.Name
 		lv := m.Value
 		if ln == "Namespace" {
-			namespace = lv
+			ns = ns.narrow(m)
+		}
+		if ln == "__name__" {
+			condition, args := metricNameCondition(m)
+			labelCondition = append(labelCondition, condition)
+			labelArgs = append(labelArgs, args...)
+			continue
 		}
 		switch ln {
 		case "Namespace":
 			ln = `m.namespace`
-		case "__name__":
-			ln = `m.metric_name`
 		case "MetricName":
 			ln = `m.metric_name`
 		case "Region":
 			ln = `m.region`
 		default:
-			ln = `IFNULL(m.dimensions->>'$.` + ln + `', "")`
+			// same as Prometheus, the absent dimension has the empty value, e.g. dim="" matches the series without dim
+			ln = `IFNULL(m.dimensions->>'$.` + ln + `', '')`
 		}
 		switch m.Type {
 		case labels.MatchEqual:
+			if isDimension(m.Name) && lv != "" {
+				// look up the series by the dimension index instead of scanning the dimensions
+				labelCondition = append(labelCondition, `m.metric_id IN (SELECT metric_id FROM metric_dimensions WHERE name = ? AND value = ?)`)
+				labelArgs = append(labelArgs, m.Name, lv)
+				continue
+			}
 			labelCondition = append(labelCondition, ln+" = ?")
 			labelArgs = append(labelArgs, lv)
 		case labels.MatchNotEqual:
@@ -123,10 +522,62 @@ func buildLabelConditions(lm []*labels.Matcher) ([]string, []interface{}, string
 			labelArgs = append(labelArgs, lv)
 		}
 	}
-	if namespace == "" {
-		return nil, nil, "", errors.New("namespace label matcher is required")
+	return labelCondition, labelArgs, ns, nil
+}
+
+// isDimension reports whether the label is a dimension, not the label of all the series.
+func isDimension(name string) bool {
+	switch name {
+	case "__name__", "Namespace", "MetricName", "Region":
+		return false
+	}
+	return true
+}
+
+// metricNameCondition returns the condition of the __name__ matcher, which matches both the original metric name and the safe one in the labels.
+func metricNameCondition(m *labels.Matcher) (string, []interface{}) {
+	var condition string
+	var args []interface{}
+	switch m.Type {
+	case labels.MatchEqual, labels.MatchNotEqual:
+		if !strings.Contains(m.Value, "_") || model.SafeMetricName(m.Value) != m.Value {
+			// the value is not the safe name of the other names
+			condition = `m.metric_name = ?`
+			args = []interface{}{m.Value}
+		} else {
+			// each "_" of the safe name replaces a character, so GLOB narrows down the names before the function is called
+			condition = `(m.metric_name GLOB ? AND safe_metric_name(m.metric_name) = ?)`
+			args = []interface{}{strings.ReplaceAll(m.Value, "_", "?"), m.Value}
+		}
+	case labels.MatchRegexp, labels.MatchNotRegexp:
+		condition = `(m.metric_name REGEXP ? OR safe_metric_name(m.metric_name) REGEXP ?)`
+		args = []interface{}{m.Value, m.Value}
+	}
+	if m.Type == labels.MatchNotEqual || m.Type == labels.MatchNotRegexp {
+		condition = "NOT (" + condition + ")"
+	}
+	return condition, args
+}
+
+// narrow returns the selector narrowed by the Namespace matcher m, if m has fewer namespaces.
+// The other matchers, e.g. Namespace!="AWS/EC2", are queried over all the lifetime tables.
+func (ns namespaceSelector) narrow(m *labels.Matcher) namespaceSelector {
+	switch m.Type {
+	case labels.MatchEqual:
+		return namespaceSelector{names: []string{m.Value}}
+	case labels.MatchRegexp:
+		if ns.names != nil {
+			return ns
+		}
+		// the alternation of the namespaces, e.g. Namespace=~"AWS/EC2|AWS/ELB"
+		if set := m.SetMatches(); len(set) > 0 {
+			return namespaceSelector{names: set}
+		}
+		if prefix := m.Prefix(); len(prefix) > len(ns.prefix) {
+			return namespaceSelector{prefix: prefix}
+		}
 	}
-	return labelCondition, labelArgs, namespace, nil
+	return ns
 }
 
 func buildTimeConditions(tr timeRange) ([]string, []interface{}) {
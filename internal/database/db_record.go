@@ -15,13 +15,28 @@ import (
 )
 
 func (ldb *LabelDB) init(ctx context.Context, tx *sql.Tx, t time.Time, namespace string) error {
-	suffix := getTableSuffix(t)
-	lsuffix := getLifetimeTableSuffix(t, namespace)
+	suffix := ldb.PartitionLayout().getTableSuffix(t)
+	lsuffix := ldb.PartitionLayout().getLifetimeTableSuffix(t, namespace)
 	_, found := ldb.initialized.Get(lsuffix)
 	if found {
 		return nil
 	}
 
+	if err := createTables(ctx, tx, suffix, lsuffix); err != nil {
+		return err
+	}
+	if ldb.searchIndexEnabled() {
+		if err := createSearchIndex(ctx, tx, suffix); err != nil {
+			return err
+		}
+	}
+
+	ldb.initialized.Add(lsuffix, struct{}{})
+
+	return nil
+}
+
+func createTables(ctx context.Context, tx *sql.Tx, suffix string, lsuffix string) error {
 	data := struct {
 		MetricsCurSuffix         string
 		MetricsLifetimeCurSuffix string
@@ -38,14 +53,10 @@ func (ldb *LabelDB) init(ctx context.Context, tx *sql.Tx, t time.Time, namespace
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, sb.String())
-	if err != nil {
+	if _, err = tx.ExecContext(ctx, sb.String()); err != nil {
 		return err
 	}
-
-	ldb.initialized.Add(lsuffix, struct{}{})
-
-	return nil
+	return migrateTx(ctx, tx, suffix)
 }
 
 func withTx(ctx context.Context, db *sql.DB, f func(tx *sql.Tx) error) error {
@@ -71,28 +82,86 @@ func withTx(ctx context.Context, db *sql.DB, f func(tx *sql.Tx) error) error {
 }
 
 func (ldb *LabelDB) RecordMetric(ctx context.Context, metric model.Metric) error {
-	if metric.ToTS.Before(metric.FromTS) {
-		return errors.New("from timestamp is greater than to timestamp")
+	return ldb.RecordMetrics(ctx, []model.Metric{metric})
+}
+
+// partitionWrite is a metric written to a partition, in the lifetime range of the partition.
+type partitionWrite struct {
+	metric *model.Metric
+	tr     timeRange
+}
+
+// RecordMetrics records the metrics in a transaction per partition, which is much faster than recording them one by one.
+// The partitions are written in order, and the partitions written before an error keep the metrics.
+func (ldb *LabelDB) RecordMetrics(ctx context.Context, metrics []model.Metric) error {
+	layout := ldb.PartitionLayout()
+	var partitions []string
+	writes := make(map[string][]partitionWrite)
+	for i := range metrics {
+		metric := &metrics[i]
+		if metric.ToTS.Before(metric.FromTS) {
+			return errors.New("from timestamp is greater than to timestamp")
+		}
+		for _, tr := range layout.getLifetimeRanges(metric.FromTS, metric.ToTS) {
+			dbPath := layout.getDBPath(tr.From)
+			if _, ok := writes[dbPath]; !ok {
+				partitions = append(partitions, dbPath)
+			}
+			writes[dbPath] = append(writes[dbPath], partitionWrite{metric: metric, tr: tr})
+		}
 	}
 
-	trs := getLifetimeRanges(metric.FromTS, metric.ToTS)
-	for _, tr := range trs {
-		db, err := ldb.getDB(tr.From)
-		if err != nil {
+	for _, dbPath := range partitions {
+		if err := ldb.recordPartition(ctx, dbPath, writes[dbPath]); err != nil {
 			return err
 		}
-		err = withTx(ctx, db, func(tx *sql.Tx) error {
-			err := ldb.init(ctx, tx, tr.From, metric.Namespace)
-			if err != nil {
-				return err
-			}
-			return ldb.recordMetricToPartition(ctx, tx, metric, tr)
-		})
-		if err != nil {
+	}
+	return nil
+}
+
+func (ldb *LabelDB) recordPartition(ctx context.Context, dbPath string, writes []partitionWrite) error {
+	// the bounds of each namespace are widened once by the lifetimes of all the metrics
+	bounds := make(map[string]timeRange)
+	var namespaces []string
+	for _, w := range writes {
+		b, ok := bounds[w.metric.Namespace]
+		if !ok {
+			namespaces = append(namespaces, w.metric.Namespace)
+			b = w.tr
+		}
+		if w.tr.From.Before(b.From) {
+			b.From = w.tr.From
+		}
+		if w.tr.To.After(b.To) {
+			b.To = w.tr.To
+		}
+		bounds[w.metric.Namespace] = b
+	}
+	for _, namespace := range namespaces {
+		if err := ldb.updateNamespaceBounds(ctx, dbPath, namespace, bounds[namespace]); err != nil {
 			return err
 		}
 	}
 
+	db, err := ldb.getDB(writes[0].tr.From)
+	if err != nil {
+		return err
+	}
+	err = withTx(ctx, db, func(tx *sql.Tx) error {
+		for _, w := range writes {
+			if err := ldb.init(ctx, tx, w.tr.From, w.metric.Namespace); err != nil {
+				return err
+			}
+			if err := ldb.recordMetricToPartition(ctx, tx, *w.metric, w.tr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ldb.prepareStmts(ctx, dbPath)
 	return nil
 }
 
@@ -103,22 +172,27 @@ func (ldb *LabelDB) recordMetricToPartition(ctx context.Context, tx *sql.Tx, met
 	}
 
 	// metrics
-	s := getTableSuffix(tr.From)
-	row := tx.QueryRowContext(ctx, `
+	dbPath := ldb.PartitionLayout().getDBPath(tr.From)
+	s := ldb.PartitionLayout().getTableSuffix(tr.From)
+	selectStmt, err := ldb.stmt(ctx, tx, dbPath, `
 		SELECT metric_id, from_timestamp, to_timestamp FROM metrics`+s+`
 		WHERE
 			namespace = ? AND
 			metric_name = ? AND
 			region = ? AND
 			dimensions = ?
-	`, metric.Namespace, metric.MetricName, metric.Region, d)
+	`)
+	if err != nil {
+		return err
+	}
+	row := selectStmt.QueryRowContext(ctx, metric.Namespace, metric.MetricName, metric.Region, d)
 
 	var metricID int64
 	var fromTS int64
 	var toTS int64
 	err = row.Scan(&metricID, &fromTS, &toTS)
 	if errors.Is(err, sql.ErrNoRows) {
-		res, err := tx.ExecContext(ctx, `
+		insertStmt, err := ldb.stmt(ctx, tx, dbPath, `
 			INSERT INTO metrics`+s+` (
 				namespace,
 				metric_name,
@@ -128,7 +202,11 @@ func (ldb *LabelDB) recordMetricToPartition(ctx context.Context, tx *sql.Tx, met
 				to_timestamp,
 				updated_at
 			) VALUES (?, ?, ?, ?, ?, ?, ?);
-			`,
+			`)
+		if err != nil {
+			return err
+		}
+		res, err := insertStmt.ExecContext(ctx,
 			metric.Namespace,
 			metric.MetricName,
 			metric.Region,
@@ -146,13 +224,17 @@ func (ldb *LabelDB) recordMetricToPartition(ctx context.Context, tx *sql.Tx, met
 			return err
 		}
 	} else if err == nil && metricID > 0 {
-		_, err := tx.ExecContext(ctx, `
+		updateStmt, err := ldb.stmt(ctx, tx, dbPath, `
 			UPDATE metrics`+s+` SET
 				from_timestamp = ?,
 				to_timestamp = ?,
 				updated_at = ?
 			WHERE metric_id = ?;
-			`,
+			`)
+		if err != nil {
+			return err
+		}
+		_, err = updateStmt.ExecContext(ctx,
 			min(tr.From.Unix(), fromTS),
 			max(tr.To.Unix(), toTS),
 			time.Now().UTC().Unix(),
@@ -166,14 +248,18 @@ func (ldb *LabelDB) recordMetricToPartition(ctx context.Context, tx *sql.Tx, met
 	}
 
 	// metrics_lifetime
-	ls := getLifetimeTableSuffix(tr.From, metric.Namespace)
-	res, err := tx.ExecContext(ctx, `
+	ls := ldb.PartitionLayout().getLifetimeTableSuffix(tr.From, metric.Namespace)
+	insertLifetimeStmt, err := ldb.stmt(ctx, tx, dbPath, `
 		INSERT OR IGNORE INTO metrics_lifetime`+ls+`(
 			metric_id,
 			from_timestamp,
 			to_timestamp
 		) VALUES (?, ?, ?);
-		`,
+		`)
+	if err != nil {
+		return err
+	}
+	res, err := insertLifetimeStmt.ExecContext(ctx,
 		metricID,
 		tr.From.Unix(),
 		tr.To.Unix(),
@@ -186,12 +272,16 @@ func (ldb *LabelDB) recordMetricToPartition(ctx context.Context, tx *sql.Tx, met
 		return err
 	}
 	if rowsAffected == 0 {
-		_, err = tx.ExecContext(ctx, `
+		updateLifetimeStmt, err := ldb.stmt(ctx, tx, dbPath, `
 			UPDATE metrics_lifetime`+ls+` SET
 				from_timestamp = ?,
 				to_timestamp = ?
 			WHERE metric_id = ?;
-			`,
+			`)
+		if err != nil {
+			return err
+		}
+		_, err = updateLifetimeStmt.ExecContext(ctx,
 			min(tr.From.Unix(), fromTS),
 			max(tr.To.Unix(), toTS),
 			metricID,
@@ -207,6 +297,8 @@ func (ldb *LabelDB) recordMetricToPartition(ctx context.Context, tx *sql.Tx, met
 func (ldb *LabelDB) WalCheckpoint(ctx context.Context) error {
 	checkpointPRAGMA := `PRAGMA wal_checkpoint(TRUNCATE)`
 	var ok, pages, moved int
+	ldb.mu.RLock()
+	defer ldb.mu.RUnlock()
 	for _, dbCache := range ldb.dbCache {
 		if err := dbCache.db.QueryRow(checkpointPRAGMA).Scan(&ok, &pages, &moved); err != nil {
 			return err
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var partitionFilePattern = regexp.MustCompile(`^labels_(\d{8})_(\d{8})\.db$`)
+
+// PartitionFiles returns the names of the partition files in dir.
+func PartitionFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || !partitionFilePattern.MatchString(e.Name()) {
+			continue
+		}
+		files = append(files, e.Name())
+	}
+	return files, nil
+}
+
+// DeletePartitionsBefore deletes partition files whose whole time range is older than t.
+func (ldb *LabelDB) DeletePartitionsBefore(ctx context.Context, t time.Time) ([]string, error) {
+	files, err := PartitionFiles(ldb.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, dbPath := range files {
+		matches := partitionFilePattern.FindStringSubmatch(dbPath)
+		to, err := time.ParseInLocation("20060102", matches[2], time.UTC)
+		if err != nil {
+			continue
+		}
+		// the partition ends at the end of the day
+		if to.Add(24 * time.Hour).After(t) {
+			continue
+		}
+
+		if err := ldb.closePartitionDB(dbPath); err != nil {
+			return deleted, err
+		}
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			err := os.Remove(filepath.Join(ldb.dir, dbPath+suffix))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return deleted, err
+			}
+		}
+		if err := ldb.deletePartitionMetadata(ctx, dbPath); err != nil {
+			return deleted, err
+		}
+		slog.Info("deleted expired partition", "dbPath", dbPath)
+		deleted = append(deleted, dbPath)
+	}
+	// the deleted partitions need to be initialized again when they are written
+	ldb.initialized.Purge()
+
+	return deleted, nil
+}
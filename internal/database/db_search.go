@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// the shortest string searched by the trigrams of the search index
+const minSearchIndexLength = 3
+
+// errSearchIndexUnavailable is returned when the search index is enabled without FTS5.
+var errSearchIndexUnavailable = errors.New("the search index requires FTS5, build with -tags sqlite_fts5")
+
+// EnableSearchIndex creates the FTS5 index of the dimension values in the partitions written or opened after this call.
+func (ldb *LabelDB) EnableSearchIndex() error {
+	if !searchIndexAvailable {
+		return errSearchIndexUnavailable
+	}
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+	ldb.searchIndex = true
+	return nil
+}
+
+func (ldb *LabelDB) searchIndexEnabled() bool {
+	ldb.mu.RLock()
+	defer ldb.mu.RUnlock()
+	return ldb.searchIndex
+}
+
+// createSearchIndex creates the search index of the partition and indexes the existing series, if it doesn't exist.
+// A document of the index is the dimension values of a series separated by the newlines, and its rowid is the metric id.
+func createSearchIndex(ctx context.Context, tx *sql.Tx, suffix string) error {
+	exists, err := tableExists(ctx, tx, "dimension_search")
+	if err != nil || exists {
+		return err
+	}
+	for _, q := range []string{
+		`CREATE VIRTUAL TABLE dimension_search USING fts5(dimensions, tokenize = 'trigram case_sensitive 1')`,
+		`INSERT INTO dimension_search (rowid, dimensions)
+SELECT m.metric_id, (SELECT group_concat(value, char(10)) FROM json_each(m.dimensions)) FROM metrics` + suffix + ` m`,
+		`CREATE TRIGGER dimension_search_insert AFTER INSERT ON metrics` + suffix + `
+BEGIN
+	INSERT INTO dimension_search (rowid, dimensions)
+	SELECT new.metric_id, group_concat(value, char(10)) FROM json_each(new.dimensions);
+END`,
+		`CREATE TRIGGER dimension_search_delete AFTER DELETE ON metrics` + suffix + `
+BEGIN
+	DELETE FROM dimension_search WHERE rowid = old.metric_id;
+END`,
+	} {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureSearchIndex creates the search index of the partition opened, if the partition has the tables.
+func ensureSearchIndex(ctx context.Context, db *sql.DB, dbPath string) error {
+	suffix, err := partitionSuffix(dbPath)
+	if err != nil {
+		return err
+	}
+	exists, err := tableExists(ctx, db, "metrics"+suffix)
+	if err != nil || !exists {
+		return err
+	}
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		return createSearchIndex(ctx, tx, suffix)
+	})
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func tableExists(ctx context.Context, db queryer, name string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)`, name).Scan(&exists)
+	return exists, err
+}
+
+// containsCondition returns the condition of the series with a dimension value containing s.
+// The search index is used if the partition has it, or the dimension values are scanned.
+func containsCondition(ctx context.Context, db *sql.DB, s string) (string, []interface{}, error) {
+	// the string with the separator of the values would match across the values
+	if searchIndexAvailable && len(s) >= minSearchIndexLength && !strings.Contains(s, "\n") {
+		exists, err := tableExists(ctx, db, "dimension_search")
+		if err != nil {
+			return "", nil, err
+		}
+		if exists {
+			// the phrase of the trigrams, the double quotes are escaped by doubling them
+			return `m.metric_id IN (SELECT rowid FROM dimension_search WHERE dimension_search MATCH ?)`, []interface{}{`"` + strings.ReplaceAll(s, `"`, `""`) + `"`}, nil
+		}
+	}
+	return `m.metric_id IN (SELECT metric_id FROM metric_dimensions WHERE instr(value, ?) > 0)`, []interface{}{s}, nil
+}
+
+// SearchSeries returns the series matching lm with a dimension value containing s, e.g. the instances of "prod-api".
+// The search is case sensitive, and the first limit series are returned if limit > 0.
+func (ldb *LabelDB) SearchSeries(ctx context.Context, from, to time.Time, lm []*labels.Matcher, s string, limit int) (map[string]*model.Metric, error) {
+	if s == "" {
+		return nil, errors.New("the search string must not be empty")
+	}
+	return ldb.QueryMetricsWithOptions(ctx, from, to, lm, limit, map[string]*model.Metric{}, QueryOptions{Contains: s})
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Stats is the statistics of the partitions in the database directory for the capacity monitoring.
+type Stats struct {
+	Partitions   []PartitionStats `json:"partitions"`
+	SizeBytes    int64            `json:"sizeBytes"`
+	WALSizeBytes int64            `json:"walSizeBytes"`
+}
+
+// PartitionStats is the statistics of a partition file.
+// The series continuing over the partitions are counted in each partition.
+type PartitionStats struct {
+	Path         string           `json:"path"`
+	Start        time.Time        `json:"start"`
+	SizeBytes    int64            `json:"sizeBytes"`
+	WALSizeBytes int64            `json:"walSizeBytes"`
+	Series       int64            `json:"series"`
+	MinTime      time.Time        `json:"minTime"`
+	MaxTime      time.Time        `json:"maxTime"`
+	Namespaces   []NamespaceStats `json:"namespaces"`
+}
+
+// NamespaceStats is the statistics of the series of a namespace in a partition.
+type NamespaceStats struct {
+	Namespace string    `json:"namespace"`
+	Series    int64     `json:"series"`
+	MinTime   time.Time `json:"minTime"`
+	MaxTime   time.Time `json:"maxTime"`
+}
+
+// Stats returns the statistics of the partition files in the directory, which are read without opening them for writing.
+// The partitions not hydrated yet are not included.
+func (ldb *LabelDB) Stats(ctx context.Context) (*Stats, error) {
+	files, err := PartitionFiles(ldb.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		Partitions: make([]PartitionStats, 0, len(files)),
+	}
+	for _, dbPath := range files {
+		ps, err := partitionStats(ctx, filepath.Join(ldb.dir, dbPath))
+		if errors.Is(err, os.ErrNotExist) {
+			// the partition might be deleted by the retention
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ps.Path = dbPath
+		stats.Partitions = append(stats.Partitions, ps)
+		stats.SizeBytes += ps.SizeBytes
+		stats.WALSizeBytes += ps.WALSizeBytes
+	}
+	return stats, nil
+}
+
+func partitionStats(ctx context.Context, path string) (PartitionStats, error) {
+	s, err := partitionSuffix(path)
+	if err != nil {
+		return PartitionStats{}, err
+	}
+	start, err := PartitionStart(path)
+	if err != nil {
+		return PartitionStats{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return PartitionStats{}, err
+	}
+	ps := PartitionStats{
+		Start:      start,
+		SizeBytes:  info.Size(),
+		Namespaces: make([]NamespaceStats, 0),
+	}
+	if info, err := os.Stat(path + "-wal"); err == nil {
+		ps.WALSizeBytes = info.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return ps, err
+	}
+
+	db, err := openPartitionFile(path, true)
+	if err != nil {
+		return ps, err
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(ctx, `SELECT namespace, COUNT(*), MIN(from_timestamp), MAX(to_timestamp) FROM metrics`+s+` GROUP BY namespace ORDER BY namespace`)
+	if isNoSuchTable(err) {
+		// the partition is empty
+		return ps, nil
+	} else if err != nil {
+		return ps, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ns NamespaceStats
+		var minTS, maxTS int64
+		if err := rows.Scan(&ns.Namespace, &ns.Series, &minTS, &maxTS); err != nil {
+			return ps, err
+		}
+		ns.MinTime = time.Unix(minTS, 0).UTC()
+		ns.MaxTime = time.Unix(maxTS, 0).UTC()
+		ps.Series += ns.Series
+		if ps.MinTime.IsZero() || ns.MinTime.Before(ps.MinTime) {
+			ps.MinTime = ns.MinTime
+		}
+		if ns.MaxTime.After(ps.MaxTime) {
+			ps.MaxTime = ns.MaxTime
+		}
+		ps.Namespaces = append(ps.Namespaces, ns)
+	}
+	return ps, rows.Err()
+}
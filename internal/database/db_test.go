@@ -4,15 +4,22 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"math/rand"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/sqlite"
 	"github.com/prometheus/prometheus/model/labels"
 )
 
@@ -66,7 +73,7 @@ func TestInsertMetric(t *testing.T) {
 	var from int64
 	var to int64
 	var updatedAt int64
-	err = rows.Scan(&metric.MetricID, &metric.Namespace, &metric.MetricName, &metric.Region, &dim, &from, &to, &updatedAt)
+	err = rows.Scan(&metric.MetricID, &metric.Namespace, &metric.MetricName, &metric.Region, &dim, &from, &to, &updatedAt, &metric.SeriesID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -79,6 +86,7 @@ func TestInsertMetric(t *testing.T) {
 	metric.ToTS = time.Unix(to, 0).UTC()
 	metric.UpdatedAt = time.Unix(updatedAt, 0).UTC()
 	if metric.MetricID != 1 ||
+		metric.SeriesID != metric.Key().ID() ||
 		metric.Namespace != namespace ||
 		metric.MetricName != "test_name" ||
 		metric.Region != "test_region" ||
@@ -186,7 +194,7 @@ func TestUpdateMetric(t *testing.T) {
 	var from int64
 	var to int64
 	var updatedAt int64
-	err = rows.Scan(&metric.MetricID, &metric.Namespace, &metric.MetricName, &metric.Region, &dim, &from, &to, &updatedAt)
+	err = rows.Scan(&metric.MetricID, &metric.Namespace, &metric.MetricName, &metric.Region, &dim, &from, &to, &updatedAt, &metric.SeriesID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -199,6 +207,7 @@ func TestUpdateMetric(t *testing.T) {
 	metric.ToTS = time.Unix(to, 0).UTC()
 	metric.UpdatedAt = time.Unix(updatedAt, 0).UTC()
 	if metric.MetricID != 1 ||
+		metric.SeriesID != metric.Key().ID() ||
 		metric.Namespace != namespace ||
 		metric.MetricName != "test_name" ||
 		metric.Region != "test_region" ||
@@ -545,8 +554,15 @@ func TestQueryMetrics(t *testing.T) {
 			if len(got) != len(tt.want) {
 				t.Fatalf("unexpected length: got=%d, want=%d", len(got), len(tt.want))
 			}
+			// the metric ids depend on the insertion order of the map, so compare in the order of the label sets
+			key := func(m model.Metric) string {
+				return labels.FromMap(m.Labels()).String()
+			}
 			sort.Slice(got, func(i, j int) bool {
-				return got[i].MetricID < got[j].MetricID
+				return key(*got[i]) < key(*got[j])
+			})
+			sort.Slice(tt.want, func(i, j int) bool {
+				return key(tt.want[i]) < key(tt.want[j])
 			})
 			for i := range got {
 				if !got[i].Equal(tt.want[i]) {
@@ -557,39 +573,2543 @@ func TestQueryMetrics(t *testing.T) {
 	}
 }
 
-func BenchmarkInsert10000Metrics(b *testing.B) {
+func TestActiveSeries(t *testing.T) {
 	ctx := context.Background()
-	dbDir := b.TempDir()
+	dbDir := t.TempDir()
 	db, err := Open(dbDir)
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
 	defer db.Close()
 
-	now := time.Now().UTC()
-	for i := 0; i < 2; i++ {
-		for j := 0; j < 10000; j++ {
-			fromTS := now.Add(-1 * time.Duration(rand.Intn(365*24*60*60)) * time.Second)
-			if i == 0 {
-				fromTS = fromTS.Add(-365 * 24 * 60 * 60 * time.Second)
-			}
-			toTS := fromTS.Add(time.Duration(rand.Intn(60*60)+1) * time.Second)
-			err = db.RecordMetric(ctx, model.Metric{
-				Namespace:  "test_namespace",
-				MetricName: "test_name",
-				Region:     "test_region",
-				Dimensions: []model.Dimension{
-					{
-						Name:  "dim1",
-						Value: fmt.Sprintf("dim_value%d", j),
-					},
+	ts, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []model.ActiveSeries{
+		{Namespace: "ns1", Region: "test_region", Count: 10, Timestamp: ts},
+		{Namespace: "ns2", Region: "test_region", Count: 20, Timestamp: ts},
+		{Namespace: "ns1", Region: "test_region", Count: 15, Timestamp: ts.Add(1 * time.Hour)},
+		// overwrite the same timestamp
+		{Namespace: "ns1", Region: "test_region", Count: 12, Timestamp: ts.Add(1 * time.Hour)},
+		// another partition
+		{Namespace: "ns1", Region: "test_region", Count: 30, Timestamp: ts.Add(PartitionInterval)},
+	}
+	for _, as := range records {
+		if err := db.RecordActiveSeries(ctx, as); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := db.QueryActiveSeries(ctx, ts, ts.Add(2*PartitionInterval), "ns1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := []int64{}
+	for _, as := range result {
+		counts = append(counts, as.Count)
+	}
+	if fmt.Sprint(counts) != fmt.Sprint([]int64{10, 12, 30}) {
+		t.Fatalf("unexpected active series: %+v", result)
+	}
+
+	result, err = db.QueryActiveSeries(ctx, ts, ts.Add(1*time.Minute), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("unexpected active series: %+v", result)
+	}
+
+	// no partition exists
+	result, err = db.QueryActiveSeries(ctx, ts.Add(-2*PartitionInterval), ts.Add(-PartitionInterval), "ns1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("unexpected active series: %+v", result)
+	}
+}
+
+func TestDeletePartitionsBefore(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		f := fromTS.Add(time.Duration(i) * PartitionInterval)
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{
+					Name:  "dim1",
+					Value: "dim_value1",
 				},
-				FromTS: fromTS,
-				ToTS:   toTS,
-			})
-			if err != nil {
-				b.Fatal(err)
+			},
+			FromTS: f,
+			ToTS:   f.Add(1 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first partition ends at 2025-02-02T23:59:59Z
+	deleted, err := db.DeletePartitionsBefore(ctx, fromTS.Add(PartitionInterval))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != fmt.Sprintf(DbPathPattern, "_20241111_20250202") {
+		t.Fatalf("unexpected deleted partitions: %v", deleted)
+	}
+
+	result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(3*PartitionInterval), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+	for _, m := range result {
+		if m.FromTS.Before(fromTS.Add(PartitionInterval)) {
+			t.Fatalf("unexpected metric: %+v", m)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the partition created before the incremental auto vacuum
+	path := filepath.Join(dbDir, fmt.Sprintf(DbPathPattern, "_20241111_20250202"))
+	fillFreePages := func() {
+		pdb, err := openPartitionFile(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pdb.Close()
+		for _, q := range []string{
+			`CREATE TABLE IF NOT EXISTS garbage (v BLOB)`,
+			`INSERT INTO garbage SELECT randomblob(4096) FROM json_each('[` + strings.Repeat("0,", 99) + `0]')`,
+			`DELETE FROM garbage`,
+		} {
+			if _, err := pdb.ExecContext(ctx, q); err != nil {
+				t.Fatal(err)
 			}
 		}
 	}
+	fillFreePages()
+
+	for i := 0; i < 2; i++ {
+		reclaimed, err := db.Optimize(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reclaimed < 100 {
+			t.Fatalf("unexpected reclaimed pages: %d", reclaimed)
+		}
+		freePages, err := freelistCount(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if freePages != 0 {
+			t.Fatalf("unexpected free pages: %d", freePages)
+		}
+		// the free pages are reclaimed by the incremental vacuum next time
+		fillFreePages()
+	}
+
+	// the partitions in use are skipped
+	if _, err := db.getPartitionDB(filepath.Base(path)); err != nil {
+		t.Fatal(err)
+	}
+	reclaimed, err := db.Optimize(ctx, 1*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != 0 {
+		t.Fatalf("the partition in use is optimized: %d", reclaimed)
+	}
+}
+
+func TestPartitionPruning(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RecordMetric(ctx, model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		FromTS:     fromTS,
+		ToTS:       fromTS.Add(1 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := PartitionLayout{}.getPartition(fromTS)
+	tests := []struct {
+		tr        timeRange
+		namespace string
+		want      bool
+	}{
+		{timeRange{fromTS, fromTS.Add(1 * time.Hour)}, "test_namespace", false},
+		// the bounds are widened to the granularity
+		{timeRange{fromTS.Add(90 * time.Minute), fromTS.Add(2 * time.Hour)}, "test_namespace", false},
+		{timeRange{fromTS.Add(3 * time.Hour), p.To}, "test_namespace", true},
+		{timeRange{p.From, fromTS.Add(-1 * time.Hour)}, "test_namespace", true},
+		// no metadata
+		{timeRange{fromTS, fromTS.Add(1 * time.Hour)}, "other_namespace", false},
+		// no partition file
+		{timeRange{p.To.Add(1 * time.Second), p.To.Add(1 * time.Hour)}, "test_namespace", true},
+	}
+	for _, tt := range tests {
+		if got := db.skipPartition(ctx, tt.tr, tt.namespace); got != tt.want {
+			t.Errorf("skipPartition(%v, %s) = %v, want %v", tt.tr, tt.namespace, got, tt.want)
+		}
+	}
+
+	// the skipped partition file is not created
+	_, err = db.QueryMetrics(ctx, p.To.Add(1*time.Second), p.To.Add(1*time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := PartitionFiles(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("unexpected partition files: %v", files)
+	}
+}
+
+func TestPartitionPruningUntracked(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		FromTS:     fromTS,
+		ToTS:       fromTS.Add(1 * time.Hour),
+	}
+	if err := db.RecordMetric(ctx, metric); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// the partition written before the bounds are recorded
+	if err := os.Remove(filepath.Join(dbDir, metadataDBPath)); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	metric.MetricName = "test_name2"
+	metric.FromTS = fromTS.Add(10 * 24 * time.Hour)
+	metric.ToTS = metric.FromTS.Add(1 * time.Hour)
+	if err := db.RecordMetric(ctx, metric); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(1*time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+}
+
+func TestGetLifetimeRanges(t *testing.T) {
+	from, err := time.ParseInLocation(time.RFC3339, "2025-01-30T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the partition boundary is 2025-02-03T00:00:00Z
+	to := from.Add(6 * 24 * time.Hour)
+	layout := PartitionLayout{}
+	trs := layout.getLifetimeRanges(from, to)
+	if len(trs) != 2 {
+		t.Fatalf("unexpected ranges: %v", trs)
+	}
+	if !trs[0].From.Equal(from) || !trs[1].To.Equal(to) || layout.getTableSuffix(trs[1].From) != "_20250203_20250427" {
+		t.Fatalf("unexpected ranges: %v", trs)
+	}
+
+	trs = layout.getLifetimeRanges(from, from)
+	if len(trs) != 1 || !trs[0].From.Equal(from) || !trs[0].To.Equal(from) {
+		t.Fatalf("unexpected ranges: %v", trs)
+	}
+
+	// the reversed range has no partitions
+	trs = layout.getLifetimeRanges(to, from)
+	if len(trs) != 0 {
+		t.Fatalf("unexpected ranges: %v", trs)
+	}
+}
+
+func TestPartitionLayout(t *testing.T) {
+	parse := func(s string) time.Time {
+		ts, err := time.ParseInLocation(time.RFC3339, s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	tests := []struct {
+		layout PartitionLayout
+		t      string
+		suffix string
+	}{
+		{PartitionLayout{}, "2025-01-01T00:00:00Z", "_20241111_20250202"},
+		{PartitionLayout{Months: 3}, "2025-01-01T00:00:00Z", "_20250101_20250331"},
+		{PartitionLayout{Months: 3}, "2025-03-31T23:59:59Z", "_20250101_20250331"},
+		{PartitionLayout{Months: 1}, "2025-02-15T00:00:00Z", "_20250201_20250228"},
+		{PartitionLayout{Months: 3, Epoch: parse("2025-02-01T00:00:00Z")}, "2025-01-15T00:00:00Z", "_20241101_20250131"},
+		// ISO week
+		{PartitionLayout{Epoch: parse("2025-01-06T00:00:00Z")}, "2025-01-06T00:00:00Z", "_20250106_20250330"},
+		{PartitionLayout{Epoch: parse("2025-01-06T00:00:00Z")}, "2025-01-05T23:59:59Z", "_20241014_20250105"},
+	}
+	for _, tt := range tests {
+		if got := tt.layout.getTableSuffix(parse(tt.t)); got != tt.suffix {
+			t.Errorf("%s: getTableSuffix(%s) = %s, want %s", tt.layout, tt.t, got, tt.suffix)
+		}
+	}
+
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := PartitionLayout{Months: 3}
+	if err := db.SetPartitionLayout(ctx, layout); err != nil {
+		t.Fatal(err)
+	}
+	fromTS := parse("2025-03-31T00:00:00Z")
+	err = db.RecordMetric(ctx, model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		FromTS:     fromTS,
+		ToTS:       fromTS.Add(48 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	files, err := PartitionFiles(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if fmt.Sprint(files) != "[labels_20250101_20250331.db labels_20250401_20250630.db]" {
+		t.Fatalf("unexpected partition files: %v", files)
+	}
+
+	// the persisted layout is used after reopening
+	db, err = Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !db.PartitionLayout().equal(layout) {
+		t.Fatalf("unexpected layout: %s", db.PartitionLayout())
+	}
+	result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(48*time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+	if err := db.SetPartitionLayout(ctx, PartitionLayout{Months: 1}); err == nil {
+		t.Fatal("expected error when changing the persisted layout")
+	}
+}
+
+func TestQueryDisappearedSeries(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	end, err := time.ParseInLocation(time.RFC3339, "2025-02-10T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the series span the partition boundary at 2025-02-03
+	lastSeen := map[string]time.Time{
+		"active":      end.Add(-30 * time.Minute),
+		"stopped":     end.Add(-10 * 24 * time.Hour),
+		"stopped_new": end.Add(-3 * time.Hour),
+	}
+	for name, ts := range lastSeen {
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: name,
+			Region:     "test_region",
+			FromTS:     end.Add(-20 * 24 * time.Hour),
+			ToTS:       ts,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := db.QueryDisappearedSeries(ctx, end.Add(-30*24*time.Hour), end, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].MetricName != "stopped" || result[1].MetricName != "stopped_new" {
+		t.Fatalf("unexpected disappeared series: %+v", result)
+	}
+	for _, m := range result {
+		if !m.ToTS.Equal(lastSeen[m.MetricName]) {
+			t.Fatalf("unexpected last seen of %s: %s", m.MetricName, m.ToTS)
+		}
+	}
+}
+
+func TestQueryNewSeries(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	start, err := time.ParseInLocation(time.RFC3339, "2025-02-10T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := start.Add(24 * time.Hour)
+	lifetimes := map[string]timeRange{
+		"old":      {start.Add(-24 * time.Hour), end},
+		"new":      {start.Add(1 * time.Hour), end},
+		"newer":    {start.Add(2 * time.Hour), start.Add(3 * time.Hour)},
+		"returned": {start.Add(2 * time.Hour), end},
+	}
+	for name, tr := range lifetimes {
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: name,
+			Region:     "test_region",
+			FromTS:     tr.From,
+			ToTS:       tr.To,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the series seen in the older partition
+	err = db.RecordMetric(ctx, model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "returned",
+		Region:     "test_region",
+		FromTS:     start.Add(-2 * PartitionInterval),
+		ToTS:       start.Add(-2 * PartitionInterval).Add(1 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.QueryNewSeries(ctx, start, end, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].MetricName != "new" || result[1].MetricName != "newer" {
+		t.Fatalf("unexpected new series: %+v", result)
+	}
+	if !result[0].FromTS.Equal(lifetimes["new"].From) {
+		t.Fatalf("unexpected first seen: %s", result[0].FromTS)
+	}
+}
+
+func TestQueryTopValues(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := map[string]int{"asg-a": 3, "asg-b": 5, "asg-c": 1}
+	for group, n := range groups {
+		for i := 0; i < n; i++ {
+			err = db.RecordMetric(ctx, model.Metric{
+				Namespace:  "test_namespace",
+				MetricName: "test_name",
+				Region:     "test_region",
+				Dimensions: []model.Dimension{
+					{Name: "AutoScalingGroupName", Value: group},
+					{Name: "InstanceId", Value: fmt.Sprintf("%s-%d", group, i)},
+				},
+				// the series span the partition boundary at 2025-02-03
+				FromTS: fromTS,
+				ToTS:   fromTS.Add(5 * 24 * time.Hour),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the series without the label is not counted
+	err = db.RecordMetric(ctx, model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		FromTS:     fromTS,
+		ToTS:       fromTS.Add(1 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[{asg-b 5} {asg-a 3}]"
+	for _, to := range []time.Time{fromTS.Add(1 * time.Hour), fromTS.Add(5 * 24 * time.Hour)} {
+		result, err := db.QueryTopValues(ctx, fromTS, to, "test_namespace", "AutoScalingGroupName", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(result) != want {
+			t.Fatalf("unexpected top values until %s: %v", to, result)
+		}
+	}
+
+	result, err := db.QueryTopValues(ctx, fromTS, fromTS.Add(1*time.Hour), "test_namespace", "__name__", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result) != "[{test_name 10}]" {
+		t.Fatalf("unexpected top values: %v", result)
+	}
+}
+
+func TestPurgeNamespace(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(5 * 24 * time.Hour)
+	// the namespaces share the lifetime table
+	for _, namespace := range []string{"test/purge", "test_purge"} {
+		for i := 0; i < 2; i++ {
+			err = db.RecordMetric(ctx, model.Metric{
+				Namespace:  namespace,
+				MetricName: "test_name",
+				Region:     "test_region",
+				Dimensions: []model.Dimension{{Name: "dim", Value: fmt.Sprint(i)}},
+				FromTS:     fromTS,
+				ToTS:       toTS,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = db.RecordActiveSeries(ctx, model.ActiveSeries{
+			Namespace: namespace,
+			Region:    "test_region",
+			Timestamp: fromTS,
+			Count:     2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	countSeries := func(namespace string) int {
+		lm := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", namespace)}
+		result, err := db.QueryMetrics(ctx, fromTS, toTS, lm, 0, make(map[string]*model.Metric))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(result)
+	}
+
+	want := map[string]int{db.layout.getDBPath(fromTS): 2, db.layout.getDBPath(toTS): 2}
+	purged, err := db.PurgeNamespace(ctx, "test/purge", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(purged) != fmt.Sprint(want) {
+		t.Fatalf("unexpected dry run result: %v", purged)
+	}
+	if n := countSeries("test/purge"); n != 2 {
+		t.Fatalf("series are deleted by the dry run: %d", n)
+	}
+
+	purged, err = db.PurgeNamespace(ctx, "test/purge", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(purged) != fmt.Sprint(want) {
+		t.Fatalf("unexpected purge result: %v", purged)
+	}
+	if n := countSeries("test/purge"); n != 0 {
+		t.Fatalf("series are not purged: %d", n)
+	}
+	if n := countSeries("test_purge"); n != 2 {
+		t.Fatalf("series of the other namespace are purged: %d", n)
+	}
+	as, err := db.QueryActiveSeries(ctx, fromTS, toTS, "test/purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 0 {
+		t.Fatalf("active series are not purged: %v", as)
+	}
+	metadataDB, err := db.getMetadataDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := metadataDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM partition_namespaces WHERE namespace = ?`, "test/purge").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("partition metadata is not purged: %d", n)
+	}
+
+	// the namespace can be recorded again
+	err = db.RecordMetric(ctx, model.Metric{
+		Namespace:  "test/purge",
+		MetricName: "test_name",
+		Region:     "test_region",
+		FromTS:     fromTS,
+		ToTS:       fromTS.Add(1 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countSeries("test/purge"); n != 1 {
+		t.Fatalf("unexpected series count after recording again: %d", n)
+	}
+}
+
+func TestQuerySeriesDiff(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the deployment at 2025-02-05 replaced i-1 with i-3, the ranges are in different partitions
+	deployedAt, err := time.ParseInLocation(time.RFC3339, "2025-02-05T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := []struct {
+		instance string
+		from     time.Time
+		to       time.Time
+	}{
+		{"i-1", deployedAt.Add(-72 * time.Hour), deployedAt},
+		{"i-2", deployedAt.Add(-72 * time.Hour), deployedAt.Add(72 * time.Hour)},
+		{"i-3", deployedAt, deployedAt.Add(72 * time.Hour)},
+	}
+	for _, s := range series {
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{{Name: "InstanceId", Value: s.instance}},
+			FromTS:     s.from,
+			ToTS:       s.to,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lm := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace")}
+	diff, err := db.QuerySeriesDiff(ctx, deployedAt.Add(-48*time.Hour), deployedAt.Add(-24*time.Hour), deployedAt.Add(24*time.Hour), deployedAt.Add(48*time.Hour), lm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := func(series []*model.Metric) string {
+		var s []string
+		for _, m := range series {
+			s = append(s, m.Dimensions[0].Value)
+		}
+		return strings.Join(s, ",")
+	}
+	if got := instances(diff.Added); got != "i-3" {
+		t.Errorf("unexpected added series: %s", got)
+	}
+	if got := instances(diff.Removed); got != "i-1" {
+		t.Errorf("unexpected removed series: %s", got)
+	}
+	if got := instances(diff.Unchanged); got != "i-2" {
+		t.Errorf("unexpected unchanged series: %s", got)
+	}
+}
+
+func TestQueryByKeys(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(5 * 24 * time.Hour)
+	var keys []model.SeriesKey
+	for i := 0; i < 3; i++ {
+		m := model.Metric{
+			Namespace:  fmt.Sprintf("test_namespace%d", i%2),
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim2", Value: "value"},
+				{Name: "dim1", Value: fmt.Sprint(i)},
+			},
+			// the series span the partition boundary at 2025-02-03
+			FromTS: fromTS,
+			ToTS:   toTS,
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, m.Key())
+	}
+	// the dimensions in different order identify the same series
+	keys[0].Dimensions = []model.Dimension{keys[0].Dimensions[1], keys[0].Dimensions[0]}
+	unknown := model.SeriesKey{Namespace: "test_namespace0", MetricName: "unknown", Region: "test_region"}
+	keys = append(keys, unknown)
+
+	result, err := db.QueryByKeys(ctx, keys, fromTS, toTS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("unexpected result count: %d", len(result))
+	}
+	for _, k := range keys[:3] {
+		m, ok := result[k.Hash()]
+		if !ok {
+			t.Fatalf("series not found: %v", k)
+		}
+		// the lifetimes are merged over the partitions
+		if !m.FromTS.Equal(fromTS) || !m.ToTS.Equal(toTS) {
+			t.Fatalf("unexpected lifetime: %s - %s", m.FromTS, m.ToTS)
+		}
+	}
+	if _, ok := result[unknown.Hash()]; ok {
+		t.Fatal("unknown series found")
+	}
+
+	result, err = db.QueryByKeys(ctx, keys, toTS.Add(24*time.Hour), toTS.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("unexpected series out of the time range: %v", result)
+	}
+}
+
+func TestScanMetrics(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(5 * 24 * time.Hour)
+	for i := 0; i < 3; i++ {
+		m := model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim1", Value: fmt.Sprint(i)},
+			},
+			// the series span the partition boundary at 2025-02-03
+			FromTS: fromTS,
+			ToTS:   toTS,
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lm := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}
+
+	// the series in multiple partitions are passed once
+	seen := make(map[string]struct{})
+	count := 0
+	err = db.ScanMetrics(ctx, fromTS, toTS, lm, 0, seen, func(m *model.Metric) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || len(seen) != 3 {
+		t.Fatalf("unexpected count: %d, seen: %d", count, len(seen))
+	}
+
+	// the series in both partitions are counted as the examined rows
+	var stats QueryStats
+	if _, err := db.QueryMetricsWithOptions(ctx, fromTS, toTS, lm, 0, make(map[string]*model.Metric), QueryOptions{Stats: &stats}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.PartitionsScanned != 2 || stats.PartitionsSkipped != 0 || stats.RowsExamined != 6 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// the seen series are skipped
+	count = 0
+	err = db.ScanMetrics(ctx, fromTS, toTS, lm, 0, seen, func(m *model.Metric) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("unexpected count: %d", count)
+	}
+
+	// the error of f stops scanning
+	errStop := errors.New("stop")
+	count = 0
+	err = db.ScanMetrics(ctx, fromTS, toTS, lm, 0, make(map[string]struct{}), func(m *model.Metric) error {
+		count++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("unexpected count: %d", count)
+	}
+
+	// the context is checked while scanning the rows
+	canceled, cancel := context.WithCancel(ctx)
+	count = 0
+	err = db.ScanMetrics(canceled, fromTS, toTS, lm, 0, make(map[string]struct{}), func(m *model.Metric) error {
+		count++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("unexpected count: %d", count)
+	}
+}
+
+func TestCountMetrics(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(5 * 24 * time.Hour)
+	lifetimes := []struct {
+		from time.Time
+		to   time.Time
+	}{
+		// spans the partition boundary at 2025-02-03
+		{fromTS, toTS},
+		{fromTS, fromTS.Add(time.Hour)},
+		// only in the second partition
+		{toTS.Add(-time.Hour), toTS},
+	}
+	for i, lt := range lifetimes {
+		m := model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim1", Value: fmt.Sprint(i)},
+			},
+			FromTS: lt.from,
+			ToTS:   lt.to,
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		from     time.Time
+		to       time.Time
+		matchers []*labels.Matcher
+		want     int
+	}{
+		{"all", fromTS, toTS, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace")}, 3},
+		{"first partition", fromTS, fromTS.Add(24 * time.Hour), []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace")}, 2},
+		{"second partition", toTS.Add(-2 * time.Hour), toTS, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace")}, 2},
+		{"label", fromTS, toTS, []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+			labels.MustNewMatcher(labels.MatchRegexp, "dim1", "0|2"),
+		}, 2},
+		{"unknown namespace", fromTS, toTS, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "unknown")}, 0},
+	}
+	for _, tt := range tests {
+		got, err := db.CountMetrics(ctx, tt.from, tt.to, tt.matchers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQueryMetricsWithoutNamespace(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(5 * 24 * time.Hour)
+	for _, namespace := range []string{"AWS/EC2", "AWS/ELB"} {
+		for _, metricName := range []string{"CPUUtilization", "RequestCount"} {
+			m := model.Metric{
+				Namespace:  namespace,
+				MetricName: metricName,
+				Region:     "test_region",
+				Dimensions: []model.Dimension{
+					{Name: "dim1", Value: "dim_value1"},
+				},
+				// spans the partition boundary at 2025-02-03
+				FromTS: fromTS,
+				ToTS:   toTS,
+			}
+			if err := db.RecordMetric(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		matchers []*labels.Matcher
+		want     []string
+	}{
+		{"metric name", []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "CPUUtilization")}, []string{"AWS/EC2", "AWS/ELB"}},
+		{"namespace not equal", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "__name__", "CPUUtilization"),
+			labels.MustNewMatcher(labels.MatchNotEqual, "Namespace", "AWS/EC2"),
+		}, []string{"AWS/ELB"}},
+		{"unknown metric name", []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "unknown")}, nil},
+	}
+	for _, tt := range tests {
+		result, err := db.QueryMetrics(ctx, fromTS, toTS, tt.matchers, 0, make(map[string]*model.Metric))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range result {
+			// the lifetime is merged over the partitions
+			if !m.FromTS.Equal(fromTS) || !m.ToTS.Equal(toTS) {
+				t.Errorf("%s: unexpected lifetime: %v", tt.name, m)
+			}
+			got = append(got, m.Namespace)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+
+		count, err := db.CountMetrics(ctx, fromTS, toTS, tt.matchers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(tt.want) {
+			t.Errorf("%s: got count %d, want %d", tt.name, count, len(tt.want))
+		}
+	}
+
+	// the limit is applied over the namespaces
+	result, err := db.QueryMetrics(ctx, fromTS, toTS, []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")}, 3, make(map[string]*model.Metric))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("unexpected result: %v", result)
+	}
+}
+
+func TestQueryMetricsNamespaceRegexp(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(time.Hour)
+	// AWS/ELB and AWS_ELB share the lifetime table
+	for _, namespace := range []string{"AWS/EC2", "AWS/ELB", "AWS_ELB", "Custom/App"} {
+		m := model.Metric{
+			Namespace:  namespace,
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim1", Value: "dim_value1"},
+			},
+			FromTS: fromTS,
+			ToTS:   toTS,
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		matcher *labels.Matcher
+		want    []string
+		skipped int
+	}{
+		{"alternation", labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "AWS/EC2|AWS/ELB"), []string{"AWS/EC2", "AWS/ELB"}, 0},
+		{"shared table", labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "AWS/ELB|AWS_ELB"), []string{"AWS/ELB", "AWS_ELB"}, 0},
+		{"unknown namespace in alternation", labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "AWS/EC2|unknown"), []string{"AWS/EC2"}, 0},
+		{"unknown namespaces", labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "unknown1|unknown2"), nil, 1},
+		{"prefix", labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "AWS/.*"), []string{"AWS/EC2", "AWS/ELB"}, 0},
+		{"unknown prefix", labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "unknown/.*"), nil, 1},
+		{"regexp", labels.MustNewMatcher(labels.MatchRegexp, "Namespace", ".*/App"), []string{"Custom/App"}, 0},
+		{"case insensitive", labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "(?i)aws/ec2|custom/app"), []string{"AWS/EC2", "Custom/App"}, 0},
+	}
+	for _, tt := range tests {
+		stats := &QueryStats{}
+		result, err := db.QueryMetricsWithOptions(ctx, fromTS, toTS, []*labels.Matcher{tt.matcher}, 0, make(map[string]*model.Metric), QueryOptions{Stats: stats})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range result {
+			got = append(got, m.Namespace)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if stats.PartitionsSkipped != tt.skipped {
+			t.Errorf("%s: got %d skipped partitions, want %d", tt.name, stats.PartitionsSkipped, tt.skipped)
+		}
+
+		count, err := db.CountMetrics(ctx, fromTS, toTS, []*labels.Matcher{tt.matcher})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(tt.want) {
+			t.Errorf("%s: got count %d, want %d", tt.name, count, len(tt.want))
+		}
+	}
+}
+
+func TestQueryMetricsSafeMetricName(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(time.Hour)
+	for _, metricName := range []string{"0test-name", "test_name", "test.name", "testxname"} {
+		m := model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: metricName,
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim1", Value: "dim_value1"},
+			},
+			FromTS: fromTS,
+			ToTS:   toTS,
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		matcher *labels.Matcher
+		want    []string
+	}{
+		{"safe name", labels.MustNewMatcher(labels.MatchEqual, "__name__", "_test_name"), []string{"0test-name"}},
+		{"safe and original name", labels.MustNewMatcher(labels.MatchEqual, "__name__", "test_name"), []string{"test.name", "test_name"}},
+		{"original name", labels.MustNewMatcher(labels.MatchEqual, "__name__", "0test-name"), []string{"0test-name"}},
+		{"not equal", labels.MustNewMatcher(labels.MatchNotEqual, "__name__", "test_name"), []string{"0test-name", "testxname"}},
+		{"regexp of safe name", labels.MustNewMatcher(labels.MatchRegexp, "__name__", "_test.*"), []string{"0test-name"}},
+		{"regexp of original name", labels.MustNewMatcher(labels.MatchRegexp, "__name__", "test[.]name"), []string{"test.name"}},
+		{"not regexp", labels.MustNewMatcher(labels.MatchNotRegexp, "__name__", "test_name|testxname"), []string{"0test-name"}},
+		{"MetricName label", labels.MustNewMatcher(labels.MatchEqual, "MetricName", "test_name"), []string{"test_name"}},
+	}
+	for _, tt := range tests {
+		matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"), tt.matcher}
+		result, err := db.QueryMetrics(ctx, fromTS, toTS, matchers, 0, make(map[string]*model.Metric))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range result {
+			got = append(got, m.MetricName)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQueryMetricsEmptyValue(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(time.Hour)
+	for _, dims := range []model.Dimensions{
+		{{Name: "dim1", Value: "a"}},
+		{{Name: "dim1", Value: "b"}, {Name: "dim2", Value: "c"}},
+	} {
+		m := model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: dims,
+			FromTS:     fromTS,
+			ToTS:       toTS,
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		matcher *labels.Matcher
+		want    []string
+	}{
+		{"absent", labels.MustNewMatcher(labels.MatchEqual, "dim2", ""), []string{"a"}},
+		{"present", labels.MustNewMatcher(labels.MatchNotEqual, "dim2", ""), []string{"b"}},
+		{"not equal includes absent", labels.MustNewMatcher(labels.MatchNotEqual, "dim2", "x"), []string{"a", "b"}},
+		{"regexp matching empty", labels.MustNewMatcher(labels.MatchRegexp, "dim2", "c|"), []string{"a", "b"}},
+		{"regexp not matching empty", labels.MustNewMatcher(labels.MatchRegexp, "dim2", ".+"), []string{"b"}},
+		{"not regexp matching empty", labels.MustNewMatcher(labels.MatchNotRegexp, "dim2", ".+"), []string{"a"}},
+		{"unknown dimension", labels.MustNewMatcher(labels.MatchEqual, "dim3", ""), []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"), tt.matcher}
+		result, err := db.QueryMetrics(ctx, fromTS, toTS, matchers, 0, make(map[string]*model.Metric))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range result {
+			got = append(got, m.Labels()["dim1"])
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQueryMetricsConcurrency(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2024-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(365 * 24 * time.Hour)
+	// the series in each partition, and the series over all the partitions
+	for i := 0; i < 8; i++ {
+		from := fromTS.Add(time.Duration(i) * PartitionInterval / 2)
+		m := model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim1", Value: fmt.Sprint(i)},
+			},
+			FromTS: from,
+			ToTS:   from.Add(time.Hour),
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ts := range []time.Time{fromTS, toTS} {
+		m := model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim1", Value: "all"},
+			},
+			FromTS: ts,
+			ToTS:   ts,
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace")}
+
+	serial, err := db.QueryMetricsWithOptions(ctx, fromTS, toTS, matchers, 0, make(map[string]*model.Metric), QueryOptions{Concurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &QueryStats{}
+	parallel, err := db.QueryMetricsWithOptions(ctx, fromTS, toTS, matchers, 0, make(map[string]*model.Metric), QueryOptions{Stats: stats})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parallel) != 9 || !reflect.DeepEqual(serial, parallel) {
+		t.Fatalf("unexpected result: %v", parallel)
+	}
+	// the lifetimes are merged over the partitions
+	all := parallel[(model.Metric{Namespace: "test_namespace", MetricName: "test_name", Region: "test_region", Dimensions: []model.Dimension{{Name: "dim1", Value: "all"}}}).UniqueKey()]
+	if all == nil || !all.FromTS.Equal(fromTS) || !all.ToTS.Equal(toTS) {
+		t.Fatalf("unexpected lifetime: %v", all)
+	}
+	if stats.PartitionsScanned+stats.PartitionsSkipped != len(db.PartitionLayout().getLifetimeRanges(fromTS, toTS)) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// the limit is respected over the partitions
+	for limit := 1; limit <= 9; limit++ {
+		result, err := db.QueryMetrics(ctx, fromTS, toTS, matchers, limit, make(map[string]*model.Metric))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != limit {
+			t.Fatalf("limit %d: unexpected result: %d series", limit, len(result))
+		}
+	}
+
+	// the canceled query fails
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := db.QueryMetrics(canceled, fromTS, toTS, matchers, 0, make(map[string]*model.Metric)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestQueryMetricsPartitionError(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(5 * 24 * time.Hour)
+	for i, lt := range [][2]time.Time{{fromTS, fromTS.Add(time.Hour)}, {toTS.Add(-time.Hour), toTS}} {
+		m := model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim1", Value: fmt.Sprint(i)},
+			},
+			FromTS: lt[0],
+			ToTS:   lt[1],
+		}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// corrupt the second partition
+	corrupted := db.layout.getDBPath(toTS)
+	if err := os.WriteFile(filepath.Join(dir, corrupted), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	lm := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}
+	if _, err := db.QueryMetrics(ctx, fromTS, toTS, lm, 0, make(map[string]*model.Metric)); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// the partition errors are not skipped after the deadline
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = db.QueryMetricsWithOptions(canceled, fromTS, toTS, lm, 0, make(map[string]*model.Metric), QueryOptions{
+		OnPartitionError: func(dbPath string, err error) {
+			t.Fatalf("unexpected partition error: %v", err)
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var failed []string
+	result, err := db.QueryMetricsWithOptions(ctx, fromTS, toTS, lm, 0, make(map[string]*model.Metric), QueryOptions{
+		OnPartitionError: func(dbPath string, err error) {
+			failed = append(failed, dbPath)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("unexpected result count: %d", len(result))
+	}
+	if len(failed) != 1 || failed[0] != corrupted {
+		t.Fatalf("unexpected failed partitions: %v", failed)
+	}
+}
+
+func TestQueryLastSeen(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	baseTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// i-1 is seen in the older partition only, i-2 in both partitions, i-3 in the newer partition only
+	series := []struct {
+		instance string
+		from     time.Time
+		to       time.Time
+	}{
+		{"i-1", baseTS, baseTS.Add(24 * time.Hour)},
+		{"i-2", baseTS, baseTS.Add(60 * 24 * time.Hour)},
+		{"i-3", baseTS.Add(50 * 24 * time.Hour), baseTS.Add(55 * 24 * time.Hour)},
+	}
+	for _, s := range series {
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{{Name: "InstanceId", Value: s.instance}},
+			FromTS:     s.from,
+			ToTS:       s.to,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lm := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace")}
+	lastSeen := func(limit int) string {
+		result, err := db.QueryLastSeen(ctx, time.Unix(0, 0).UTC(), baseTS.Add(365*24*time.Hour), lm, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s []string
+		for _, m := range result {
+			s = append(s, m.Dimensions[0].Value+"@"+m.ToTS.Format("0102"))
+		}
+		return strings.Join(s, ",")
+	}
+	if got := lastSeen(0); got != "i-2@0302,i-3@0225,i-1@0102" {
+		t.Fatalf("unexpected last seen: %s", got)
+	}
+	// the older partition is not searched
+	if got := lastSeen(2); got != "i-2@0302,i-3@0225" {
+		t.Fatalf("unexpected last seen with limit: %s", got)
+	}
+}
+
+func BenchmarkInsert10000Metrics(b *testing.B) {
+	ctx := context.Background()
+	dbDir := b.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 10000; j++ {
+			fromTS := now.Add(-1 * time.Duration(rand.Intn(365*24*60*60)) * time.Second)
+			if i == 0 {
+				fromTS = fromTS.Add(-365 * 24 * 60 * 60 * time.Second)
+			}
+			toTS := fromTS.Add(time.Duration(rand.Intn(60*60)+1) * time.Second)
+			err = db.RecordMetric(ctx, model.Metric{
+				Namespace:  "test_namespace",
+				MetricName: "test_name",
+				Region:     "test_region",
+				Dimensions: []model.Dimension{
+					{
+						Name:  "dim1",
+						Value: fmt.Sprintf("dim_value%d", j),
+					},
+				},
+				FromTS: fromTS,
+				ToTS:   toTS,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkRecordMetrics10000Metrics is BenchmarkInsert10000Metrics with the batches of 1000 metrics.
+func BenchmarkRecordMetrics10000Metrics(b *testing.B) {
+	ctx := context.Background()
+	dbDir := b.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	for i := 0; i < 2; i++ {
+		var batch []model.Metric
+		for j := 0; j < 10000; j++ {
+			fromTS := now.Add(-1 * time.Duration(rand.Intn(365*24*60*60)) * time.Second)
+			if i == 0 {
+				fromTS = fromTS.Add(-365 * 24 * 60 * 60 * time.Second)
+			}
+			toTS := fromTS.Add(time.Duration(rand.Intn(60*60)+1) * time.Second)
+			batch = append(batch, model.Metric{
+				Namespace:  "test_namespace",
+				MetricName: "test_name",
+				Region:     "test_region",
+				Dimensions: []model.Dimension{
+					{
+						Name:  "dim1",
+						Value: fmt.Sprintf("dim_value%d", j),
+					},
+				},
+				FromTS: fromTS,
+				ToTS:   toTS,
+			})
+			if len(batch) == 1000 {
+				if err := db.RecordMetrics(ctx, batch); err != nil {
+					b.Fatal(err)
+				}
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// BenchmarkLifetimeRangeQuery compares the r-tree lifetime tables with a b-tree index on the same rows.
+// Most of the series are long-lived, so the b-tree index can only bound one side of the range.
+func BenchmarkLifetimeRangeQuery(b *testing.B) {
+	ctx := context.Background()
+	db, err := sql.Open(driverName, sqlite.DSN(b.TempDir()+"/lifetime.db", sqlite.Options{WAL: true}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.ExecContext(ctx, `
+		CREATE VIRTUAL TABLE lifetime_rtree USING rtree_i32(metric_id, from_timestamp, to_timestamp);
+		CREATE TABLE lifetime_btree (metric_id INTEGER PRIMARY KEY, from_timestamp INT NOT NULL, to_timestamp INT NOT NULL);
+		CREATE INDEX idx_lifetime_btree ON lifetime_btree(from_timestamp, to_timestamp);
+	`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	const partitionSeconds = int64(PartitionInterval / time.Second)
+	err = withTx(ctx, db, func(tx *sql.Tx) error {
+		for i := 0; i < 100000; i++ {
+			from := rand.Int63n(partitionSeconds)
+			to := from + rand.Int63n(3600)
+			// long-lived series
+			if i%2 == 0 {
+				to = from + rand.Int63n(partitionSeconds-from)
+			}
+			for _, table := range []string{"lifetime_rtree", "lifetime_btree"} {
+				_, err := tx.ExecContext(ctx, `INSERT INTO `+table+` VALUES (?, ?, ?)`, i, from, to)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, table := range []string{"lifetime_rtree", "lifetime_btree"} {
+		b.Run(table, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				from := rand.Int63n(partitionSeconds)
+				var n int
+				err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+table+` WHERE from_timestamp <= ? AND to_timestamp >= ?`, from+3600, from).Scan(&n)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLabelNames(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the later series is in the next partition
+	laterTS := fromTS.Add(100 * 24 * time.Hour)
+	for _, m := range []model.Metric{
+		{Namespace: "AWS/EC2", Dimensions: model.Dimensions{{Name: "InstanceId", Value: "i-1"}}, FromTS: fromTS},
+		{Namespace: "AWS/EC2", Dimensions: model.Dimensions{{Name: "AutoScalingGroupName", Value: "asg"}}, FromTS: laterTS},
+		{Namespace: "AWS/ELB", Dimensions: model.Dimensions{{Name: "LoadBalancerName", Value: "lb"}}, FromTS: fromTS},
+		{Namespace: "AWS/S3", FromTS: fromTS},
+	} {
+		m.MetricName = "test_name"
+		m.Region = "us-east-1"
+		m.ToTS = m.FromTS.Add(time.Hour)
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		matchers []*labels.Matcher
+		want     []string
+	}{
+		{
+			name:     "across the partitions",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "AWS/EC2")},
+			want:     []string{"AutoScalingGroupName", "InstanceId", "MetricName", "Namespace", "Region", "__name__"},
+		},
+		{
+			name:     "by the dimension",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "LoadBalancerName", "")},
+			want:     []string{"LoadBalancerName", "MetricName", "Namespace", "Region", "__name__"},
+		},
+		{
+			name:     "without the dimensions",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "AWS/S3")},
+			want:     []string{"MetricName", "Namespace", "Region", "__name__"},
+		},
+		{
+			name:     "no series",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "AWS/Lambda")},
+			want:     []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.LabelNames(ctx, fromTS, laterTS.Add(time.Hour), tt.matchers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("unexpected label names: %v", got)
+			}
+		})
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-02-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the later series are in the next partition
+	laterTS := fromTS.Add(100 * 24 * time.Hour)
+	for _, m := range []model.Metric{
+		{Namespace: "AWS/EC2", MetricName: "CPUUtilization", Dimensions: model.Dimensions{{Name: "InstanceId", Value: "i-3"}}, FromTS: fromTS},
+		{Namespace: "AWS/EC2", MetricName: "CPUUtilization", Dimensions: model.Dimensions{{Name: "InstanceId", Value: "i-1"}}, FromTS: laterTS},
+		{Namespace: "AWS/EC2", MetricName: "Network.In", Dimensions: model.Dimensions{{Name: "InstanceId", Value: "i-2"}}, FromTS: laterTS},
+		{Namespace: "AWS/EC2", MetricName: "CPUUtilization", Dimensions: model.Dimensions{{Name: "AutoScalingGroupName", Value: "asg"}}, FromTS: fromTS},
+		{Namespace: "AWS/ELB", MetricName: "Latency", Dimensions: model.Dimensions{{Name: "InstanceId", Value: "i-9"}}, FromTS: fromTS},
+	} {
+		m.Region = "us-east-1"
+		m.ToTS = m.FromTS.Add(time.Hour)
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ec2 := labels.MustNewMatcher(labels.MatchEqual, "Namespace", "AWS/EC2")
+	tests := []struct {
+		name     string
+		label    string
+		matchers []*labels.Matcher
+		limit    int
+		want     []string
+	}{
+		{name: "dimension across the partitions", label: "InstanceId", matchers: []*labels.Matcher{ec2}, want: []string{"i-1", "i-2", "i-3"}},
+		{name: "limit", label: "InstanceId", matchers: []*labels.Matcher{ec2}, limit: 2, want: []string{"i-1", "i-2"}},
+		{name: "safe metric name", label: "__name__", matchers: []*labels.Matcher{ec2}, want: []string{"CPUUtilization", "Network_In"}},
+		{name: "metric name", label: "MetricName", matchers: []*labels.Matcher{ec2}, want: []string{"CPUUtilization", "Network.In"}},
+		{name: "without matchers", label: "Namespace", want: []string{"AWS/EC2", "AWS/ELB"}},
+		{name: "filtered by the dimension", label: "InstanceId", matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "Network_In")}, want: []string{"i-2"}},
+		{name: "unknown label", label: "LoadBalancerName", matchers: []*labels.Matcher{ec2}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.LabelValues(ctx, tt.label, fromTS, laterTS.Add(time.Hour), tt.matchers, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("unexpected label values: %v", got)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RecordMetric(ctx, model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		Dimensions: []model.Dimension{{Name: "dim1", Value: "dim_value1"}},
+		FromTS:     fromTS,
+		ToTS:       fromTS.Add(1 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the partition created before the migrations
+	path := filepath.Join(dbDir, fmt.Sprintf(DbPathPattern, "_20241111_20250202"))
+	pdb, err := openPartitionFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`DROP INDEX idx_metrics_updated_at`,
+		`DROP TRIGGER metric_dimensions_insert`,
+		`DROP TRIGGER metric_dimensions_delete`,
+		`DROP TABLE metric_dimensions`,
+		`DROP TRIGGER metrics_series_id`,
+		`DROP INDEX idx_metrics_series_id`,
+		`ALTER TABLE metrics_20241111_20250202 DROP COLUMN series_id`,
+		`DROP TABLE schema_version`,
+	} {
+		if _, err := pdb.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pdb.Close()
+
+	db, err = Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the dimensions of the existing series are indexed by the migration
+	result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(1*time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+		labels.MustNewMatcher(labels.MatchEqual, "dim1", "dim_value1"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+	// the series ids of the existing series are filled by the migration
+	for _, m := range result {
+		if m.SeriesID != m.Key().ID() {
+			t.Fatalf("unexpected series id: %d", m.SeriesID)
+		}
+	}
+	pdb, err = db.getDB(fromTS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version, indexes int
+	if err := pdb.QueryRowContext(ctx, `SELECT version FROM schema_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion() {
+		t.Fatalf("unexpected schema version: %d", version)
+	}
+	if err := pdb.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_metrics_updated_at'`).Scan(&indexes); err != nil {
+		t.Fatal(err)
+	}
+	if indexes != 1 {
+		t.Fatal("the migration is not applied")
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		files fstest.MapFS
+		valid bool
+	}{
+		{fstest.MapFS{"m/0002_b.sql": {}, "m/0001_a.sql": {}}, true},
+		{fstest.MapFS{"m/a.sql": {}}, false},
+		{fstest.MapFS{"m/0000_a.sql": {}}, false},
+		{fstest.MapFS{"m/0001_a.sql": {}, "m/1_b.sql": {}}, false},
+	}
+	for _, tt := range tests {
+		ms, err := loadMigrations(tt.files, "m")
+		if (err == nil) != tt.valid {
+			t.Fatalf("unexpected error of %v: %v", tt.files, err)
+		}
+		if tt.valid && (ms[0].name != "a" || ms[1].version != 2) {
+			t.Fatalf("unexpected migrations: %+v", ms)
+		}
+	}
+}
+
+func TestDimensionIndex(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  fmt.Sprintf("test_namespace%d", i%2),
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "dim1", Value: fmt.Sprintf("dim_value%d", i)},
+				{Name: "dim2", Value: "dim_value"},
+			},
+			FromTS: fromTS,
+			ToTS:   fromTS.Add(1 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		matchers []*labels.Matcher
+		count    int
+	}{
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "dim1", "dim_value1")}, 1},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "dim2", "dim_value")}, 3},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "dim2", "dim_value1")}, 0},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "dim3", "")}, 3},
+	}
+	for _, tt := range tests {
+		result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(1*time.Hour), tt.matchers, 0, map[string]*model.Metric{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != tt.count {
+			t.Fatalf("unexpected metrics count of %v: %d", tt.matchers, len(result))
+		}
+	}
+
+	// the dimensions of the deleted series are deleted
+	if _, err := db.PurgeNamespace(ctx, "test_namespace0", false); err != nil {
+		t.Fatal(err)
+	}
+	pdb, err := db.getDB(fromTS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := pdb.QueryRowContext(ctx, `SELECT count(*) FROM metric_dimensions`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected dimensions count: %d", n)
+	}
+}
+
+func TestSearchSeries(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the dimension values are scanned without FTS5
+	if err := db.EnableSearchIndex(); err != nil && !errors.Is(err, errSearchIndexUnavailable) {
+		t.Fatal(err)
+	}
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, instance := range []string{"web-prod-api-1", "web-prod-api-2", "web-staging-api-1", "web-test-1"} {
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{Name: "InstanceId", Value: instance},
+				{Name: "Role", Value: "web"},
+			},
+			FromTS: fromTS,
+			ToTS:   fromTS.Add(1 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		s        string
+		matchers []*labels.Matcher
+		count    int
+	}{
+		{"prod-api", nil, 2},
+		{"api", nil, 3},
+		{"Prod", nil, 0},
+		{"p", nil, 3},
+		// the quotes are searched as they are
+		{`"prod"`, nil, 0},
+		// the values are not searched across the dimensions
+		{"1\nweb", nil, 0},
+		{"web", []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "InstanceId", ".*staging.*")}, 1},
+	}
+	for _, tt := range tests {
+		lm := append([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace")}, tt.matchers...)
+		result, err := db.SearchSeries(ctx, fromTS, fromTS.Add(1*time.Hour), lm, tt.s, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != tt.count {
+			t.Fatalf("unexpected series count of %q: %d", tt.s, len(result))
+		}
+	}
+	if result, err := db.SearchSeries(ctx, fromTS, fromTS.Add(1*time.Hour), nil, "api", 1); err != nil || len(result) != 1 {
+		t.Fatalf("the limit is not applied: %v, %v", result, err)
+	}
+
+	pdb, err := db.getDB(fromTS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := tableExists(ctx, pdb, "dimension_search"); err != nil || exists != searchIndexAvailable {
+		t.Fatalf("unexpected search index: %v, %v", exists, err)
+	}
+}
+
+func TestRecordMetrics(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := func(namespace string, i int, from time.Time, to time.Time) model.Metric {
+		return model.Metric{
+			Namespace:  namespace,
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{{Name: "dim1", Value: fmt.Sprintf("dim_value%d", i)}},
+			FromTS:     from,
+			ToTS:       to,
+		}
+	}
+	err = db.RecordMetrics(ctx, []model.Metric{
+		metric("test_namespace1", 0, fromTS, fromTS.Add(1*time.Hour)),
+		metric("test_namespace2", 0, fromTS, fromTS.Add(1*time.Hour)),
+		// over the partitions
+		metric("test_namespace1", 1, fromTS, fromTS.Add(PartitionInterval)),
+		// the same series extends the lifetime
+		metric("test_namespace1", 0, fromTS.Add(1*time.Hour), fromTS.Add(2*time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(PartitionInterval), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "test_namespace.*"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+	for _, m := range result {
+		if m.Namespace == "test_namespace1" && m.Dimensions[0].Value == "dim_value0" && !m.ToTS.Equal(fromTS.Add(2*time.Hour)) {
+			t.Fatalf("the lifetime is not extended: %+v", m)
+		}
+	}
+	// the series in the next partition is found by the namespace bounds
+	result, err = db.QueryMetrics(ctx, fromTS.Add(PartitionInterval-time.Hour), fromTS.Add(PartitionInterval), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace1"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("unexpected metrics count in the next partition: %d", len(result))
+	}
+
+	if err := db.RecordMetrics(ctx, []model.Metric{metric("test_namespace1", 2, fromTS.Add(1*time.Hour), fromTS)}); err == nil {
+		t.Fatal("the invalid lifetime is recorded")
+	}
+}
+
+func TestStmtCache(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// a connection of the partition, the statements must not be prepared on the other connections during the transaction
+	if err := db.SetWalAutoCheckpoint(0); err != nil {
+		t.Fatal(err)
+	}
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  fmt.Sprintf("test_namespace%d", i%2),
+			MetricName: "test_name",
+			Region:     "test_region",
+			FromTS:     fromTS,
+			ToTS:       fromTS.Add(time.Duration(i+1) * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dbCache := db.dbCache[fmt.Sprintf(DbPathPattern, "_20241111_20250202")]
+	// the select, the insert and the update of the metrics, the inserts of the lifetimes of the namespaces, and the update of the lifetime of test_namespace0
+	if len(dbCache.stmts.stmts) != 6 || len(dbCache.stmts.missing) != 0 {
+		t.Fatalf("unexpected statements: %v, missing %v", len(dbCache.stmts.stmts), dbCache.stmts.missing)
+	}
+	result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(3*time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "test_namespace.*"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+}
+
+func TestPartitionNotFound(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RecordMetric(ctx, model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		FromTS:     fromTS,
+		ToTS:       fromTS.Add(1 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdb, err := db.getDB(fromTS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pdb.ExecContext(ctx, `SELECT * FROM metrics_missing`)
+	if !isNoSuchTable(err) {
+		t.Errorf("expected the missing table, got %v", err)
+	}
+	var tnf *TableNotFoundError
+	if !errors.As(wrapTableNotFound(err), &tnf) || tnf.Table != "metrics_missing" {
+		t.Errorf("expected TableNotFoundError of metrics_missing, got %v", err)
+	}
+	_, err = pdb.ExecContext(ctx, `SELECT * FROM`)
+	if err == nil || isNoSuchTable(err) {
+		t.Errorf("expected the syntax error, got %v", err)
+	}
+	if !errors.Is(errNotHydrated, ErrPartitionNotFound) {
+		t.Error("expected errNotHydrated to be ErrPartitionNotFound")
+	}
+
+	// the namespace without the table is skipped
+	s := db.PartitionLayout().getTableSuffix(fromTS)
+	_, err = db.scanPartition(ctx, timeRange{From: fromTS, To: fromTS.Add(1 * time.Hour)}, namespaceSelector{names: []string{"other_namespace"}}, nil, nil, "", 0, func(m *model.Metric) error {
+		return nil
+	})
+	if !errors.As(err, &tnf) || tnf.Table != "metrics_lifetime"+lifetimeTableSuffix(s, "other_namespace") {
+		t.Errorf("expected TableNotFoundError of the lifetime table, got %v", err)
+	}
+	_, err = db.scanPartition(ctx, timeRange{From: fromTS, To: fromTS.Add(1 * time.Hour)}, namespaceSelector{prefix: "other_"}, nil, nil, "", 0, func(m *model.Metric) error {
+		return nil
+	})
+	if !errors.Is(err, ErrPartitionNotFound) {
+		t.Errorf("expected ErrPartitionNotFound, got %v", err)
+	}
+}
+
+func TestMaxOpenPartitions(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenPartitions(2)
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dbPaths []string
+	for i := 0; i < 3; i++ {
+		ts := fromTS.Add(time.Duration(i) * PartitionInterval)
+		dbPath := db.PartitionLayout().getDBPath(ts)
+		dbPaths = append(dbPaths, dbPath)
+		if _, err := db.getPartitionDB(dbPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the partitions used recently are kept open
+	if len(db.OpenDBs()) != 3 {
+		t.Fatalf("unexpected open partitions: %v", db.OpenDBs())
+	}
+
+	db.mu.Lock()
+	for i, dbPath := range dbPaths {
+		dbCache := db.dbCache[dbPath]
+		dbCache.lastUsed = time.Now().UTC().Add(-time.Duration(10-i) * time.Minute)
+		db.dbCache[dbPath] = dbCache
+	}
+	db.mu.Unlock()
+	evictedDB := db.dbCache[dbPaths[0]].db
+	dbPath := db.PartitionLayout().getDBPath(fromTS.Add(3 * PartitionInterval))
+	if _, err := db.getPartitionDB(dbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, odb := range db.OpenDBs() {
+		got = append(got, odb.Path)
+	}
+	sort.Strings(got)
+	want := []string{dbPaths[2], dbPath}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected open partitions: got=%v, want=%v", got, want)
+	}
+	if err := evictedDB.PingContext(ctx); err == nil {
+		t.Error("expected the evicted partition to be closed")
+	}
+}
+
+func TestSeriesID(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		Dimensions: []model.Dimension{{Name: "dim2", Value: "dim_value2"}, {Name: "dim1", Value: "dim_value1"}},
+	}
+	// the other series is recorded first in the second partition, so the metric ids are different
+	for _, m := range []model.Metric{
+		{Namespace: "test_namespace", MetricName: "other", Region: "test_region", FromTS: fromTS.Add(PartitionInterval), ToTS: fromTS.Add(PartitionInterval)},
+		{Namespace: metric.Namespace, MetricName: metric.MetricName, Region: metric.Region, Dimensions: metric.Dimensions, FromTS: fromTS, ToTS: fromTS.Add(PartitionInterval)},
+	} {
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lm := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+		labels.MustNewMatcher(labels.MatchEqual, "MetricName", "test_name"),
+	}
+	var metricIDs []int64
+	for _, ts := range []time.Time{fromTS, fromTS.Add(PartitionInterval)} {
+		result, err := db.QueryMetrics(ctx, ts, ts, lm, 0, map[string]*model.Metric{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1 {
+			t.Fatalf("unexpected metrics count: %d", len(result))
+		}
+		for _, m := range result {
+			if m.SeriesID != metric.Key().ID() {
+				t.Errorf("unexpected series id: %d, want %d", m.SeriesID, metric.Key().ID())
+			}
+			metricIDs = append(metricIDs, m.MetricID)
+		}
+	}
+	if metricIDs[0] == metricIDs[1] {
+		t.Errorf("expected the different metric ids: %v", metricIDs)
+	}
+
+	// the replicated rows have the same series ids
+	path := filepath.Join(dbDir, db.PartitionLayout().getDBPath(fromTS))
+	changes, err := PartitionChanges(ctx, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := filepath.Join(t.TempDir(), filepath.Base(path))
+	if err := ApplyPartitionChanges(ctx, replica, changes); err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := openPartitionFile(replica, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	var seriesID int64
+	if err := rdb.QueryRowContext(ctx, `SELECT series_id FROM metrics`+db.PartitionLayout().getTableSuffix(fromTS)).Scan(&seriesID); err != nil {
+		t.Fatal(err)
+	}
+	if seriesID != metric.Key().ID() {
+		t.Errorf("unexpected replicated series id: %d", seriesID)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []model.Metric{
+		{Namespace: "ns1", MetricName: "m1", Region: "test_region", FromTS: fromTS, ToTS: fromTS.Add(time.Hour)},
+		{Namespace: "ns1", MetricName: "m2", Region: "test_region", FromTS: fromTS.Add(time.Minute), ToTS: fromTS.Add(2 * time.Hour)},
+		{Namespace: "ns2", MetricName: "m1", Region: "test_region", FromTS: fromTS, ToTS: fromTS},
+		{Namespace: "ns2", MetricName: "m1", Region: "test_region", FromTS: fromTS.Add(PartitionInterval), ToTS: fromTS.Add(PartitionInterval)},
+	} {
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Partitions) != 2 {
+		t.Fatalf("unexpected partitions count: %d", len(stats.Partitions))
+	}
+	var sizeBytes int64
+	for _, p := range stats.Partitions {
+		if p.SizeBytes == 0 {
+			t.Errorf("unexpected partition size: %+v", p)
+		}
+		sizeBytes += p.SizeBytes
+	}
+	if stats.SizeBytes != sizeBytes {
+		t.Errorf("unexpected total size: %d, want %d", stats.SizeBytes, sizeBytes)
+	}
+
+	p := stats.Partitions[0]
+	if p.Path != db.PartitionLayout().getDBPath(fromTS) || p.Series != 3 || !p.MinTime.Equal(fromTS) || !p.MaxTime.Equal(fromTS.Add(2*time.Hour)) {
+		t.Errorf("unexpected partition stats: %+v", p)
+	}
+	want := []NamespaceStats{
+		{Namespace: "ns1", Series: 2, MinTime: fromTS, MaxTime: fromTS.Add(2 * time.Hour)},
+		{Namespace: "ns2", Series: 1, MinTime: fromTS, MaxTime: fromTS},
+	}
+	if !reflect.DeepEqual(p.Namespaces, want) {
+		t.Errorf("unexpected namespace stats: %+v", p.Namespaces)
+	}
+	if p := stats.Partitions[1]; p.Path != db.PartitionLayout().getDBPath(fromTS.Add(PartitionInterval)) || p.Series != 1 {
+		t.Errorf("unexpected partition stats: %+v", p)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []time.Time{fromTS, fromTS.Add(PartitionInterval)} {
+		m := model.Metric{Namespace: "test_namespace", MetricName: "test_name", Region: "test_region", FromTS: ts, ToTS: ts}
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.Backup(ctx, dbDir); err == nil {
+		t.Error("expected error for the database directory")
+	}
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	files, err := db.Backup(ctx, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		db.PartitionLayout().getDBPath(fromTS),
+		db.PartitionLayout().getDBPath(fromTS.Add(PartitionInterval)),
+		metadataDBPath,
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("unexpected backed up files: %v", files)
+	}
+	// the previous backup is overwritten
+	m := model.Metric{Namespace: "test_namespace", MetricName: "other", Region: "test_region", FromTS: fromTS, ToTS: fromTS}
+	if err := db.RecordMetric(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Backup(ctx, backupDir); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !slices.Contains(want, e.Name()) {
+			t.Errorf("unexpected file in backup directory: %s", e.Name())
+		}
+	}
+	bdb, err := Open(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+	lm := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}
+	result, err := bdb.QueryMetrics(ctx, fromTS, fromTS, lm, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Errorf("unexpected metrics count: %d", len(result))
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := model.Metric{Namespace: "test_namespace", MetricName: "test_name", Region: "test_region", FromTS: fromTS, ToTS: fromTS}
+	if err := db.RecordMetric(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	backupDir := t.TempDir()
+	if _, err := db.Backup(ctx, backupDir); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := db.PartitionLayout().getDBPath(fromTS)
+
+	// restore into the empty directory
+	restoreDir := filepath.Join(t.TempDir(), "restore")
+	restored, err := RestoreBackup(ctx, backupDir, restoreDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, []string{dbPath, metadataDBPath}) {
+		t.Errorf("unexpected restored files: %v", restored)
+	}
+
+	// the partition updated after the backup is not overwritten
+	m.ToTS = fromTS.Add(time.Hour)
+	if err := db.RecordMetric(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the version is in seconds
+	pdb, err := openPartitionFile(filepath.Join(dbDir, dbPath), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pdb.ExecContext(ctx, `UPDATE metrics`+db.PartitionLayout().getTableSuffix(fromTS)+` SET updated_at = updated_at + 1`); err != nil {
+		t.Fatal(err)
+	}
+	pdb.Close()
+	if _, err := RestoreBackup(ctx, backupDir, dbDir, false); err == nil {
+		t.Error("expected error for the newer partition")
+	}
+	restored, err = RestoreBackup(ctx, backupDir, dbDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, []string{dbPath}) {
+		t.Errorf("unexpected restored files: %v", restored)
+	}
+	rdb, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	result, err := rdb.QueryMetrics(ctx, fromTS.Add(time.Hour), fromTS.Add(time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Errorf("expected the lifetime in the backup: %v", result)
+	}
+
+	// the partition file renamed to the other partition is rejected
+	other := db.PartitionLayout().getDBPath(fromTS.Add(PartitionInterval))
+	if err := os.Rename(filepath.Join(backupDir, dbPath), filepath.Join(backupDir, other)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreBackup(ctx, backupDir, t.TempDir(), false); err == nil {
+		t.Error("expected error for the mismatched partition")
+	}
+}
+
+func TestPurgeStaleSeries(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the stale series are purged from the current partitions
+	fromTS := time.Now().UTC().Truncate(time.Hour)
+	for _, m := range []model.Metric{
+		{Namespace: "AWS/Lambda", MetricName: "stale", Region: "test_region", FromTS: fromTS, ToTS: fromTS},
+		{Namespace: "AWS/Lambda", MetricName: "fresh", Region: "test_region", FromTS: fromTS, ToTS: fromTS},
+		{Namespace: "AWS/EC2", MetricName: "stale", Region: "test_region", FromTS: fromTS, ToTS: fromTS},
+	} {
+		if err := db.RecordMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the recorder sets updated_at to the recorded time
+	dbPath := db.PartitionLayout().getDBPath(fromTS)
+	s := db.PartitionLayout().getTableSuffix(fromTS)
+	pdb, err := db.getPartitionDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().UTC().Add(-7 * 24 * time.Hour)
+	if _, err := pdb.ExecContext(ctx, `UPDATE metrics`+s+` SET updated_at = ? WHERE metric_name = 'stale'`, before.Add(-time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the partition ended before is left to the retention
+	purged, err := db.PurgeStaleSeries(ctx, "AWS/Lambda", fromTS.Add(2*PartitionInterval))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("unexpected purge of the ended partition: %v", purged)
+	}
+	purged, err = db.PurgeStaleSeries(ctx, "AWS/Lambda", before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(purged, map[string]int{dbPath: 1}) {
+		t.Errorf("unexpected purged series: %v", purged)
+	}
+
+	for namespace, want := range map[string][]string{"AWS/Lambda": {"fresh"}, "AWS/EC2": {"stale"}} {
+		result, err := db.QueryMetrics(ctx, fromTS, fromTS, []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "Namespace", namespace),
+		}, 0, map[string]*model.Metric{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, m := range result {
+			names = append(names, m.MetricName)
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("unexpected series of %s: %v", namespace, names)
+		}
+	}
+	var lifetimes int
+	if err := pdb.QueryRowContext(ctx, "SELECT COUNT(*) FROM `metrics_lifetime"+lifetimeTableSuffix(s, "AWS/Lambda")+"`").Scan(&lifetimes); err != nil {
+		t.Fatal(err)
+	}
+	if lifetimes != 1 {
+		t.Errorf("unexpected lifetime rows: %d", lifetimes)
+	}
 }
@@ -0,0 +1,17 @@
+package database
+
+import (
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/sqlite"
+)
+
+// driverName is the sqlite driver with the REGEXP, safe_metric_name and series_hash functions.
+const driverName = sqlite.DriverName
+
+const busyTimeout = 10 * time.Second
+
+// missingTable returns the table of the driver error reading the table which doesn't exist.
+func missingTable(err error) (string, bool) {
+	return sqlite.MissingTable(err)
+}
@@ -0,0 +1,38 @@
+package database
+
+import "errors"
+
+// ErrPartitionNotFound is returned when the partition, or the table of the namespace in the partition, doesn't exist,
+// so that the callers can tell no data from the failures with errors.Is.
+var ErrPartitionNotFound = errors.New("partition not found")
+
+// TableNotFoundError is the error of reading the table which doesn't exist in the partition.
+type TableNotFoundError struct {
+	Table string
+	// Err is the driver error, if any
+	Err error
+}
+
+func (e *TableNotFoundError) Error() string {
+	return "no such table: " + e.Table
+}
+
+func (e *TableNotFoundError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{ErrPartitionNotFound}
+	}
+	return []error{ErrPartitionNotFound, e.Err}
+}
+
+// wrapTableNotFound returns TableNotFoundError for the driver error of the missing table, and the other errors as is.
+func wrapTableNotFound(err error) error {
+	if table, ok := missingTable(err); ok {
+		return &TableNotFoundError{Table: table, Err: err}
+	}
+	return err
+}
+
+// isNoSuchTable reports whether the table or the partition doesn't exist.
+func isNoSuchTable(err error) bool {
+	return errors.Is(wrapTableNotFound(err), ErrPartitionNotFound)
+}
@@ -0,0 +1,262 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/mtanda/prometheus-labels-db/internal/objstore"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	hydrationTimeout = 5 * time.Minute
+	// the partitions uploaded after they are found missing are hydrated after missingTTL
+	missingTTL = 5 * time.Minute
+)
+
+// errNotHydrated is returned instead of opening the missing partition, which would create an empty file hiding the partition uploaded later.
+var errNotHydrated = fmt.Errorf("%w in the object storage", ErrPartitionNotFound)
+
+type hydratedFile struct {
+	ldb    *LabelDB
+	dbPath string
+	size   int64
+}
+
+// evictedFile is the file evicted under mu, which is closed and removed after unlocking.
+type evictedFile struct {
+	path    string
+	dbPath  string
+	dbCache DBCache
+	open    bool
+	done    chan struct{}
+}
+
+// Hydrator downloads missing partition files from the object storage on first access,
+// and keeps the downloaded files up to maxBytes by evicting the least recently used ones.
+// The partitions used within evictionGrace are kept over maxBytes, and evicted by Shrink after they become idle.
+type Hydrator struct {
+	bucket   objstore.Bucket
+	maxBytes int64
+	// mu guards files, size, missing and the evicted files, the downloads are shared by the group without holding it
+	mu      sync.Mutex
+	files   *lru.LRU[string, hydratedFile]
+	size    int64
+	missing map[string]time.Time
+	// evicted is closed and removed by unlock, and evicting is closed when they are removed
+	evicted  []evictedFile
+	evicting map[string]chan struct{}
+	group    singleflight.Group
+}
+
+func NewHydrator(bucket objstore.Bucket, maxBytes int64) (*Hydrator, error) {
+	h := &Hydrator{
+		bucket:   bucket,
+		maxBytes: maxBytes,
+		missing:  make(map[string]time.Time),
+		evicting: make(map[string]chan struct{}),
+	}
+	files, err := lru.NewLRU[string, hydratedFile](math.MaxInt, h.onEvict)
+	if err != nil {
+		return nil, err
+	}
+	h.files = files
+	return h, nil
+}
+
+// onEvict takes the database of the evicted file out of ldb, and leaves closing and removing it to unlock.
+// The caller must hold mu.
+func (h *Hydrator) onEvict(path string, f hydratedFile) {
+	h.size -= f.size
+	dbCache, open := f.ldb.takePartitionDB(f.dbPath)
+	done := make(chan struct{})
+	h.evicting[path] = done
+	h.evicted = append(h.evicted, evictedFile{
+		path:    path,
+		dbPath:  f.dbPath,
+		dbCache: dbCache,
+		open:    open,
+		done:    done,
+	})
+}
+
+// unlock releases mu, and then closes and removes the evicted files, since closing waits for their running queries.
+func (h *Hydrator) unlock() {
+	evicted := h.evicted
+	h.evicted = nil
+	h.mu.Unlock()
+	for _, f := range evicted {
+		h.remove(f)
+	}
+}
+
+func (h *Hydrator) remove(f evictedFile) {
+	if f.open {
+		if err := f.dbCache.close(); err != nil {
+			// ignore error
+			slog.Error("failed to close db", "err", err, "dbPath", f.dbPath)
+		}
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(f.path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			// ignore error
+			slog.Error("failed to remove hydrated file", "err", err, "path", f.path+suffix)
+		}
+	}
+	h.mu.Lock()
+	delete(h.evicting, f.path)
+	h.mu.Unlock()
+	close(f.done)
+	slog.Info("evicted hydrated partition", "path", f.path)
+}
+
+// register adds the existing partition files of ldb to the cache.
+func (h *Hydrator) register(ldb *LabelDB) error {
+	files, err := PartitionFiles(ldb.dir)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.unlock()
+	for _, dbPath := range files {
+		info, err := os.Stat(filepath.Join(ldb.dir, dbPath))
+		if err != nil {
+			return err
+		}
+		h.add(ldb, dbPath, info.Size())
+	}
+	return nil
+}
+
+func (h *Hydrator) add(ldb *LabelDB, dbPath string, size int64) {
+	h.files.Add(filepath.Join(ldb.dir, dbPath), hydratedFile{
+		ldb:    ldb,
+		dbPath: dbPath,
+		size:   size,
+	})
+	h.size += size
+	h.evict()
+}
+
+// evict removes the least recently used files until the total size fits maxBytes, skipping the partitions in use.
+func (h *Hydrator) evict() {
+	paths := h.files.Keys()
+	threshold := time.Now().UTC().Add(-evictionGrace)
+	// keep the last added file even if it's larger than maxBytes
+	for _, path := range paths[:max(len(paths)-1, 0)] {
+		if h.size <= h.maxBytes {
+			return
+		}
+		if f, ok := h.files.Peek(path); ok && f.ldb.usedSince(f.dbPath, threshold) {
+			continue
+		}
+		h.files.Remove(path)
+	}
+}
+
+// Shrink evicts the files kept over maxBytes while their partitions were in use.
+// The evicted partitions are closed after unlocking, so the other partitions are not blocked by their running queries.
+func (h *Hydrator) Shrink() {
+	h.mu.Lock()
+	defer h.unlock()
+	h.evict()
+}
+
+// hydrate downloads the partition file of ldb if it doesn't exist locally.
+// The concurrent hydrations of the same partition share the download, and don't block the other partitions.
+func (h *Hydrator) hydrate(ldb *LabelDB, dbPath string) error {
+	path := filepath.Join(ldb.dir, dbPath)
+	if h.cached(path) {
+		return nil
+	}
+	_, err, _ := h.group.Do(path, func() (interface{}, error) {
+		return nil, h.download(ldb, dbPath, path)
+	})
+	return err
+}
+
+// cached reports whether the partition is hydrated, or recently found missing in the object storage.
+// It waits for the eviction of the partition, so that the file being removed is downloaded again.
+func (h *Hydrator) cached(path string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for {
+		done, ok := h.evicting[path]
+		if !ok {
+			break
+		}
+		h.mu.Unlock()
+		<-done
+		h.mu.Lock()
+	}
+	if _, ok := h.files.Get(path); ok {
+		return true
+	}
+	if t, ok := h.missing[path]; ok {
+		if time.Since(t) < missingTTL {
+			return true
+		}
+		delete(h.missing, path)
+	}
+	return false
+}
+
+func (h *Hydrator) download(ldb *LabelDB, dbPath string, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		// the file is not downloaded by the hydrator, keep it as is
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hydrationTimeout)
+	defer cancel()
+	tmpPath := path + ".download"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	err = h.bucket.Get(ctx, ldb.hydrationPrefix+dbPath, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if errors.Is(err, objstore.ErrNotFound) {
+			// the partition doesn't exist in the object storage either
+			h.mu.Lock()
+			h.missing[path] = time.Now()
+			h.mu.Unlock()
+			return nil
+		}
+		return err
+	}
+
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.add(ldb, dbPath, info.Size())
+	h.unlock()
+	slog.Info("hydrated partition", "dbPath", dbPath, "size", info.Size())
+	return nil
+}
+
+// SetHydrator enables on-demand hydration of the partition files.
+// The partition files are stored under prefix in the object storage.
+func (ldb *LabelDB) SetHydrator(h *Hydrator, prefix string) error {
+	ldb.hydrator = h
+	ldb.hydrationPrefix = prefix
+	return h.register(ldb)
+}
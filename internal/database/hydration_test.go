@@ -0,0 +1,306 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/objstore"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestHydration(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	bucketDir := t.TempDir()
+	dstDir := t.TempDir()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// prepare partitions and upload them to the bucket
+	src, err := Open(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		f := fromTS.Add(time.Duration(i) * PartitionInterval)
+		err = src.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{
+					Name:  "dim1",
+					Value: fmt.Sprintf("dim_value%d", i),
+				},
+			},
+			FromTS: f,
+			ToTS:   f.Add(1 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.WalCheckpoint(ctx); err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+	bucket := objstore.NewFileBucket(bucketDir)
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fileSize int64
+	for _, e := range entries {
+		if !partitionFilePattern.MatchString(e.Name()) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(srcDir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bucket.Put(ctx, e.Name(), f); err != nil {
+			t.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileSize = max(fileSize, info.Size())
+		f.Close()
+	}
+
+	// keep only 2 partitions locally
+	hydrator, err := NewHydrator(bucket, fileSize*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.SetHydrator(hydrator, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(3*PartitionInterval), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+
+	entries, err = os.ReadDir(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partitions := 0
+	for _, e := range entries {
+		if partitionFilePattern.MatchString(e.Name()) {
+			partitions++
+		}
+	}
+	// the partitions used by the query are kept until they become idle
+	if partitions != 3 {
+		t.Fatalf("unexpected number of local partitions: %d", partitions)
+	}
+	db.mu.Lock()
+	for dbPath, dbCache := range db.dbCache {
+		dbCache.lastUsed = dbCache.lastUsed.Add(-2 * IdleTimeout)
+		db.dbCache[dbPath] = dbCache
+	}
+	db.mu.Unlock()
+	if err := db.CleanupUnusedDB(ctx); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = os.ReadDir(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partitions = 0
+	for _, e := range entries {
+		if partitionFilePattern.MatchString(e.Name()) {
+			partitions++
+		}
+	}
+	if partitions != 2 {
+		t.Fatalf("unexpected number of local partitions after cleanup: %d", partitions)
+	}
+}
+
+// blockingBucket counts the downloads, and blocks them until release is closed if it's set.
+type blockingBucket struct {
+	objstore.Bucket
+	gets    atomic.Int32
+	release chan struct{}
+}
+
+func (b *blockingBucket) Get(ctx context.Context, key string, w io.Writer) error {
+	b.gets.Add(1)
+	if b.release != nil {
+		<-b.release
+	}
+	return b.Bucket.Get(ctx, key, w)
+}
+
+func TestHydrationMissing(t *testing.T) {
+	ctx := context.Background()
+	dstDir := t.TempDir()
+	bucket := &blockingBucket{Bucket: objstore.NewFileBucket(t.TempDir())}
+
+	hydrator, err := NewHydrator(bucket, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.SetHydrator(hydrator, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		result, err := db.QueryActiveSeries(ctx, fromTS, fromTS.Add(1*time.Hour), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 0 {
+			t.Fatalf("unexpected active series: %v", result)
+		}
+	}
+	// the missing partition is cached
+	if n := bucket.gets.Load(); n != 1 {
+		t.Fatalf("unexpected number of downloads: %d", n)
+	}
+	// the empty partition file is not created
+	files, err := PartitionFiles(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("unexpected partition files: %v", files)
+	}
+
+	// the partition uploaded later is hydrated after the cache expires
+	srcDir := t.TempDir()
+	src, err := Open(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.RecordMetric(ctx, model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		FromTS:     fromTS,
+		ToTS:       fromTS.Add(1 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.WalCheckpoint(ctx); err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+	dbPath := PartitionLayout{}.getDBPath(fromTS)
+	f, err := os.Open(filepath.Join(srcDir, dbPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := bucket.Put(ctx, dbPath, f); err != nil {
+		t.Fatal(err)
+	}
+	hydrator.mu.Lock()
+	hydrator.missing[filepath.Join(dstDir, dbPath)] = time.Now().Add(-missingTTL)
+	hydrator.mu.Unlock()
+
+	result, err := db.QueryMetrics(ctx, fromTS, fromTS.Add(1*time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+}
+
+func TestHydrationConcurrent(t *testing.T) {
+	dstDir := t.TempDir()
+	bucket := &blockingBucket{Bucket: objstore.NewFileBucket(t.TempDir()), release: make(chan struct{})}
+
+	hydrator, err := NewHydrator(bucket, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the partition hydrated before
+	cachedPath := fmt.Sprintf(DbPathPattern, "_20241111_20250202")
+	if err := os.WriteFile(filepath.Join(dstDir, cachedPath), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetHydrator(hydrator, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the concurrent hydrations of the same partition share the download
+	dbPath := fmt.Sprintf(DbPathPattern, "_20250203_20250427")
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := hydrator.hydrate(db, dbPath); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	for bucket.gets.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the cached partition doesn't wait for the download
+	done := make(chan error)
+	go func() {
+		done <- hydrator.hydrate(db, cachedPath)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hydration of the cached partition is blocked by the download")
+	}
+
+	close(bucket.release)
+	wg.Wait()
+	if n := bucket.gets.Load(); n != 1 {
+		t.Fatalf("unexpected number of downloads: %d", n)
+	}
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	lockFileName      = "recorder.lock"
+	lockRetryInterval = 1 * time.Second
+)
+
+var ErrLocked = errors.New("database directory is locked by another process")
+
+// Lock is the exclusive lock of the database directory, which prevents multiple recorders from writing it.
+// The lock is released by the kernel when the holder dies.
+type Lock struct {
+	f *os.File
+}
+
+// AcquireLock locks the database directory. If wait is true, it waits until the lock is released or ctx is done,
+// otherwise it returns ErrLocked immediately.
+func AcquireLock(ctx context.Context, dir string, wait bool) (*Lock, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(lockRetryInterval)
+	defer ticker.Stop()
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &Lock{f: f}, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, err
+		}
+		if !wait {
+			f.Close()
+			return nil, ErrLocked
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *Lock) Release() error {
+	return errors.Join(syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN), l.f.Close())
+}
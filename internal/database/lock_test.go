@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	lock, err := AcquireLock(ctx, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireLock(ctx, dir, false); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireLock(timeoutCtx, dir, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// the standby takes over when the lock is released
+	acquired := make(chan *Lock)
+	go func() {
+		l, err := AcquireLock(ctx, dir, true)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case l := <-acquired:
+		if l == nil {
+			t.Fatal("failed to acquire the lock")
+		}
+		l.Release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock is not acquired after the release")
+	}
+}
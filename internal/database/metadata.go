@@ -0,0 +1,298 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/sqlite"
+)
+
+const (
+	metadataDBPath     = "metadata.db"
+	partitionLayoutKey = "partition_layout"
+	// the bounds are widened to the granularity to reduce the writes
+	boundsGranularity = 1 * time.Hour
+)
+
+const createMetadataTableStmt = `
+CREATE TABLE IF NOT EXISTS partition_namespaces (
+	partition TEXT NOT NULL,
+	namespace TEXT NOT NULL,
+	min_timestamp INT NOT NULL,
+	max_timestamp INT NOT NULL,
+	PRIMARY KEY (partition, namespace)
+);
+-- the partitions created after the bounds are recorded, the bounds of the other partitions are incomplete
+CREATE TABLE IF NOT EXISTS tracked_partitions (
+	partition TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+`
+
+type bounds struct {
+	min int64
+	max int64
+}
+
+func boundsKey(dbPath string, namespace string) string {
+	return dbPath + "\x00" + namespace
+}
+
+func (ldb *LabelDB) getMetadataDB() (*sql.DB, error) {
+	ldb.metadataMu.Lock()
+	defer ldb.metadataMu.Unlock()
+	if ldb.metadataDB != nil {
+		return ldb.metadataDB, nil
+	}
+
+	db, err := sql.Open(driverName, sqlite.DSN(filepath.Join(ldb.dir, metadataDBPath), sqlite.Options{WAL: true, BusyTimeout: busyTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createMetadataTableStmt); err != nil {
+		db.Close()
+		return nil, err
+	}
+	ldb.metadataDB = db
+	return db, nil
+}
+
+// updateNamespaceBounds widens the lifetime bounds of the namespace in the partition.
+// It must be called before the metrics are written, so that queries never skip the written metrics.
+func (ldb *LabelDB) updateNamespaceBounds(ctx context.Context, dbPath string, namespace string, tr timeRange) error {
+	if err := ldb.trackPartition(ctx, dbPath); err != nil {
+		return err
+	}
+	key := boundsKey(dbPath, namespace)
+	ldb.mu.RLock()
+	b, ok := ldb.bounds[key]
+	ldb.mu.RUnlock()
+	if ok && b.min <= tr.From.Unix() && tr.To.Unix() <= b.max {
+		return nil
+	}
+
+	newBounds := bounds{
+		min: tr.From.Truncate(boundsGranularity).Unix(),
+		max: tr.To.Truncate(boundsGranularity).Add(boundsGranularity).Unix(),
+	}
+	if ok {
+		newBounds.min = min(newBounds.min, b.min)
+		newBounds.max = max(newBounds.max, b.max)
+	}
+	db, err := ldb.getMetadataDB()
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO partition_namespaces (
+			partition,
+			namespace,
+			min_timestamp,
+			max_timestamp
+		) VALUES (?, ?, ?, ?)
+		ON CONFLICT(partition, namespace) DO UPDATE SET
+			min_timestamp = MIN(min_timestamp, excluded.min_timestamp),
+			max_timestamp = MAX(max_timestamp, excluded.max_timestamp);
+		`,
+		dbPath,
+		namespace,
+		newBounds.min,
+		newBounds.max,
+	)
+	if err != nil {
+		return err
+	}
+	ldb.mu.Lock()
+	ldb.bounds[key] = newBounds
+	ldb.mu.Unlock()
+	return nil
+}
+
+// trackPartition marks the partition as tracked if it's not created yet.
+// The partitions written before upgrading or by the replication are not tracked, and never skipped.
+func (ldb *LabelDB) trackPartition(ctx context.Context, dbPath string) error {
+	ldb.mu.RLock()
+	_, ok := ldb.seenPartitions[dbPath]
+	ldb.mu.RUnlock()
+	if ok {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(ldb.dir, dbPath)); err == nil {
+		ldb.markSeen(dbPath)
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	db, err := ldb.getMetadataDB()
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO tracked_partitions (partition) VALUES (?)`, dbPath); err != nil {
+		return err
+	}
+	ldb.markSeen(dbPath)
+	return nil
+}
+
+func (ldb *LabelDB) markSeen(dbPath string) {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+	ldb.seenPartitions[dbPath] = struct{}{}
+}
+
+// skipPartition reports whether the partition can't have the metrics of the namespace in the time range.
+func (ldb *LabelDB) skipPartition(ctx context.Context, tr timeRange, namespace string) bool {
+	dbPath := ldb.PartitionLayout().getDBPath(tr.From)
+	if ldb.hydrator != nil {
+		if err := ldb.hydrator.hydrate(ldb, dbPath); err != nil {
+			// the error is returned when the partition is opened
+			return false
+		}
+	}
+	if _, err := os.Stat(filepath.Join(ldb.dir, dbPath)); errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+
+	db, err := ldb.getMetadataDB()
+	if err != nil {
+		// ignore error
+		slog.Error("failed to open metadata db", "err", err)
+		return false
+	}
+	var minTS, maxTS int64
+	err = db.QueryRowContext(ctx, `
+		SELECT n.min_timestamp, n.max_timestamp FROM partition_namespaces n
+		JOIN tracked_partitions p ON p.partition = n.partition
+		WHERE n.partition = ? AND n.namespace = ?
+	`, dbPath, namespace).Scan(&minTS, &maxTS)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			// ignore error
+			slog.Error("failed to get partition metadata", "err", err, "dbPath", dbPath)
+		}
+		// the partition might be written without the metadata, e.g. before upgrading or by the replication
+		return false
+	}
+	return maxTS < tr.From.Unix() || tr.To.Unix() < minTS
+}
+
+func (ldb *LabelDB) deletePartitionMetadata(ctx context.Context, dbPath string) error {
+	ldb.mu.Lock()
+	for key := range ldb.bounds {
+		if len(key) > len(dbPath) && key[:len(dbPath)+1] == dbPath+"\x00" {
+			delete(ldb.bounds, key)
+		}
+	}
+	delete(ldb.seenPartitions, dbPath)
+	ldb.mu.Unlock()
+	db, err := ldb.getMetadataDB()
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM tracked_partitions WHERE partition = ?`, dbPath); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM partition_namespaces WHERE partition = ?`, dbPath)
+	return err
+}
+
+func (l PartitionLayout) equal(other PartitionLayout) bool {
+	return l.Months == other.Months && l.Epoch.Equal(other.Epoch)
+}
+
+func loadPartitionLayout(ctx context.Context, db *sql.DB) (PartitionLayout, bool, error) {
+	var value string
+	err := db.QueryRowContext(ctx, `SELECT value FROM settings WHERE key = ?`, partitionLayoutKey).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PartitionLayout{}, false, nil
+	} else if err != nil {
+		return PartitionLayout{}, false, err
+	}
+	var layout PartitionLayout
+	if err := json.Unmarshal([]byte(value), &layout); err != nil {
+		return PartitionLayout{}, false, err
+	}
+	return layout, true, nil
+}
+
+// LoadPartitionLayout returns the partition layout persisted in dir, or the default layout if it's not persisted.
+func LoadPartitionLayout(ctx context.Context, dir string) (PartitionLayout, error) {
+	path := filepath.Join(dir, metadataDBPath)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return PartitionLayout{}, nil
+	}
+	db, err := sql.Open(driverName, sqlite.DSN(path, sqlite.Options{ReadOnly: true, BusyTimeout: busyTimeout}))
+	if err != nil {
+		return PartitionLayout{}, err
+	}
+	defer db.Close()
+	layout, _, err := loadPartitionLayout(ctx, db)
+	if isNoSuchTable(err) {
+		return PartitionLayout{}, nil
+	}
+	return layout, err
+}
+
+func (ldb *LabelDB) PartitionLayout() PartitionLayout {
+	ldb.mu.RLock()
+	defer ldb.mu.RUnlock()
+	return ldb.layout
+}
+
+func (ldb *LabelDB) setLayout(layout PartitionLayout) {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+	ldb.layout = layout
+}
+
+// SetPartitionLayout changes the partition layout and persists it.
+// The layout can't be changed once it's persisted or the partitions are written in the default layout.
+func (ldb *LabelDB) SetPartitionLayout(ctx context.Context, layout PartitionLayout) error {
+	if err := layout.Validate(); err != nil {
+		return err
+	}
+	db, err := ldb.getMetadataDB()
+	if err != nil {
+		return err
+	}
+	persisted, ok, err := loadPartitionLayout(ctx, db)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if !persisted.equal(layout) {
+			return fmt.Errorf("partition layout can't be changed from %s to %s", persisted, layout)
+		}
+		ldb.setLayout(layout)
+		return nil
+	}
+	if !layout.equal(PartitionLayout{}) {
+		files, err := PartitionFiles(ldb.dir)
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			return fmt.Errorf("partition layout can't be changed to %s, the existing partitions use the default layout", layout)
+		}
+	}
+
+	value, err := json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO settings (key, value) VALUES (?, ?)`, partitionLayoutKey, string(value)); err != nil {
+		return err
+	}
+	ldb.setLayout(layout)
+	return nil
+}
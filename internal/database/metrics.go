@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const partitionStatsTimeout = 10 * time.Second
+
+type partitionCollector struct {
+	dir       string
+	size      *prometheus.Desc
+	walSize   *prometheus.Desc
+	freePages *prometheus.Desc
+}
+
+// NewPartitionCollector returns a collector of the file sizes and the free pages of the partitions in dir.
+func NewPartitionCollector(dir string) prometheus.Collector {
+	return &partitionCollector{
+		dir: dir,
+		size: prometheus.NewDesc(
+			"database_partition_size_bytes",
+			"Size of the partition db file",
+			[]string{"partition"}, nil,
+		),
+		walSize: prometheus.NewDesc(
+			"database_partition_wal_size_bytes",
+			"Size of the partition WAL file",
+			[]string{"partition"}, nil,
+		),
+		freePages: prometheus.NewDesc(
+			"database_partition_free_pages",
+			"Number of the free pages in the partition db file",
+			[]string{"partition"}, nil,
+		),
+	}
+}
+
+func (c *partitionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.size
+	ch <- c.walSize
+	ch <- c.freePages
+}
+
+func (c *partitionCollector) Collect(ch chan<- prometheus.Metric) {
+	files, err := PartitionFiles(c.dir)
+	if err != nil {
+		// ignore error
+		slog.Error("failed to list partitions", "err", err, "dir", c.dir)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), partitionStatsTimeout)
+	defer cancel()
+	for _, dbPath := range files {
+		path := filepath.Join(c.dir, dbPath)
+		info, err := os.Stat(path)
+		if err != nil {
+			// the partition might be deleted by the retention
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(info.Size()), dbPath)
+
+		var walSize int64
+		if info, err := os.Stat(path + "-wal"); err == nil {
+			walSize = info.Size()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("failed to stat WAL", "err", err, "path", path)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.walSize, prometheus.GaugeValue, float64(walSize), dbPath)
+
+		freePages, err := freelistCount(ctx, path)
+		if err != nil {
+			// ignore error
+			slog.Error("failed to get free pages", "err", err, "path", path)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.freePages, prometheus.GaugeValue, float64(freePages), dbPath)
+	}
+}
+
+func freelistCount(ctx context.Context, path string) (int64, error) {
+	db, err := openPartitionFile(path, true)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var n int64
+	err = db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPartitionCollector(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+	db, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err := db.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			FromTS:     fromTS.Add(time.Duration(i) * PartitionInterval),
+			ToTS:       fromTS.Add(time.Duration(i) * PartitionInterval).Add(1 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewPartitionCollector(dbDir)
+	if n := testutil.CollectAndCount(c); n != 6 {
+		t.Fatalf("unexpected number of metrics: %d", n)
+	}
+	expected := fmt.Sprintf(`
+# HELP database_partition_free_pages Number of the free pages in the partition db file
+# TYPE database_partition_free_pages gauge
+database_partition_free_pages{partition="%s"} 0
+database_partition_free_pages{partition="%s"} 0
+`, fmt.Sprintf(DbPathPattern, "_20241111_20250202"), fmt.Sprintf(DbPathPattern, "_20250203_20250427"))
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "database_partition_free_pages"); err != nil {
+		t.Fatal(err)
+	}
+}
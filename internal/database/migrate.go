@@ -0,0 +1,146 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// The schema of the partitions is sql/table.sql, followed by the migrations in sql/migrations.
+// A migration is named <version>_<name>.sql, and the template is executed with the table suffix of the partition.
+// The schema of table.sql must not be changed, add a migration instead.
+
+//go:embed sql/migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	tmpl    *template.Template
+}
+
+var migrations = mustLoadMigrations(migrationFiles, "sql/migrations")
+
+func mustLoadMigrations(fsys fs.FS, dir string) []migration {
+	ms, err := loadMigrations(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return ms
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	var ms []migration
+	for _, e := range entries {
+		v, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(v)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name: %s", e.Name())
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(e.Name()).Parse(string(b))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{version: version, name: name, tmpl: tmpl})
+	}
+	slices.SortFunc(ms, func(a, b migration) int {
+		return a.version - b.version
+	})
+	for i := 1; i < len(ms); i++ {
+		if ms[i].version == ms[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version: %d", ms[i].version)
+		}
+	}
+	return ms, nil
+}
+
+// SchemaVersion is the version of the schema of the partitions created by this version.
+func SchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// migrateTx applies the migrations newer than the schema version of the partition.
+func migrateTx(ctx context.Context, tx *sql.Tx, suffix string) error {
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (version INT NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	err := tx.QueryRowContext(ctx, `SELECT version FROM schema_version`).Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if version >= SchemaVersion() {
+		return nil
+	}
+
+	data := struct {
+		MetricsCurSuffix string
+	}{
+		MetricsCurSuffix: suffix,
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		var sb strings.Builder
+		if err := m.tmpl.Execute(&sb, data); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sb.String()); err != nil {
+			return fmt.Errorf("failed to apply migration %d_%s: %w", m.version, m.name, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_version`); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_version (version) VALUES (?)`, SchemaVersion())
+	return err
+}
+
+// migrate applies the migrations to the partition database opened.
+// The partitions without the tables are migrated by createTables when they are written.
+func migrate(ctx context.Context, db *sql.DB, dbPath string) error {
+	suffix, err := partitionSuffix(dbPath)
+	if err != nil {
+		return err
+	}
+	var version int
+	err = db.QueryRowContext(ctx, `SELECT version FROM schema_version`).Scan(&version)
+	if err == nil && version >= SchemaVersion() {
+		return nil
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) && !isNoSuchTable(err) {
+		return err
+	}
+	exists, err := tableExists(ctx, db, "metrics"+suffix)
+	if err != nil || !exists {
+		return err
+	}
+	err = withTx(ctx, db, func(tx *sql.Tx) error {
+		return migrateTx(ctx, tx, suffix)
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("migrated partition", "dbPath", dbPath, "from", version, "to", SchemaVersion())
+	return nil
+}
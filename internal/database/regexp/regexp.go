@@ -1,13 +1,49 @@
 package regexp
 
-// #cgo LDFLAGS: -lsqlite3 -lpcre
-// #include <sqlite3.h>
-//
-// // extension function defined in sqlite3_mod_regexp.c
-// extern int sqlite3_extension_init(sqlite3*, char**, const sqlite3_api_routines*);
-//
-// // Use constructor to register extension function with sqlite.
-// void __attribute__((constructor)) init(void) {
-//   sqlite3_auto_extension((void*) sqlite3_extension_init);
-// }
-import "C"
+import (
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// CacheSize is the number of the compiled patterns shared in the process.
+const CacheSize = 1000
+
+var (
+	cache, _ = lru.New[string, *labels.FastRegexMatcher](CacheSize)
+
+	lookupsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "regexp_cache_lookups_total",
+		Help: "Total number of the compiled regexp lookups",
+	})
+	compilesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "regexp_cache_compiles_total",
+		Help: "Total number of the regexp compilations on cache misses",
+	})
+)
+
+// RegisterMetrics registers the metrics of the compiled pattern cache.
+func RegisterMetrics(registry prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{lookupsTotal, compilesTotal} {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compile returns the matcher of the pattern with the same semantics as Prometheus label matchers, i.e. RE2 syntax fully anchored.
+// The compiled patterns are cached.
+func Compile(pattern string) (*labels.FastRegexMatcher, error) {
+	lookupsTotal.Inc()
+	if m, ok := cache.Get(pattern); ok {
+		return m, nil
+	}
+	compilesTotal.Inc()
+	m, err := labels.NewFastRegexMatcher(pattern)
+	if err != nil {
+		return nil, err
+	}
+	cache.Add(pattern, m)
+	return m, nil
+}
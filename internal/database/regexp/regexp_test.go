@@ -0,0 +1,24 @@
+package regexp
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCompileCache(t *testing.T) {
+	pattern := "cache_test_.*"
+	compiles := testutil.ToFloat64(compilesTotal)
+	for i := 0; i < 3; i++ {
+		m, err := Compile(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.MatchString("cache_test_1") {
+			t.Fatal("unexpected mismatch")
+		}
+	}
+	if n := testutil.ToFloat64(compilesTotal) - compiles; n != 1 {
+		t.Fatalf("unexpected compile count: %v", n)
+	}
+}
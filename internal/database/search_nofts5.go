@@ -0,0 +1,6 @@
+//go:build !(sqlite_fts5 || fts5 || sqlite_purego)
+
+package database
+
+// searchIndexAvailable is whether the sqlite driver is built with FTS5, which modernc.org/sqlite always is.
+const searchIndexAvailable = false
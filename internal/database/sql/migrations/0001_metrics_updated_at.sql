@@ -0,0 +1,2 @@
+-- for querying the series updated since the last query
+CREATE INDEX IF NOT EXISTS idx_metrics_updated_at ON `metrics{{.MetricsCurSuffix}}`(updated_at);
@@ -0,0 +1,24 @@
+-- the dimensions of the series, for looking up the series by the dimension value without scanning the JSON
+CREATE TABLE IF NOT EXISTS metric_dimensions (
+	metric_id INT NOT NULL,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (name, value, metric_id)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS idx_metric_dimensions_metric_id ON metric_dimensions(metric_id);
+
+INSERT OR IGNORE INTO metric_dimensions (metric_id, name, value)
+SELECT m.metric_id, d.key, d.value FROM `metrics{{.MetricsCurSuffix}}` m, json_each(m.dimensions) d;
+
+-- the dimensions of a series never change, because they are a part of the series identity
+CREATE TRIGGER IF NOT EXISTS metric_dimensions_insert AFTER INSERT ON `metrics{{.MetricsCurSuffix}}`
+BEGIN
+	INSERT OR IGNORE INTO metric_dimensions (metric_id, name, value)
+	SELECT new.metric_id, key, value FROM json_each(new.dimensions);
+END;
+
+CREATE TRIGGER IF NOT EXISTS metric_dimensions_delete AFTER DELETE ON `metrics{{.MetricsCurSuffix}}`
+BEGIN
+	DELETE FROM metric_dimensions WHERE metric_id = old.metric_id;
+END;
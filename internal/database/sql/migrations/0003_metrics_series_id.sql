@@ -0,0 +1,12 @@
+-- the id of the series, which is the hash of the series identity, so that the same series has the same id in all the partitions
+ALTER TABLE `metrics{{.MetricsCurSuffix}}` ADD COLUMN series_id INT;
+
+UPDATE `metrics{{.MetricsCurSuffix}}` SET series_id = series_hash(namespace, metric_name, region, dimensions);
+
+CREATE INDEX IF NOT EXISTS idx_metrics_series_id ON `metrics{{.MetricsCurSuffix}}`(series_id);
+
+CREATE TRIGGER IF NOT EXISTS metrics_series_id AFTER INSERT ON `metrics{{.MetricsCurSuffix}}`
+BEGIN
+	UPDATE `metrics{{.MetricsCurSuffix}}` SET series_id = series_hash(new.namespace, new.metric_name, new.region, new.dimensions)
+	WHERE metric_id = new.metric_id;
+END;
@@ -13,3 +13,11 @@ CREATE TABLE IF NOT EXISTS `metrics{{.MetricsCurSuffix}}` (
 CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics ON `metrics{{.MetricsCurSuffix}}`(namespace, metric_name, region, dimensions);
 
 CREATE VIRTUAL TABLE IF NOT EXISTS `metrics_lifetime{{.MetricsLifetimeCurSuffix}}` USING rtree_i32(metric_id, from_timestamp, to_timestamp);
+
+CREATE TABLE IF NOT EXISTS `active_series{{.MetricsCurSuffix}}` (
+	namespace TEXT NOT NULL,
+	region TEXT NOT NULL,
+	timestamp INT NOT NULL,
+	count INT NOT NULL,
+	PRIMARY KEY (namespace, region, timestamp)
+);
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// stmtCache is the prepared statements of a partition database, keyed by the query.
+// The queries include the table suffixes, so that each namespace of the partition has its statements.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+	// the queries to be prepared after the transaction, because the statements can't be prepared on the other connections during the transaction,
+	// e.g. the tables are not committed yet, or the database has a single connection
+	missing map[string]struct{}
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{
+		stmts:   make(map[string]*sql.Stmt),
+		missing: make(map[string]struct{}),
+	}
+}
+
+func (c *stmtCache) get(query string) (*sql.Stmt, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stmt, ok := c.stmts[query]
+	if !ok {
+		c.missing[query] = struct{}{}
+	}
+	return stmt, ok
+}
+
+func (c *stmtCache) prepareMissing(ctx context.Context, db *sql.DB) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query := range c.missing {
+		stmt, err := db.PrepareContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		c.stmts[query] = stmt
+		delete(c.missing, query)
+	}
+	return nil
+}
+
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var allErr error
+	for query, stmt := range c.stmts {
+		allErr = errors.Join(allErr, stmt.Close())
+		delete(c.stmts, query)
+	}
+	return allErr
+}
+
+// close closes the prepared statements and the database.
+func (c DBCache) close() error {
+	return errors.Join(c.stmts.close(), c.db.Close())
+}
+
+// stmt returns the statement of the query in the transaction of the partition, which is closed with the transaction.
+// The statements not cached yet are prepared in the transaction, and cached by prepareStmts after the transaction.
+func (ldb *LabelDB) stmt(ctx context.Context, tx *sql.Tx, dbPath string, query string) (*sql.Stmt, error) {
+	ldb.mu.RLock()
+	dbCache, ok := ldb.dbCache[dbPath]
+	ldb.mu.RUnlock()
+	if ok {
+		if stmt, ok := dbCache.stmts.get(query); ok {
+			return tx.StmtContext(ctx, stmt), nil
+		}
+	}
+	return tx.PrepareContext(ctx, query)
+}
+
+// prepareStmts caches the statements used by the transactions of the partition.
+func (ldb *LabelDB) prepareStmts(ctx context.Context, dbPath string) {
+	ldb.mu.RLock()
+	dbCache, ok := ldb.dbCache[dbPath]
+	ldb.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if err := dbCache.stmts.prepareMissing(ctx, dbCache.db); err != nil {
+		// ignore error
+		slog.Error("failed to prepare statements", "err", err, "dbPath", dbPath)
+	}
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+var ErrTenantNotFound = errors.New("tenant not found")
+
+var validTenantPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func ValidateTenant(tenant string) error {
+	if tenant == "" {
+		// default tenant
+		return nil
+	}
+	if tenant == "." || tenant == ".." || !validTenantPattern.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant name: %q", tenant)
+	}
+	return nil
+}
+
+// OpenTenant opens the database of the tenant, which is stored in the subdirectory of dir.
+// The default tenant ("") uses dir itself.
+func OpenTenant(dir string, tenant string) (*LabelDB, error) {
+	if err := ValidateTenant(tenant); err != nil {
+		return nil, err
+	}
+	tenantDir := filepath.Join(dir, tenant)
+	if stat, err := os.Stat(tenantDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(tenantDir, 0o777); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %v", err)
+		}
+	} else if err != nil {
+		return nil, err
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("path exists but is not a directory: %s", tenantDir)
+	}
+	return Open(tenantDir)
+}
+
+// Tenants manages the databases of the existing tenants.
+type Tenants struct {
+	dir      string
+	mu       sync.Mutex
+	dbs      map[string]*LabelDB
+	hydrator *Hydrator
+	// maxOpenPartitions is the limit of the open partitions of each tenant
+	maxOpenPartitions int
+}
+
+func OpenTenants(dir string) *Tenants {
+	return &Tenants{
+		dir: dir,
+		dbs: make(map[string]*LabelDB),
+	}
+}
+
+func (t *Tenants) Get(tenant string) (*LabelDB, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ldb, ok := t.dbs[tenant]; ok {
+		return ldb, nil
+	}
+	if err := ValidateTenant(tenant); err != nil {
+		return nil, err
+	}
+	// don't create directories for unknown tenants on the read path
+	tenantDir := filepath.Join(t.dir, tenant)
+	if tenant != "" {
+		if stat, err := os.Stat(tenantDir); err != nil || !stat.IsDir() {
+			if !t.existsInObjectStorage(tenant) {
+				return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, tenant)
+			}
+			if err := os.MkdirAll(tenantDir, 0o777); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ldb, err := Open(tenantDir)
+	if err != nil {
+		return nil, err
+	}
+	ldb.SetMaxOpenPartitions(t.maxOpenPartitions)
+	if t.hydrator != nil {
+		prefix := ""
+		if tenant != "" {
+			prefix = tenant + "/"
+		}
+		if err := ldb.SetHydrator(t.hydrator, prefix); err != nil {
+			return nil, err
+		}
+	}
+	t.dbs[tenant] = ldb
+	return ldb, nil
+}
+
+func (t *Tenants) existsInObjectStorage(tenant string) bool {
+	if t.hydrator == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hydrationTimeout)
+	defer cancel()
+	keys, err := t.hydrator.bucket.List(ctx, tenant+"/")
+	if err != nil {
+		slog.Error("failed to list objects", "err", err, "tenant", tenant)
+		return false
+	}
+	return len(keys) > 0
+}
+
+// SetHydrator enables on-demand hydration for the tenants opened after this call.
+func (t *Tenants) SetHydrator(h *Hydrator) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hydrator = h
+}
+
+// SetMaxOpenPartitions limits the number of the open partitions of each tenant opened after this call, 0 means unlimited.
+func (t *Tenants) SetMaxOpenPartitions(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxOpenPartitions = n
+}
+
+func (t *Tenants) CleanupUnusedDB(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var allErr error
+	for tenant, ldb := range t.dbs {
+		if err := ldb.CleanupUnusedDB(ctx); err != nil {
+			slog.Error("failed to cleanup unused db", "err", err, "tenant", tenant)
+			allErr = errors.Join(allErr, err)
+		}
+	}
+	return allErr
+}
+
+func (t *Tenants) ShrinkMemory() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, ldb := range t.dbs {
+		ldb.ShrinkMemory()
+	}
+}
+
+// OpenDBs returns the open partition databases of each tenant.
+func (t *Tenants) OpenDBs() map[string][]OpenDB {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dbs := make(map[string][]OpenDB, len(t.dbs))
+	for tenant, ldb := range t.dbs {
+		dbs[tenant] = ldb.OpenDBs()
+	}
+	return dbs
+}
+
+func (t *Tenants) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var allErr error
+	for _, ldb := range t.dbs {
+		allErr = errors.Join(allErr, ldb.Close())
+	}
+	t.dbs = make(map[string]*LabelDB)
+	return allErr
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestValidateTenant(t *testing.T) {
+	for _, tenant := range []string{"", "team-a", "team_b.1"} {
+		if err := ValidateTenant(tenant); err != nil {
+			t.Fatalf("unexpected error for %q: %v", tenant, err)
+		}
+	}
+	for _, tenant := range []string{".", "..", "../team", "team/a", "team a"} {
+		if err := ValidateTenant(tenant); err == nil {
+			t.Fatalf("expected error for %q", tenant)
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	ctx := context.Background()
+	dbDir := t.TempDir()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toTS := fromTS.Add(24 * time.Hour)
+
+	for _, tenant := range []string{"team-a", "team-b"} {
+		db, err := OpenTenant(dbDir, tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{
+					Name:  "tenant",
+					Value: tenant,
+				},
+			},
+			FromTS: fromTS,
+			ToTS:   toTS,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	tenants := OpenTenants(dbDir)
+	defer tenants.Close()
+	for _, tenant := range []string{"team-a", "team-b"} {
+		db, err := tenants.Get(tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := db.QueryMetrics(ctx, fromTS, toTS, []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+		}, 0, map[string]*model.Metric{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1 {
+			t.Fatalf("unexpected result count for %s: %d", tenant, len(result))
+		}
+		for _, m := range result {
+			if m.Dimensions[0].Value != tenant {
+				t.Fatalf("unexpected metric for %s: %+v", tenant, m)
+			}
+		}
+	}
+
+	dbs := tenants.OpenDBs()
+	for _, tenant := range []string{"team-a", "team-b"} {
+		if len(dbs[tenant]) != 1 || dbs[tenant][0].Path != fmt.Sprintf(DbPathPattern, "_20241111_20250202") {
+			t.Fatalf("unexpected open dbs for %s: %+v", tenant, dbs[tenant])
+		}
+	}
+
+	if _, err := tenants.Get("team-c"); !errors.Is(err, ErrTenantNotFound) {
+		t.Fatalf("expected ErrTenantNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgpack = "application/x-msgpack"
+	// each line is the label set of a series
+	ContentTypeNDJSON = "application/x-ndjson"
+	// each series is a length-delimited prometheus.Labels message, and the whole body is snappy block compressed
+	ContentTypeProtobuf = "application/x-protobuf"
+	protobufParams      = "; proto=prometheus.Labels; encoding=delimited"
+	WarningsHeader      = "X-Labels-DB-Warning"
+	ErrorHeader         = "X-Labels-DB-Error"
+)
+
+var supported = []string{ContentTypeJSON, ContentTypeMsgpack, ContentTypeProtobuf, ContentTypeNDJSON}
+
+// Negotiate returns the supported content type with the highest quality in the Accept header.
+// JSON is returned if nothing in the header is supported.
+func Negotiate(accept string) string {
+	best := ContentTypeJSON
+	bestQ := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ || q == 0 {
+			continue
+		}
+		for _, ct := range supported {
+			if mediaType == ct || mediaType == "*/*" && ct == ContentTypeJSON {
+				best = ct
+				bestQ = q
+				break
+			}
+		}
+	}
+	return best
+}
+
+// Truncation is the metadata of the series truncated by the limit.
+type Truncation struct {
+	// the estimated number of the matching series, without the limit
+	TotalEstimate int
+}
+
+// WriteSeries writes the series in the content type negotiated by the Accept header of r.
+// The warnings are sent in the header for protobuf, which has no field for them.
+// The truncation and the stats are included in JSON and msgpack if not nil.
+func WriteSeries(w http.ResponseWriter, r *http.Request, data []map[string]string, warnings []string, truncation *Truncation, stats any) error {
+	switch Negotiate(r.Header.Get("Accept")) {
+	case ContentTypeProtobuf:
+		b, err := MarshalProtobuf(data)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", ContentTypeProtobuf+protobufParams)
+		w.Header().Set("Content-Encoding", "snappy")
+		for _, warning := range warnings {
+			w.Header().Add(WarningsHeader, warning)
+		}
+		_, err = w.Write(b)
+		return err
+	case ContentTypeNDJSON:
+		nw := NewNDJSONWriter(w)
+		for _, series := range data {
+			if err := nw.Write(series); err != nil {
+				return err
+			}
+		}
+		nw.Close(warnings)
+		return nil
+	case ContentTypeMsgpack:
+		w.Header().Set("Content-Type", ContentTypeMsgpack)
+		return msgpack.NewEncoder(w).Encode(response(data, warnings, truncation, stats))
+	default:
+		w.Header().Set("Content-Type", ContentTypeJSON)
+		return writeJSON(w, data, warnings, truncation, stats)
+	}
+}
+
+// NDJSONWriter writes the series one by one as they are found.
+// The warnings and the error are sent in the trailer, since they may be found after the series are written.
+type NDJSONWriter struct {
+	w http.ResponseWriter
+	// the scratch of a line
+	buf  []byte
+	keys []string
+}
+
+func NewNDJSONWriter(w http.ResponseWriter) *NDJSONWriter {
+	w.Header().Set("Content-Type", ContentTypeNDJSON)
+	w.Header().Set("Trailer", WarningsHeader+", "+ErrorHeader)
+	return &NDJSONWriter{w: w}
+}
+
+func (n *NDJSONWriter) Write(series map[string]string) error {
+	n.buf, n.keys = appendSeries(n.buf[:0], n.keys, series)
+	n.buf = append(n.buf, '\n')
+	_, err := n.w.Write(n.buf)
+	return err
+}
+
+// Close sets the warnings in the trailer.
+func (n *NDJSONWriter) Close(warnings []string) {
+	for _, warning := range warnings {
+		n.w.Header().Add(WarningsHeader, warning)
+	}
+}
+
+// Abort sets the error in the trailer, since the status code is already sent.
+func (n *NDJSONWriter) Abort(err error) {
+	n.w.Header().Set(ErrorHeader, err.Error())
+}
+
+func response(data []map[string]string, warnings []string, truncation *Truncation, stats any) map[string]interface{} {
+	resp := map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	}
+	if len(warnings) > 0 {
+		resp["warnings"] = warnings
+	}
+	if truncation != nil {
+		resp["truncated"] = true
+		resp["totalEstimate"] = truncation.TotalEstimate
+	}
+	if stats != nil {
+		resp["stats"] = stats
+	}
+	return resp
+}
+
+// MarshalProtobuf encodes the series as the length-delimited prometheus.Labels messages compressed by snappy.
+func MarshalProtobuf(data []map[string]string) ([]byte, error) {
+	var buf []byte
+	for _, series := range data {
+		pb := prompb.Labels{Labels: make([]prompb.Label, 0, len(series))}
+		for name, value := range series {
+			pb.Labels = append(pb.Labels, prompb.Label{Name: name, Value: value})
+		}
+		sort.Slice(pb.Labels, func(i, j int) bool {
+			return pb.Labels[i].Name < pb.Labels[j].Name
+		})
+		b, err := pb.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	return snappy.Encode(nil, buf), nil
+}
+
+// UnmarshalProtobuf decodes the body encoded by MarshalProtobuf.
+func UnmarshalProtobuf(body []byte) ([]map[string]string, error) {
+	buf, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	data := []map[string]string{}
+	for len(buf) > 0 {
+		n, size := binary.Uvarint(buf)
+		if size <= 0 || uint64(len(buf)-size) < n {
+			return nil, errors.New("invalid length of the message")
+		}
+		var pb prompb.Labels
+		if err := pb.Unmarshal(buf[size : size+int(n)]); err != nil {
+			return nil, err
+		}
+		series := make(map[string]string, len(pb.Labels))
+		for _, l := range pb.Labels {
+			series[l.Name] = l.Value
+		}
+		data = append(data, series)
+		buf = buf[size+int(n):]
+	}
+	return data, nil
+}
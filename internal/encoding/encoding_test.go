@@ -0,0 +1,197 @@
+package encoding
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ContentTypeJSON},
+		{"*/*", ContentTypeJSON},
+		{"text/html", ContentTypeJSON},
+		{"application/x-protobuf", ContentTypeProtobuf},
+		{"application/x-msgpack, application/json;q=0.5", ContentTypeMsgpack},
+		{"application/json;q=0.5, application/x-protobuf;q=0.9", ContentTypeProtobuf},
+		{"application/x-protobuf;q=0, application/x-msgpack;q=0.1", ContentTypeMsgpack},
+		{"application/x-ndjson", ContentTypeNDJSON},
+	}
+	for _, tt := range tests {
+		if got := Negotiate(tt.accept); got != tt.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestWriteSeries(t *testing.T) {
+	data := []map[string]string{
+		{"__name__": "CPUUtilization", "Namespace": "AWS/EC2", "InstanceId": "i-1"},
+		{"__name__": "CPUUtilization", "Namespace": "AWS/EC2", "InstanceId": "i-2"},
+	}
+	type response struct {
+		Status   string              `json:"status" msgpack:"status"`
+		Data     []map[string]string `json:"data" msgpack:"data"`
+		Warnings []string            `json:"warnings" msgpack:"warnings"`
+	}
+
+	for _, accept := range []string{ContentTypeJSON, ContentTypeMsgpack, ContentTypeProtobuf, ContentTypeNDJSON} {
+		r := httptest.NewRequest("GET", "/api/v1/series", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		if err := WriteSeries(w, r, data, []string{"warning"}, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []map[string]string
+		body := w.Body.Bytes()
+		switch accept {
+		case ContentTypeJSON:
+			var resp response
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatal(err)
+			}
+			got = resp.Data
+			if !reflect.DeepEqual(resp.Warnings, []string{"warning"}) {
+				t.Fatalf("unexpected warnings: %v", resp.Warnings)
+			}
+		case ContentTypeMsgpack:
+			var resp response
+			if err := msgpack.Unmarshal(body, &resp); err != nil {
+				t.Fatal(err)
+			}
+			got = resp.Data
+		case ContentTypeProtobuf:
+			if w.Header().Get("Content-Encoding") != "snappy" {
+				t.Fatalf("unexpected content encoding: %s", w.Header().Get("Content-Encoding"))
+			}
+			if w.Header().Get(WarningsHeader) != "warning" {
+				t.Fatalf("unexpected warnings: %v", w.Header().Values(WarningsHeader))
+			}
+			var err error
+			got, err = UnmarshalProtobuf(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case ContentTypeNDJSON:
+			if trailer := w.Result().Trailer.Get(WarningsHeader); trailer != "warning" {
+				t.Fatalf("unexpected warnings: %v", trailer)
+			}
+			dec := json.NewDecoder(bytes.NewReader(body))
+			for dec.More() {
+				var series map[string]string
+				if err := dec.Decode(&series); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, series)
+			}
+		}
+		if !reflect.DeepEqual(got, data) {
+			t.Fatalf("%s: got %v, want %v", accept, got, data)
+		}
+	}
+}
+
+func TestWriteSeriesStats(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/series", nil)
+	w := httptest.NewRecorder()
+	stats := map[string]int{"returned": 1}
+	if err := WriteSeries(w, r, []map[string]string{{"__name__": "CPUUtilization"}}, nil, nil, stats); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Stats map[string]int `json:"stats"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp.Stats, stats) {
+		t.Fatalf("unexpected stats: %v", resp.Stats)
+	}
+}
+
+func TestWriteSeriesTruncation(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/series", nil)
+	w := httptest.NewRecorder()
+	if err := WriteSeries(w, r, []map[string]string{{"__name__": "CPUUtilization"}}, nil, &Truncation{TotalEstimate: 10}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Truncated     bool `json:"truncated"`
+		TotalEstimate int  `json:"totalEstimate"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Truncated || resp.TotalEstimate != 10 {
+		t.Fatalf("unexpected truncation: %+v", resp)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	data := []map[string]string{
+		{"__name__": "CPUUtilization", "Namespace": "AWS/EC2", "InstanceId": "i-1"},
+		{"__name__": "Latency", "Namespace": "AWS/ELB", "LoadBalancer": "a<b>&\"c\"\\d\n\t\x01", "Name": "caf\u00e9 \u2028"},
+		{},
+	}
+	tests := []struct {
+		name       string
+		data       []map[string]string
+		warnings   []string
+		truncation *Truncation
+		stats      any
+	}{
+		{name: "series", data: data},
+		{name: "no series", data: []map[string]string{}},
+		{name: "nil series"},
+		{name: "all fields", data: data, warnings: []string{"<warning>"}, truncation: &Truncation{TotalEstimate: 10}, stats: map[string]int{"returned": 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bytes.Buffer
+			if err := writeJSON(&got, tt.data, tt.warnings, tt.truncation, tt.stats); err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			if err := json.NewEncoder(&want).Encode(response(tt.data, tt.warnings, tt.truncation, tt.stats)); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != want.String() {
+				t.Fatalf("unexpected JSON:\n%s\nwant:\n%s", got.String(), want.String())
+			}
+		})
+	}
+	// the invalid UTF-8 is replaced, the escape of encoding/json differs by the Go versions
+	var got bytes.Buffer
+	if err := writeJSON(&got, []map[string]string{{"Name": "a\xffb"}}, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Data []map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(got.Bytes(), &resp); err != nil || resp.Data[0]["Name"] != "a\ufffdb" {
+		t.Fatalf("unexpected JSON: %s %v", got.String(), err)
+	}
+}
+
+func BenchmarkWriteJSON(b *testing.B) {
+	data := make([]map[string]string, 100000)
+	for i := range data {
+		data[i] = map[string]string{"__name__": "CPUUtilization", "MetricName": "CPUUtilization", "Namespace": "AWS/EC2", "Region": "us-east-1", "InstanceId": fmt.Sprintf("i-%08d", i)}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := writeJSON(io.Discard, data, nil, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
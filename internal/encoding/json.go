@@ -0,0 +1,157 @@
+package encoding
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// the buffer of the JSON responses, written to the client when it is full
+const jsonBufferSize = 64 * 1024
+
+// jsonWriter writes the series without reflection, the writers are pooled to reuse the buffers over the responses.
+type jsonWriter struct {
+	bw *bufio.Writer
+	// the scratch of a series
+	buf  []byte
+	keys []string
+}
+
+var jsonWriterPool = sync.Pool{
+	New: func() any {
+		return &jsonWriter{bw: bufio.NewWriterSize(nil, jsonBufferSize)}
+	},
+}
+
+// writeJSON writes the response the same as encoding/json encodes the map of response, with the keys in order.
+func writeJSON(w io.Writer, data []map[string]string, warnings []string, truncation *Truncation, stats any) error {
+	jw := jsonWriterPool.Get().(*jsonWriter)
+	defer func() {
+		jw.bw.Reset(nil)
+		jsonWriterPool.Put(jw)
+	}()
+	jw.bw.Reset(w)
+
+	jw.bw.WriteString(`{"data":`)
+	if data == nil {
+		jw.bw.WriteString("null")
+	} else {
+		jw.bw.WriteByte('[')
+		for i, series := range data {
+			jw.buf = jw.buf[:0]
+			if i > 0 {
+				jw.buf = append(jw.buf, ',')
+			}
+			jw.buf, jw.keys = appendSeries(jw.buf, jw.keys, series)
+			if _, err := jw.bw.Write(jw.buf); err != nil {
+				return err
+			}
+		}
+		jw.bw.WriteByte(']')
+	}
+	if stats != nil {
+		if err := writeJSONField(jw.bw, "stats", stats); err != nil {
+			return err
+		}
+	}
+	jw.bw.WriteString(`,"status":"success"`)
+	if truncation != nil {
+		jw.bw.WriteString(`,"totalEstimate":` + strconv.Itoa(truncation.TotalEstimate) + `,"truncated":true`)
+	}
+	if len(warnings) > 0 {
+		if err := writeJSONField(jw.bw, "warnings", warnings); err != nil {
+			return err
+		}
+	}
+	jw.bw.WriteString("}\n")
+	return jw.bw.Flush()
+}
+
+func writeJSONField(bw *bufio.Writer, name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	bw.WriteString(`,"` + name + `":`)
+	_, err = bw.Write(b)
+	return err
+}
+
+// appendSeries appends the label set as a JSON object with the sorted keys, same as encoding/json.
+// keys is the scratch of the keys, and returned for the reuse.
+func appendSeries(dst []byte, keys []string, series map[string]string) ([]byte, []string) {
+	keys = keys[:0]
+	for k := range series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	dst = append(dst, '{')
+	for i, k := range keys {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendString(dst, k)
+		dst = append(dst, ':')
+		dst = appendString(dst, series[k])
+	}
+	return append(dst, '}'), keys
+}
+
+const hex = "0123456789abcdef"
+
+// appendString appends s as a JSON string escaped the same as encoding/json, including the HTML characters.
+func appendString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '\\', '"':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		// the line and paragraph separators don't work in JSONP
+		if c == '\u2028' || c == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hex[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
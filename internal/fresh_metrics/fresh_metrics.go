@@ -2,39 +2,67 @@ package fresh_metrics
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"regexp"
+	"maps"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/mtanda/prometheus-labels-db/internal/database/regexp"
 	"github.com/mtanda/prometheus-labels-db/internal/model"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/model/labels"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/time/rate"
 )
 
 const (
 	maxCacheSize = 100
 	cacheTTL     = 5 * time.Minute
+	tracerName   = "github.com/mtanda/prometheus-labels-db/internal/fresh_metrics"
 )
 
+var ErrNamespaceNotAllowed = errors.New("namespace is not allowed to query fresh metrics")
+
 type CloudWatchAPI interface {
 	cloudwatch.ListMetricsAPIClient
 }
 
+type cachedDimensions struct {
+	dimensions []map[string]string
+	expiresAt  time.Time
+}
+
+// CacheEntry is the state of a cached ListMetrics result.
+type CacheEntry struct {
+	Key        string  `json:"key"`
+	Series     int     `json:"series"`
+	TTLSeconds float64 `json:"ttlSeconds"`
+}
+
 type FreshMetrics struct {
 	CwClient         map[string]CloudWatchAPI
 	limiter          *rate.Limiter
-	cache            *expirable.LRU[string, []map[string]string]
+	cache            *expirable.LRU[string, cachedDimensions]
 	apiCallsTotal    *prometheus.CounterVec
 	apiCallDurations prometheus.Histogram
+	// nil allows all namespaces
+	allowedNamespaces map[string]struct{}
+	newClient         func(ctx context.Context, region string) (CloudWatchAPI, error)
+	// time.Duration, changed by the reload while querying
+	cutoff atomic.Int64
 }
 
 func New(limiter *rate.Limiter, registry *prometheus.Registry) *FreshMetrics {
@@ -47,29 +75,129 @@ func New(limiter *rate.Limiter, registry *prometheus.Registry) *FreshMetrics {
 		Help:    "Duration of CloudWatch API call in seconds",
 		Buckets: prometheus.ExponentialBuckets(0.01, 2, 20),
 	})
-	cache := expirable.NewLRU[string, []map[string]string](maxCacheSize, nil, cacheTTL)
-	return &FreshMetrics{
+	cache := expirable.NewLRU[string, cachedDimensions](maxCacheSize, nil, cacheTTL)
+	f := &FreshMetrics{
 		CwClient:         make(map[string]CloudWatchAPI),
 		limiter:          limiter,
 		cache:            cache,
 		apiCallsTotal:    apiCallsTotal,
 		apiCallDurations: apiCallDurations,
+		newClient:        newCloudWatchClient,
+	}
+	f.cutoff.Store(int64(model.RecentlyActiveWindow))
+	return f
+}
+
+func newCloudWatchClient(ctx context.Context, region string) (CloudWatchAPI, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return cloudwatch.NewFromConfig(awsCfg), nil
+}
+
+// SetClientFactory replaces the CloudWatch client of each region, e.g. with the mock for local development.
+func (f *FreshMetrics) SetClientFactory(newClient func(ctx context.Context, region string) (CloudWatchAPI, error)) {
+	f.newClient = newClient
+}
+
+// SetAllowedNamespaces restricts the namespaces which can call the CloudWatch API, empty allows all namespaces.
+func (f *FreshMetrics) SetAllowedNamespaces(namespaces []string) {
+	if len(namespaces) == 0 {
+		f.allowedNamespaces = nil
+		return
 	}
+	f.allowedNamespaces = make(map[string]struct{}, len(namespaces))
+	for _, ns := range namespaces {
+		f.allowedNamespaces[ns] = struct{}{}
+	}
+}
+
+// SetCutoff changes how far back the queries reach the fresh metrics, which are assumed to be active since the cutoff.
+func (f *FreshMetrics) SetCutoff(cutoff time.Duration) {
+	f.cutoff.Store(int64(cutoff))
 }
 
-func (f *FreshMetrics) QueryMetrics(ctx context.Context, lm []*labels.Matcher, result map[string]*model.Metric) (map[string]*model.Metric, error) {
-	namespace, metricName, region, dimConditions := parseMatcher(lm)
-	if namespace == "" || metricName == "" || region == "" {
+// Cutoff returns how far back the queries reach the fresh metrics.
+func (f *FreshMetrics) Cutoff() time.Duration {
+	return time.Duration(f.cutoff.Load())
+}
+
+// PurgeCache drops all cached dimensions.
+func (f *FreshMetrics) PurgeCache() {
+	f.cache.Purge()
+}
+
+// CacheEntries returns the cached ListMetrics results.
+func (f *FreshMetrics) CacheEntries() []CacheEntry {
+	now := time.Now().UTC()
+	keys := f.cache.Keys()
+	entries := make([]CacheEntry, 0, len(keys))
+	for _, k := range keys {
+		c, ok := f.cache.Peek(k)
+		if !ok {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			Key:        k,
+			Series:     len(c.dimensions),
+			TTLSeconds: c.expiresAt.Sub(now).Seconds(),
+		})
+	}
+	return entries
+}
+
+// LimiterTokens returns the number of the available tokens of the ListMetrics rate limiter.
+func (f *FreshMetrics) LimiterTokens() float64 {
+	return f.limiter.Tokens()
+}
+
+// QueryMetrics adds the series matching lm to result, until result has limit series (unlimited if 0).
+// The series are added in the order of their keys, so that the same series are returned over the cached ListMetrics results.
+// The alternation of the namespaces, e.g. Namespace=~"AWS/EC2|AWS/ELB", lists the metrics of each namespace.
+// If some of the namespaces are not allowed, the series of the others are added and ErrNamespaceNotAllowed is returned.
+func (f *FreshMetrics) QueryMetrics(ctx context.Context, lm []*labels.Matcher, limit int, result map[string]*model.Metric) (map[string]*model.Metric, error) {
+	namespaces, metricName, region, dimConditions := parseMatcher(lm)
+	if len(namespaces) == 0 || metricName == "" || region == "" {
 		slog.Warn("namespace, metricName, and region are required")
 		return result, nil
 	}
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "FreshMetrics.QueryMetrics")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("cloudwatch.namespace", strings.Join(namespaces, "|")),
+		attribute.String("cloudwatch.metric_name", metricName),
+		attribute.String("cloudwatch.region", region),
+	)
+	count := len(result)
+	var notAllowed error
+	for _, namespace := range namespaces {
+		var err error
+		result, err = f.queryMetrics(ctx, namespace, metricName, region, dimConditions, limit, result)
+		if errors.Is(err, ErrNamespaceNotAllowed) {
+			notAllowed = err
+			continue
+		} else if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return result, err
+		}
+	}
+	span.SetAttributes(attribute.Int("series", len(result)-count))
+	return result, notAllowed
+}
+
+func (f *FreshMetrics) queryMetrics(ctx context.Context, namespace, metricName, region string, dimConditions []*labels.Matcher, limit int, result map[string]*model.Metric) (map[string]*model.Metric, error) {
+	if f.allowedNamespaces != nil {
+		if _, ok := f.allowedNamespaces[namespace]; !ok {
+			return result, fmt.Errorf("%w: %s", ErrNamespaceNotAllowed, namespace)
+		}
+	}
 
 	if _, ok := f.CwClient[region]; !ok {
-		awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+		client, err := f.newClient(ctx, region)
 		if err != nil {
 			return nil, err
 		}
-		client := cloudwatch.NewFromConfig(awsCfg)
 		f.CwClient[region] = client
 	}
 
@@ -88,12 +216,13 @@ func (f *FreshMetrics) QueryMetrics(ctx context.Context, lm []*labels.Matcher, r
 	}
 
 	now := time.Now().UTC()
+	metrics := make(map[string]*model.Metric, len(filteredDimensions))
 	for _, dims := range filteredDimensions {
 		m := model.Metric{
 			Namespace:  namespace,
 			MetricName: metricName,
 			Region:     region,
-			FromTS:     now.Add(-(60*3 + 50) * time.Minute),
+			FromTS:     now.Add(-f.Cutoff()),
 			ToTS:       now,
 		}
 		for k, v := range dims {
@@ -102,14 +231,23 @@ func (f *FreshMetrics) QueryMetrics(ctx context.Context, lm []*labels.Matcher, r
 				Value: v,
 			})
 		}
-		result[m.UniqueKey()] = &m
+		metrics[m.UniqueKey()] = &m
+	}
+	for _, k := range slices.Sorted(maps.Keys(metrics)) {
+		// same as the database, check if we have enough results
+		if limit != 0 && len(result) >= limit {
+			break
+		}
+		result[k] = metrics[k]
 	}
 
 	return result, nil
 }
 
-func parseMatcher(lm []*labels.Matcher) (string, string, string, []*labels.Matcher) {
-	namespace := ""
+// parseMatcher returns the namespaces, the metric name, the region and the dimension matchers of lm.
+// The namespaces are nil unless the Namespace matcher is an equality or an alternation of the namespaces.
+func parseMatcher(lm []*labels.Matcher) ([]string, string, string, []*labels.Matcher) {
+	var namespaces []string
 	metricName := ""
 	region := ""
 	dimConditions := make([]*labels.Matcher, 0)
@@ -117,7 +255,12 @@ func parseMatcher(lm []*labels.Matcher) (string, string, string, []*labels.Match
 		// TODO: expect m.Type == labels.MatchEqual for Namespace / MetricName / Region, but not always, I'll fix it later
 		switch m.Name {
 		case "Namespace":
-			namespace = m.Value
+			switch m.Type {
+			case labels.MatchEqual:
+				namespaces = []string{m.Value}
+			case labels.MatchRegexp:
+				namespaces = m.SetMatches()
+			}
 		case "__name__":
 			metricName = m.Value
 		case "MetricName":
@@ -138,39 +281,33 @@ func parseMatcher(lm []*labels.Matcher) (string, string, string, []*labels.Match
 			dimConditions = append(dimConditions, m)
 		}
 	}
-	return namespace, metricName, region, dimConditions
+	return namespaces, metricName, region, dimConditions
 }
 
+// matchAllConditions reports whether the dimensions match all the conditions.
+// Same as Prometheus and the database, the absent dimension has the empty value, e.g. dim!="" requires dim.
 func matchAllConditions(dims map[string]string, dimConditions []*labels.Matcher) bool {
 	for _, dc := range dimConditions {
-		if _, ok := dims[dc.Name]; !ok {
-			return false
-		}
+		v := dims[dc.Name]
 		switch dc.Type {
 		case labels.MatchEqual:
-			if dims[dc.Name] != dc.Value {
+			if v != dc.Value {
 				return false
 			}
 		case labels.MatchNotEqual:
-			if dims[dc.Name] == dc.Value {
+			if v == dc.Value {
 				return false
 			}
-		case labels.MatchRegexp:
-			r, err := regexp.Compile(dc.Value)
+		case labels.MatchRegexp, labels.MatchNotRegexp:
+			m, err := regexp.Compile(dc.Value)
 			if err != nil {
 				// ignore error
 				slog.Error("failed to compile regexp", "error", err)
 				return false
 			}
-			return r.Match([]byte(dims[dc.Name]))
-		case labels.MatchNotRegexp:
-			r, err := regexp.Compile(dc.Value)
-			if err != nil {
-				// ignore error
-				slog.Error("failed to compile regexp", "error", err)
+			if m.MatchString(v) != (dc.Type == labels.MatchRegexp) {
 				return false
 			}
-			return !r.Match([]byte(dims[dc.Name]))
 		}
 	}
 	return true
@@ -184,7 +321,7 @@ func (f *FreshMetrics) getAllDimensions(ctx context.Context, region string, name
 
 	// Check if the cache already contains the result
 	if cache, ok := f.cache.Get(cacheKey); ok {
-		return cache, nil
+		return cache.dimensions, nil
 	}
 
 	// Get or create a mutex for the specific cache key
@@ -197,14 +334,17 @@ func (f *FreshMetrics) getAllDimensions(ctx context.Context, region string, name
 
 	// Double-check the cache after acquiring the lock
 	if cache, ok := f.cache.Get(cacheKey); ok {
-		return cache, nil
+		return cache.dimensions, nil
 	}
 
 	if rawResult, err := f.listMetrics(ctx, region, namespace, metricName); err != nil {
 		return nil, err
 	} else {
 		result := f.convertResult(rawResult)
-		f.cache.Add(cacheKey, result)
+		f.cache.Add(cacheKey, cachedDimensions{
+			dimensions: result,
+			expiresAt:  time.Now().UTC().Add(cacheTTL),
+		})
 		return result, nil
 	}
 }
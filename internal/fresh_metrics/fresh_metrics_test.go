@@ -0,0 +1,88 @@
+package fresh_metrics
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/time/rate"
+)
+
+func TestAllowedNamespaces(t *testing.T) {
+	f := New(rate.NewLimiter(rate.Inf, 1), prometheus.NewRegistry())
+	f.SetAllowedNamespaces([]string{"AWS/EC2"})
+
+	result, err := f.QueryMetrics(context.Background(), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "Custom/App"),
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "Requests"),
+		labels.MustNewMatcher(labels.MatchEqual, "Region", "us-east-1"),
+	}, 0, map[string]*model.Metric{})
+	if !errors.Is(err, ErrNamespaceNotAllowed) {
+		t.Fatalf("expected ErrNamespaceNotAllowed, got %v", err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if _, ok := f.CwClient["us-east-1"]; ok {
+		t.Fatal("CloudWatch client is created for the disallowed namespace")
+	}
+
+	f.SetAllowedNamespaces(nil)
+	if f.allowedNamespaces != nil {
+		t.Fatal("all namespaces should be allowed")
+	}
+}
+
+func TestParseMatcherNamespaces(t *testing.T) {
+	tests := []struct {
+		matcher *labels.Matcher
+		want    []string
+	}{
+		{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "AWS/EC2"), []string{"AWS/EC2"}},
+		{labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "AWS/EC2|AWS/ELB"), []string{"AWS/EC2", "AWS/ELB"}},
+		// ListMetrics can't list the namespaces by a pattern
+		{labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "AWS/.*"), nil},
+		{labels.MustNewMatcher(labels.MatchNotEqual, "Namespace", "AWS/EC2"), nil},
+	}
+	for _, tt := range tests {
+		got, _, _, _ := parseMatcher([]*labels.Matcher{tt.matcher})
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseMatcher(%v) = %v, want %v", tt.matcher, got, tt.want)
+		}
+	}
+}
+
+func TestMatchAllConditions(t *testing.T) {
+	dims := map[string]string{"InstanceId": "i-12", "AutoScalingGroupName": "web"}
+	tests := []struct {
+		matchers []*labels.Matcher
+		want     bool
+	}{
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "InstanceId", "i-1.*")}, true},
+		// fully anchored
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "InstanceId", "i-1")}, false},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchNotRegexp, "InstanceId", "i-1")}, true},
+		// the conditions after the regexp are also evaluated
+		{[]*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchRegexp, "InstanceId", "i-.*"),
+			labels.MustNewMatcher(labels.MatchEqual, "AutoScalingGroupName", "api"),
+		}, false},
+		// the absent dimension has the empty value
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "LoadBalancer", "")}, true},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "LoadBalancer", "")}, false},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "LoadBalancer", "lb-1")}, true},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "LoadBalancer", "lb-.*|")}, true},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "LoadBalancer", ".+")}, false},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchNotRegexp, "LoadBalancer", ".+")}, true},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "InstanceId", "")}, false},
+	}
+	for _, tt := range tests {
+		if got := matchAllConditions(dims, tt.matchers); got != tt.want {
+			t.Errorf("matchAllConditions(%v) = %v, want %v", tt.matchers, got, tt.want)
+		}
+	}
+}
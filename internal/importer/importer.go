@@ -18,8 +18,10 @@ import (
 )
 
 const (
-	MaxRetry          = 3
-	reportInterval    = 1000
+	MaxRetry       = 3
+	reportInterval = 1000
+	// the metrics recorded in a transaction of each partition
+	importBatchSize   = 100
 	importerStatePath = "importer_state.json"
 	// https://aws.amazon.com/about-aws/whats-new/2016/11/cloudwatch-extends-metrics-retention-and-new-user-interface/
 	cloudwatchExpireDays = 455
@@ -95,6 +97,30 @@ func (im *Importer) Import(ctx context.Context) error {
 	c := 0
 	importStartTime := time.Now().UTC()
 	lastReportTime := time.Now().UTC()
+	batch := make([]model.Metric, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		i := 0
+		for ; i < MaxRetry; i++ {
+			err := im.ldb.RecordMetrics(ctx, batch)
+			if err != nil {
+				im.importTotal.WithLabelValues("error").Inc()
+				sleepDuration := time.Duration(100*(1<<i)) * time.Millisecond // 0.1s, 0.2s, 0.4s, etc.
+				time.Sleep(sleepDuration)
+			} else {
+				im.importTotal.WithLabelValues("success").Add(float64(len(batch)))
+				break
+			}
+		}
+		if i == MaxRetry {
+			slog.Error("import failed", "day", start, "metrics", batch)
+			return fmt.Errorf("import failed")
+		}
+		batch = batch[:0]
+		return nil
+	}
 	for ss.Next() {
 		series := ss.At()
 		ls := series.Labels()
@@ -135,22 +161,12 @@ func (im *Importer) Import(ctx context.Context) error {
 		if err := limiter.Wait(ctx); err != nil {
 			return err
 		}
-		i := 0
-		for ; i < MaxRetry; i++ {
-			err := im.ldb.RecordMetric(ctx, metric)
-			if err != nil {
-				im.importTotal.WithLabelValues("error").Inc()
-				sleepDuration := time.Duration(100*(1<<i)) * time.Millisecond // 0.1s, 0.2s, 0.4s, etc.
-				time.Sleep(sleepDuration)
-			} else {
-				im.importTotal.WithLabelValues("success").Inc()
-				break
+		batch = append(batch, metric)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
 			}
 		}
-		if i == MaxRetry {
-			slog.Error("import failed", "day", start, "metric", metric)
-			return fmt.Errorf("import failed")
-		}
 
 		c++
 		if c%reportInterval == 0 {
@@ -161,6 +177,9 @@ func (im *Importer) Import(ctx context.Context) error {
 	if ss.Err() != nil {
 		return err
 	}
+	if err := flush(); err != nil {
+		return err
+	}
 
 	slog.Info("import 1 day records", "day", start, "durationSec", time.Since(importStartTime).Seconds(), "count", c)
 
@@ -0,0 +1,320 @@
+package labelindex
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	// the updates are requested with overlap, because updated_at is set before the transaction is committed
+	updatesOverlap = 5 * time.Minute
+	// the namespaces queried less than this score, which halves on each refresh, are dropped
+	minScore = 1
+)
+
+// Index keeps the series of the most queried namespaces in memory, so that the frequent queries of them,
+// e.g. the autocomplete of Grafana, don't hit SQLite.
+// The series recorded within the window are loaded, and the series updated since the last refresh are added on each refresh.
+type Index struct {
+	maxNamespaces int
+	window        time.Duration
+
+	mu sync.RWMutex
+	// the queries of the namespaces, decayed on each refresh
+	scores     map[key]float64
+	namespaces map[key]*namespaceIndex
+
+	queries       *prometheus.CounterVec
+	namespacesLen prometheus.Gauge
+	seriesLen     prometheus.Gauge
+}
+
+// key is a namespace of a tenant database.
+type key struct {
+	db        *database.LabelDB
+	namespace string
+}
+
+type namespaceIndex struct {
+	// the series by the metric names and the unique keys
+	metrics map[string]map[string]*model.Metric
+	// the series updated after this time are not in the index yet
+	refreshedAt time.Time
+	// the series are complete since this time
+	from time.Time
+}
+
+// New returns the index of up to maxNamespaces namespaces.
+func New(maxNamespaces int, window time.Duration, registry prometheus.Registerer) *Index {
+	return &Index{
+		maxNamespaces: maxNamespaces,
+		window:        window,
+		scores:        make(map[key]float64),
+		namespaces:    make(map[key]*namespaceIndex),
+		queries: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "label_index_queries_total",
+			Help: "Total number of the queries of the namespaces by whether they are served from the label index",
+		}, []string{"result"}),
+		namespacesLen: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "label_index_namespaces",
+			Help: "Number of the namespaces in the label index",
+		}),
+		seriesLen: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "label_index_series",
+			Help: "Number of the series in the label index",
+		}),
+	}
+}
+
+// Query adds the series matching lm to result same as database.LabelDB.QueryMetrics,
+// or returns false if the namespace of lm is not in the index or the time range is before the window.
+// The series recorded since the last refresh are not returned.
+func (x *Index) Query(db *database.LabelDB, from, to time.Time, lm []*labels.Matcher, limit int, result map[string]*model.Metric) (map[string]*model.Metric, bool) {
+	if x == nil {
+		return result, false
+	}
+	namespace := ""
+	for _, m := range lm {
+		if m.Name == "Namespace" && m.Type == labels.MatchEqual {
+			namespace = m.Value
+		}
+	}
+	if namespace == "" {
+		return result, false
+	}
+	k := key{db: db, namespace: namespace}
+
+	x.mu.Lock()
+	x.scores[k]++
+	x.mu.Unlock()
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ni, ok := x.namespaces[k]
+	if !ok || from.Before(ni.from) {
+		x.queries.WithLabelValues("miss").Inc()
+		return result, false
+	}
+	x.queries.WithLabelValues("hit").Inc()
+
+	for metricName, series := range ni.metrics {
+		if !matchMetricName(lm, metricName) {
+			continue
+		}
+		for k, m := range series {
+			if m.FromTS.After(to) || m.ToTS.Before(from) || !matchSeries(lm, m) {
+				continue
+			}
+			if r, ok := result[k]; ok {
+				r.FromTS = minTime(r.FromTS, m.FromTS)
+				r.ToTS = maxTime(r.ToTS, m.ToTS)
+				continue
+			}
+			if limit != 0 && len(result) >= limit {
+				return result, true
+			}
+			// the series in the index are not changed by the callers
+			c := *m
+			result[k] = &c
+		}
+	}
+	return result, true
+}
+
+// matchMetricName returns whether the series of the metric name can match lm.
+// Same as the database, __name__ matches both the original metric name and the safe one.
+func matchMetricName(lm []*labels.Matcher, metricName string) bool {
+	for _, m := range lm {
+		switch m.Name {
+		case labels.MetricName:
+			matched := matchesPositive(m, metricName) || matchesPositive(m, model.SafeMetricName(metricName))
+			if matched == (m.Type == labels.MatchNotEqual || m.Type == labels.MatchNotRegexp) {
+				return false
+			}
+		case "MetricName":
+			if !m.Matches(metricName) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchesPositive matches v by the equality or the regexp of the negated matcher m.
+func matchesPositive(m *labels.Matcher, v string) bool {
+	switch m.Type {
+	case labels.MatchNotEqual:
+		return m.Value == v
+	case labels.MatchNotRegexp:
+		return !m.Matches(v)
+	}
+	return m.Matches(v)
+}
+
+// matchSeries returns whether the labels other than the metric names match lm.
+// Same as the database, the absent dimension has the empty value.
+func matchSeries(lm []*labels.Matcher, metric *model.Metric) bool {
+	for _, m := range lm {
+		var v string
+		switch m.Name {
+		case labels.MetricName, "MetricName":
+			continue
+		case "Namespace":
+			v = metric.Namespace
+		case "Region":
+			v = metric.Region
+		default:
+			for _, d := range metric.Dimensions {
+				if d.Name == m.Name {
+					v = d.Value
+					break
+				}
+			}
+		}
+		if !m.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Run refreshes the index at the interval until ctx is done.
+func (x *Index) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			x.Refresh(ctx, time.Now().UTC())
+		}
+	}
+}
+
+// Refresh loads the most queried namespaces, adds the series updated since the last refresh to the loaded ones,
+// and drops the other namespaces and the series ended before the window.
+func (x *Index) Refresh(ctx context.Context, now time.Time) {
+	x.mu.Lock()
+	var hot []key
+	for k, score := range x.scores {
+		if score >= minScore {
+			hot = append(hot, k)
+		}
+	}
+	slices.SortFunc(hot, func(a, b key) int {
+		return cmp.Or(cmp.Compare(x.scores[b], x.scores[a]), cmp.Compare(a.namespace, b.namespace))
+	})
+	if len(hot) > x.maxNamespaces {
+		hot = hot[:x.maxNamespaces]
+	}
+	for k, score := range x.scores {
+		if score /= 2; score < minScore {
+			delete(x.scores, k)
+			continue
+		}
+		x.scores[k] = score
+	}
+	for k := range x.namespaces {
+		if !slices.Contains(hot, k) {
+			delete(x.namespaces, k)
+		}
+	}
+	loaded := maps.Clone(x.namespaces)
+	x.mu.Unlock()
+
+	for _, k := range hot {
+		ni, err := x.refreshNamespace(ctx, k, loaded[k], now)
+		if err != nil {
+			// ignore error
+			slog.Error("failed to refresh label index", "namespace", k.namespace, "error", err)
+			ni = nil
+		}
+		x.mu.Lock()
+		if ni == nil {
+			delete(x.namespaces, k)
+		} else {
+			x.namespaces[k] = ni
+		}
+		x.mu.Unlock()
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	series := 0
+	for _, ni := range x.namespaces {
+		for _, m := range ni.metrics {
+			series += len(m)
+		}
+	}
+	x.namespacesLen.Set(float64(len(x.namespaces)))
+	x.seriesLen.Set(float64(series))
+}
+
+// refreshNamespace loads the namespace if ni is nil, or adds the updated series to ni.
+func (x *Index) refreshNamespace(ctx context.Context, k key, ni *namespaceIndex, now time.Time) (*namespaceIndex, error) {
+	from := now.Add(-x.window)
+	lm := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", k.namespace)}
+	var opts database.QueryOptions
+	if ni != nil {
+		opts.UpdatedSince = ni.refreshedAt.Add(-updatesOverlap)
+	}
+	result, err := k.db.QueryMetricsWithOptions(ctx, from, now, lm, 0, make(map[string]*model.Metric), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if ni == nil {
+		ni = &namespaceIndex{metrics: make(map[string]map[string]*model.Metric)}
+	} else if ni != x.namespaces[k] {
+		// dropped while querying
+		return nil, nil
+	}
+	for uk, m := range result {
+		series, ok := ni.metrics[m.MetricName]
+		if !ok {
+			series = make(map[string]*model.Metric)
+			ni.metrics[m.MetricName] = series
+		}
+		if old, ok := series[uk]; ok {
+			m.FromTS = minTime(old.FromTS, m.FromTS)
+			m.ToTS = maxTime(old.ToTS, m.ToTS)
+		}
+		series[uk] = m
+	}
+	for metricName, series := range ni.metrics {
+		maps.DeleteFunc(series, func(_ string, m *model.Metric) bool { return m.ToTS.Before(from) })
+		if len(series) == 0 {
+			delete(ni.metrics, metricName)
+		}
+	}
+	ni.refreshedAt = now
+	ni.from = from
+	return ni, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
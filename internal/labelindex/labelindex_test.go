@@ -0,0 +1,110 @@
+package labelindex
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func recordMetrics(t *testing.T, ldb *database.LabelDB, namespace string, from time.Time, start, n int) {
+	for i := start; i < start+n; i++ {
+		dimensions := []model.Dimension{{Name: "InstanceId", Value: fmt.Sprintf("i-%03d", i)}}
+		if i%2 == 0 {
+			dimensions = append(dimensions, model.Dimension{Name: "AutoScalingGroupName", Value: "asg"})
+		}
+		err := ldb.RecordMetric(context.Background(), model.Metric{
+			Namespace:  namespace,
+			MetricName: "Request.Count",
+			Region:     "us-east-1",
+			Dimensions: dimensions,
+			FromTS:     from,
+			ToTS:       from.Add(10 * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	ldb, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	now := time.Now().UTC().Truncate(time.Second)
+	from := now.Add(-1 * time.Hour)
+	recordMetrics(t, ldb, "AWS/EC2", from, 0, 4)
+	recordMetrics(t, ldb, "AWS/ELB", from, 0, 4)
+
+	x := New(1, 24*time.Hour, prometheus.NewRegistry())
+	ec2 := labels.MustNewMatcher(labels.MatchEqual, "Namespace", "AWS/EC2")
+	if _, ok := x.Query(ldb, from, now, []*labels.Matcher{ec2}, 0, map[string]*model.Metric{}); ok {
+		t.Fatal("the namespace is indexed before the refresh")
+	}
+	x.Refresh(ctx, now)
+
+	tests := [][]*labels.Matcher{
+		{ec2},
+		{ec2, labels.MustNewMatcher(labels.MatchEqual, "InstanceId", "i-001")},
+		{ec2, labels.MustNewMatcher(labels.MatchEqual, "AutoScalingGroupName", "")},
+		{ec2, labels.MustNewMatcher(labels.MatchRegexp, "InstanceId", "i-00[12]")},
+		{ec2, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "Request_Count")},
+		{ec2, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "Request.Count")},
+		{ec2, labels.MustNewMatcher(labels.MatchNotEqual, labels.MetricName, "Request_Count")},
+		{ec2, labels.MustNewMatcher(labels.MatchNotRegexp, "MetricName", "Request.*")},
+		{ec2, labels.MustNewMatcher(labels.MatchEqual, "Region", "us-west-2")},
+	}
+	for _, lm := range tests {
+		indexed, ok := x.Query(ldb, from, now, lm, 0, map[string]*model.Metric{})
+		if !ok {
+			t.Fatalf("%v is not served from the index", lm)
+		}
+		expected, err := ldb.QueryMetrics(ctx, from, now, lm, 0, map[string]*model.Metric{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(slices.Sorted(maps.Keys(indexed)), slices.Sorted(maps.Keys(expected))) {
+			t.Fatalf("unexpected series of %v: %v, expected %v", lm, slices.Sorted(maps.Keys(indexed)), slices.Sorted(maps.Keys(expected)))
+		}
+	}
+	if result, _ := x.Query(ldb, from, now, []*labels.Matcher{ec2}, 2, map[string]*model.Metric{}); len(result) != 2 {
+		t.Fatalf("the limit is not applied: %v", result)
+	}
+	if _, ok := x.Query(ldb, now.Add(-48*time.Hour), now, []*labels.Matcher{ec2}, 0, map[string]*model.Metric{}); ok {
+		t.Fatal("the range before the window is served from the index")
+	}
+	elb := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "Namespace", "AWS/ELB")}
+	if _, ok := x.Query(ldb, from, now, elb, 0, map[string]*model.Metric{}); ok {
+		t.Fatal("the namespace over the limit is indexed")
+	}
+
+	// the series recorded since the refresh are added by the next refresh
+	recordMetrics(t, ldb, "AWS/EC2", from, 4, 2)
+	if result, _ := x.Query(ldb, from, now, []*labels.Matcher{ec2}, 0, map[string]*model.Metric{}); len(result) != 4 {
+		t.Fatalf("unexpected series before the refresh: %v", result)
+	}
+	x.Refresh(ctx, now.Add(1*time.Minute))
+	if result, _ := x.Query(ldb, from, now, []*labels.Matcher{ec2}, 0, map[string]*model.Metric{}); len(result) != 6 {
+		t.Fatalf("unexpected series after the refresh: %v", result)
+	}
+
+	// the namespaces not queried are dropped
+	for range 10 {
+		x.Refresh(ctx, now.Add(1*time.Minute))
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if len(x.namespaces) != 0 {
+		t.Fatalf("the namespaces are not dropped: %v", x.namespaces)
+	}
+}
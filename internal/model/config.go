@@ -2,21 +2,87 @@ package model
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	commonmodel "github.com/prometheus/common/model"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Targets []Target `yaml:"targets"`
+	Tenants   []Tenant        `yaml:"tenants"`
+	Targets   []Target        `yaml:"targets"`
+	Redaction []RedactionRule `yaml:"redaction"`
+}
+
+type Tenant struct {
+	Name        string               `yaml:"name"`
+	Retention   commonmodel.Duration `yaml:"retention"`
+	StaleSeries []StaleSeriesRule    `yaml:"stale_series"`
+}
+
+// StaleSeriesRule purges the series of Namespace not updated for After from the current partitions, independent of the retention.
+type StaleSeriesRule struct {
+	Namespace string               `yaml:"namespace"`
+	After     commonmodel.Duration `yaml:"after"`
 }
 
 type Target struct {
 	Region    string   `yaml:"region"`
 	Namespace []string `yaml:"namespace"`
+	Tenant    string   `yaml:"tenant"`
+}
+
+const (
+	RedactionHash = "hash"
+	RedactionMask = "mask"
+	RedactionDrop = "drop"
+)
+
+// RedactionRule redacts the dimension values matching Pattern before they are stored.
+// Action is one of "hash", "mask" or "drop", and Dimension limits the rule to the dimension names matching it.
+type RedactionRule struct {
+	Dimension string `yaml:"dimension"`
+	Pattern   string `yaml:"pattern"`
+	Action    string `yaml:"action"`
+}
+
+// Validate reports an error if the rule can't be compiled.
+func (r RedactionRule) Validate() error {
+	switch r.Action {
+	case RedactionHash, RedactionMask, RedactionDrop:
+	default:
+		return fmt.Errorf("unknown redaction action: %s", r.Action)
+	}
+	if _, err := regexp.Compile(r.Pattern); err != nil {
+		return err
+	}
+	_, err := regexp.Compile(r.Dimension)
+	return err
+}
+
+// Retention returns the retention of the tenant, or 0 if it's not configured.
+func (c *Config) Retention(tenant string) time.Duration {
+	for _, t := range c.Tenants {
+		if t.Name == tenant {
+			return time.Duration(t.Retention)
+		}
+	}
+	return 0
+}
+
+// StaleSeries returns the stale series rules of the tenant.
+func (c *Config) StaleSeries(tenant string) []StaleSeriesRule {
+	for _, t := range c.Tenants {
+		if t.Name == tenant {
+			return t.StaleSeries
+		}
+	}
+	return nil
 }
 
 func LoadConfig(configFile string) (*Config, error) {
@@ -31,6 +97,20 @@ func LoadConfig(configFile string) (*Config, error) {
 		return nil, err
 	}
 
+	for _, rule := range cfg.Redaction {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tenant := range cfg.Tenants {
+		for _, rule := range tenant.StaleSeries {
+			if rule.Namespace == "" || rule.After <= 0 {
+				return nil, fmt.Errorf("invalid stale series rule of tenant %q: namespace and positive after are required", tenant.Name)
+			}
+		}
+	}
+
 	for i, target := range cfg.Targets {
 		if target.Region == "" {
 			region, err := GetDefaultRegion()
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// MergeStrategy decides the lifetime of the series found in both the fresh metrics and the database.
+type MergeStrategy string
+
+const (
+	// MergeUnion uses the range covering both lifetimes.
+	MergeUnion MergeStrategy = "union"
+	// MergePreferDB uses the lifetime in the database.
+	MergePreferDB MergeStrategy = "prefer-db"
+	// MergePreferFresh uses the lifetime of the fresh metrics.
+	MergePreferFresh MergeStrategy = "prefer-fresh"
+)
+
+func ParseMergeStrategy(s string) (MergeStrategy, error) {
+	switch ms := MergeStrategy(s); ms {
+	case MergeUnion, MergePreferDB, MergePreferFresh:
+		return ms, nil
+	default:
+		return "", fmt.Errorf("unknown merge strategy: %s", s)
+	}
+}
+
+// MergeMetrics merges the fresh metrics into the metrics from the database, and returns the merged metrics.
+// The series only in either of them are kept as is.
+func MergeMetrics(db map[string]*Metric, fresh map[string]*Metric, strategy MergeStrategy) map[string]*Metric {
+	result := make(map[string]*Metric, len(db)+len(fresh))
+	for k, m := range db {
+		result[k] = m
+	}
+	for k, f := range fresh {
+		d, ok := result[k]
+		if !ok {
+			result[k] = f
+			continue
+		}
+		switch strategy {
+		case MergePreferDB:
+			continue
+		case MergePreferFresh:
+			result[k] = f
+		default:
+			merged := *d
+			merged.FromTS = minTime(d.FromTS, f.FromTS)
+			merged.ToTS = maxTime(d.ToTS, f.ToTS)
+			result[k] = &merged
+		}
+	}
+	return result
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,63 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeMetrics(t *testing.T) {
+	now := time.Date(2025, 2, 1, 12, 0, 0, 0, time.UTC)
+	fresh := func(key string) map[string]*Metric {
+		return map[string]*Metric{key: {MetricName: "fresh", FromTS: now.Add(-4 * time.Hour), ToTS: now}}
+	}
+	tests := []struct {
+		name     string
+		dbFrom   time.Time
+		dbTo     time.Time
+		strategy MergeStrategy
+		wantFrom time.Time
+		wantTo   time.Time
+		wantName string
+	}{
+		// the database has the older lifetime, and the fresh metrics are newer
+		{"overlap union", now.Add(-24 * time.Hour), now.Add(-1 * time.Hour), MergeUnion, now.Add(-24 * time.Hour), now, "db"},
+		{"overlap prefer db", now.Add(-24 * time.Hour), now.Add(-1 * time.Hour), MergePreferDB, now.Add(-24 * time.Hour), now.Add(-1 * time.Hour), "db"},
+		{"overlap prefer fresh", now.Add(-24 * time.Hour), now.Add(-1 * time.Hour), MergePreferFresh, now.Add(-4 * time.Hour), now, "fresh"},
+		// the lifetimes share only the boundary
+		{"adjacent union", now.Add(-24 * time.Hour), now.Add(-4 * time.Hour), MergeUnion, now.Add(-24 * time.Hour), now, "db"},
+		// the database is contained in the fresh metrics
+		{"contained union", now.Add(-2 * time.Hour), now.Add(-1 * time.Hour), MergeUnion, now.Add(-4 * time.Hour), now, "db"},
+		// the database has been updated after the fresh metrics are cached
+		{"newer db union", now.Add(-2 * time.Hour), now.Add(1 * time.Hour), MergeUnion, now.Add(-4 * time.Hour), now.Add(1 * time.Hour), "db"},
+		{"newer db prefer fresh", now.Add(-2 * time.Hour), now.Add(1 * time.Hour), MergePreferFresh, now.Add(-4 * time.Hour), now, "fresh"},
+	}
+	for _, tt := range tests {
+		db := map[string]*Metric{
+			"k":  {MetricName: "db", FromTS: tt.dbFrom, ToTS: tt.dbTo},
+			"db": {MetricName: "db_only", FromTS: tt.dbFrom, ToTS: tt.dbTo},
+		}
+		f := fresh("k")
+		f["fresh"] = &Metric{MetricName: "fresh_only", FromTS: now, ToTS: now}
+		result := MergeMetrics(db, f, tt.strategy)
+		if len(result) != 3 {
+			t.Fatalf("%s: unexpected result count: %d", tt.name, len(result))
+		}
+		m := result["k"]
+		if !m.FromTS.Equal(tt.wantFrom) || !m.ToTS.Equal(tt.wantTo) || m.MetricName != tt.wantName {
+			t.Errorf("%s: unexpected merged metric: %s %s %s", tt.name, m.MetricName, m.FromTS, m.ToTS)
+		}
+		// the inputs are not modified
+		if !db["k"].FromTS.Equal(tt.dbFrom) || !db["k"].ToTS.Equal(tt.dbTo) {
+			t.Errorf("%s: the database metric is modified", tt.name)
+		}
+	}
+
+	for _, s := range []string{"union", "prefer-db", "prefer-fresh"} {
+		if _, err := ParseMergeStrategy(s); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := ParseMergeStrategy("unknown"); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+}
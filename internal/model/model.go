@@ -2,14 +2,21 @@ package model
 
 import (
 	"encoding/json"
+	"hash/fnv"
 	"regexp"
 	"sort"
 	"strings"
 	"time"
 )
 
+// RecentlyActiveWindow is how long the metrics listed by ListMetrics with RecentlyActive=PT3H may have been inactive.
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_ListMetrics.html
+// There is a low probability that the returned results include metrics with last published data as much as 50 minutes more than the specified time interval.
+const RecentlyActiveWindow = (60*3 + 50) * time.Minute
+
 type Metric struct {
 	MetricID   int64
+	SeriesID   int64 // the same in all the partitions, unlike MetricID
 	Namespace  string
 	MetricName string
 	Region     string
@@ -103,9 +110,55 @@ func (a Metric) UniqueKey() string {
 	return key
 }
 
+// SeriesKey identifies a series regardless of its lifetime.
+type SeriesKey struct {
+	Namespace  string
+	MetricName string
+	Region     string
+	Dimensions Dimensions
+}
+
+func (a Metric) Key() SeriesKey {
+	return SeriesKey{
+		Namespace:  a.Namespace,
+		MetricName: a.MetricName,
+		Region:     a.Region,
+		Dimensions: a.Dimensions,
+	}
+}
+
+// Hash returns the FNV-1a hash of the series, which doesn't depend on the order of the dimensions.
+func (k SeriesKey) Hash() uint64 {
+	dimensions := make(Dimensions, len(k.Dimensions))
+	copy(dimensions, k.Dimensions)
+	sort.Slice(dimensions, func(i, j int) bool {
+		return dimensions[i].Name < dimensions[j].Name
+	})
+
+	h := fnv.New64a()
+	// separate the fields with the byte which doesn't appear in UTF-8 strings
+	for _, s := range []string{k.Namespace, k.MetricName, k.Region} {
+		h.Write([]byte(s))
+		h.Write([]byte{0xff})
+	}
+	for _, d := range dimensions {
+		h.Write([]byte(d.Name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(d.Value))
+		h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+// ID returns the global id of the series, which is the hash of the series as int64.
+// It's not allocated by a global series table, so the partitions agree on it without sharing one.
+func (k SeriesKey) ID() int64 {
+	return int64(k.Hash())
+}
+
 func (a Metric) Labels() map[string]string {
 	labels := map[string]string{
-		"__name__":   safeMetricName(a.MetricName),
+		"__name__":   SafeMetricName(a.MetricName),
 		"MetricName": a.MetricName, // store original metric name
 		"Namespace":  a.Namespace,
 		"Region":     a.Region,
@@ -121,7 +174,8 @@ var (
 	invalidMetricNamePattern = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
 )
 
-func safeMetricName(name string) string {
+// SafeMetricName returns the metric name of the __name__ label, with the characters invalid in Prometheus replaced by "_".
+func SafeMetricName(name string) string {
 	if len(name) == 0 {
 		return ""
 	}
@@ -137,3 +191,10 @@ type MetricLifetime struct {
 	FromTS   time.Time
 	ToTS     time.Time
 }
+
+type ActiveSeries struct {
+	Namespace string
+	Region    string
+	Count     int64
+	Timestamp time.Time
+}
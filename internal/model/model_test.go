@@ -27,3 +27,26 @@ func TestLabels_WithSafeMetricName(t *testing.T) {
 	labels := metric.Labels()
 	assert.Equal(t, expectedLabels, labels, "Labels should correctly replace invalid characters in metric name")
 }
+
+func TestSeriesKeyHash(t *testing.T) {
+	a := SeriesKey{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		Dimensions: Dimensions{{Name: "dim1", Value: "v1"}, {Name: "dim2", Value: "v2"}},
+	}
+	b := a
+	b.Dimensions = Dimensions{{Name: "dim2", Value: "v2"}, {Name: "dim1", Value: "v1"}}
+	assert.Equal(t, a.Hash(), b.Hash(), "Hash should not depend on the order of the dimensions")
+
+	// the fields are separated
+	c := a
+	c.Dimensions = Dimensions{{Name: "dim1", Value: "v1dim2"}, {Name: "", Value: "v2"}}
+	assert.NotEqual(t, a.Hash(), c.Hash())
+	d := a
+	d.Namespace, d.MetricName = "test_namespacetest", "_name"
+	assert.NotEqual(t, a.Hash(), d.Hash())
+
+	assert.Equal(t, int64(a.Hash()), a.ID())
+	assert.Equal(t, a.ID(), b.ID())
+}
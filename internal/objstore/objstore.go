@@ -0,0 +1,193 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type Bucket interface {
+	Get(ctx context.Context, key string, w io.Writer) error
+	Put(ctx context.Context, key string, r io.ReadSeeker) error
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// New returns the bucket for the URL, s3://bucket/prefix or file:///path.
+func New(ctx context.Context, rawURL string) (Bucket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		return NewS3Bucket(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+	case "file":
+		return NewFileBucket(u.Path), nil
+	default:
+		return nil, fmt.Errorf("unsupported object storage URL: %s", rawURL)
+	}
+}
+
+type S3Bucket struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Bucket(ctx context.Context, bucket string, prefix string) (*S3Bucket, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Bucket{
+		client: s3.NewFromConfig(awsCfg),
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+func (b *S3Bucket) Get(ctx context.Context, key string, w io.Writer) error {
+	output, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return err
+	}
+	defer output.Body.Close()
+	_, err = io.Copy(w, output.Body)
+	return err
+}
+
+func (b *S3Bucket) Put(ctx context.Context, key string, r io.ReadSeeker) error {
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+		Body:   r,
+	})
+	return err
+}
+
+func (b *S3Bucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix + prefix),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range output.Contents {
+			keys = append(keys, strings.TrimPrefix(*o.Key, b.prefix))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b *S3Bucket) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	})
+	return err
+}
+
+// FileBucket stores objects in the local directory, it's mainly used for testing.
+type FileBucket struct {
+	dir string
+}
+
+func NewFileBucket(dir string) *FileBucket {
+	return &FileBucket{dir: dir}
+}
+
+func (b *FileBucket) Get(ctx context.Context, key string, w io.Writer) error {
+	f, err := os.Open(filepath.Join(b.dir, key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (b *FileBucket) Put(ctx context.Context, key string, r io.ReadSeeker) error {
+	path := filepath.Join(b.dir, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (b *FileBucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(b.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		key, err := filepath.Rel(b.dir, path)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (b *FileBucket) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(b.dir, key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ type CloudWatchScraper struct {
 	region              string
 	namespaces          []string
 	metricsCh           chan model.Metric
+	activeSeriesCh      chan model.ActiveSeries
 	limiter             *rate.Limiter
 	cancel              context.CancelFunc
 	done                chan struct{}
@@ -33,7 +34,7 @@ type CloudWatchScraper struct {
 	apiCallsTotal       *prometheus.CounterVec
 }
 
-func NewCloudWatchScraper(client CloudWatchAPI, region string, ns []string, ch chan model.Metric, limiter *rate.Limiter, registry *prometheus.Registry) *CloudWatchScraper {
+func NewCloudWatchScraper(client CloudWatchAPI, region string, ns []string, ch chan model.Metric, asCh chan model.ActiveSeries, limiter *rate.Limiter, registry prometheus.Registerer) *CloudWatchScraper {
 	reg := prometheus.WrapRegistererWith(
 		prometheus.Labels{"region": region},
 		registry,
@@ -55,6 +56,7 @@ func NewCloudWatchScraper(client CloudWatchAPI, region string, ns []string, ch c
 		region:              region,
 		namespaces:          ns,
 		metricsCh:           ch,
+		activeSeriesCh:      asCh,
 		limiter:             limiter,
 		done:                make(chan struct{}),
 		scrapeMetricsTotal:  scrapeMetricsTotal,
@@ -129,6 +131,8 @@ func (c *CloudWatchScraper) Oneshot(wg *sync.WaitGroup) {
 func (c *CloudWatchScraper) scrape(ctx context.Context, ns string) error {
 	slog.Info("scraping metrics", "namespace", ns)
 	now := time.Now().UTC()
+	count := int64(0)
+	completed := true
 
 	paginator := cloudwatch.NewListMetricsPaginator(c.cwClient, &cloudwatch.ListMetricsInput{
 		Namespace:      aws.String(ns),
@@ -139,6 +143,7 @@ func (c *CloudWatchScraper) scrape(ctx context.Context, ns string) error {
 			// ignore error
 			slog.Error("failed to wait for limiter", "error", err)
 			c.scrapeWarningsTotal.Inc()
+			completed = false
 			continue
 		}
 		output, err := paginator.NextPage(ctx)
@@ -147,6 +152,7 @@ func (c *CloudWatchScraper) scrape(ctx context.Context, ns string) error {
 			slog.Error("failed to list metrics", "error", err, "namespace", ns)
 			c.apiCallsTotal.WithLabelValues("ListMetrics", ns, "error").Inc()
 			c.scrapeWarningsTotal.Inc()
+			completed = false
 			break
 		}
 		c.apiCallsTotal.WithLabelValues("ListMetrics", ns, "success").Inc()
@@ -163,13 +169,22 @@ func (c *CloudWatchScraper) scrape(ctx context.Context, ns string) error {
 				MetricName: *m.MetricName,
 				Region:     c.region,
 				Dimensions: dim,
-				// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_ListMetrics.html
-				// There is a low probability that the returned results include metrics with last published data as much as 50 minutes more than the specified time interval.
-				FromTS:    now.Add(-(60*3 + 50) * time.Minute),
-				ToTS:      now,
-				UpdatedAt: now,
+				FromTS:     now.Add(-model.RecentlyActiveWindow),
+				ToTS:       now,
+				UpdatedAt:  now,
 			}
 			c.scrapeMetricsTotal.WithLabelValues(ns).Inc()
+			count++
+		}
+	}
+
+	// partial scrape results don't represent the number of active series
+	if completed {
+		c.activeSeriesCh <- model.ActiveSeries{
+			Namespace: ns,
+			Region:    c.region,
+			Count:     count,
+			Timestamp: now,
 		}
 	}
 	return nil
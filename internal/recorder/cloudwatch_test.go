@@ -38,9 +38,10 @@ func TestScrape(t *testing.T) {
 	scrapeInterval = 10 * time.Second
 	client := &mockCloudWatchAPI{}
 	metricsCh := make(chan model.Metric, 10)
+	activeSeriesCh := make(chan model.ActiveSeries, 10)
 	limiter := rate.NewLimiter(10000, 1)
 	reg := prometheus.NewRegistry()
-	recorder := NewCloudWatchScraper(client, "test_region", []string{"test_namespace"}, metricsCh, limiter, reg)
+	recorder := NewCloudWatchScraper(client, "test_region", []string{"test_namespace"}, metricsCh, activeSeriesCh, limiter, reg)
 	recorder.Run()
 	time.Sleep(3 * time.Second)
 	recorder.Stop()
@@ -52,4 +53,12 @@ func TestScrape(t *testing.T) {
 	if len(metrics) != 1 {
 		t.Fatalf("unexpected metrics count: %d", len(metrics))
 	}
+	close(activeSeriesCh)
+	activeSeries := make([]model.ActiveSeries, 0, 10)
+	for as := range activeSeriesCh {
+		activeSeries = append(activeSeries, as)
+	}
+	if len(activeSeries) != 1 || activeSeries[0].Count != 1 || activeSeries[0].Namespace != "test_namespace" {
+		t.Fatalf("unexpected active series: %+v", activeSeries)
+	}
 }
@@ -16,21 +16,48 @@ const (
 	MaxRetry              = 3
 	WALCheckpointInterval = 6 * 60 * time.Minute
 	recordRateLimit       = 200
+	// the metrics received at once are recorded in a transaction of each partition
+	recordBatchSize = 100
+	// the maintenance runs in the first check of the maintenance hour
+	maintenanceCheckInterval = 10 * time.Minute
+	// the partitions written within this period are not optimized
+	maintenanceIdle = 24 * time.Hour
 )
 
+type Replicator interface {
+	Sync(ctx context.Context) error
+}
+
 type Recorder struct {
 	ldb                    *database.LabelDB
 	metricsCh              chan model.Metric
+	activeSeriesCh         chan model.ActiveSeries
 	limiter                *rate.Limiter
+	retention              time.Duration
+	staleSeries            []model.StaleSeriesRule
+	maintenanceHour        int
+	lastMaintenance        time.Time
+	replicator             Replicator
+	replicationInterval    time.Duration
+	redactor               *Redactor
 	done                   chan struct{}
 	recordTotal            *prometheus.CounterVec
 	recordWarningsTotal    prometheus.Counter
 	recordDurations        prometheus.Histogram
 	walCheckpointTotal     *prometheus.CounterVec
 	walCheckpointDurations prometheus.Histogram
+	activeSeries           *prometheus.GaugeVec
+	replicationTotal       *prometheus.CounterVec
+	replicationDurations   prometheus.Histogram
+	replicationLastSuccess prometheus.Gauge
+	deletedPartitionsTotal prometheus.Counter
+	purgedStaleSeries      *prometheus.CounterVec
+	maintenanceTotal       *prometheus.CounterVec
+	maintenanceDurations   prometheus.Histogram
+	reclaimedPagesTotal    prometheus.Counter
 }
 
-func New(ldb *database.LabelDB, ch chan model.Metric, registry *prometheus.Registry) *Recorder {
+func New(ldb *database.LabelDB, ch chan model.Metric, asCh chan model.ActiveSeries, registry prometheus.Registerer) *Recorder {
 	recordTotal := promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
 		Name: "recorder_record_total",
 		Help: "Total number of recording metrics operations",
@@ -53,17 +80,213 @@ func New(ldb *database.LabelDB, ch chan model.Metric, registry *prometheus.Regis
 		Help:    "Duration of wal checkpoint in seconds",
 		Buckets: prometheus.ExponentialBuckets(0.01, 2, 20),
 	})
-	limiter := rate.NewLimiter(rate.Limit(recordRateLimit), 1)
+	activeSeries := promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "recorder_active_series",
+		Help: "Number of active series found in the last scrape",
+	}, []string{"region", "namespace"})
+	replicationTotal := promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "recorder_replication_total",
+		Help: "Total number of replication operations",
+	}, []string{"status"})
+	replicationDurations := promauto.With(registry).NewHistogram(prometheus.HistogramOpts{
+		Name:    "recorder_replication_duration_seconds",
+		Help:    "Duration of replication in seconds",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 20),
+	})
+	replicationLastSuccess := promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Name: "recorder_replication_last_success_timestamp_seconds",
+		Help: "Last success timestamp of replication operations",
+	})
+	deletedPartitionsTotal := promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Name: "recorder_deleted_partitions_total",
+		Help: "Total number of partitions deleted for the retention",
+	})
+	purgedStaleSeries := promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "recorder_purged_stale_series_total",
+		Help: "Total number of the series purged for not being updated",
+	}, []string{"namespace"})
+	maintenanceTotal := promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "recorder_maintenance_total",
+		Help: "Total number of the maintenance operations of the partitions",
+	}, []string{"status"})
+	maintenanceDurations := promauto.With(registry).NewHistogram(prometheus.HistogramOpts{
+		Name:    "recorder_maintenance_duration_seconds",
+		Help:    "Duration of the maintenance of the partitions in seconds",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 20),
+	})
+	reclaimedPagesTotal := promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Name: "recorder_maintenance_reclaimed_pages_total",
+		Help: "Total number of the pages reclaimed by the vacuum of the partitions",
+	})
+	limiter := rate.NewLimiter(rate.Limit(recordRateLimit), recordBatchSize)
 	return &Recorder{
 		ldb:                    ldb,
 		metricsCh:              ch,
+		activeSeriesCh:         asCh,
 		limiter:                limiter,
+		maintenanceHour:        -1,
 		done:                   make(chan struct{}),
 		recordTotal:            recordTotal,
 		recordWarningsTotal:    recordWarningsTotal,
 		recordDurations:        recordDurations,
 		walCheckpointTotal:     walCheckpointTotal,
 		walCheckpointDurations: walCheckpointDurations,
+		activeSeries:           activeSeries,
+		replicationTotal:       replicationTotal,
+		replicationDurations:   replicationDurations,
+		replicationLastSuccess: replicationLastSuccess,
+		deletedPartitionsTotal: deletedPartitionsTotal,
+		purgedStaleSeries:      purgedStaleSeries,
+		maintenanceTotal:       maintenanceTotal,
+		maintenanceDurations:   maintenanceDurations,
+		reclaimedPagesTotal:    reclaimedPagesTotal,
+	}
+}
+
+// SetRetention sets the retention period of the recorded partitions, 0 means no retention.
+func (r *Recorder) SetRetention(retention time.Duration) {
+	r.retention = retention
+}
+
+// SetMaintenanceHour runs PRAGMA optimize and the vacuum on the idle partitions every day at the hour of the local time, -1 disables it.
+// The maintenance is skipped with the replication, because the partitions are checkpointed without shipping WAL.
+// SetStaleSeries purges the series of the namespaces not updated for the period of each rule, when the expired partitions are deleted.
+func (r *Recorder) SetStaleSeries(rules []model.StaleSeriesRule) {
+	r.staleSeries = rules
+}
+
+func (r *Recorder) SetMaintenanceHour(hour int) {
+	r.maintenanceHour = hour
+}
+
+// SetReplicator enables the replication of the recorded partitions.
+// The replicator is called from the recording goroutine, so that no writes happen during the replication.
+func (r *Recorder) SetReplicator(replicator Replicator, interval time.Duration) error {
+	r.replicator = replicator
+	r.replicationInterval = interval
+	// WAL must not be restarted before shipping it
+	return r.ldb.SetWalAutoCheckpoint(0)
+}
+
+// SetRedactor redacts the dimension values of the metrics before they are recorded.
+func (r *Recorder) SetRedactor(redactor *Redactor) {
+	r.redactor = redactor
+}
+
+func (r *Recorder) replicate(ctx context.Context) {
+	if r.replicator == nil {
+		return
+	}
+	now := time.Now().UTC()
+	err := r.replicator.Sync(ctx)
+	if err != nil {
+		// ignore error
+		slog.Error("failed to replicate", "error", err)
+		r.replicationTotal.WithLabelValues("error").Inc()
+		return
+	}
+	r.replicationTotal.WithLabelValues("success").Inc()
+	r.replicationDurations.Observe(time.Since(now).Seconds())
+	r.replicationLastSuccess.Set(float64(now.Unix()))
+}
+
+func (r *Recorder) deleteExpiredPartitions(ctx context.Context) {
+	if r.retention <= 0 {
+		return
+	}
+	deleted, err := r.ldb.DeletePartitionsBefore(ctx, time.Now().UTC().Add(-r.retention))
+	if err != nil {
+		// ignore error
+		slog.Error("failed to delete expired partitions", "error", err)
+		return
+	}
+	r.deletedPartitionsTotal.Add(float64(len(deleted)))
+	if len(deleted) > 0 {
+		slog.Info("deleted expired partitions", "partitions", deleted)
+	}
+}
+
+func (r *Recorder) purgeStaleSeries(ctx context.Context) {
+	for _, rule := range r.staleSeries {
+		purged, err := r.ldb.PurgeStaleSeries(ctx, rule.Namespace, time.Now().UTC().Add(-time.Duration(rule.After)))
+		total := 0
+		for _, count := range purged {
+			total += count
+		}
+		r.purgedStaleSeries.WithLabelValues(rule.Namespace).Add(float64(total))
+		if err != nil {
+			// ignore error
+			slog.Error("failed to purge stale series", "error", err, "namespace", rule.Namespace)
+			continue
+		}
+		if total > 0 {
+			slog.Info("purged stale series", "namespace", rule.Namespace, "series", total, "partitions", purged)
+		}
+	}
+}
+
+func (r *Recorder) maintain(ctx context.Context, now time.Time) {
+	if r.maintenanceHour < 0 || r.replicator != nil || now.Hour() != r.maintenanceHour || now.Sub(r.lastMaintenance) < 1*time.Hour {
+		return
+	}
+	r.lastMaintenance = now
+	slog.Info("maintenance triggered")
+	reclaimed, err := r.ldb.Optimize(ctx, maintenanceIdle)
+	r.reclaimedPagesTotal.Add(float64(reclaimed))
+	if err != nil {
+		// ignore error
+		slog.Error("failed to maintain partitions", "error", err)
+		r.maintenanceTotal.WithLabelValues("error").Inc()
+		return
+	}
+	slog.Info("maintenance completed", "reclaimedPages", reclaimed)
+	r.maintenanceTotal.WithLabelValues("success").Inc()
+	r.maintenanceDurations.Observe(time.Since(now).Seconds())
+}
+
+// receiveBatch receives the metrics already sent after metric, up to recordBatchSize, and returns whether the channel is closed.
+func (r *Recorder) receiveBatch(metric model.Metric) ([]model.Metric, bool) {
+	metrics := []model.Metric{metric}
+	for len(metrics) < recordBatchSize {
+		select {
+		case m, ok := <-r.metricsCh:
+			if !ok {
+				return metrics, true
+			}
+			metrics = append(metrics, m)
+		default:
+			return metrics, false
+		}
+	}
+	return metrics, false
+}
+
+func (r *Recorder) recordBatch(ctx context.Context, metrics []model.Metric) {
+	if err := r.limiter.WaitN(ctx, len(metrics)); err != nil {
+		// ignore error
+		slog.Error("failed to wait for limiter", "error", err)
+		r.recordWarningsTotal.Inc()
+		return
+	}
+	if r.redactor != nil {
+		for i := range metrics {
+			metrics[i] = r.redactor.Redact(metrics[i])
+		}
+	}
+	for i := 0; i < MaxRetry; i++ {
+		now := time.Now().UTC()
+		err := r.ldb.RecordMetrics(ctx, metrics)
+		if err != nil {
+			// ignore error
+			slog.Error("failed to record metrics", "error", err, "metrics", len(metrics), "retry", i+1)
+			r.recordTotal.WithLabelValues("error").Inc()
+			sleepDuration := time.Duration(100*(1<<i)) * time.Millisecond // 0.1s, 0.2s, 0.4s, etc.
+			time.Sleep(sleepDuration)
+		} else {
+			r.recordTotal.WithLabelValues("success").Add(float64(len(metrics)))
+			r.recordDurations.Observe(time.Since(now).Seconds())
+			break
+		}
 	}
 }
 
@@ -71,44 +294,69 @@ func (r *Recorder) Run() {
 	ctx := context.TODO()
 	go func() {
 		defer close(r.done)
+		activeSeriesCh := r.activeSeriesCh
 		checkpointTicker := time.NewTicker(WALCheckpointInterval)
 		defer checkpointTicker.Stop()
+		maintenanceTicker := time.NewTicker(maintenanceCheckInterval)
+		defer maintenanceTicker.Stop()
+		var replicationC <-chan time.Time
+		if r.replicator != nil {
+			replicationTicker := time.NewTicker(r.replicationInterval)
+			defer replicationTicker.Stop()
+			replicationC = replicationTicker.C
+		}
 
 		// set initial counter value
 		r.recordTotal.WithLabelValues("success")
 		r.recordTotal.WithLabelValues("error")
 		r.walCheckpointTotal.WithLabelValues("success")
 		r.walCheckpointTotal.WithLabelValues("error")
+		r.replicationTotal.WithLabelValues("success")
+		r.replicationTotal.WithLabelValues("error")
+		r.maintenanceTotal.WithLabelValues("success")
+		r.maintenanceTotal.WithLabelValues("error")
+		for _, rule := range r.staleSeries {
+			r.purgedStaleSeries.WithLabelValues(rule.Namespace)
+		}
+
+		r.deleteExpiredPartitions(ctx)
+		r.purgeStaleSeries(ctx)
 
 		for {
 			select {
 			case metric, ok := <-r.metricsCh:
 				if !ok {
 					// channel is closed, stop the recorder
+					r.replicate(ctx)
 					return
 				}
-				if err := r.limiter.Wait(ctx); err != nil {
-					// ignore error
-					slog.Error("failed to wait for limiter", "error", err)
-					r.recordWarningsTotal.Inc()
+				metrics, closed := r.receiveBatch(metric)
+				r.recordBatch(ctx, metrics)
+				if closed {
+					r.replicate(ctx)
+					return
+				}
+			case as, ok := <-activeSeriesCh:
+				if !ok {
+					// stop receiving from the closed channel
+					activeSeriesCh = nil
 					continue
 				}
-				for i := 0; i < MaxRetry; i++ {
-					now := time.Now().UTC()
-					err := r.ldb.RecordMetric(ctx, metric)
-					if err != nil {
-						// ignore error
-						slog.Error("failed to record metric", "error", err, "metric", metric, "retry", i+1)
-						r.recordTotal.WithLabelValues("error").Inc()
-						sleepDuration := time.Duration(100*(1<<i)) * time.Millisecond // 0.1s, 0.2s, 0.4s, etc.
-						time.Sleep(sleepDuration)
-					} else {
-						r.recordTotal.WithLabelValues("success").Inc()
-						r.recordDurations.Observe(time.Since(now).Seconds())
-						break
-					}
+				r.activeSeries.WithLabelValues(as.Region, as.Namespace).Set(float64(as.Count))
+				err := r.ldb.RecordActiveSeries(ctx, as)
+				if err != nil {
+					// ignore error
+					slog.Error("failed to record active series", "error", err, "namespace", as.Namespace, "region", as.Region)
+					r.recordWarningsTotal.Inc()
 				}
+			case now := <-maintenanceTicker.C:
+				r.maintain(ctx, now)
+			case <-replicationC:
+				r.replicate(ctx)
 			case <-checkpointTicker.C:
+				// ship WAL before it's truncated
+				r.replicate(ctx)
+
 				slog.Info("WAL checkpoint triggered")
 				now := time.Now().UTC()
 				err := r.ldb.WalCheckpoint(ctx)
@@ -129,6 +377,9 @@ func (r *Recorder) Run() {
 				} else {
 					slog.Info("cleanup unused DB completed")
 				}
+
+				r.deleteExpiredPartitions(ctx)
+				r.purgeStaleSeries(ctx)
 			}
 		}
 	}()
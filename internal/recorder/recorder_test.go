@@ -2,6 +2,7 @@ package recorder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -9,6 +10,8 @@ import (
 	"github.com/mtanda/prometheus-labels-db/internal/database"
 	"github.com/mtanda/prometheus-labels-db/internal/model"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	commonmodel "github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 )
 
@@ -23,8 +26,9 @@ func TestRecord(t *testing.T) {
 		t.Fatal(err)
 	}
 	metricsCh := make(chan model.Metric, chanLength)
+	activeSeriesCh := make(chan model.ActiveSeries, chanLength)
 	reg := prometheus.NewRegistry()
-	recorder := New(ldb, metricsCh, reg)
+	recorder := New(ldb, metricsCh, activeSeriesCh, reg)
 	recorder.Run()
 
 	now := time.Now().UTC()
@@ -46,6 +50,7 @@ func TestRecord(t *testing.T) {
 			UpdatedAt: now,
 		}
 	}
+	close(activeSeriesCh)
 	close(metricsCh)
 	recorder.Stop()
 
@@ -56,3 +61,139 @@ func TestRecord(t *testing.T) {
 		t.Fatalf("unexpected metrics count: %d", len(result))
 	}
 }
+
+func TestDeleteExpiredPartitions(t *testing.T) {
+	ctx := context.Background()
+	ldb, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Now().UTC().Add(-2 * 365 * 24 * time.Hour)
+	err = ldb.RecordMetric(ctx, model.Metric{
+		Namespace:  "test_namespace",
+		MetricName: "test_name",
+		Region:     "test_region",
+		FromTS:     from,
+		ToTS:       from.Add(1 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metricsCh := make(chan model.Metric)
+	activeSeriesCh := make(chan model.ActiveSeries)
+	recorder := New(ldb, metricsCh, activeSeriesCh, prometheus.NewRegistry())
+	recorder.SetRetention(455 * 24 * time.Hour)
+	recorder.Run()
+	close(activeSeriesCh)
+	close(metricsCh)
+	recorder.Stop()
+
+	if v := testutil.ToFloat64(recorder.deletedPartitionsTotal); v != 1 {
+		t.Fatalf("unexpected deleted partitions: %v", v)
+	}
+	result, err := ldb.QueryMetrics(ctx, from, from.Add(1*time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("the expired metrics are not deleted: %v", result)
+	}
+}
+
+func TestMaintain(t *testing.T) {
+	ldb, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := New(ldb, make(chan model.Metric), make(chan model.ActiveSeries), prometheus.NewRegistry())
+	now := time.Now()
+	recorder.maintain(context.Background(), now)
+	if v := testutil.ToFloat64(recorder.maintenanceTotal.WithLabelValues("success")); v != 0 {
+		t.Fatalf("the disabled maintenance runs: %v", v)
+	}
+
+	recorder.SetMaintenanceHour(now.Hour())
+	recorder.maintain(context.Background(), now)
+	// the maintenance runs once in the hour
+	recorder.maintain(context.Background(), now.Add(maintenanceCheckInterval))
+	if v := testutil.ToFloat64(recorder.maintenanceTotal.WithLabelValues("success")); v != 1 {
+		t.Fatalf("unexpected maintenance count: %v", v)
+	}
+}
+
+type fakeReplicator struct {
+	err error
+}
+
+func (f *fakeReplicator) Sync(ctx context.Context) error {
+	return f.err
+}
+
+func TestReplicate(t *testing.T) {
+	ldb, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	recorder := New(ldb, make(chan model.Metric), make(chan model.ActiveSeries), prometheus.NewRegistry())
+	replicator := &fakeReplicator{err: errors.New("failed")}
+	if err := recorder.SetReplicator(replicator, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.replicate(context.Background())
+	if v := testutil.ToFloat64(recorder.replicationLastSuccess); v != 0 {
+		t.Fatalf("unexpected last success timestamp after the error: %v", v)
+	}
+	replicator.err = nil
+	now := time.Now().UTC()
+	recorder.replicate(context.Background())
+	if v := testutil.ToFloat64(recorder.replicationLastSuccess); v < float64(now.Unix()) {
+		t.Fatalf("unexpected last success timestamp: %v", v)
+	}
+	if v := testutil.ToFloat64(recorder.replicationTotal.WithLabelValues("error")); v != 1 {
+		t.Fatalf("unexpected replication errors: %v", v)
+	}
+}
+
+func TestPurgeStaleSeries(t *testing.T) {
+	ctx := context.Background()
+	ldb, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	now := time.Now().UTC()
+	for _, ns := range []string{"AWS/Lambda", "AWS/EC2"} {
+		err := ldb.RecordMetric(ctx, model.Metric{
+			Namespace:  ns,
+			MetricName: "test_name",
+			Region:     "test_region",
+			FromTS:     now,
+			ToTS:       now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := New(ldb, make(chan model.Metric), make(chan model.ActiveSeries), prometheus.NewRegistry())
+	// the series recorded just now are stale for the negative period
+	recorder.SetStaleSeries([]model.StaleSeriesRule{{Namespace: "AWS/Lambda", After: commonmodel.Duration(-time.Second)}})
+	recorder.purgeStaleSeries(ctx)
+	if v := testutil.ToFloat64(recorder.purgedStaleSeries.WithLabelValues("AWS/Lambda")); v != 1 {
+		t.Fatalf("unexpected purged series: %v", v)
+	}
+	result, err := ldb.QueryMetrics(ctx, now, now, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "Namespace", "AWS/.+"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("unexpected metrics count: %d", len(result))
+	}
+}
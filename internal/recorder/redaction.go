@@ -0,0 +1,97 @@
+package recorder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const redactionMask = "***"
+
+type redactionRule struct {
+	dimension *regexp.Regexp
+	pattern   *regexp.Regexp
+	action    string
+}
+
+// Redactor redacts the sensitive dimension values, e.g. emails or tokens in custom metrics.
+type Redactor struct {
+	rules         []redactionRule
+	redactedTotal *prometheus.CounterVec
+}
+
+func NewRedactor(rules []model.RedactionRule, registry prometheus.Registerer) (*Redactor, error) {
+	r := &Redactor{
+		redactedTotal: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "recorder_redacted_values_total",
+			Help: "Total number of redacted dimension values",
+		}, []string{"action"}),
+	}
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		rr := redactionRule{
+			pattern: pattern,
+			action:  rule.Action,
+		}
+		if rule.Dimension != "" {
+			rr.dimension, err = regexp.Compile("^(?:" + rule.Dimension + ")$")
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.rules = append(r.rules, rr)
+		r.redactedTotal.WithLabelValues(rule.Action)
+	}
+	return r, nil
+}
+
+// Redact returns the metric with the redacted dimensions. The first matching rule is applied to each dimension.
+func (r *Redactor) Redact(metric model.Metric) model.Metric {
+	if len(r.rules) == 0 {
+		return metric
+	}
+
+	dimensions := make(model.Dimensions, 0, len(metric.Dimensions))
+	for _, d := range metric.Dimensions {
+		rule, ok := r.match(d)
+		if !ok {
+			dimensions = append(dimensions, d)
+			continue
+		}
+		r.redactedTotal.WithLabelValues(rule.action).Inc()
+		switch rule.action {
+		case model.RedactionHash:
+			sum := sha256.Sum256([]byte(d.Value))
+			d.Value = hex.EncodeToString(sum[:8])
+		case model.RedactionMask:
+			d.Value = rule.pattern.ReplaceAllLiteralString(d.Value, redactionMask)
+		case model.RedactionDrop:
+			continue
+		}
+		dimensions = append(dimensions, d)
+	}
+	metric.Dimensions = dimensions
+	return metric
+}
+
+func (r *Redactor) match(d model.Dimension) (redactionRule, bool) {
+	for _, rule := range r.rules {
+		if rule.dimension != nil && !rule.dimension.MatchString(d.Name) {
+			continue
+		}
+		if rule.pattern.MatchString(d.Value) {
+			return rule, true
+		}
+	}
+	return redactionRule{}, false
+}
@@ -0,0 +1,66 @@
+package recorder
+
+import (
+	"testing"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRedact(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r, err := NewRedactor([]model.RedactionRule{
+		{Dimension: "User|Owner", Pattern: `^[^@]+@[^@]+$`, Action: model.RedactionHash},
+		{Pattern: `tok_[0-9a-z]+`, Action: model.RedactionMask},
+		{Dimension: "SessionId", Pattern: `.+`, Action: model.RedactionDrop},
+	}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metric := r.Redact(model.Metric{
+		Namespace:  "Custom/App",
+		MetricName: "Requests",
+		Dimensions: model.Dimensions{
+			{Name: "User", Value: "alice@example.com"},
+			{Name: "Path", Value: "/api?token=tok_abc123"},
+			{Name: "SessionId", Value: "abcdef"},
+			{Name: "Email", Value: "bob@example.com"},
+		},
+	})
+	want := model.Dimensions{
+		{Name: "User", Value: "ff8d9819fc0e12bf"},
+		{Name: "Path", Value: "/api?token=***"},
+		{Name: "Email", Value: "bob@example.com"},
+	}
+	if len(metric.Dimensions) != len(want) {
+		t.Fatalf("unexpected dimensions: %v", metric.Dimensions)
+	}
+	for i := range want {
+		if metric.Dimensions[i] != want[i] {
+			t.Fatalf("unexpected dimension: %v, want %v", metric.Dimensions[i], want[i])
+		}
+	}
+
+	for action, want := range map[string]float64{model.RedactionHash: 1, model.RedactionMask: 1, model.RedactionDrop: 1} {
+		if got := testutil.ToFloat64(r.redactedTotal.WithLabelValues(action)); got != want {
+			t.Errorf("unexpected redacted count of %s: %v", action, got)
+		}
+	}
+}
+
+func TestNewRedactorInvalidRule(t *testing.T) {
+	for _, rule := range []model.RedactionRule{
+		{Pattern: ".+", Action: "unknown"},
+		{Pattern: "(", Action: model.RedactionMask},
+		{Dimension: "(", Pattern: ".+", Action: model.RedactionMask},
+	} {
+		if _, err := NewRedactor([]model.RedactionRule{rule}, prometheus.NewRegistry()); err == nil {
+			t.Errorf("expected error for %v", rule)
+		}
+		if err := rule.Validate(); err == nil {
+			t.Errorf("expected validation error for %v", rule)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package relabel
+
+import (
+	"os"
+
+	"github.com/prometheus/prometheus/model/labels"
+	promrelabel "github.com/prometheus/prometheus/model/relabel"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	RelabelConfigs []*promrelabel.Config `yaml:"relabel_configs"`
+}
+
+// LoadConfig loads the relabel configs in the same format as Prometheus.
+func LoadConfig(path string) ([]*promrelabel.Config, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := yaml.UnmarshalStrict(buf, &cfg); err != nil {
+		return nil, err
+	}
+	for _, c := range cfg.RelabelConfigs {
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return cfg.RelabelConfigs, nil
+}
+
+// Apply rewrites the labels of the series. The dropped series are removed, and the series which become the same are merged.
+func Apply(data []map[string]string, cfgs []*promrelabel.Config) []map[string]string {
+	if len(cfgs) == 0 {
+		return data
+	}
+
+	result := make([]map[string]string, 0, len(data))
+	seen := make(map[string]struct{}, len(data))
+	for _, m := range data {
+		lbls, keep := promrelabel.Process(labels.FromMap(m), cfgs...)
+		if !keep {
+			continue
+		}
+		key := lbls.String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		result = append(result, lbls.Map())
+	}
+	return result
+}
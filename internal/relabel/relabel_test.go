@@ -0,0 +1,59 @@
+package relabel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relabel.yaml")
+	err := os.WriteFile(path, []byte(`
+relabel_configs:
+- action: labelmap
+  regex: Region
+  replacement: region
+- action: labeldrop
+  regex: Region|InternalId
+- target_label: source
+  replacement: cloudwatch
+- source_labels: [Namespace]
+  regex: Test/.*
+  action: drop
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := Apply([]map[string]string{
+		{"__name__": "CPUUtilization", "Namespace": "AWS/EC2", "Region": "us-east-1", "InstanceId": "i-1", "InternalId": "a"},
+		{"__name__": "CPUUtilization", "Namespace": "AWS/EC2", "Region": "us-east-1", "InstanceId": "i-1", "InternalId": "b"},
+		{"__name__": "Requests", "Namespace": "Test/App", "Region": "us-east-1"},
+	}, cfgs)
+	want := []map[string]string{
+		{"__name__": "CPUUtilization", "Namespace": "AWS/EC2", "region": "us-east-1", "InstanceId": "i-1", "source": "cloudwatch"},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Fatalf("unexpected result: %v", data)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relabel.yaml")
+	err := os.WriteFile(path, []byte(`
+relabel_configs:
+- action: replace
+  source_labels: [Region]
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected error for replace without target_label")
+	}
+}
@@ -0,0 +1,262 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	followerSyncTimeout = 10 * time.Minute
+	// changes are requested with overlap, because updated_at is set before the transaction is committed
+	changesOverlap = 5 * time.Minute
+)
+
+// Follower keeps the local partitions in sync with the leader's replication endpoint.
+type Follower struct {
+	leaderURL string
+	client    *http.Client
+	dir       string
+	tenants   *database.Tenants
+	// the latest version applied to each local partition file
+	versions map[string]int64
+
+	syncTotal       *prometheus.CounterVec
+	lastSyncSuccess prometheus.Gauge
+}
+
+// NewFollower returns the follower of the leader, client sends the credentials required by the leader, or a plain client is used if it's nil.
+func NewFollower(leaderURL string, dir string, tenants *database.Tenants, client *http.Client, registry prometheus.Registerer) *Follower {
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &Follower{
+		leaderURL: strings.TrimSuffix(leaderURL, "/"),
+		client:    client,
+		dir:       dir,
+		tenants:   tenants,
+		versions:  make(map[string]int64),
+		syncTotal: promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+			Name: "replication_follower_sync_total",
+			Help: "Total number of syncs from the leader",
+		}, []string{"status"}),
+		lastSyncSuccess: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "replication_follower_last_sync_success_timestamp_seconds",
+			Help: "Last success timestamp of syncs from the leader",
+		}),
+	}
+}
+
+func (f *Follower) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f.sync(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *Follower) sync(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, followerSyncTimeout)
+	defer cancel()
+	if err := f.Sync(ctx); err != nil {
+		// ignore error
+		slog.Error("failed to sync from the leader", "err", err)
+		f.syncTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	f.syncTotal.WithLabelValues("success").Inc()
+	f.lastSyncSuccess.Set(float64(time.Now().UTC().Unix()))
+}
+
+// Sync copies new partitions and applies the changes of existing partitions of all tenants.
+func (f *Follower) Sync(ctx context.Context) error {
+	var tenants []string
+	if err := f.get(ctx, "tenants", nil, &tenants); err != nil {
+		return err
+	}
+	var allErr error
+	for _, tenant := range tenants {
+		if err := f.syncTenant(ctx, tenant); err != nil {
+			slog.Error("failed to sync tenant", "err", err, "tenant", tenant)
+			allErr = errors.Join(allErr, err)
+		}
+	}
+	return allErr
+}
+
+func (f *Follower) syncTenant(ctx context.Context, tenant string) error {
+	if err := database.ValidateTenant(tenant); err != nil {
+		return err
+	}
+	dir := filepath.Join(f.dir, tenant)
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return err
+	}
+
+	// the partitions must be opened in the same layout as the leader
+	var layout database.PartitionLayout
+	if err := f.get(ctx, "layout", url.Values{"tenant": {tenant}}, &layout); err != nil {
+		return err
+	}
+	ldb, err := f.tenants.Get(tenant)
+	if err != nil {
+		return err
+	}
+	if err := ldb.SetPartitionLayout(ctx, layout); err != nil {
+		return err
+	}
+
+	var partitions []partitionInfo
+	if err := f.get(ctx, "partitions", url.Values{"tenant": {tenant}}, &partitions); err != nil {
+		return err
+	}
+	var oldest time.Time
+	for _, p := range partitions {
+		start, err := database.PartitionStart(p.Name)
+		if err != nil {
+			return err
+		}
+		if oldest.IsZero() || start.Before(oldest) {
+			oldest = start
+		}
+		if err := f.syncPartition(ctx, tenant, filepath.Join(dir, p.Name)); err != nil {
+			return fmt.Errorf("failed to sync partition %s: %w", p.Name, err)
+		}
+	}
+
+	// delete the partitions expired on the leader
+	if !oldest.IsZero() {
+		deleted, err := ldb.DeletePartitionsBefore(ctx, oldest)
+		for _, dbPath := range deleted {
+			delete(f.versions, filepath.Join(dir, dbPath))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Follower) syncPartition(ctx context.Context, tenant string, path string) error {
+	params := url.Values{
+		"tenant":    {tenant},
+		"partition": {filepath.Base(path)},
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		version, err := f.download(ctx, params, path)
+		if err != nil {
+			return err
+		}
+		f.versions[path] = version
+		slog.Info("copied partition from the leader", "path", path, "version", version)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	version, ok := f.versions[path]
+	if !ok {
+		var err error
+		version, err = database.PartitionVersion(ctx, path)
+		if err != nil {
+			return err
+		}
+	}
+	since := max(version-int64(changesOverlap.Seconds()), 0)
+	params.Set("since", strconv.FormatInt(since, 10))
+	var changes database.Changes
+	if err := f.get(ctx, "changes", params, &changes); err != nil {
+		return err
+	}
+	if len(changes.Metrics) > 0 || len(changes.ActiveSeries) > 0 {
+		if err := database.ApplyPartitionChanges(ctx, path, &changes); err != nil {
+			return err
+		}
+	}
+	f.versions[path] = max(version, changes.Version)
+	return nil
+}
+
+// download writes the snapshot of the partition to path, and returns its version.
+func (f *Follower) download(ctx context.Context, params url.Values, path string) (int64, error) {
+	resp, err := f.request(ctx, "snapshot", params)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	version, err := strconv.ParseInt(resp.Header.Get(versionHeader), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version: %w", err)
+	}
+
+	tmpPath := path + ".replica"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return version, os.Rename(tmpPath, path)
+}
+
+func (f *Follower) request(ctx context.Context, endpoint string, params url.Values) (*http.Response, error) {
+	u := f.leaderURL + apiPrefix + endpoint
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d from %s: %s", resp.StatusCode, u, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (f *Follower) get(ctx context.Context, endpoint string, params url.Values, data interface{}) error {
+	resp, err := f.request(ctx, endpoint, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	response := struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+	return json.Unmarshal(response.Data, data)
+}
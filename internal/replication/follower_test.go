@@ -0,0 +1,203 @@
+package replication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestFollowerSync(t *testing.T) {
+	ctx := context.Background()
+	leaderDir := t.TempDir()
+	followerDir := t.TempDir()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leader, err := database.OpenTenant(leaderDir, "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	recordMetrics(t, leader, fromTS, 0, 10)
+
+	server := httptest.NewServer(Handler(leaderDir))
+	defer server.Close()
+
+	tenants := database.OpenTenants(followerDir)
+	defer tenants.Close()
+	follower := NewFollower(server.URL, followerDir, tenants, nil, prometheus.NewRegistry())
+
+	// copy the snapshot
+	if err := follower.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ldb, err := tenants.Get("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := countMetrics(t, ldb, fromTS); c != 10 {
+		t.Fatalf("unexpected metrics count: %d", c)
+	}
+
+	// apply the changes
+	recordMetrics(t, leader, fromTS, 5, 10)
+	recordMetrics(t, leader, fromTS.Add(database.PartitionInterval), 0, 5)
+	if err := follower.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c := countMetrics(t, ldb, fromTS); c != 15 {
+		t.Fatalf("unexpected metrics count: %d", c)
+	}
+	if c := countMetrics(t, ldb, fromTS.Add(database.PartitionInterval)); c != 5 {
+		t.Fatalf("unexpected metrics count: %d", c)
+	}
+
+	// delete the partitions expired on the leader
+	if _, err := leader.DeletePartitionsBefore(ctx, fromTS.Add(database.PartitionInterval)); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	files, err := database.PartitionFiles(ldb.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("unexpected partitions: %v", files)
+	}
+}
+
+func TestFollowerSyncConcurrentQueries(t *testing.T) {
+	ctx := context.Background()
+	leaderDir := t.TempDir()
+	followerDir := t.TempDir()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leader, err := database.OpenTenant(leaderDir, "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	recordMetrics(t, leader, fromTS, 0, 10)
+
+	server := httptest.NewServer(Handler(leaderDir))
+	defer server.Close()
+
+	tenants := database.OpenTenants(followerDir)
+	defer tenants.Close()
+	follower := NewFollower(server.URL, followerDir, tenants, nil, prometheus.NewRegistry())
+	if err := follower.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ldb, err := tenants.Get("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the queries run while the follower changes the layout and the open partitions
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// the partitions can be deleted while they are queried
+				_, _ = ldb.QueryMetrics(ctx, fromTS, fromTS.Add(6*database.PartitionInterval), []*labels.Matcher{
+					labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+				}, 0, map[string]*model.Metric{})
+				ldb.OpenDBs()
+			}
+		}()
+	}
+	for i := range 5 {
+		recordMetrics(t, leader, fromTS.Add(time.Duration(i+1)*database.PartitionInterval), 0, 5)
+		if err := follower.Sync(ctx); err != nil {
+			t.Error(err)
+			break
+		}
+		if _, err := leader.DeletePartitionsBefore(ctx, fromTS.Add(time.Duration(i+1)*database.PartitionInterval)); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestFollowerSyncCredentials(t *testing.T) {
+	ctx := context.Background()
+	leaderDir := t.TempDir()
+	followerDir := t.TempDir()
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader, err := database.OpenTenant(leaderDir, "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	recordMetrics(t, leader, fromTS, 0, 10)
+
+	// the leader requires the bearer token
+	handler := Handler(leaderDir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-a" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tenants := database.OpenTenants(followerDir)
+	defer tenants.Close()
+	if err := NewFollower(server.URL, followerDir, tenants, nil, prometheus.NewRegistry()).Sync(ctx); err == nil {
+		t.Fatal("expected error without the credentials")
+	}
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &web.ClientConfig{BearerTokenFile: tokenFile}
+	client, err := cfg.NewClient(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFollower(server.URL, followerDir, tenants, client, prometheus.NewRegistry()).Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ldb, err := tenants.Get("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := countMetrics(t, ldb, fromTS); c != 10 {
+		t.Fatalf("unexpected metrics count: %d", c)
+	}
+}
@@ -0,0 +1,323 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/objstore"
+	"github.com/mtanda/prometheus-labels-db/internal/sqlite"
+)
+
+// The replica is stored in the following layout:
+//
+//	<prefix>generations/<generation>/<partition>/snapshot.db
+//	<prefix>generations/<generation>/<partition>/synced_at
+//	<prefix>generations/<generation>/<partition>/wal/<index>/<offset>.wal
+//
+// A generation starts when the replicator starts. Each partition has a snapshot of the main db file,
+// and WAL segments follow it. The WAL index is incremented when SQLite restarts the WAL.
+// synced_at records when the main db file was last known to be replicated.
+const (
+	generationsDir   = "generations/"
+	snapshotName     = "snapshot.db"
+	syncedAtName     = "synced_at"
+	walDir           = "wal/"
+	walHeaderSize    = 32
+	walFrameHeader   = 24
+	checkpointPages  = 1000
+	generationFormat = "20060102T150405Z"
+)
+
+type partitionState struct {
+	index  int
+	offset int64
+	salt   []byte
+}
+
+type Replicator struct {
+	dir        string
+	bucket     objstore.Bucket
+	prefix     string
+	generation string
+	partitions map[string]*partitionState
+}
+
+// New returns a replicator of the partitions in dir. The partitions must not be written during Sync.
+func New(dir string, bucket objstore.Bucket, prefix string) (*Replicator, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &Replicator{
+		dir:        dir,
+		bucket:     bucket,
+		prefix:     prefix,
+		generation: now.Format(generationFormat) + "-" + hex.EncodeToString(b),
+		partitions: make(map[string]*partitionState),
+	}, nil
+}
+
+func (r *Replicator) partitionKey(generation string, dbPath string) string {
+	return r.prefix + generationsDir + generation + "/" + dbPath + "/"
+}
+
+// Sync ships the committed WAL frames of all partitions to the object storage.
+func (r *Replicator) Sync(ctx context.Context) error {
+	files, err := database.PartitionFiles(r.dir)
+	if err != nil {
+		return err
+	}
+
+	var allErr error
+	seen := make(map[string]struct{})
+	for _, dbPath := range files {
+		seen[dbPath] = struct{}{}
+		if err := r.syncPartition(ctx, dbPath); err != nil {
+			slog.Error("failed to replicate partition", "err", err, "dbPath", dbPath)
+			allErr = errors.Join(allErr, err)
+		}
+	}
+	for dbPath := range r.partitions {
+		if _, ok := seen[dbPath]; !ok {
+			// the partition is deleted
+			delete(r.partitions, dbPath)
+		}
+	}
+	return allErr
+}
+
+func (r *Replicator) syncPartition(ctx context.Context, dbPath string) error {
+	path := filepath.Join(r.dir, dbPath)
+	state, ok := r.partitions[dbPath]
+	if !ok {
+		needed, err := r.needsSnapshot(ctx, dbPath)
+		if err != nil {
+			return err
+		}
+		state = &partitionState{}
+		if needed {
+			if err := r.snapshot(ctx, dbPath); err != nil {
+				return err
+			}
+			state.index = 0
+		} else {
+			// no change since the last replication, start from the next WAL write
+			state.index = -1
+		}
+		r.partitions[dbPath] = state
+	}
+
+	wal, err := os.ReadFile(path + "-wal")
+	if errors.Is(err, os.ErrNotExist) || len(wal) < walHeaderSize {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	salt := wal[16:24]
+	if state.index < 0 {
+		// the partition is written for the first time in this generation
+		if err := r.snapshot(ctx, dbPath); err != nil {
+			return err
+		}
+		state.index = 0
+		state.offset = 0
+		state.salt = nil
+		// the snapshot includes the WAL frames if the checkpoint succeeded
+		wal, err = os.ReadFile(path + "-wal")
+		if errors.Is(err, os.ErrNotExist) || len(wal) < walHeaderSize {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		salt = wal[16:24]
+	}
+	if state.salt != nil && !bytes.Equal(state.salt, salt) {
+		// WAL is restarted
+		state.index++
+		state.offset = 0
+	}
+	state.salt = bytes.Clone(salt)
+
+	end := committedWALSize(wal)
+	if end > state.offset {
+		key := fmt.Sprintf("%s%s%08d/%016d.wal", r.partitionKey(r.generation, dbPath), walDir, state.index, state.offset)
+		if err := r.bucket.Put(ctx, key, bytes.NewReader(wal[state.offset:end])); err != nil {
+			return err
+		}
+		state.offset = end
+	}
+
+	// checkpoint by ourselves, because auto checkpoint might restart WAL before shipping
+	pageSize := int64(binary.BigEndian.Uint32(wal[8:12]))
+	if end > walHeaderSize+checkpointPages*(walFrameHeader+pageSize) {
+		if err := checkpoint(ctx, path); err != nil {
+			return err
+		}
+		return r.putSyncedAt(ctx, dbPath)
+	}
+	return nil
+}
+
+func (r *Replicator) putSyncedAt(ctx context.Context, dbPath string) error {
+	now := strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
+	return r.bucket.Put(ctx, r.partitionKey(r.generation, dbPath)+syncedAtName, strings.NewReader(now))
+}
+
+// committedWALSize returns the size of the WAL up to the last committed frame.
+func committedWALSize(wal []byte) int64 {
+	pageSize := int64(binary.BigEndian.Uint32(wal[8:12]))
+	salt := wal[16:24]
+	frameSize := walFrameHeader + pageSize
+	end := int64(walHeaderSize)
+	for off := int64(walHeaderSize); off+frameSize <= int64(len(wal)); off += frameSize {
+		frame := wal[off : off+frameSize]
+		// frames of the previous WAL have different salt
+		if !bytes.Equal(frame[8:16], salt) {
+			break
+		}
+		// commit frame has the size of the database after the commit
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			end = off + frameSize
+		}
+	}
+	return end
+}
+
+func (r *Replicator) needsSnapshot(ctx context.Context, dbPath string) (bool, error) {
+	info, err := os.Stat(filepath.Join(r.dir, dbPath))
+	if err != nil {
+		return false, err
+	}
+	generation, err := latestGeneration(ctx, r.bucket, r.prefix, dbPath)
+	if err != nil {
+		return false, err
+	}
+	if generation == "" {
+		return true, nil
+	}
+	var buf bytes.Buffer
+	if err := r.bucket.Get(ctx, r.partitionKey(generation, dbPath)+syncedAtName, &buf); err != nil {
+		if errors.Is(err, objstore.ErrNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	syncedAt, err := strconv.ParseInt(buf.String(), 10, 64)
+	if err != nil {
+		return true, nil
+	}
+	return info.ModTime().After(time.Unix(0, syncedAt)), nil
+}
+
+func (r *Replicator) snapshot(ctx context.Context, dbPath string) error {
+	path := filepath.Join(r.dir, dbPath)
+	if err := checkpoint(ctx, path); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := r.bucket.Put(ctx, r.partitionKey(r.generation, dbPath)+snapshotName, f); err != nil {
+		return err
+	}
+	if err := r.putSyncedAt(ctx, dbPath); err != nil {
+		return err
+	}
+	slog.Info("replicated partition snapshot", "dbPath", dbPath, "generation", r.generation)
+
+	r.deleteOldGenerations(ctx, dbPath)
+	return nil
+}
+
+// deleteOldGenerations deletes the replica of the partition in the previous generations.
+func (r *Replicator) deleteOldGenerations(ctx context.Context, dbPath string) {
+	generations, err := listGenerations(ctx, r.bucket, r.prefix, dbPath)
+	if err != nil {
+		// ignore error
+		slog.Error("failed to list generations", "err", err, "dbPath", dbPath)
+		return
+	}
+	for _, generation := range generations {
+		if generation == r.generation {
+			continue
+		}
+		keys, err := r.bucket.List(ctx, r.partitionKey(generation, dbPath))
+		if err != nil {
+			// ignore error
+			slog.Error("failed to list objects", "err", err, "dbPath", dbPath)
+			continue
+		}
+		for _, key := range keys {
+			if err := r.bucket.Delete(ctx, key); err != nil {
+				// ignore error
+				slog.Error("failed to delete object", "err", err, "key", key)
+			}
+		}
+	}
+}
+
+func checkpoint(ctx context.Context, path string) error {
+	db, err := sql.Open(sqlite.DriverName, sqlite.DSN(path, sqlite.Options{BusyTimeout: 10 * time.Second}))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var busy, pages, moved int
+	if err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &pages, &moved); err != nil {
+		return err
+	}
+	if busy != 0 {
+		slog.Warn("WAL checkpoint is blocked by readers", "path", path)
+	}
+	return nil
+}
+
+// listGenerations returns the generations which have the snapshot of the partition in ascending order.
+func listGenerations(ctx context.Context, bucket objstore.Bucket, prefix string, dbPath string) ([]string, error) {
+	keys, err := bucket.List(ctx, prefix+generationsDir)
+	if err != nil {
+		return nil, err
+	}
+	var generations []string
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, prefix+generationsDir), "/")
+		if len(parts) == 3 && parts[1] == dbPath && parts[2] == snapshotName {
+			generations = append(generations, parts[0])
+		}
+	}
+	return generations, nil
+}
+
+func latestGeneration(ctx context.Context, bucket objstore.Bucket, prefix string, dbPath string) (string, error) {
+	generations, err := listGenerations(ctx, bucket, prefix, dbPath)
+	if err != nil || len(generations) == 0 {
+		return "", err
+	}
+	return generations[len(generations)-1], nil
+}
+
+func download(ctx context.Context, bucket objstore.Bucket, key string, w io.Writer) error {
+	if err := bucket.Get(ctx, key, w); err != nil {
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return nil
+}
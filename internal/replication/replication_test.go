@@ -0,0 +1,178 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+	"github.com/mtanda/prometheus-labels-db/internal/objstore"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func recordMetrics(t *testing.T, ldb *database.LabelDB, from time.Time, start, n int) {
+	ctx := context.Background()
+	for i := start; i < start+n; i++ {
+		err := ldb.RecordMetric(ctx, model.Metric{
+			Namespace:  "test_namespace",
+			MetricName: "test_name",
+			Region:     "test_region",
+			Dimensions: []model.Dimension{
+				{
+					Name:  "dim1",
+					Value: fmt.Sprintf("dim_value%d", i),
+				},
+			},
+			FromTS: from,
+			ToTS:   from.Add(1 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func countMetrics(t *testing.T, ldb *database.LabelDB, from time.Time) int {
+	result, err := ldb.QueryMetrics(context.Background(), from, from.Add(1*time.Hour), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "Namespace", "test_namespace"),
+	}, 0, map[string]*model.Metric{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(result)
+}
+
+func TestReplicateAndRestore(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	bucket := objstore.NewFileBucket(t.TempDir())
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := database.Open(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := src.SetWalAutoCheckpoint(0); err != nil {
+		t.Fatal(err)
+	}
+	replicator, err := New(srcDir, bucket, "tenant/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot and the first WAL segment
+	recordMetrics(t, src, fromTS, 0, 10)
+	if err := replicator.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recordMetrics(t, src, fromTS, 10, 10)
+	if err := replicator.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// restart WAL
+	if err := src.WalCheckpoint(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recordMetrics(t, src, fromTS, 20, 10)
+	if err := replicator.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// another partition
+	recordMetrics(t, src, fromTS.Add(database.PartitionInterval), 0, 5)
+	if err := replicator.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Restore(ctx, bucket, "tenant/", dstDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 {
+		t.Fatalf("unexpected restored partitions: %v", restored)
+	}
+
+	dst, err := database.Open(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if c := countMetrics(t, dst, fromTS); c != 30 {
+		t.Fatalf("unexpected metrics count: %d", c)
+	}
+	if c := countMetrics(t, dst, fromTS.Add(database.PartitionInterval)); c != 5 {
+		t.Fatalf("unexpected metrics count: %d", c)
+	}
+
+	// don't clobber existing partitions
+	if _, err := Restore(ctx, bucket, "tenant/", dstDir, false); err == nil {
+		t.Fatal("expected error for existing partitions")
+	}
+}
+
+func TestNewGenerationSkipsUnchangedPartitions(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	bucket := objstore.NewFileBucket(t.TempDir())
+
+	fromTS, err := time.ParseInLocation(time.RFC3339, "2025-01-01T00:00:00Z", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := database.Open(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := src.SetWalAutoCheckpoint(0); err != nil {
+		t.Fatal(err)
+	}
+	recordMetrics(t, src, fromTS, 0, 10)
+	replicator, err := New(srcDir, bucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replicator.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	firstGeneration := replicator.generation
+
+	// the generation name has a second resolution
+	time.Sleep(1 * time.Second)
+	replicator, err = New(srcDir, bucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replicator.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := fmt.Sprintf(database.DbPathPattern, "_20241111_20250202")
+	generations, err := listGenerations(ctx, bucket, "", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 1 || generations[0] != firstGeneration {
+		t.Fatalf("unexpected generations: %v", generations)
+	}
+
+	// written partitions are replicated in the new generation
+	recordMetrics(t, src, fromTS, 10, 10)
+	if err := replicator.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	generations, err = listGenerations(ctx, bucket, "", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 1 || generations[0] != replicator.generation {
+		t.Fatalf("unexpected generations: %v", generations)
+	}
+}
@@ -0,0 +1,178 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mtanda/prometheus-labels-db/internal/objstore"
+	"github.com/mtanda/prometheus-labels-db/internal/sqlite"
+)
+
+// Restore rebuilds the partitions in dir from the latest generation of each partition in the replica.
+// Existing partition files are not overwritten unless force is true.
+func Restore(ctx context.Context, bucket objstore.Bucket, prefix string, dir string, force bool) ([]string, error) {
+	keys, err := bucket.List(ctx, prefix+generationsDir)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make(map[string]struct{})
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, prefix+generationsDir), "/")
+		if len(parts) == 3 && parts[2] == snapshotName {
+			partitions[parts[1]] = struct{}{}
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	var restored []string
+	for dbPath := range partitions {
+		path := filepath.Join(dir, dbPath)
+		if _, err := os.Stat(path); err == nil && !force {
+			return restored, fmt.Errorf("partition already exists: %s", path)
+		}
+		generation, err := latestGeneration(ctx, bucket, prefix, dbPath)
+		if err != nil {
+			return restored, err
+		}
+		if err := restorePartition(ctx, bucket, prefix, generation, dbPath, path); err != nil {
+			return restored, err
+		}
+		slog.Info("restored partition", "dbPath", dbPath, "generation", generation)
+		restored = append(restored, dbPath)
+	}
+	sort.Strings(restored)
+	return restored, nil
+}
+
+type walSegment struct {
+	key    string
+	index  int
+	offset int64
+}
+
+func restorePartition(ctx context.Context, bucket objstore.Bucket, prefix string, generation string, dbPath string, path string) error {
+	partitionKey := prefix + generationsDir + generation + "/" + dbPath + "/"
+	keys, err := bucket.List(ctx, partitionKey+walDir)
+	if err != nil {
+		return err
+	}
+	var segments []walSegment
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, partitionKey+walDir), "/")
+		if len(parts) != 2 || !strings.HasSuffix(parts[1], ".wal") {
+			continue
+		}
+		index, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return err
+		}
+		offset, err := strconv.ParseInt(strings.TrimSuffix(parts[1], ".wal"), 10, 64)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, walSegment{key: key, index: index, offset: offset})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].index != segments[j].index {
+			return segments[i].index < segments[j].index
+		}
+		return segments[i].offset < segments[j].offset
+	})
+
+	// restore into the temporary file, and rename it when all WAL segments are applied
+	tmpPath := path + ".restore"
+	defer removeFiles(tmpPath)
+	removeFiles(tmpPath)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = download(ctx, bucket, partitionKey+snapshotName, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(segments); {
+		index := segments[i].index
+		wal, err := os.Create(tmpPath + "-wal")
+		if err != nil {
+			return err
+		}
+		var offset int64
+		for ; i < len(segments) && segments[i].index == index; i++ {
+			if segments[i].offset != offset {
+				wal.Close()
+				return fmt.Errorf("missing WAL segment: index=%d, offset=%d", index, offset)
+			}
+			cw := &countingWriter{w: wal}
+			if err := download(ctx, bucket, segments[i].key, cw); err != nil {
+				wal.Close()
+				return err
+			}
+			offset += cw.n
+		}
+		if err := wal.Close(); err != nil {
+			return err
+		}
+		os.Remove(tmpPath + "-shm")
+		if err := checkpoint(ctx, tmpPath); err != nil {
+			return err
+		}
+	}
+
+	if err := integrityCheck(ctx, tmpPath); err != nil {
+		return err
+	}
+	removeFiles(path)
+	return os.Rename(tmpPath, path)
+}
+
+func integrityCheck(ctx context.Context, path string) error {
+	db, err := sql.Open(sqlite.DriverName, sqlite.DSN(path, sqlite.Options{}))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s: %s", path, result)
+	}
+	return nil
+}
+
+func removeFiles(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			// ignore error
+			slog.Error("failed to remove file", "err", err, "path", path+suffix)
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
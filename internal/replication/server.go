@@ -0,0 +1,198 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database"
+)
+
+const (
+	apiPrefix     = "/api/v1/replication/"
+	versionHeader = "X-Replication-Version"
+)
+
+type partitionInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Handler serves the partitions of the tenants in dir to the followers.
+// It has no authentication, so it must only be reachable on a trusted network.
+//
+//	GET /api/v1/replication/tenants
+//	GET /api/v1/replication/partitions?tenant=<tenant>
+//	GET /api/v1/replication/layout?tenant=<tenant>
+//	GET /api/v1/replication/snapshot?tenant=<tenant>&partition=<partition>
+//	GET /api/v1/replication/changes?tenant=<tenant>&partition=<partition>&since=<version>
+func Handler(dir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"tenants", func(w http.ResponseWriter, r *http.Request) {
+		tenantsHandler(w, r, dir)
+	})
+	mux.HandleFunc(apiPrefix+"partitions", func(w http.ResponseWriter, r *http.Request) {
+		partitionsHandler(w, r, dir)
+	})
+	mux.HandleFunc(apiPrefix+"layout", func(w http.ResponseWriter, r *http.Request) {
+		layoutHandler(w, r, dir)
+	})
+	mux.HandleFunc(apiPrefix+"snapshot", func(w http.ResponseWriter, r *http.Request) {
+		snapshotHandler(w, r, dir)
+	})
+	mux.HandleFunc(apiPrefix+"changes", func(w http.ResponseWriter, r *http.Request) {
+		changesHandler(w, r, dir)
+	})
+	return mux
+}
+
+func writeData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	})
+}
+
+func tenantsHandler(w http.ResponseWriter, r *http.Request, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, "failed to list tenants: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the default tenant is stored in dir itself
+	tenants := []string{""}
+	for _, e := range entries {
+		if !e.IsDir() || database.ValidateTenant(e.Name()) != nil {
+			continue
+		}
+		tenants = append(tenants, e.Name())
+	}
+	writeData(w, tenants)
+}
+
+func tenantDir(r *http.Request, dir string) (string, error) {
+	tenant := r.URL.Query().Get("tenant")
+	if err := database.ValidateTenant(tenant); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, tenant), nil
+}
+
+// partitionPath returns the path of the requested partition, which must exist in the tenant directory.
+func partitionPath(r *http.Request, dir string) (string, int, error) {
+	dir, err := tenantDir(r, dir)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	dbPath := r.URL.Query().Get("partition")
+	files, err := database.PartitionFiles(dir)
+	if errors.Is(err, os.ErrNotExist) || !slices.Contains(files, dbPath) {
+		return "", http.StatusNotFound, errors.New("partition not found: " + dbPath)
+	} else if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	return filepath.Join(dir, dbPath), http.StatusOK, nil
+}
+
+func layoutHandler(w http.ResponseWriter, r *http.Request, dir string) {
+	dir, err := tenantDir(r, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	layout, err := database.LoadPartitionLayout(r.Context(), dir)
+	if err != nil {
+		http.Error(w, "failed to load partition layout: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeData(w, layout)
+}
+
+func partitionsHandler(w http.ResponseWriter, r *http.Request, dir string) {
+	dir, err := tenantDir(r, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files, err := database.PartitionFiles(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "tenant not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to list partitions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	partitions := make([]partitionInfo, 0, len(files))
+	for _, dbPath := range files {
+		info, err := os.Stat(filepath.Join(dir, dbPath))
+		if err != nil {
+			// the partition might be deleted by the retention
+			continue
+		}
+		partitions = append(partitions, partitionInfo{Name: dbPath, Size: info.Size()})
+	}
+	writeData(w, partitions)
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request, dir string) {
+	path, code, err := partitionPath(r, dir)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".snapshot-*")
+	if err != nil {
+		http.Error(w, "failed to create snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	version, err := database.SnapshotPartition(r.Context(), path, f.Name())
+	if err != nil {
+		slog.Error("failed to create snapshot", "err", err, "path", path)
+		http.Error(w, "failed to create snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to create snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set(versionHeader, strconv.FormatInt(version, 10))
+	if _, err := io.Copy(w, f); err != nil {
+		// ignore error
+		slog.Error("failed to send snapshot", "err", err, "path", path)
+	}
+}
+
+func changesHandler(w http.ResponseWriter, r *http.Request, dir string) {
+	path, code, err := partitionPath(r, dir)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "failed to parse since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes, err := database.PartitionChanges(r.Context(), path, since)
+	if err != nil {
+		slog.Error("failed to get changes", "err", err, "path", path)
+		http.Error(w, "failed to get changes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeData(w, changes)
+}
@@ -0,0 +1,55 @@
+//go:build !sqlite_purego
+
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+)
+
+// DriverName is the name of the registered driver.
+const DriverName = "sqlite3_regexp"
+
+func init() {
+	sql.Register(DriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: registerFuncs,
+	})
+}
+
+func registerFuncs(conn *sqlite3.SQLiteConn) error {
+	if err := conn.RegisterFunc("regexp", regexpFunc, true); err != nil {
+		return err
+	}
+	if err := conn.RegisterFunc("series_hash", seriesHash, true); err != nil {
+		return err
+	}
+	// the metric name of the __name__ label, so that the labels of the series can be queried as returned
+	return conn.RegisterFunc("safe_metric_name", model.SafeMetricName, true)
+}
+
+// the DSN parameters of go-sqlite3 for the pragmas
+var pragmaParams = map[string]string{
+	"journal_mode": "_journal_mode",
+	"synchronous":  "_sync",
+	"busy_timeout": "_busy_timeout",
+	"auto_vacuum":  "_auto_vacuum",
+}
+
+func pragma(name string, value string) string {
+	return pragmaParams[name] + "=" + value
+}
+
+// MissingTable returns the table of the error reading the table which doesn't exist.
+// SQLite has no dedicated code for it, so the message of SQLITE_ERROR is inspected, which is pinned by TestMissingTable.
+func MissingTable(err error) (string, bool) {
+	var se sqlite3.Error
+	if !errors.As(err, &se) || se.Code != sqlite3.ErrError {
+		return "", false
+	}
+	return strings.CutPrefix(se.Error(), "no such table: ")
+}
@@ -0,0 +1,82 @@
+//go:build sqlite_purego
+
+package sqlite
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	modernc "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+)
+
+// DriverName is the name of the registered driver.
+// The functions are registered to all the connections of the driver.
+const DriverName = "sqlite"
+
+func init() {
+	modernc.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *modernc.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, err := stringArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		s, err := stringArg(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return regexpFunc(pattern, s)
+	})
+	modernc.MustRegisterDeterministicScalarFunction("series_hash", 4, func(ctx *modernc.FunctionContext, args []driver.Value) (driver.Value, error) {
+		var s [4]string
+		for i := range s {
+			v, err := stringArg(args[i])
+			if err != nil {
+				return nil, err
+			}
+			s[i] = v
+		}
+		return seriesHash(s[0], s[1], s[2], s[3])
+	})
+	modernc.MustRegisterDeterministicScalarFunction("safe_metric_name", 1, func(ctx *modernc.FunctionContext, args []driver.Value) (driver.Value, error) {
+		name, err := stringArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return model.SafeMetricName(name), nil
+	})
+}
+
+// stringArg returns the TEXT or BLOB argument as string, same as the functions of go-sqlite3.
+func stringArg(v driver.Value) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	default:
+		return "", errors.New("argument must be BLOB or TEXT")
+	}
+}
+
+func pragma(name string, value string) string {
+	return "_pragma=" + name + "(" + value + ")"
+}
+
+// MissingTable returns the table of the error reading the table which doesn't exist.
+// SQLite has no dedicated code for it, so the message of SQLITE_ERROR is inspected, which is pinned by TestMissingTable.
+func MissingTable(err error) (string, bool) {
+	var se *modernc.Error
+	if !errors.As(err, &se) || se.Code() != sqlite3.SQLITE_ERROR {
+		return "", false
+	}
+	// the message is formatted as "SQL logic error: no such table: <table> (1)"
+	_, table, ok := strings.Cut(se.Error(), "no such table: ")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(table, fmt.Sprintf(" (%d)", sqlite3.SQLITE_ERROR)), true
+}
@@ -0,0 +1,66 @@
+// Package sqlite registers the SQLite driver with the REGEXP, safe_metric_name and series_hash functions.
+// The driver is mattn/go-sqlite3 built with cgo, or modernc.org/sqlite in pure Go with the sqlite_purego build tag.
+package sqlite
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/database/regexp"
+	"github.com/mtanda/prometheus-labels-db/internal/model"
+)
+
+// Options are the parameters of the connections of DSN.
+type Options struct {
+	ReadOnly bool
+	// WAL sets journal_mode=WAL and synchronous=NORMAL
+	WAL         bool
+	BusyTimeout time.Duration
+	// IncrementalVacuum sets auto_vacuum=INCREMENTAL, which takes effect on the new database
+	IncrementalVacuum bool
+}
+
+// DSN returns the data source name of the database file at path for DriverName.
+func DSN(path string, opts Options) string {
+	var params []string
+	if opts.ReadOnly {
+		params = append(params, "mode=ro")
+	}
+	if opts.WAL {
+		params = append(params, pragma("journal_mode", "WAL"), pragma("synchronous", "NORMAL"))
+	}
+	if opts.BusyTimeout > 0 {
+		params = append(params, pragma("busy_timeout", strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10)))
+	}
+	if opts.IncrementalVacuum {
+		params = append(params, pragma("auto_vacuum", "incremental"))
+	}
+	if len(params) == 0 {
+		return "file:" + path
+	}
+	return "file:" + path + "?" + strings.Join(params, "&")
+}
+
+// regexpFunc is the REGEXP function, which matches s with the pattern as Prometheus label matchers.
+func regexpFunc(pattern string, s string) (bool, error) {
+	m, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	return m.MatchString(s), nil
+}
+
+// seriesHash is the series_hash function, which returns the global id of the series of the metrics row.
+func seriesHash(namespace string, metricName string, region string, dimensions string) (int64, error) {
+	var ds model.Dimensions
+	if err := ds.UnmarshalJSON([]byte(dimensions)); err != nil {
+		return 0, err
+	}
+	return model.SeriesKey{
+		Namespace:  namespace,
+		MetricName: metricName,
+		Region:     region,
+		Dimensions: ds,
+	}.ID(), nil
+}
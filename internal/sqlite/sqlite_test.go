@@ -0,0 +1,150 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestRegexp(t *testing.T) {
+	db, err := sql.Open(DriverName, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		pattern string
+		s       string
+	}{
+		// fully anchored
+		{"EC2", "AWS/EC2"},
+		{"AWS/.*", "AWS/EC2"},
+		{"i-1|i-2", "i-12"},
+		// RE2 syntax
+		{`(?i)aws/ec2`, "AWS/EC2"},
+		// dot matches newline
+		{"a.b", "a\nb"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		var got bool
+		if err := db.QueryRow(`SELECT ? REGEXP ?`, tt.s, tt.pattern).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		want := labels.MustNewMatcher(labels.MatchRegexp, "l", tt.pattern).Matches(tt.s)
+		if got != want {
+			t.Errorf("%q REGEXP %q = %v, want %v", tt.s, tt.pattern, got, want)
+		}
+	}
+
+	// lookahead is not supported by RE2
+	var got bool
+	if err := db.QueryRow(`SELECT ? REGEXP ?`, "abc", "a(?=b)").Scan(&got); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
+
+func TestSafeMetricName(t *testing.T) {
+	db, err := sql.Open(DriverName, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var got string
+	if err := db.QueryRow(`SELECT safe_metric_name(?)`, "CPUUtilization").Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != "CPUUtilization" {
+		t.Errorf("unexpected metric name: %q", got)
+	}
+}
+
+func TestDSN(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open(DriverName, DSN(path, Options{WAL: true, BusyTimeout: 10000 * time.Millisecond, IncrementalVacuum: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, `CREATE TABLE t (id INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pragma string
+		want   string
+	}{
+		{"journal_mode", "wal"},
+		// NORMAL
+		{"synchronous", "1"},
+		{"busy_timeout", "10000"},
+		// INCREMENTAL
+		{"auto_vacuum", "2"},
+	}
+	for _, tt := range tests {
+		var got string
+		if err := db.QueryRowContext(ctx, `PRAGMA `+tt.pragma).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("PRAGMA %s = %q, want %q", tt.pragma, got, tt.want)
+		}
+	}
+
+	ro, err := sql.Open(DriverName, DSN(path, Options{ReadOnly: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if _, err := ro.ExecContext(ctx, `INSERT INTO t VALUES (1)`); err == nil {
+		t.Error("expected error for writing the read-only database")
+	}
+}
+
+// TestMissingTable pins the message of the missing table inspected by MissingTable,
+// run with and without -tags sqlite_purego to cover both drivers.
+func TestMissingTable(t *testing.T) {
+	db, err := sql.Open(DriverName, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE metrics_20250101 (metric_id INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		table string
+	}{
+		{query: `SELECT * FROM missing`, table: "missing"},
+		{query: `SELECT * FROM "metrics_20250101" JOIN metrics_lifetime_20250101 USING (metric_id)`, table: "metrics_lifetime_20250101"},
+		{query: `INSERT INTO missing VALUES (1)`, table: "missing"},
+		{query: `DELETE FROM missing`, table: "missing"},
+		{query: `SELECT * FROM main.missing`, table: "main.missing"},
+	}
+	for _, tt := range tests {
+		_, err := db.Exec(tt.query)
+		if err == nil || !strings.Contains(err.Error(), "no such table: "+tt.table) {
+			t.Errorf("unexpected message of %q: %v", tt.query, err)
+		}
+		if table, ok := MissingTable(err); !ok || table != tt.table {
+			t.Errorf("unexpected missing table of %q: %q, %v, err: %v", tt.query, table, ok, err)
+		}
+	}
+
+	for _, query := range []string{`SELECT * FROM`, `SELECT missing FROM metrics_20250101`} {
+		_, err := db.Exec(query)
+		if _, ok := MissingTable(err); ok || err == nil {
+			t.Errorf("expected the other error of %q, got %v", query, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package systemd implements the readiness notification, the watchdog and the socket activation of systemd.
+package systemd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+	StateWatchdog = "WATCHDOG=1"
+
+	// the file descriptors passed by systemd start from 3
+	listenFDsStart = 3
+)
+
+// Notify sends the state to systemd. It returns false if the process is not run with Type=notify.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// abstract namespace socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready notifies systemd that the startup is finished.
+func Ready() {
+	if _, err := Notify(StateReady); err != nil {
+		// ignore error
+		slog.Error("failed to notify readiness to systemd", "error", err)
+	}
+}
+
+// Stopping notifies systemd that the shutdown is started.
+func Stopping() {
+	if _, err := Notify(StateStopping); err != nil {
+		// ignore error
+		slog.Error("failed to notify stopping to systemd", "error", err)
+	}
+}
+
+// WatchdogInterval returns the watchdog timeout configured by WatchdogSec, or 0 if the watchdog is disabled.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// the watchdog is for another process
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("WATCHDOG_USEC must be positive")
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// RunWatchdog keeps the watchdog alive until ctx is done, it returns immediately if the watchdog is disabled.
+func RunWatchdog(ctx context.Context) {
+	interval, err := WatchdogInterval()
+	if err != nil {
+		// ignore error
+		slog.Error("invalid watchdog setting", "error", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	// ping twice in the timeout as recommended by sd_watchdog_enabled(3)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := Notify(StateWatchdog); err != nil {
+				// ignore error
+				slog.Error("failed to notify watchdog to systemd", "error", err)
+			}
+		}
+	}
+}
+
+// Listeners returns the sockets passed by the socket activation.
+func Listeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// don't pass the sockets to the child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener duplicates the file descriptor
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,61 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Notify(StateReady); ok || err != nil {
+		t.Fatalf("unexpected result without NOTIFY_SOCKET: %v, %v", ok, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	if ok, err := Notify(StateReady); !ok || err != nil {
+		t.Fatalf("failed to notify: %v, %v", ok, err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != StateReady {
+		t.Fatalf("unexpected state: %s", buf[:n])
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec    string
+		pid     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", "", 0, false},
+		{"30000000", "", 30 * time.Second, false},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second, false},
+		{"30000000", "1", 0, false},
+		{"invalid", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		got, err := WatchdogInterval()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("WatchdogInterval() with WATCHDOG_USEC=%q, WATCHDOG_PID=%q = %v, %v", tt.usec, tt.pid, got, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Config is the OTLP exporter of the spans.
+type Config struct {
+	Endpoint      string
+	Protocol      string
+	Insecure      bool
+	SamplingRatio float64
+}
+
+// RegisterFlags registers the tracing.* flags to fs.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Endpoint, "tracing.endpoint", "", "host:port of the OTLP receiver to send the spans to (disabled if empty)")
+	fs.StringVar(&c.Protocol, "tracing.protocol", "grpc", "Protocol of the OTLP receiver (grpc or http)")
+	fs.BoolVar(&c.Insecure, "tracing.insecure", false, "Send the spans without TLS")
+	fs.Float64Var(&c.SamplingRatio, "tracing.sampling-ratio", 1, "Ratio of the traces sampled, unless the parent span is sampled by the client")
+}
+
+// Setup sets the global tracer provider exporting the spans of service, and returns the function flushing the spans on shutdown.
+// The spans are not recorded if the endpoint is not configured.
+func Setup(ctx context.Context, cfg Config, service string) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var client otlptrace.Client
+	switch cfg.Protocol {
+	case "grpc":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(opts...)
+	case "http":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(opts...)
+	default:
+		return nil, fmt.Errorf("unknown tracing protocol: %s", cfg.Protocol)
+	}
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SamplingRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	// continue the traces of Grafana and the other clients
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,21 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	// disabled without the endpoint
+	shutdown, err := Setup(context.Background(), Config{Protocol: "unknown"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Setup(context.Background(), Config{Endpoint: "localhost:4317", Protocol: "unknown"}, "test"); err == nil {
+		t.Fatal("expected error for the unknown protocol")
+	}
+}
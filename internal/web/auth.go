@@ -0,0 +1,197 @@
+package web
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+// The errors of Server.Authorize.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrRateLimited  = errors.New("rate limit exceeded")
+)
+
+// authPathPrefixes are the paths protected by the authentication, /metrics and the health checks are kept open for scraping and probes.
+var authPathPrefixes = []string{"/api/", "/admin/", debugPathPrefix, "/-/reload"}
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+// reloadableHandler serves next with the authentication of the web config loaded last.
+type reloadableHandler struct {
+	next    http.Handler
+	handler atomic.Pointer[http.Handler]
+}
+
+func (h *reloadableHandler) load(c *WebConfig) error {
+	handler, err := c.authHandler(h.next)
+	if err != nil {
+		return err
+	}
+	h.handler.Store(&handler)
+	return nil
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*h.handler.Load()).ServeHTTP(w, r)
+}
+
+// authenticator accepts the basic auth users and the bearer tokens, and limits the requests of each of them.
+type authenticator struct {
+	handler http.Handler
+	users   map[string]string
+	tokens  []string
+	limit   *RateLimitConfig
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]struct{}
+	limiters map[string]*rate.Limiter
+}
+
+// authHandler returns handler requiring the credentials of the web config, or handler as is if no credential is configured.
+func (c *WebConfig) authHandler(handler http.Handler) (http.Handler, error) {
+	if len(c.BasicAuthUsers) == 0 && c.BearerTokensFile == "" {
+		if c.RateLimit != nil {
+			return nil, errors.New("rate_limit requires basic_auth_users or bearer_tokens_file")
+		}
+		return handler, nil
+	}
+	if c.RateLimit != nil && c.RateLimit.RequestsPerSecond <= 0 {
+		return nil, errors.New("requests_per_second of rate_limit must be positive")
+	}
+	a := &authenticator{
+		handler:  handler,
+		users:    c.BasicAuthUsers,
+		limit:    c.RateLimit,
+		verified: make(map[[sha256.Size]byte]struct{}),
+		limiters: make(map[string]*rate.Limiter),
+	}
+	if c.BearerTokensFile != "" {
+		tokens, err := loadBearerTokens(c.BearerTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	}
+	return a, nil
+}
+
+// loadBearerTokens reads a token per line, empty lines and lines starting with # are ignored.
+func loadBearerTokens(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no bearer token found in " + path)
+	}
+	return tokens, nil
+}
+
+func (a *authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !slices.ContainsFunc(authPathPrefixes, func(prefix string) bool { return strings.HasPrefix(r.URL.Path, prefix) }) {
+		a.handler.ServeHTTP(w, r)
+		return
+	}
+	switch err := a.authorize(r.Header.Get("Authorization")); err {
+	case ErrUnauthorized:
+		if len(a.users) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="labels-db"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	case ErrRateLimited:
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	a.handler.ServeHTTP(w, r)
+}
+
+// authorize checks the credentials of the Authorization header and the rate limit of the identity.
+func (a *authenticator) authorize(authorization string) error {
+	id, ok := a.authenticate(authorization)
+	if !ok {
+		return ErrUnauthorized
+	}
+	if !a.allow(id) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// authenticate returns the identity of the user or the token of the Authorization header.
+func (a *authenticator) authenticate(authorization string) (string, bool) {
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return "token:" + t, true
+			}
+		}
+		return "", false
+	}
+	// parsed by net/http, same as the HTTP requests
+	r := &http.Request{Header: http.Header{"Authorization": []string{authorization}}}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, ok := a.users[user]
+	if !ok {
+		return "", false
+	}
+	// bcrypt is slow by design, so the verified credentials are cached
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	a.mu.Lock()
+	_, verified := a.verified[key]
+	a.mu.Unlock()
+	if !verified {
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return "", false
+		}
+		a.mu.Lock()
+		a.verified[key] = struct{}{}
+		a.mu.Unlock()
+	}
+	return "user:" + user, true
+}
+
+// allow reports whether the request of the identity is within the rate limit.
+func (a *authenticator) allow(id string) bool {
+	if a.limit == nil {
+		return true
+	}
+	a.mu.Lock()
+	limiter, ok := a.limiters[id]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(a.limit.RequestsPerSecond), max(a.limit.Burst, 1))
+		a.limiters[id] = limiter
+	}
+	a.mu.Unlock()
+	return limiter.Allow()
+}
@@ -0,0 +1,182 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthHandler(t *testing.T) {
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokensFile := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokensFile, []byte("# grafana\ntoken-a\n\ntoken-b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	webConfig, err := LoadWebConfig(writeWebConfig(t, dir, `
+basic_auth_users:
+  prometheus: `+string(hash)+`
+bearer_tokens_file: `+tokensFile+`
+rate_limit:
+  requests_per_second: 0.001
+  burst: 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := webConfig.authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(path string, set func(r *http.Request)) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		set(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	none := func(r *http.Request) {}
+
+	tests := []struct {
+		name string
+		path string
+		set  func(r *http.Request)
+		want int
+	}{
+		{"basic auth", "/api/v1/series", basic("prometheus", "secret"), http.StatusOK},
+		// the verified credentials are cached
+		{"basic auth again", "/api/v1/series", basic("prometheus", "secret"), http.StatusOK},
+		{"wrong password", "/api/v1/series", basic("prometheus", "wrong"), http.StatusUnauthorized},
+		{"unknown user", "/api/v1/series", basic("grafana", "secret"), http.StatusUnauthorized},
+		{"bearer token", "/api/v1/series", bearer("token-b"), http.StatusOK},
+		{"unknown token", "/api/v1/series", bearer("token-c"), http.StatusUnauthorized},
+		{"comment is not a token", "/api/v1/series", bearer("# grafana"), http.StatusUnauthorized},
+		{"no credentials", "/api/v1/series", none, http.StatusUnauthorized},
+		{"metrics are open", "/metrics", none, http.StatusOK},
+		// the burst of the user is used up, the other tokens are limited separately
+		{"rate limited", "/api/v1/series", basic("prometheus", "secret"), http.StatusTooManyRequests},
+		{"other token", "/api/v1/series", bearer("token-a"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := do(tt.path, tt.set); got != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// the admin endpoints, e.g. the backup of the recorder, are protected
+	r := httptest.NewRequest(http.MethodPost, "/admin/backup", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("admin without credentials: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthHandlerConfig(t *testing.T) {
+	dir := t.TempDir()
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("# no tokens\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokensFile := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokensFile, []byte("token-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"no auth", "{}", false},
+		{"rate limit without auth", "rate_limit: {requests_per_second: 1}", true},
+		{"no tokens", "bearer_tokens_file: " + emptyFile, true},
+		{"missing tokens file", "bearer_tokens_file: " + filepath.Join(dir, "missing"), true},
+		{"tokens", "bearer_tokens_file: " + tokensFile, false},
+		{"zero rate limit", "bearer_tokens_file: " + tokensFile + "\nrate_limit: {burst: 1}", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webConfig, err := LoadWebConfig(writeWebConfig(t, t.TempDir(), tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = webConfig.authHandler(http.NotFoundHandler())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestServerReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	tokensFile := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokensFile, []byte("token-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.ConfigFile = writeWebConfig(t, dir, "bearer_tokens_file: "+tokensFile+"\n")
+	server, err := NewServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/series", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	if got := do("token-b"); got != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", got)
+	}
+
+	// the tokens file is read again
+	if err := os.WriteFile(tokensFile, []byte("token-b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := do("token-b"); got != http.StatusOK {
+		t.Fatalf("unexpected status: %d", got)
+	}
+	if got := do("token-a"); got != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", got)
+	}
+	// the other servers, e.g. gRPC, follow the reloaded config
+	if err := server.Authorize("Bearer token-b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := server.Authorize("Bearer token-a"); err != ErrUnauthorized {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := server.Authorize(""); err != ErrUnauthorized {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the invalid config is not applied
+	writeWebConfig(t, dir, "unknown: 1\n")
+	if err := server.ReloadConfig(); err == nil {
+		t.Fatal("expected error for the invalid config")
+	}
+	if got := do("token-b"); got != http.StatusOK {
+		t.Fatalf("unexpected status: %d", got)
+	}
+}
@@ -0,0 +1,146 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ClientConfig is the credentials and the TLS settings of the requests to the other labels-db services, in the same format as the Prometheus HTTP client config.
+type ClientConfig struct {
+	BasicAuth       *BasicAuth       `yaml:"basic_auth"`
+	BearerTokenFile string           `yaml:"bearer_token_file"`
+	TLSConfig       *TLSClientConfig `yaml:"tls_config"`
+}
+
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+type TLSClientConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// LoadClientConfig loads the client config file.
+func LoadClientConfig(path string) (*ClientConfig, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg ClientConfig
+	if err := yaml.UnmarshalStrict(buf, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// NewClient returns the HTTP client sending the credentials of c, or the plain client if c is nil.
+// The password and token files are read on each request, so that they can be rotated without restarting.
+func (c *ClientConfig) NewClient(timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if c == nil {
+		return client, nil
+	}
+	if c.BasicAuth != nil && c.BearerTokenFile != "" {
+		return nil, errors.New("at most one of basic_auth and bearer_token_file must be configured")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.TLSConfig != nil {
+		tlsConfig, err := c.TLSConfig.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	client.Transport = &credentialsTransport{next: transport, config: c}
+	// detect the errors on startup
+	if _, err := c.authorization(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (tc *TLSClientConfig) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+	if tc.CAFile != "" {
+		buf, err := os.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificate found in %s", tc.CAFile)
+		}
+	}
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return nil, errors.New("both cert_file and key_file are required for the client certificate")
+	}
+	if tc.CertFile != "" {
+		reloader := &certReloader{certFile: tc.CertFile, keyFile: tc.KeyFile}
+		if _, err := reloader.getCertificate(nil); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.getCertificate(nil)
+		}
+	}
+	return cfg, nil
+}
+
+// authorization returns the value of the Authorization header, or empty if no credential is configured.
+func (c *ClientConfig) authorization() (string, error) {
+	if c.BearerTokenFile != "" {
+		buf, err := os.ReadFile(c.BearerTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + strings.TrimSpace(string(buf)), nil
+	}
+	if c.BasicAuth != nil {
+		r := &http.Request{Header: http.Header{}}
+		password := ""
+		if c.BasicAuth.PasswordFile != "" {
+			buf, err := os.ReadFile(c.BasicAuth.PasswordFile)
+			if err != nil {
+				return "", err
+			}
+			password = strings.TrimSpace(string(buf))
+		}
+		r.SetBasicAuth(c.BasicAuth.Username, password)
+		return r.Header.Get("Authorization"), nil
+	}
+	return "", nil
+}
+
+type credentialsTransport struct {
+	next   http.RoundTripper
+	config *ClientConfig
+}
+
+func (t *credentialsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	authorization, err := t.config.authorization()
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		// RoundTrip must not modify the request
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", authorization)
+	}
+	return t.next.RoundTrip(r)
+}
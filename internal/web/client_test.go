@@ -0,0 +1,80 @@
+package web
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	var got string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("token-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(cfg *ClientConfig) error {
+		client, err := cfg.NewClient(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	tlsConfig := &TLSClientConfig{CAFile: caFile}
+	if err := get(&ClientConfig{BearerTokenFile: tokenFile, TLSConfig: tlsConfig}); err != nil {
+		t.Fatal(err)
+	}
+	if got != "Bearer token-a" {
+		t.Errorf("unexpected authorization: %q", got)
+	}
+	// the rotated token is sent without restarting
+	if err := os.WriteFile(tokenFile, []byte("token-b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(&ClientConfig{BearerTokenFile: tokenFile, TLSConfig: tlsConfig}); err != nil {
+		t.Fatal(err)
+	}
+	if got != "Bearer token-b" {
+		t.Errorf("unexpected authorization after rotation: %q", got)
+	}
+	if err := get(&ClientConfig{BasicAuth: &BasicAuth{Username: "prometheus", PasswordFile: passwordFile}, TLSConfig: tlsConfig}); err != nil {
+		t.Fatal(err)
+	}
+	r := &http.Request{Header: http.Header{"Authorization": {got}}}
+	if user, password, ok := r.BasicAuth(); !ok || user != "prometheus" || password != "secret" {
+		t.Errorf("unexpected basic auth: %q", got)
+	}
+
+	// the server certificate is not trusted without the CA
+	if err := get(&ClientConfig{}); err == nil {
+		t.Error("expected error without the CA")
+	}
+	if _, err := (&ClientConfig{BearerTokenFile: tokenFile, BasicAuth: &BasicAuth{Username: "prometheus"}}).NewClient(time.Second); err == nil {
+		t.Error("expected error for both basic_auth and bearer_token_file")
+	}
+	if _, err := (&ClientConfig{TLSConfig: &TLSClientConfig{CertFile: caFile}}).NewClient(time.Second); err == nil {
+		t.Error("expected error for the certificate without the key")
+	}
+}
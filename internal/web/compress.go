@@ -0,0 +1,145 @@
+package web
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+)
+
+var (
+	gzipPool = sync.Pool{New: func() any {
+		return gzip.NewWriter(nil)
+	}}
+	zstdPool = sync.Pool{New: func() any {
+		// the errors are only for the invalid options
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}}
+)
+
+// negotiateEncoding returns the supported encoding with the highest quality in the Accept-Encoding header, or empty if none.
+// zstd is preferred over gzip with the same quality.
+func negotiateEncoding(acceptEncoding string) string {
+	best := ""
+	bestQ := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		// parse as a media type to get the q parameter
+		name, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if name != encodingGzip && name != encodingZstd || q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && name == encodingZstd {
+			best = name
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// Compress compresses the responses with gzip or zstd negotiated by the Accept-Encoding header.
+// The responses which already have Content-Encoding, e.g. snappy, are sent as is.
+func Compress(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	wroteHeader bool
+	w           io.WriteCloser
+	release     func()
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	h := c.Header()
+	if h.Get("Content-Encoding") == "" && code != http.StatusNoContent && code != http.StatusNotModified {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		switch c.encoding {
+		case encodingZstd:
+			zw := zstdPool.Get().(*zstd.Encoder)
+			zw.Reset(c.ResponseWriter)
+			c.w = zw
+			c.release = func() { zstdPool.Put(zw) }
+		default:
+			gw := gzipPool.Get().(*gzip.Writer)
+			gw.Reset(c.ResponseWriter)
+			c.w = gw
+			c.release = func() { gzipPool.Put(gw) }
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		if c.Header().Get("Content-Type") == "" {
+			// detect before compressing, same as net/http
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.w == nil {
+		return c.ResponseWriter.Write(b)
+	}
+	return c.w.Write(b)
+}
+
+// Flush sends the compressed data written so far, e.g. for the streamed responses.
+func (c *compressWriter) Flush() {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if f, ok := c.w.(interface{ Flush() error }); ok {
+		// ignore error, the next write fails
+		_ = f.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) close() {
+	if c.w == nil {
+		return
+	}
+	// ignore error, the client has gone
+	_ = c.w.Close()
+	c.release()
+}
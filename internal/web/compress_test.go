@@ -0,0 +1,89 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", encodingGzip},
+		{"gzip, deflate, br, zstd", encodingZstd},
+		{"zstd;q=0.5, gzip", encodingGzip},
+		{"gzip;q=0, zstd;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat(`{"__name__":"CPUUtilization"}`, 100)
+	handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/snappy" {
+			w.Header().Set("Content-Encoding", "snappy")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		want           string
+	}{
+		{"/", "", ""},
+		{"/", "gzip", encodingGzip},
+		{"/", "zstd", encodingZstd},
+		{"/snappy", "gzip", "snappy"},
+	}
+	for _, tt := range tests {
+		// run twice to reuse the pooled encoders
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.want {
+				t.Fatalf("%s %q: unexpected Content-Encoding: %q", tt.path, tt.acceptEncoding, got)
+			}
+			var reader io.Reader = w.Body
+			switch tt.want {
+			case encodingGzip:
+				gr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reader = gr
+			case encodingZstd:
+				zr, err := zstd.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer zr.Close()
+				reader = zr
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != body {
+				t.Fatalf("%s %q: unexpected body: %q", tt.path, tt.acceptEncoding, got)
+			}
+		}
+	}
+}
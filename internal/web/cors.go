@@ -0,0 +1,70 @@
+package web
+
+import (
+	"flag"
+	"net/http"
+	"regexp"
+)
+
+// CORSConfig is the origins, methods and headers allowed to the browser-based clients.
+type CORSConfig struct {
+	Origin  string
+	Methods string
+	Headers string
+}
+
+func DefaultCORSConfig() *CORSConfig {
+	return &CORSConfig{
+		Methods: "GET,POST",
+		Headers: "Accept,Authorization,Content-Type,X-Scope-OrgID",
+	}
+}
+
+// RegisterFlags registers the web.cors.* flags to fs, the current values of c are used as the defaults.
+func (c *CORSConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Origin, "web.cors.origin", c.Origin, `Regex of the origins allowed by CORS, anchored on both ends, e.g. 'https?://(domain1|domain2)\.com' (disabled if empty)`)
+	fs.StringVar(&c.Methods, "web.cors.methods", c.Methods, "Comma separated methods allowed by CORS")
+	fs.StringVar(&c.Headers, "web.cors.headers", c.Headers, "Comma separated request headers allowed by CORS")
+}
+
+type corsHandler struct {
+	handler http.Handler
+	origin  *regexp.Regexp
+	methods string
+	headers string
+}
+
+// corsHandler returns handler adding the CORS headers for the allowed origins, or handler as is if CORS is disabled.
+func (c *CORSConfig) corsHandler(handler http.Handler) (http.Handler, error) {
+	if c == nil || c.Origin == "" {
+		return handler, nil
+	}
+	origin, err := regexp.Compile("^(?:" + c.Origin + ")$")
+	if err != nil {
+		return nil, err
+	}
+	return &corsHandler{
+		handler: handler,
+		origin:  origin,
+		methods: c.Methods,
+		headers: c.Headers,
+	}, nil
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !h.origin.MatchString(origin) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	// the preflight requests have no credentials, so they are answered before the authentication
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", h.methods)
+		w.Header().Set("Access-Control-Allow-Headers", h.headers)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
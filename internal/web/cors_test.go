@@ -0,0 +1,115 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCORSHandler(t *testing.T) {
+	cfg := DefaultCORSConfig()
+	cfg.Origin = `https://(grafana|ui)\.example\.com`
+	called := false
+	handler, err := cfg.corsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		wantOrigin  string
+		wantMethods string
+		wantCalled  bool
+	}{
+		{"allowed", http.MethodGet, "https://grafana.example.com", false, "https://grafana.example.com", "", true},
+		{"preflight", http.MethodOptions, "https://ui.example.com", true, "https://ui.example.com", "GET,POST", false},
+		// the origin is anchored
+		{"not allowed", http.MethodGet, "https://grafana.example.com.evil", false, "", "", true},
+		{"preflight not allowed", http.MethodOptions, "https://evil.example.com", true, "", "", true},
+		{"same origin", http.MethodGet, "", false, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			r := httptest.NewRequest(tt.method, "/api/v1/series", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("unexpected allowed origin: %q", got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("unexpected allowed methods: %q", got)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("handler called: %v", called)
+			}
+			if tt.preflight && !tt.wantCalled && w.Code != http.StatusNoContent {
+				t.Errorf("unexpected status: %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestCORSHandlerDisabled(t *testing.T) {
+	next := http.NotFoundHandler()
+	handler, err := DefaultCORSConfig().corsHandler(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handler.(*corsHandler); ok {
+		t.Fatal("CORS is enabled without the origin")
+	}
+	cfg := &CORSConfig{Origin: "("}
+	if _, err := cfg.corsHandler(next); err == nil {
+		t.Fatal("expected error for the invalid origin")
+	}
+}
+
+func TestServerCORSPreflight(t *testing.T) {
+	dir := t.TempDir()
+	tokensFile := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokensFile, []byte("token-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.ConfigFile = writeWebConfig(t, dir, "bearer_tokens_file: "+tokensFile)
+	cfg.CORS = DefaultCORSConfig()
+	cfg.CORS.Origin = "https://grafana.example.com"
+	server, err := NewServer("", http.NotFoundHandler(), cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the preflight request without the credentials is not rejected by the authentication
+	r := httptest.NewRequest(http.MethodOptions, "/api/v1/series", nil)
+	r.Header.Set("Origin", "https://grafana.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/series", nil)
+	r.Header.Set("Origin", "https://grafana.example.com")
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Fatalf("unexpected response: %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,31 @@
+package web
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+const debugPathPrefix = "/debug/"
+
+// debugHandler serves pprof and expvar under /debug/ if enabled, otherwise /debug/ is not found.
+// The handlers registered to http.DefaultServeMux by importing the packages are not used.
+func debugHandler(handler http.Handler, enable bool) http.Handler {
+	debug := http.NewServeMux()
+	if enable {
+		debug.HandleFunc(debugPathPrefix+"pprof/", pprof.Index)
+		debug.HandleFunc(debugPathPrefix+"pprof/cmdline", pprof.Cmdline)
+		debug.HandleFunc(debugPathPrefix+"pprof/profile", pprof.Profile)
+		debug.HandleFunc(debugPathPrefix+"pprof/symbol", pprof.Symbol)
+		debug.HandleFunc(debugPathPrefix+"pprof/trace", pprof.Trace)
+		debug.Handle(debugPathPrefix+"vars", expvar.Handler())
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, debugPathPrefix) {
+			debug.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
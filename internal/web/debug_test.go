@@ -0,0 +1,30 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	tests := []struct {
+		enable bool
+		path   string
+		want   int
+	}{
+		{true, "/debug/pprof/", http.StatusOK},
+		{true, "/debug/pprof/cmdline", http.StatusOK},
+		{true, "/debug/vars", http.StatusOK},
+		// the handlers registered to http.DefaultServeMux by importing the packages are not served
+		{false, "/debug/pprof/", http.StatusNotFound},
+		{false, "/debug/vars", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		handler := debugHandler(http.DefaultServeMux, tt.enable)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("enable=%v %s: got status %d, want %d", tt.enable, tt.path, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleHealth(t *testing.T) {
+	var readyErr error
+	mux := http.NewServeMux()
+	HandleHealth(mux, func() error {
+		return readyErr
+	})
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := get("/-/ready"); code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	readyErr = errors.New("not started")
+	if code := get("/-/ready"); code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	// the server is healthy even if it's not ready
+	if code := get("/-/healthy"); code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", code)
+	}
+}
+
+func TestCheckDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckDir(file); err == nil {
+		t.Fatal("expected error for the file")
+	}
+	if err := CheckDir(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected error for the missing directory")
+	}
+}
@@ -0,0 +1,233 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// WebConfig is the file of --web.config.file, in the same format as the Prometheus exporter toolkit.
+type WebConfig struct {
+	TLSServerConfig *TLSServerConfig `yaml:"tls_server_config"`
+	// BasicAuthUsers is the bcrypt hashes of the passwords keyed by the users
+	BasicAuthUsers   map[string]string `yaml:"basic_auth_users"`
+	BearerTokensFile string            `yaml:"bearer_tokens_file"`
+	// RateLimit is applied to each user and token
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+}
+
+type TLSServerConfig struct {
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	MinVersion   string   `yaml:"min_version"`
+	MaxVersion   string   `yaml:"max_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	// ClientAuthType is RequireAndVerifyClientCert by default when ClientCAFile is set
+	ClientAuthType    string   `yaml:"client_auth_type"`
+	ClientCAFile      string   `yaml:"client_ca_file"`
+	ClientAllowedSANs []string `yaml:"client_allowed_sans"`
+	ClientAllowedCNs  []string `yaml:"client_allowed_cns"`
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// LoadWebConfig loads the web config file.
+func LoadWebConfig(path string) (*WebConfig, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg WebConfig
+	if err := yaml.UnmarshalStrict(buf, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// TLSConfig returns the TLS config of the server, or nil if TLS is not configured.
+// The certificate is reloaded when the files are updated, e.g. by cert-manager.
+func (c *WebConfig) TLSConfig() (*tls.Config, error) {
+	if c.TLSServerConfig == nil {
+		return nil, nil
+	}
+	tc := c.TLSServerConfig
+	if tc.CertFile == "" || tc.KeyFile == "" {
+		return nil, errors.New("both cert_file and key_file are required")
+	}
+	cfg := &tls.Config{
+		// same as the Prometheus exporter toolkit
+		MinVersion: tls.VersionTLS12,
+	}
+	if tc.MinVersion != "" {
+		v, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version: %s", tc.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if tc.MaxVersion != "" {
+		v, ok := tlsVersions[tc.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version: %s", tc.MaxVersion)
+		}
+		cfg.MaxVersion = v
+	}
+	for _, name := range tc.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	if err := tc.configureClientAuth(cfg); err != nil {
+		return nil, err
+	}
+
+	reloader := &certReloader{certFile: tc.CertFile, keyFile: tc.KeyFile}
+	// detect the errors on startup
+	if _, err := reloader.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	cfg.GetCertificate = reloader.getCertificate
+	return cfg, nil
+}
+
+// configureClientAuth sets the verification of the client certificates to cfg.
+func (tc *TLSServerConfig) configureClientAuth(cfg *tls.Config) error {
+	authType := tc.ClientAuthType
+	if authType == "" && tc.ClientCAFile != "" {
+		authType = "RequireAndVerifyClientCert"
+	}
+	if authType != "" {
+		t, ok := clientAuthTypes[authType]
+		if !ok {
+			return fmt.Errorf("unknown client auth type: %s", authType)
+		}
+		cfg.ClientAuth = t
+	}
+	verify := cfg.ClientAuth == tls.VerifyClientCertIfGiven || cfg.ClientAuth == tls.RequireAndVerifyClientCert
+	if verify && tc.ClientCAFile == "" {
+		return fmt.Errorf("client_ca_file is required for %s", authType)
+	}
+	if tc.ClientCAFile != "" {
+		buf, err := os.ReadFile(tc.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("no certificate found in %s", tc.ClientCAFile)
+		}
+	}
+
+	if len(tc.ClientAllowedSANs) == 0 && len(tc.ClientAllowedCNs) == 0 {
+		return nil
+	}
+	if !verify {
+		return errors.New("client_allowed_sans and client_allowed_cns require the client certificates to be verified")
+	}
+	// VerifyConnection is also called for the resumed sessions, unlike VerifyPeerCertificate
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+			return errors.New("client certificate is required")
+		}
+		if !tc.allowed(cs.VerifiedChains[0][0]) {
+			return errors.New("client certificate is not allowed")
+		}
+		return nil
+	}
+	return nil
+}
+
+// allowed reports whether the common name or one of the SANs of the client certificate is allowed.
+func (tc *TLSServerConfig) allowed(cert *x509.Certificate) bool {
+	if slices.Contains(tc.ClientAllowedCNs, cert.Subject.CommonName) {
+		return true
+	}
+	sans := append(slices.Clone(cert.DNSNames), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if slices.Contains(tc.ClientAllowedSANs, san) {
+			return true
+		}
+	}
+	return false
+}
+
+func cipherSuite(name string) (uint16, bool) {
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if s.Name == name {
+			return s.ID, true
+		}
+	}
+	return 0, false
+}
+
+// certReloader loads the certificate again when the files are modified.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
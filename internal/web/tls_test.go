@@ -0,0 +1,363 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and returns it.
+func writeCertificate(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+	return writeNamedCertificate(t, certFile, keyFile, serial, "labels-db")
+}
+
+// writeNamedCertificate writes a self-signed certificate of the common name cn for 127.0.0.1 and returns it.
+func writeNamedCertificate(t *testing.T, certFile, keyFile string, serial int64, cn string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeWebConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "web.yml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	cert := writeCertificate(t, certFile, keyFile, 1)
+
+	cfg := DefaultConfig()
+	cfg.ConfigFile = writeWebConfig(t, dir, `
+tls_server_config:
+  cert_file: `+certFile+`
+  key_file: `+keyFile+`
+  min_version: TLS13
+`)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	server, err := NewServer("", handler, cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	get := func(roots *x509.CertPool, maxVersion uint16) (string, error) {
+		transport := &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, MaxVersion: maxVersion},
+			ForceAttemptHTTP2: true,
+		}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + l.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	body, err := get(roots, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HTTP/2 is negotiated by ALPN
+	if body != "HTTP/2.0" {
+		t.Fatalf("unexpected protocol: %s", body)
+	}
+	if _, err := get(roots, tls.VersionTLS12); err == nil {
+		t.Fatal("expected error for TLS 1.2")
+	}
+
+	// the rotated certificate is used for the new connections
+	time.Sleep(10 * time.Millisecond)
+	rotated := writeCertificate(t, certFile, keyFile, 2)
+	future := time.Now().Add(time.Second)
+	os.Chtimes(certFile, future, future)
+	if _, err := get(roots, 0); err == nil {
+		t.Fatal("expected error for the rotated certificate")
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(rotated)
+	if _, err := get(roots, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	serverCert := writeCertificate(t, certFile, keyFile, 1)
+
+	// both clients are trusted, but only one of them is allowed
+	allowedCert := filepath.Join(dir, "allowed.crt")
+	allowedKey := filepath.Join(dir, "allowed.key")
+	writeNamedCertificate(t, allowedCert, allowedKey, 2, "prometheus")
+	deniedCert := filepath.Join(dir, "denied.crt")
+	deniedKey := filepath.Join(dir, "denied.key")
+	writeNamedCertificate(t, deniedCert, deniedKey, 3, "unknown")
+	var cas []byte
+	for _, f := range []string{allowedCert, deniedCert} {
+		buf, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cas = append(cas, buf...)
+	}
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, cas, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ConfigFile = writeWebConfig(t, dir, `
+tls_server_config:
+  cert_file: `+certFile+`
+  key_file: `+keyFile+`
+  client_ca_file: `+caFile+`
+  client_allowed_cns: [prometheus]
+`)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+	server, err := NewServer("", handler, cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	get := func(certs []tls.Certificate) (string, error) {
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + l.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	load := func(certFile, keyFile string) []tls.Certificate {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []tls.Certificate{cert}
+	}
+
+	body, err := get(load(allowedCert, allowedKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "prometheus" {
+		t.Fatalf("unexpected client: %s", body)
+	}
+	if _, err := get(load(deniedCert, deniedKey)); err == nil {
+		t.Fatal("expected error for the client which is not allowed")
+	}
+	if _, err := get(nil); err == nil {
+		t.Fatal("expected error without the client certificate")
+	}
+}
+
+func TestWebConfigTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeCertificate(t, certFile, keyFile, 1)
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+		check   func(*tls.Config) bool
+	}{
+		{
+			name:   "no TLS",
+			config: "{}",
+			check:  func(c *tls.Config) bool { return c == nil },
+		},
+		{
+			name: "defaults",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile + `
+  key_file: ` + keyFile,
+			check: func(c *tls.Config) bool { return c.MinVersion == tls.VersionTLS12 && c.CipherSuites == nil },
+		},
+		{
+			name: "cipher suites",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile + `
+  key_file: ` + keyFile + `
+  cipher_suites:
+    - TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+    - TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256`,
+			check: func(c *tls.Config) bool {
+				return len(c.CipherSuites) == 2 && c.CipherSuites[0] == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+			},
+		},
+		{
+			name: "unknown cipher suite",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile + `
+  key_file: ` + keyFile + `
+  cipher_suites: [TLS_UNKNOWN]`,
+			wantErr: true,
+		},
+		{
+			name: "unknown version",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile + `
+  key_file: ` + keyFile + `
+  min_version: SSL30`,
+			wantErr: true,
+		},
+		{
+			name: "missing key",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile,
+			wantErr: true,
+		},
+		{
+			name: "missing file",
+			config: `
+tls_server_config:
+  cert_file: ` + filepath.Join(dir, "missing.crt") + `
+  key_file: ` + keyFile,
+			wantErr: true,
+		},
+		{
+			name: "client CA",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile + `
+  key_file: ` + keyFile + `
+  client_ca_file: ` + certFile,
+			check: func(c *tls.Config) bool { return c.ClientAuth == tls.RequireAndVerifyClientCert && c.ClientCAs != nil },
+		},
+		{
+			name: "unknown client auth type",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile + `
+  key_file: ` + keyFile + `
+  client_auth_type: VerifyClientCert`,
+			wantErr: true,
+		},
+		{
+			name: "verify without client CA",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile + `
+  key_file: ` + keyFile + `
+  client_auth_type: VerifyClientCertIfGiven`,
+			wantErr: true,
+		},
+		{
+			name: "allowed SANs without verification",
+			config: `
+tls_server_config:
+  cert_file: ` + certFile + `
+  key_file: ` + keyFile + `
+  client_auth_type: RequireAnyClientCert
+  client_allowed_sans: [prometheus.example.com]`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			config:  "tls_config: {}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webConfig, err := LoadWebConfig(writeWebConfig(t, t.TempDir(), tt.config))
+			if err == nil {
+				var c *tls.Config
+				c, err = webConfig.TLSConfig()
+				if err == nil && !tt.check(c) {
+					t.Fatalf("unexpected TLS config: %+v", c)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
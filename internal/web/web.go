@@ -0,0 +1,264 @@
+package web
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtanda/prometheus-labels-db/internal/systemd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const unixScheme = "unix://"
+
+// Config is the limits of the HTTP server against slow or huge requests, and the connection settings.
+type Config struct {
+	ReadHeaderTimeout    time.Duration
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	MaxHeaderBytes       int
+	MaxRequestBytes      int64
+	KeepAlive            bool
+	EnableH2C            bool
+	MaxConcurrentStreams uint
+	SystemdSocket        bool
+	Compression          bool
+	ConfigFile           string
+	EnablePprof          bool
+	// CORS is registered by the servers for the browser-based clients
+	CORS *CORSConfig
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       1 * time.Minute,
+		WriteTimeout:      5 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+		MaxRequestBytes:   10 << 20,
+		KeepAlive:         true,
+		// same as golang.org/x/net/http2
+		MaxConcurrentStreams: 250,
+	}
+}
+
+// RegisterFlags registers the web.* flags to fs, the current values of cfg are used as the defaults.
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "web.read-header-timeout", cfg.ReadHeaderTimeout, "Maximum duration to read the request headers")
+	fs.DurationVar(&cfg.ReadTimeout, "web.read-timeout", cfg.ReadTimeout, "Maximum duration to read the entire request (unlimited if 0)")
+	fs.DurationVar(&cfg.WriteTimeout, "web.write-timeout", cfg.WriteTimeout, "Maximum duration before timing out writes of the response (unlimited if 0)")
+	fs.DurationVar(&cfg.IdleTimeout, "web.idle-timeout", cfg.IdleTimeout, "Maximum duration to wait for the next request on keep-alive connections")
+	fs.IntVar(&cfg.MaxHeaderBytes, "web.max-header-bytes", cfg.MaxHeaderBytes, "Maximum size of the request headers")
+	fs.Int64Var(&cfg.MaxRequestBytes, "web.max-request-bytes", cfg.MaxRequestBytes, "Maximum size of the request body (unlimited if 0)")
+	fs.BoolVar(&cfg.KeepAlive, "web.keep-alive", cfg.KeepAlive, "Reuse the connections for the subsequent requests")
+	fs.BoolVar(&cfg.EnableH2C, "web.enable-h2c", cfg.EnableH2C, "Serve HTTP/2 without TLS (h2c), HTTP/2 is always enabled with TLS")
+	fs.UintVar(&cfg.MaxConcurrentStreams, "web.http2-max-concurrent-streams", cfg.MaxConcurrentStreams, "Maximum number of concurrent streams per HTTP/2 connection")
+	fs.BoolVar(&cfg.Compression, "web.compression", cfg.Compression, "Compress the responses with gzip or zstd when the client accepts")
+	fs.StringVar(&cfg.ConfigFile, "web.config.file", cfg.ConfigFile, "Path to the web config file to enable TLS and authentication")
+	fs.BoolVar(&cfg.EnablePprof, "web.enable-pprof", cfg.EnablePprof, "Serve pprof and expvar under /debug/")
+	fs.BoolVar(&cfg.SystemdSocket, "web.systemd-socket", cfg.SystemdSocket, "Use the socket passed by the systemd socket activation instead of --web.listen-address")
+}
+
+// Server is the HTTP server which counts the connections.
+type Server struct {
+	*http.Server
+	configFile string
+	// nil without the web config file
+	auth            *reloadableHandler
+	systemdSocket   bool
+	tls             bool
+	connections     prometheus.Counter
+	openConnections prometheus.Gauge
+}
+
+// NewServer returns the HTTP server listening on addr with the settings of cfg.
+func NewServer(addr string, handler http.Handler, cfg Config, registry *prometheus.Registry) (*Server, error) {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler = debugHandler(handler, cfg.EnablePprof)
+	var webConfig *WebConfig
+	var auth *reloadableHandler
+	if cfg.ConfigFile != "" {
+		var err error
+		webConfig, err = LoadWebConfig(cfg.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = &reloadableHandler{next: handler}
+		if err := auth.load(webConfig); err != nil {
+			return nil, err
+		}
+		handler = auth
+	}
+	handler, err := cfg.CORS.corsHandler(handler)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Compression {
+		handler = Compress(handler)
+	}
+	if cfg.MaxRequestBytes > 0 {
+		handler = http.MaxBytesHandler(handler, cfg.MaxRequestBytes)
+	}
+	h2s := &http2.Server{
+		MaxConcurrentStreams: uint32(cfg.MaxConcurrentStreams),
+		IdleTimeout:          cfg.IdleTimeout,
+	}
+	if cfg.EnableH2C {
+		handler = h2c.NewHandler(handler, h2s)
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	server.SetKeepAlivesEnabled(cfg.KeepAlive)
+	if webConfig != nil {
+		var err error
+		server.TLSConfig, err = webConfig.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// http2.ConfigureServer always sets TLSConfig
+	enableTLS := server.TLSConfig != nil
+	// apply the settings to HTTP/2 over TLS
+	if err := http2.ConfigureServer(server, h2s); err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		Server:        server,
+		configFile:    cfg.ConfigFile,
+		auth:          auth,
+		systemdSocket: cfg.SystemdSocket,
+		tls:           enableTLS,
+		connections: promauto.With(registry).NewCounter(prometheus.CounterOpts{
+			Name: "http_connections_total",
+			Help: "Total number of accepted connections",
+		}),
+		openConnections: promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+			Name: "http_open_connections",
+			Help: "Number of open connections",
+		}),
+	}, nil
+}
+
+// ReloadConfig loads the web config file again, and applies the authentication and the rate limits to the following requests.
+// The TLS settings are not reloaded, except the certificates reloaded when the files are updated.
+func (s *Server) ReloadConfig() error {
+	if s.auth == nil {
+		return nil
+	}
+	webConfig, err := LoadWebConfig(s.configFile)
+	if err != nil {
+		return err
+	}
+	return s.auth.load(webConfig)
+}
+
+// Authorize checks the Authorization of the requests not served by s, e.g. the gRPC API,
+// with the authentication and the rate limits of the web config loaded last, so the users and the tokens share their limits with the HTTP requests.
+// It returns ErrUnauthorized or ErrRateLimited, or nil if no credential is configured.
+func (s *Server) Authorize(authorization string) error {
+	if s.auth == nil {
+		return nil
+	}
+	a, ok := (*s.auth.handler.Load()).(*authenticator)
+	if !ok {
+		return nil
+	}
+	return a.authorize(authorization)
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Listen returns the socket passed by systemd if enabled, otherwise listens on the address of s.
+func (s *Server) Listen() (net.Listener, error) {
+	if !s.systemdSocket {
+		return Listen(s.Addr)
+	}
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) != 1 {
+		return nil, fmt.Errorf("expected 1 socket passed by systemd, got %d", len(listeners))
+	}
+	return listeners[0], nil
+}
+
+// Listen listens on the TCP address, or on the unix domain socket if addr is unix:///path/to/socket.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		// remove the socket left by the previous process
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	if addr == "" {
+		addr = ":http"
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve serves HTTPS if TLS is configured by the web config file.
+func (s *Server) Serve(l net.Listener) error {
+	l = &countingListener{Listener: l, server: s}
+	if s.tls {
+		// the certificate is given by TLSConfig.GetCertificate
+		return s.Server.ServeTLS(l, "", "")
+	}
+	return s.Server.Serve(l)
+}
+
+type countingListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.server.connections.Inc()
+	l.server.openConnections.Inc()
+	return &countingConn{Conn: conn, server: l.server}, nil
+}
+
+// countingConn is also closed by the HTTP/2 server after h2c hijacks the connection.
+type countingConn struct {
+	net.Conn
+	server *Server
+	once   sync.Once
+}
+
+func (c *countingConn) Close() error {
+	c.once.Do(c.server.openConnections.Dec)
+	return c.Conn.Close()
+}
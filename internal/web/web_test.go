@@ -0,0 +1,170 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+)
+
+func TestRegisterFlags(t *testing.T) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse([]string{"--web.write-timeout=0", "--web.max-request-bytes=100"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.WriteTimeout != 0 || cfg.MaxRequestBytes != 100 || cfg.ReadHeaderTimeout != 10*time.Second {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestNewServerLimitsRequestBody(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxRequestBytes = 10
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	server, err := NewServer("", handler, cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{strings.Repeat("a", 10), http.StatusOK},
+		{strings.Repeat("a", 11), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("body size %d: got %d, want %d", len(tt.body), w.Code, tt.want)
+		}
+	}
+}
+
+func TestServerH2C(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EnableH2C = true
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	server, err := NewServer("", handler, cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	// HTTP/2 with prior knowledge
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "HTTP/2.0" {
+			t.Fatalf("unexpected protocol: %s", body)
+		}
+	}
+	// the connection is reused
+	if got := testutil.ToFloat64(server.connections); got != 1 {
+		t.Fatalf("unexpected connections: %v", got)
+	}
+	if got := testutil.ToFloat64(server.openConnections); got != 1 {
+		t.Fatalf("unexpected open connections: %v", got)
+	}
+
+	transport.CloseIdleConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(server.openConnections) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web.sock")
+	// the socket left by the previous process is replaced
+	for i := 0; i < 2; i++ {
+		l, err := Listen("unix://" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Addr().Network() != "unix" {
+			t.Fatalf("unexpected network: %s", l.Addr().Network())
+		}
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+	}
+
+	server, err := NewServer("unix://"+path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}), DefaultConfig(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Get("http://unix/")
+		if err != nil {
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "ok" {
+			t.Fatalf("unexpected body: %s", body)
+		}
+		break
+	}
+}
@@ -7,7 +7,6 @@ pkgs.mkShell {
     pkgs.gopls
     pkgs.gotests
     pkgs.delve
-    pkgs.pcre
     pkgs.sqlite
     pkgs.goreleaser
   ];